@@ -47,8 +47,9 @@ func FromString(p string) (Integrated, error) {
 
 	data := bigi.Bytes()
 
+	// big.Int drops the leading zero bytes of the checksum and of the address
 	if len(data) < SIZE+2 {
-		return Integrated{}, errors.New("invalid address")
+		data = append(make([]byte, SIZE+2-len(data)), data...)
 	}
 
 	sum := checksum(data[len(data)-SIZE:])
@@ -78,6 +79,12 @@ func checksum(a []byte) []byte {
 	return sumb
 }
 
+// IsValid returns true if the address is not INVALID_ADDRESS. Any other value can be the hash of a public key:
+// the prefix and the checksum only belong to the string encoding, which is verified by FromString.
+func (a Address) IsValid() bool {
+	return a != INVALID_ADDRESS
+}
+
 func (a Address) Integrated() Integrated {
 	return Integrated{
 		Addr: a,
@@ -1,6 +1,7 @@
 package address_test
 
 import (
+	"hash/crc32"
 	"still-blockchain/address"
 	"testing"
 
@@ -31,3 +32,41 @@ func TestAddress(t *testing.T) {
 		t.Error("address does not match")
 	}
 }
+
+func TestAddressIsValid(t *testing.T) {
+	if address.INVALID_ADDRESS.IsValid() {
+		t.Error("INVALID_ADDRESS is valid")
+	}
+	if !address.GenesisAddress.IsValid() {
+		t.Error("genesis address is not valid")
+	}
+	if !address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("example seed"))).Public()).IsValid() {
+		t.Error("address is not valid")
+	}
+
+	// the first checksum byte is zero, so it's dropped by the string encoding
+	for i := 0; ; i++ {
+		addr := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte{byte(i), byte(i >> 8)})).Public())
+		if crc32.ChecksumIEEE(addr[:])&0xff != 0 {
+			continue
+		}
+		if !addr.IsValid() {
+			t.Fatalf("address %x with zero checksum byte is not valid", addr)
+		}
+		decoded, err := address.FromString(addr.String())
+		if err != nil {
+			t.Fatalf("address %x with zero checksum byte can't be decoded: %v", addr, err)
+		}
+		if decoded.Addr != addr || decoded.Subaddr != 0 {
+			t.Fatalf("address %x with zero checksum byte is decoded as %x", addr, decoded.Addr)
+		}
+		break
+	}
+
+	// an address with a leading zero byte
+	var addr address.Address
+	addr[1] = 1
+	if decoded, err := address.FromString(addr.String()); err != nil || decoded.Addr != addr {
+		t.Errorf("address %x is decoded as %x, error %v", addr, decoded.Addr, err)
+	}
+}
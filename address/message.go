@@ -0,0 +1,27 @@
+package address
+
+import (
+	"still-blockchain/bitcrypto"
+
+	"github.com/zeebo/blake3"
+)
+
+// context string used to derive the signed hash of messages, so that message signatures can never be valid
+// transaction signatures
+const message_context = "still-blockchain signed message v1"
+
+// MessageHash returns the data that is signed by message signatures
+func MessageHash(msg []byte) []byte {
+	hash := make([]byte, 32)
+	blake3.DeriveKey(message_context, msg, hash)
+	return hash
+}
+
+// VerifyMessage returns true if sig is a valid signature of msg by the public key pub, and pub belongs to addr.
+// Addresses are hashes of public keys, so the public key has to be provided together with the signature.
+func VerifyMessage(addr Address, msg []byte, pub bitcrypto.Pubkey, sig bitcrypto.Signature) bool {
+	if FromPubKey(pub) != addr {
+		return false
+	}
+	return bitcrypto.VerifySignature(pub, MessageHash(msg), sig)
+}
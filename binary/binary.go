@@ -11,3 +11,6 @@ var (
 )
 
 var AppendUvarint = binary.AppendUvarint
+var ReadUvarint = binary.ReadUvarint
+
+const MaxVarintLen64 = binary.MaxVarintLen64
@@ -1,9 +1,11 @@
 package block
 
 import (
+	"bufio"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"slices"
 	"still-blockchain/address"
 	"still-blockchain/binary"
@@ -36,6 +38,7 @@ func (b BlockHeader) PrevHash() util.Hash {
 	return b.Ancestors[0]
 }
 
+// Block is encoded to JSON with a custom format, see json.go
 type Block struct {
 	BlockHeader `json:"header"`
 
@@ -92,29 +95,48 @@ func (b *Block) SortOtherChains() {
 	})
 }
 
+// checkOtherChains checks that the chains are sorted by strictly increasing network ID, as SortOtherChains sorts
+// them, and that no hash is repeated. The order is part of the block hash, so accepting any other order would
+// allow changing the hash of a block without invalidating it. It's checked by Prevalidate rather than when
+// deserializing, so that blocks stored before the rule was added can still be read.
+func checkOtherChains(chains []HashingID) error {
+	for i, v := range chains {
+		if i > 0 && v.NetworkID <= chains[i-1].NetworkID {
+			return fmt.Errorf("OtherChains are not sorted: network id 0x%x after 0x%x", v.NetworkID,
+				chains[i-1].NetworkID)
+		}
+		for _, v2 := range chains[:i] {
+			if v.Hash == v2.Hash {
+				return fmt.Errorf("duplicate OtherChain hash %x", v.Hash)
+			}
+		}
+	}
+	return nil
+}
+
 func (b *Block) setMiningBlob(m MiningBlob) error {
+	if len(m.Chains) > config.MAX_MERGE_MINED_CHAINS {
+		return fmt.Errorf("mining blob has too many chains: %d, max: %d", len(m.Chains),
+			config.MAX_MERGE_MINED_CHAINS)
+	}
+
 	b.Timestamp = m.Timestamp
 	b.Nonce = m.Nonce
 	b.NonceExtra = m.NonceExtra
-	b.OtherChains = make([]HashingID, 0)
+	b.OtherChains = make([]HashingID, 0, len(m.Chains))
 	containsNetworkID := false
-	var lastNetworkId uint64 = 0
-	for _, v := range m.Chains {
+	for i, v := range m.Chains {
+		if i > 0 && v.NetworkID <= m.Chains[i-1].NetworkID {
+			return fmt.Errorf("mining blob is not sorted correctly")
+		}
 		if v.NetworkID != config.NETWORK_ID {
-			if v.NetworkID <= lastNetworkId {
-				return fmt.Errorf("mining blob is not sorted correctly")
-			}
 			for _, oc := range b.OtherChains {
-				if oc.Hash == v.Hash || oc.NetworkID == v.NetworkID {
+				if oc.Hash == v.Hash {
 					return fmt.Errorf("duplicate hashing id 0x%x %x", v.NetworkID, v.Hash)
 				}
 			}
 			b.OtherChains = append(b.OtherChains, v)
-			return nil
 		} else {
-			if containsNetworkID {
-				return fmt.Errorf("mining blob has duplicate network id")
-			}
 			containsNetworkID = true
 		}
 	}
@@ -183,7 +205,6 @@ func (b *BlockHeader) Deserialize(data []byte) ([]byte, error) {
 		return d.RemainingData(), fmt.Errorf("OtherChains exceed limit: %d", numChains)
 	}
 	b.OtherChains = make([]HashingID, numChains)
-	// check that there are no duplicate chains
 	for i := range b.OtherChains {
 		if d.Error() != nil {
 			return d.RemainingData(), d.Error()
@@ -246,6 +267,25 @@ func (b Block) Serialize() []byte {
 
 	return s.Output()
 }
+
+// decodeDifficulty decodes a difficulty serialized as a little-endian byte slice. Only the canonical encoding
+// written by Serialize, without trailing zero bytes, is accepted, so each block has a single valid encoding.
+// Stored blocks are always written by Serialize, so they can be read even if they were received before the rule.
+func decodeDifficulty(data []byte) (Uint128, error) {
+	if len(data) > 16 {
+		return Uint128{}, fmt.Errorf("difficulty too long: %d bytes", len(data))
+	}
+	if len(data) > 0 && data[len(data)-1] == 0 {
+		return Uint128{}, errors.New("difficulty is not canonically encoded")
+	}
+	diff := make([]byte, 16)
+	copy(diff, data)
+	return Uint128{
+		Hi: binary.LittleEndian.Uint64(diff[8:]),
+		Lo: binary.LittleEndian.Uint64(diff[:8]),
+	}, nil
+}
+
 func (b *Block) Deserialize(data []byte) error {
 	data, err := b.BlockHeader.Deserialize(data)
 	if err != nil {
@@ -254,19 +294,14 @@ func (b *Block) Deserialize(data []byte) error {
 
 	d := binary.NewDes(data)
 
-	// read difficulty
-	diff := make([]byte, 16)
-	copy(diff, d.ReadByteSlice())
-	b.Difficulty = Uint128{
-		Hi: binary.LittleEndian.Uint64(diff[8:]),
-		Lo: binary.LittleEndian.Uint64(diff[:8]),
+	// read difficulty and cumulative difficulty
+	b.Difficulty, err = decodeDifficulty(d.ReadByteSlice())
+	if err != nil {
+		return err
 	}
-	// read cumulative difficulty
-	diff = make([]byte, 16)
-	copy(diff, d.ReadByteSlice())
-	b.CumulativeDiff = Uint128{
-		Hi: binary.LittleEndian.Uint64(diff[8:]),
-		Lo: binary.LittleEndian.Uint64(diff[:8]),
+	b.CumulativeDiff, err = decodeDifficulty(d.ReadByteSlice())
+	if err != nil {
+		return err
 	}
 
 	if d.Error() != nil {
@@ -304,19 +339,14 @@ func (b *Block) DeserializeFull(data []byte) ([]*transaction.Transaction, error)
 		Data: data,
 	}
 
-	// read difficulty
-	diff := make([]byte, 16)
-	copy(diff, d.ReadByteSlice())
-	b.Difficulty = Uint128{
-		Hi: binary.LittleEndian.Uint64(diff[8:]),
-		Lo: binary.LittleEndian.Uint64(diff[:8]),
+	// read difficulty and cumulative difficulty
+	b.Difficulty, err = decodeDifficulty(d.ReadByteSlice())
+	if err != nil {
+		return nil, err
 	}
-	// read cumulative difficulty
-	diff = make([]byte, 16)
-	copy(diff, d.ReadByteSlice())
-	b.CumulativeDiff = Uint128{
-		Hi: binary.LittleEndian.Uint64(diff[8:]),
-		Lo: binary.LittleEndian.Uint64(diff[:8]),
+	b.CumulativeDiff, err = decodeDifficulty(d.ReadByteSlice())
+	if err != nil {
+		return nil, err
 	}
 
 	numTx := d.ReadUvarint()
@@ -349,6 +379,92 @@ func (b *Block) DeserializeFull(data []byte) ([]*transaction.Transaction, error)
 	return txs, d.Error()
 }
 
+// maxCommitmentSize is the maximum serialized size of a side block commitment
+const maxCommitmentSize = 32 + 32*config.MINIDAG_ANCESTORS + binary.MaxVarintLen64 + 4 + 16 + binary.MaxVarintLen64 +
+	(config.MAX_MERGE_MINED_CHAINS-1)*(8+32)
+
+// maxHeaderSize is the maximum serialized size of a block header
+const maxHeaderSize = 1 + 2*binary.MaxVarintLen64 + 4 + 16 + address.SIZE + 32*config.MINIDAG_ANCESTORS +
+	binary.MaxVarintLen64 + (config.MAX_MERGE_MINED_CHAINS-1)*(8+32) +
+	binary.MaxVarintLen64 + config.MAX_SIDE_BLOCKS*maxCommitmentSize
+
+// DeserializeFullStream deserializes a full block like DeserializeFull, but reads it from r one transaction at
+// a time, calling fn with each transaction in block order. Memory is allocated for the data actually read rather
+// than for the counts declared by the peer, and each transaction is limited to MAX_TX_SIZE bytes.
+// Deserialization stops at the first error returned by fn.
+// It doesn't bound the memory used by the P2P block packets: they are authenticated as a whole, so the packet,
+// limited to P2P_MAX_PACKET_SIZE, is already in memory when the block is deserialized.
+func (b *Block) DeserializeFullStream(r io.Reader, fn func(tx *transaction.Transaction) error) error {
+	br := bufio.NewReaderSize(r, maxHeaderSize)
+
+	// the header has a variable size, so it's deserialized from a bounded prefix of the stream
+	head, err := br.Peek(maxHeaderSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	rem, err := b.BlockHeader.Deserialize(head)
+	if err != nil {
+		return err
+	}
+	if _, err := br.Discard(len(head) - len(rem)); err != nil {
+		return err
+	}
+
+	// read difficulty and cumulative difficulty
+	for _, v := range []*Uint128{&b.Difficulty, &b.CumulativeDiff} {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		if n > 16 {
+			return fmt.Errorf("difficulty too long: %d bytes", n)
+		}
+		diff := make([]byte, n)
+		if _, err := io.ReadFull(br, diff); err != nil {
+			return err
+		}
+		*v, err = decodeDifficulty(diff)
+		if err != nil {
+			return err
+		}
+	}
+
+	numTx, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if numTx > config.MAX_TX_PER_BLOCK {
+		return fmt.Errorf("block has too many transactions: %d, max: %d", numTx, config.MAX_TX_PER_BLOCK)
+	}
+
+	b.Transactions = b.Transactions[:0]
+	buf := make([]byte, config.MAX_TX_SIZE)
+	for i := uint64(0); i < numTx; i++ {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		if n > config.MAX_TX_SIZE {
+			return fmt.Errorf("transaction %d too large: %d bytes, max: %d", i, n, config.MAX_TX_SIZE)
+		}
+		if _, err := io.ReadFull(br, buf[:n]); err != nil {
+			return err
+		}
+
+		tx := &transaction.Transaction{}
+		if err := tx.Deserialize(buf[:n]); err != nil {
+			return err
+		}
+		b.Transactions = append(b.Transactions, tx.Hash())
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (b Block) Hash() util.Hash {
 	return blake3.Sum256(b.Serialize()[:])
 }
@@ -375,14 +491,43 @@ func ValidPowValue(val Uint128, diff Uint128) bool {
 	return val.Cmp(uint128.Max.Div(diff)) <= 0
 }
 
+// VerifyPoW computes the PoW hash of the block from its commitment, with the seed of its timestamp, and returns
+// it along with true if it meets the block difficulty. Unlike Prevalidate, the hash is always computed, even for
+// blocks secured by checkpoints and on regtest, and the side blocks are not checked.
+func VerifyPoW(bl *Block) (bool, [16]byte, error) {
+	if bl.Difficulty.IsZero() {
+		return false, [16]byte{}, errors.New("difficulty is zero")
+	}
+
+	commitment := bl.Commitment()
+	hash := commitment.PowHash(commitment.MiningBlob().GetSeed())
+	return bl.ValidPowHash(hash), hash, nil
+}
+
+var ErrInvalidRecipient = errors.New("block recipient is not a valid address")
+
 // Prevalidate contains basic validity check, such as PoW hash and timestamp not in future
 func (b Block) Prevalidate() error {
+	return b.prevalidate(checkpoints.IsSecured(b.Height))
+}
+
+// PrevalidateFull is like Prevalidate, but it always verifies the PoW, even if the block is secured by
+// checkpoints. It's much slower, so it should only be used for auditing the chain.
+func (b Block) PrevalidateFull() error {
+	return b.prevalidate(false)
+}
+
+func (b Block) prevalidate(skipPow bool) error {
 	// Generally, try insering the least expensive checks first, most expensive last
 
 	if b.Version != 0 {
 		return fmt.Errorf("unexpected block version %d", b.Version)
 	}
 
+	if !b.Recipient.IsValid() {
+		return fmt.Errorf("%w: %x", ErrInvalidRecipient, b.Recipient)
+	}
+
 	if b.Difficulty.IsZero() {
 		return errors.New("difficulty is zero")
 	}
@@ -391,31 +536,35 @@ func (b Block) Prevalidate() error {
 		return errors.New("difficulty is less than minimum")
 	}
 
-	if b.Timestamp > util.Time()+config.FUTURE_TIME_LIMIT*1000 {
+	if b.Timestamp > util.AdjustedTime()+config.FUTURE_TIME_LIMIT*1000 {
 		return errors.New("block is too much in the future")
 	}
 
-	// check that OtherChains are valid (no duplicates)
-	for i, v := range b.OtherChains {
+	// check that OtherChains are valid (sorted, no duplicates)
+	if err := checkOtherChains(b.OtherChains); err != nil {
+		return err
+	}
+	for _, v := range b.OtherChains {
 		if v.NetworkID == config.NETWORK_ID {
 			return fmt.Errorf("other chain %x includes current network id", v.Hash)
 		}
-		for i2, v2 := range b.OtherChains {
-			if i != i2 && (v.Hash == v2.Hash || v.NetworkID == v2.NetworkID) {
-				return fmt.Errorf("duplicate OtherChain: %x %d; %x %d", v.Hash, v.NetworkID,
-					v2.Hash, v2.NetworkID)
-			}
+	}
+	for _, side := range b.SideBlocks {
+		if err := checkOtherChains(side.OtherChains); err != nil {
+			return fmt.Errorf("side block: %w", err)
 		}
 	}
 
-	if !checkpoints.IsSecured(b.Height) {
-		commitment := b.Commitment()
-		mb := commitment.MiningBlob()
-		seed := mb.GetSeed()
-		powhash := commitment.PowHash(seed)
-		if !b.ValidPowHash(powhash) {
+	// the PoW of regtest blocks is never checked
+	if !skipPow && !config.IS_REGTEST {
+		valid, powhash, err := VerifyPoW(&b)
+		if err != nil {
+			return err
+		}
+		if !valid {
 			return fmt.Errorf("block %x with PoW %x does not meet difficulty", b.Hash(), powhash)
 		}
+		seed := b.Commitment().MiningBlob().GetSeed()
 
 		// prevalidate side blocks
 		for _, side := range b.SideBlocks {
@@ -431,13 +580,13 @@ func (b Block) Prevalidate() error {
 				return fmt.Errorf("commitment does not meet difficulty")
 			}
 		}
-	} else {
-		if checkpoints.IsCheckpoint(b.Height) {
-			expectedHash := checkpoints.GetCheckpoint(b.Height)
-			h := b.Hash()
-			if h != expectedHash {
-				return fmt.Errorf("block %x does not match checkpoint %x", h, expectedHash)
-			}
+	}
+
+	if checkpoints.IsCheckpoint(b.Height) {
+		expectedHash := checkpoints.GetCheckpoint(b.Height)
+		h := b.Hash()
+		if h != expectedHash {
+			return fmt.Errorf("block %x does not match checkpoint %x", h, expectedHash)
 		}
 	}
 
@@ -1,11 +1,15 @@
 package block
 
 import (
+	"bytes"
 	crand "crypto/rand"
+	"errors"
 	"math/rand/v2"
 	"reflect"
 	"runtime"
 	"still-blockchain/address"
+	"still-blockchain/binary"
+	"still-blockchain/checkpoints"
 	"still-blockchain/config"
 	"still-blockchain/transaction"
 	"testing"
@@ -94,6 +98,55 @@ func TestSerialize(t *testing.T) {
 		t.Fatal("bl and bl2 don't match")
 	}
 }
+func TestPrevalidateFull(t *testing.T) {
+	if config.IS_REGTEST {
+		t.Skip("the PoW is not checked on regtest")
+	}
+
+	randomstill.InitHash(runtime.NumCPU(), false)
+
+	// pretend that the first 32 blocks are secured by checkpoints
+	oldInterval, oldMax := checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 32, 1
+	defer func() {
+		checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = oldInterval, oldMax
+	}()
+
+	bl := sampleBlock
+	bl.Height = 5
+	bl.Recipient = address.GenesisAddress
+	// with this difficulty, the PoW is never going to be valid
+	bl.Difficulty = uint128.Max
+
+	if err := bl.Prevalidate(); err != nil {
+		t.Fatal("Prevalidate should skip PoW of checkpointed blocks:", err)
+	}
+	if err := bl.PrevalidateFull(); err == nil {
+		t.Fatal("PrevalidateFull should reject a checkpointed block with invalid PoW")
+	}
+}
+
+func TestPrevalidateRecipient(t *testing.T) {
+	// PoW is skipped for checkpointed blocks
+	oldInterval, oldMax := checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 32, 1
+	defer func() {
+		checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = oldInterval, oldMax
+	}()
+
+	bl := sampleBlock
+	bl.Height = 5
+	bl.Recipient = address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	if err := bl.Prevalidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	bl.Recipient = address.INVALID_ADDRESS
+	if err := bl.Prevalidate(); !errors.Is(err, ErrInvalidRecipient) {
+		t.Fatalf("block with invalid recipient returned %v, expected %v", err, ErrInvalidRecipient)
+	}
+}
+
 func BenchmarkSerialization(b *testing.B) {
 	bl := sampleBlock
 
@@ -109,3 +162,292 @@ func BenchmarkDeserialization(b *testing.B) {
 		bl.Deserialize(blser)
 	}
 }
+
+func TestSetMiningBlobOtherChains(t *testing.T) {
+	bl := sampleBlock
+
+	other := []HashingID{
+		{NetworkID: config.NETWORK_ID - 1, Hash: blake3.Sum256([]byte("chain 1"))},
+		{NetworkID: config.NETWORK_ID + 1, Hash: blake3.Sum256([]byte("chain 2"))},
+	}
+	mb := MiningBlob{
+		Timestamp: rand.Uint64(),
+		Nonce:     rand.Uint32(),
+		Chains:    []HashingID{other[0], bl.Commitment().HashingID(), other[1]},
+	}
+
+	err := bl.setMiningBlob(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bl.OtherChains, other) {
+		t.Fatalf("OtherChains is %x, expected %x", bl.OtherChains, other)
+	}
+
+	// chains must be sorted
+	unsorted := mb
+	unsorted.Chains = []HashingID{mb.Chains[2], mb.Chains[1], mb.Chains[0]}
+	if err := bl.setMiningBlob(unsorted); err == nil {
+		t.Fatal("expected error for unsorted chains")
+	}
+
+	// the current network must be included
+	missing := mb
+	missing.Chains = other
+	if err := bl.setMiningBlob(missing); err == nil {
+		t.Fatal("expected error for missing network id")
+	}
+
+	// the number of chains is limited
+	tooMany := mb
+	tooMany.Chains = nil
+	for i := 0; i <= config.MAX_MERGE_MINED_CHAINS; i++ {
+		tooMany.Chains = append(tooMany.Chains, HashingID{
+			NetworkID: config.NETWORK_ID + uint64(i),
+			Hash:      blake3.Sum256([]byte{byte(i)}),
+		})
+	}
+	if err := bl.setMiningBlob(tooMany); err == nil {
+		t.Fatal("expected error for too many chains")
+	}
+}
+
+// serializeFull serializes a block with the data of its transactions, like the BLOCK packet
+func serializeFull(bl Block, txs [][]byte) []byte {
+	s := binary.NewSer(nil)
+	s.AddFixedByteArray(bl.BlockHeader.Serialize())
+	for _, v := range []Uint128{bl.Difficulty, bl.CumulativeDiff} {
+		diff := make([]byte, 16)
+		v.PutBytes(diff)
+		for len(diff) > 0 && diff[len(diff)-1] == 0 {
+			diff = diff[:len(diff)-1]
+		}
+		s.AddByteSlice(diff)
+	}
+	s.AddUvarint(uint64(len(txs)))
+	for _, v := range txs {
+		s.AddByteSlice(v)
+	}
+	return s.Output()
+}
+
+func TestDeserializeFullStream(t *testing.T) {
+	bl := sampleBlock
+	bl.Height = 1234
+	bl.OtherChains = []HashingID{{NetworkID: config.NETWORK_ID + 1, Hash: blake3.Sum256([]byte("chain"))}}
+	bl.SideBlocks = []Commitment{{BaseHash: blake3.Sum256([]byte("side")), Timestamp: 6975000}}
+
+	var txs [][]byte
+	for i := uint64(1); i <= 20; i++ {
+		tx := transaction.Transaction{
+			Recipient: address.Address{byte(i)},
+			Nonce:     i,
+			Amount:    i * config.COIN,
+			Fee:       i * 1000,
+		}
+		txs = append(txs, tx.Serialize())
+	}
+	data := serializeFull(bl, txs)
+
+	full := &Block{}
+	expected, err := full.DeserializeFull(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &Block{}
+	var got []*transaction.Transaction
+	err = stream.DeserializeFullStream(bytes.NewReader(data), func(tx *transaction.Transaction) error {
+		got = append(got, tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("streamed transactions %v, expected %v", got, expected)
+	}
+	if stream.Hash() != full.Hash() || !reflect.DeepEqual(stream.Transactions, full.Transactions) {
+		t.Fatalf("streamed block hash %x, expected %x", stream.Hash(), full.Hash())
+	}
+
+	// the callback error stops deserialization
+	stop := errors.New("stop")
+	n := 0
+	err = (&Block{}).DeserializeFullStream(bytes.NewReader(data), func(tx *transaction.Transaction) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 3 {
+		t.Fatalf("deserialization stopped after %d transactions with error %v", n, err)
+	}
+
+	// oversized transactions are rejected before being read
+	large := serializeFull(bl, [][]byte{make([]byte, config.MAX_TX_SIZE+1)})
+	if err := (&Block{}).DeserializeFullStream(bytes.NewReader(large), func(*transaction.Transaction) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expected error for oversized transaction")
+	}
+
+	// the declared number of transactions is limited
+	s := binary.NewSer(nil)
+	s.AddUvarint(config.MAX_TX_PER_BLOCK + 1)
+	empty := serializeFull(bl, nil)
+	tooMany := append(empty[:len(empty)-1], s.Output()...)
+	if err := (&Block{}).DeserializeFullStream(bytes.NewReader(tooMany), func(*transaction.Transaction) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expected error for too many transactions")
+	}
+
+	// a truncated block is rejected
+	if err := (&Block{}).DeserializeFullStream(bytes.NewReader(data[:len(data)-10]), func(*transaction.Transaction) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expected error for truncated block")
+	}
+}
+
+func TestNonCanonicalDifficulty(t *testing.T) {
+	bl := sampleBlock
+
+	// difficulty 10000 is canonically encoded as 10 27, an extra zero byte doesn't change its value
+	encode := func(diff []byte) []byte {
+		s := binary.NewSer(nil)
+		s.AddFixedByteArray(bl.BlockHeader.Serialize())
+		s.AddByteSlice(diff)
+		s.AddByteSlice([]byte{2})
+		s.AddUvarint(0)
+		return s.Output()
+	}
+	canonical := encode([]byte{0x10, 0x27})
+	if !bytes.Equal(canonical, bl.Serialize()) {
+		t.Fatalf("canonical encoding is %x, expected %x", canonical, bl.Serialize())
+	}
+
+	for _, diff := range [][]byte{{0x10, 0x27, 0}, {0x10, 0x27, 0, 0}, {0}, make([]byte, 17)} {
+		data := encode(diff)
+		if err := (&Block{}).Deserialize(data); err == nil {
+			t.Errorf("Deserialize accepted difficulty encoded as %x", diff)
+		}
+		if _, err := (&Block{}).DeserializeFull(data); err == nil {
+			t.Errorf("DeserializeFull accepted difficulty encoded as %x", diff)
+		}
+		err := (&Block{}).DeserializeFullStream(bytes.NewReader(data), func(*transaction.Transaction) error {
+			return nil
+		})
+		if err == nil {
+			t.Errorf("DeserializeFullStream accepted difficulty encoded as %x", diff)
+		}
+	}
+
+	bl2 := &Block{}
+	if err := bl2.Deserialize(canonical); err != nil {
+		t.Fatal(err)
+	}
+	if bl2.Difficulty != bl.Difficulty || bl2.CumulativeDiff != bl.CumulativeDiff {
+		t.Fatalf("difficulty is %s %s, expected %s %s", bl2.Difficulty, bl2.CumulativeDiff, bl.Difficulty,
+			bl.CumulativeDiff)
+	}
+}
+
+func TestPrevalidateOtherChainsOrder(t *testing.T) {
+	// PoW is skipped for checkpointed blocks
+	oldInterval, oldMax := checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 32, 1
+	defer func() {
+		checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = oldInterval, oldMax
+	}()
+
+	chain1 := HashingID{NetworkID: config.NETWORK_ID + 1, Hash: blake3.Sum256([]byte("chain 1"))}
+	chain2 := HashingID{NetworkID: config.NETWORK_ID + 2, Hash: blake3.Sum256([]byte("chain 2"))}
+
+	tests := []struct {
+		name   string
+		chains []HashingID
+		valid  bool
+	}{
+		{"sorted", []HashingID{chain1, chain2}, true},
+		{"out of order", []HashingID{chain2, chain1}, false},
+		{"duplicate network id", []HashingID{chain1, {NetworkID: chain1.NetworkID, Hash: chain2.Hash}}, false},
+		{"duplicate hash", []HashingID{chain1, {NetworkID: chain2.NetworkID, Hash: chain1.Hash}}, false},
+	}
+	for _, v := range tests {
+		bl := sampleBlock
+		bl.Height = 5
+		bl.Recipient = address.GenesisAddress
+		bl.OtherChains = v.chains
+
+		// side block commitments are checked too
+		side := bl
+		side.OtherChains = nil
+		side.SideBlocks = []Commitment{{Timestamp: 6975000, OtherChains: v.chains}}
+
+		for _, bl := range []Block{bl, side} {
+			// stored blocks can always be read, whatever the order
+			dec := Block{}
+			if err := dec.Deserialize(bl.Serialize()); err != nil {
+				t.Fatalf("%s: %v", v.name, err)
+			}
+			if dec.Hash() != bl.Hash() {
+				t.Fatalf("%s: deserialized block has hash %x, expected %x", v.name, dec.Hash(), bl.Hash())
+			}
+
+			err := dec.Prevalidate()
+			if v.valid && err != nil {
+				t.Errorf("%s: %v", v.name, err)
+			} else if !v.valid && err == nil {
+				t.Errorf("%s: OtherChains are accepted (side blocks: %d)", v.name, len(bl.SideBlocks))
+			}
+		}
+	}
+}
+
+func TestVerifyPoW(t *testing.T) {
+	randomstill.InitHash(runtime.NumCPU(), false)
+
+	bl := sampleBlock
+	bl.Difficulty = uint128.From64(16)
+
+	// look for a nonce meeting the difficulty, and for one which doesn't
+	var validNonce, invalidNonce uint32
+	var foundValid, foundInvalid bool
+	for nonce := uint32(0); nonce < 1000 && !(foundValid && foundInvalid); nonce++ {
+		bl.Nonce = nonce
+		valid, hash, err := VerifyPoW(&bl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitment := bl.Commitment()
+		if hash != commitment.PowHash(commitment.MiningBlob().GetSeed()) {
+			t.Fatalf("nonce %d: returned hash %x is not the PoW hash", nonce, hash)
+		}
+		if valid && !foundValid {
+			validNonce, foundValid = nonce, true
+		} else if !valid && !foundInvalid {
+			invalidNonce, foundInvalid = nonce, true
+		}
+	}
+	if !foundValid || !foundInvalid {
+		t.Fatalf("no valid or invalid nonce found: %v %v", foundValid, foundInvalid)
+	}
+
+	// the block mined with the valid nonce passes, and fails once the nonce is tweaked
+	bl.Nonce = validNonce
+	if valid, hash, err := VerifyPoW(&bl); err != nil || !valid {
+		t.Fatalf("block with valid PoW %x fails: %v", hash, err)
+	}
+	bl.Nonce = invalidNonce
+	if valid, hash, err := VerifyPoW(&bl); err != nil || valid {
+		t.Fatalf("block with tweaked nonce and PoW %x passes: %v", hash, err)
+	}
+
+	bl.Difficulty = uint128.Zero
+	if _, _, err := VerifyPoW(&bl); err == nil {
+		t.Fatal("block with zero difficulty passes")
+	}
+}
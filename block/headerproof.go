@@ -0,0 +1,16 @@
+package block
+
+// HeaderProof is the chain of mainchain blocks from a block trusted by a light client, usually the last one it
+// verified, up to a given height. Blocks don't include transaction data, only their hashes, so the block hashes
+// can be recomputed.
+type HeaderProof struct {
+	Anchor uint64  `json:"anchor"`           // height of the first block, whose hash must be trusted
+	Parent *Block  `json:"parent,omitempty"` // parent of the first block, nil if it's the genesis block
+	Blocks []Block `json:"blocks"`           // blocks from the anchor to the requested height, ascending
+}
+
+// ExpectedCumulativeDiff returns the cumulative difficulty of the block given the one of the previous block.
+func (b Block) ExpectedCumulativeDiff(prevCumDiff Uint128) Uint128 {
+	sideDiff := b.Difficulty.Mul64(2 * uint64(len(b.SideBlocks))).Div64(3)
+	return prevCumDiff.Add(b.Difficulty).Add(sideDiff)
+}
@@ -0,0 +1,132 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"still-blockchain/address"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"still-blockchain/util/enc"
+	"still-blockchain/util/uint128"
+)
+
+// blockJSON is the JSON representation of a block used by RPC. Fields are always encoded in this order,
+// hashes and binary data are hex strings, and difficulties are decimal strings, since they don't fit in the
+// numbers supported by most JSON parsers.
+type blockJSON struct {
+	Hash           util.Hash          `json:"hash"`
+	Version        uint8              `json:"version"`
+	Height         uint64             `json:"height"`
+	Timestamp      uint64             `json:"timestamp"`
+	Nonce          uint32             `json:"nonce"`
+	NonceExtra     enc.Hex            `json:"nonce_extra"`
+	OtherChains    []hashingIDJSON    `json:"other_chains"`
+	Recipient      address.Integrated `json:"recipient"`
+	Ancestors      Ancestors          `json:"ancestors"`
+	SideBlocks     []enc.Hex          `json:"side_blocks"` // serialized commitments
+	Difficulty     string             `json:"difficulty"`
+	CumulativeDiff string             `json:"cumulative_diff"`
+	Transactions   []util.Hash        `json:"transactions"`
+}
+
+type hashingIDJSON struct {
+	NetworkID uint64    `json:"network_id"`
+	Hash      util.Hash `json:"hash"`
+}
+
+func (b Block) MarshalJSON() ([]byte, error) {
+	j := blockJSON{
+		Hash:           b.Hash(),
+		Version:        b.Version,
+		Height:         b.Height,
+		Timestamp:      b.Timestamp,
+		Nonce:          b.Nonce,
+		NonceExtra:     b.NonceExtra[:],
+		OtherChains:    make([]hashingIDJSON, len(b.OtherChains)),
+		Recipient:      b.Recipient.Integrated(),
+		Ancestors:      b.Ancestors,
+		SideBlocks:     make([]enc.Hex, len(b.SideBlocks)),
+		Difficulty:     b.Difficulty.String(),
+		CumulativeDiff: b.CumulativeDiff.String(),
+		Transactions:   make([]util.Hash, len(b.Transactions)),
+	}
+	for i, v := range b.OtherChains {
+		j.OtherChains[i] = hashingIDJSON{
+			NetworkID: v.NetworkID,
+			Hash:      v.Hash,
+		}
+	}
+	for i, v := range b.SideBlocks {
+		j.SideBlocks[i] = v.Serialize()
+	}
+	for i, v := range b.Transactions {
+		j.Transactions[i] = util.Hash(v)
+	}
+
+	return json.Marshal(j)
+}
+
+func (b *Block) UnmarshalJSON(data []byte) error {
+	j := blockJSON{}
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+
+	if len(j.NonceExtra) != len(b.NonceExtra) {
+		return fmt.Errorf("invalid nonce_extra length %d", len(j.NonceExtra))
+	}
+	diff, err := uint128.FromString(j.Difficulty)
+	if err != nil {
+		return fmt.Errorf("invalid difficulty: %w", err)
+	}
+	cumDiff, err := uint128.FromString(j.CumulativeDiff)
+	if err != nil {
+		return fmt.Errorf("invalid cumulative_diff: %w", err)
+	}
+	if j.Recipient.Subaddr != 0 {
+		return fmt.Errorf("block recipient must not be an integrated address")
+	}
+
+	*b = Block{
+		BlockHeader: BlockHeader{
+			Version:     j.Version,
+			Height:      j.Height,
+			Timestamp:   j.Timestamp,
+			Nonce:       j.Nonce,
+			NonceExtra:  [16]byte(j.NonceExtra),
+			OtherChains: make([]HashingID, len(j.OtherChains)),
+			Recipient:   j.Recipient.Addr,
+			Ancestors:   j.Ancestors,
+			SideBlocks:  make([]Commitment, len(j.SideBlocks)),
+		},
+		Difficulty:     diff,
+		CumulativeDiff: cumDiff,
+		Transactions:   make([]transaction.TXID, len(j.Transactions)),
+	}
+	for i, v := range j.OtherChains {
+		b.OtherChains[i] = HashingID{
+			NetworkID: v.NetworkID,
+			Hash:      v.Hash,
+		}
+	}
+	for i, v := range j.SideBlocks {
+		rem, err := b.SideBlocks[i].Deserialize(v)
+		if err != nil {
+			return fmt.Errorf("invalid side block %d: %w", i, err)
+		}
+		if len(rem) != 0 {
+			return fmt.Errorf("invalid side block %d: unexpected trailing data", i)
+		}
+	}
+	for i, v := range j.Transactions {
+		b.Transactions[i] = transaction.TXID(v)
+	}
+
+	// the hash is optional, but a mismatch means that the JSON data is inconsistent
+	if hash := b.Hash(); j.Hash != (util.Hash{}) && hash != j.Hash {
+		return fmt.Errorf("block hash mismatch: expected %x, got %x", j.Hash, hash)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package block
+
+import (
+	"encoding/json"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/transaction"
+	"still-blockchain/util/uint128"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+func TestBlockJSON(t *testing.T) {
+	bl := sampleBlock
+	bl.Height = 123
+	bl.NonceExtra = [16]byte{1, 2, 3}
+	bl.Recipient = address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	bl.Ancestors[0] = blake3.Sum256([]byte("prev"))
+	bl.OtherChains = []HashingID{{NetworkID: 1, Hash: blake3.Sum256([]byte("chain"))}}
+	bl.SideBlocks = []Commitment{sampleBlock.Commitment()}
+	bl.Difficulty = uint128.Uint128{Hi: 1, Lo: 2}
+	bl.CumulativeDiff = uint128.Max
+	bl.Transactions = []transaction.TXID{blake3.Sum256([]byte("tx"))}
+
+	data, err := json.Marshal(bl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%s", data)
+
+	for _, v := range []string{`"difficulty":"18446744073709551618"`, `"height":123`,
+		`"hash":"` + bl.Hash().String() + `"`} {
+		if !strings.Contains(string(data), v) {
+			t.Errorf("JSON doesn't contain %s", v)
+		}
+	}
+
+	bl2 := Block{}
+	err = json.Unmarshal(data, &bl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(bl.Serialize(), bl2.Serialize()) {
+		t.Fatalf("unmarshaled block differs:\n%v\n%v", bl, bl2)
+	}
+
+	// encoding is deterministic
+	data2, err := json.Marshal(bl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(data2) {
+		t.Fatalf("JSON encoding is not stable:\n%s\n%s", data, data2)
+	}
+
+	// an inconsistent hash is rejected
+	bad := strings.Replace(string(data), `"height":123`, `"height":124`, 1)
+	if json.Unmarshal([]byte(bad), &bl2) == nil {
+		t.Fatal("block with wrong hash should not be unmarshaled")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"still-blockchain/config"
 
 	"github.com/still-project/go-randomstill"
-	"github.com/zeebo/blake3"
 )
 
 type HashingID struct {
@@ -81,10 +80,7 @@ func (m *MiningBlob) Deserialize(b []byte) error {
 }
 
 func (m MiningBlob) GetSeed() randomstill.Seed {
-	b := make([]byte, 8)
-	seedhashId := GetSeedhashId(m.Timestamp)
-	binary.LittleEndian.PutUint64(b, seedhashId)
-	return blake3.Sum256(b)
+	return getSeed(GetSeedhashId(m.Timestamp))
 }
 func GetSeedhashId(time uint64) uint64 {
 	return time / (config.SEEDHASH_DURATION * 1000)
@@ -1,42 +1,181 @@
 package block
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"still-blockchain/config"
+	"still-blockchain/util"
 )
 
-func reduce(n, count uint64) uint64 {
-	if count == 0 {
-		return n
-	}
-	return reduce(n*9/10, count-1)
+// RewardSchedule is the emission schedule of new coins: the reward of a block only depends on its height, and the
+// supply at a height is the sum of the rewards of the blocks up to it
+type RewardSchedule struct {
+	LaunchReward      uint64 // reward of the blocks of the first interval
+	InitialReward     uint64 // reward of the blocks of the second interval, reduced at every following one
+	ReductionInterval uint64 // number of blocks between two reward reductions
+	ReductionPercent  uint64 // percentage by which the reward is reduced at every interval, 50 for halvings
+	TailEmission      uint64 // minimum reward, paid forever once the reductions reach it
+
+	// coins that can ever exist, math.MaxUint64 if the supply is unbounded because of the tail emission
+	MaxSupply uint64
+}
+
+// Schedule is the emission schedule of this network, configured in config
+var Schedule = RewardSchedule{
+	LaunchReward:      config.BLOCK_REWARD / 2,
+	InitialReward:     config.BLOCK_REWARD,
+	ReductionInterval: config.REDUCTION_INTERVAL,
+	ReductionPercent:  config.REDUCTION_PERCENT,
+	TailEmission:      config.TAIL_EMISSION,
+	MaxSupply:         config.MAX_SUPPLY,
 }
 
 func (b Block) Reward() uint64 {
-	return Reward(b.Height)
+	return Schedule.Reward(b.Height)
 }
 
 func Reward(height uint64) uint64 {
-	// supply reduction every 60 days (2 months)
-	reductions := height / config.REDUCTION_INTERVAL
-	if reductions == 0 {
-		return config.BLOCK_REWARD / 2
+	return Schedule.Reward(height)
+}
+
+func GetSupplyAtHeight(height uint64) uint64 {
+	return Schedule.SupplyAtHeight(height)
+}
+
+// next returns the reward of the interval following the given one, which has the given reward
+func (s RewardSchedule) next(interval, reward uint64) uint64 {
+	if interval == 0 {
+		return max(s.InitialReward, s.TailEmission)
 	}
+	return max(reward*(100-s.ReductionPercent)/100, s.TailEmission)
+}
 
-	return reduce(config.BLOCK_REWARD, reductions-1)
+// Reward returns the reward of the block at the given height. The reward reduces every ReductionInterval blocks,
+// which is a fixed number of days whatever the target block time is.
+func (s RewardSchedule) Reward(height uint64) uint64 {
+	reward := s.LaunchReward
+	for i := uint64(0); i < height/s.ReductionInterval; i++ {
+		if i > 0 && reward <= s.TailEmission {
+			break
+		}
+		reward = s.next(i, reward)
+	}
+	return reward
 }
 
-func supplyAtPhase(reductions uint64) uint64 {
+// SupplyAtHeight returns the sum of the rewards of the blocks from the genesis to the given height, included
+func (s RewardSchedule) SupplyAtHeight(height uint64) uint64 {
 	var supply uint64
-	for reductions > 0 {
-		supply += Reward(config.REDUCTION_INTERVAL*reductions-1) * config.REDUCTION_INTERVAL
-		reductions--
+	reward := s.LaunchReward
+	for i := uint64(0); i < height/s.ReductionInterval; i++ {
+		supply += reward * s.ReductionInterval
+		reward = s.next(i, reward)
 	}
-	return supply
+	return supply + reward*(height%s.ReductionInterval+1)
 }
 
-func GetSupplyAtHeight(height uint64) uint64 {
-	reductions := height / config.REDUCTION_INTERVAL
-	reductionBlocks := height%config.REDUCTION_INTERVAL + 1
-	phaseSupply := supplyAtPhase(reductions)
-	return phaseSupply + Reward(height)*reductionBlocks
+// phaseStarts calls fn with the first height of every reward interval, until the reward stops changing
+func (s RewardSchedule) phaseStarts(fn func(height uint64) error) error {
+	for height := uint64(0); ; height += s.ReductionInterval {
+		if err := fn(height); err != nil {
+			return err
+		}
+		if height > 0 && s.Reward(height) == s.Reward(height+s.ReductionInterval) {
+			return nil
+		}
+	}
+}
+
+// Emission returns the total supply that the schedule emits, and false if the supply is unbounded because of
+// the tail emission
+func (s RewardSchedule) Emission() (uint64, bool) {
+	var last uint64
+	s.phaseStarts(func(height uint64) error {
+		last = height
+		return nil
+	})
+	if s.Reward(last) != 0 {
+		return 0, false
+	}
+	return s.SupplyAtHeight(last), true
+}
+
+// Validate checks that the schedule is well formed, that SupplyAtHeight is the sum of the rewards: at the first
+// and last block of every interval, the supply must grow by the reward of the block, and that MaxSupply is the
+// total emission, which rounding only makes up to a millionth lower. It's called at startup, since a wrong
+// schedule would silently corrupt the supply, and a wrong MaxSupply would reject valid transactions.
+func (s RewardSchedule) Validate() error {
+	if s.ReductionInterval == 0 {
+		return errors.New("reward reduction interval is zero")
+	}
+	if s.ReductionPercent > 100 {
+		return fmt.Errorf("reward reduction percentage %d is not between 0 and 100", s.ReductionPercent)
+	}
+	if s.ReductionPercent == 0 && s.TailEmission == 0 {
+		return errors.New("reward never reduces, and there's no tail emission")
+	}
+
+	err := s.phaseStarts(func(start uint64) error {
+		end := start + s.ReductionInterval - 1
+		if s.Reward(start) != s.Reward(end) {
+			return fmt.Errorf("reward changes from %d to %d within the interval starting at %d", s.Reward(start),
+				s.Reward(end), start)
+		}
+		for _, height := range []uint64{start, end} {
+			var prevSupply uint64
+			if height > 0 {
+				prevSupply = s.SupplyAtHeight(height - 1)
+			}
+			if emitted := s.SupplyAtHeight(height) - prevSupply; emitted != s.Reward(height) {
+				return fmt.Errorf("supply grows by %d at height %d, but the block reward is %d", emitted, height,
+					s.Reward(height))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	emission, bounded := s.Emission()
+	switch {
+	case !bounded && s.MaxSupply != math.MaxUint64:
+		return fmt.Errorf("the tail emission makes the supply unbounded, but the max supply is %d", s.MaxSupply)
+	case bounded && (s.MaxSupply < emission || s.MaxSupply-emission > s.MaxSupply/1_000_000):
+		return fmt.Errorf("the schedule emits %d coins, but the max supply is %d", emission, s.MaxSupply)
+	}
+	return nil
+}
+
+// SplitReward splits the total reward of a block, fees included, between the miner and the governance address,
+// which receives governancePercent percent of it. The governance share is rounded down and the miner receives the
+// remainder, so that the two always add up to the total, whether the block has transactions or not.
+func SplitReward(total, governancePercent uint64) (miner, governance uint64, err error) {
+	governance, err = util.SafeMul(total, governancePercent)
+	if err != nil {
+		return 0, 0, err
+	}
+	governance /= 100
+	return total - governance, governance, nil
+}
+
+// ValidateRewardSplit checks that governancePercent is a valid percentage, and that SplitReward doesn't overflow
+// at the largest block reward of the emission schedule. It's called at startup, since a wrong configuration would
+// only be noticed when a block reward can't be split.
+func ValidateRewardSplit(governancePercent uint64) error {
+	if governancePercent > 100 {
+		return fmt.Errorf("governance reward percentage %d is not between 0 and 100", governancePercent)
+	}
+
+	// the reward only changes at the first block of every reward phase
+	var largest uint64
+	Schedule.phaseStarts(func(height uint64) error {
+		largest = max(largest, Reward(height))
+		return nil
+	})
+	if _, _, err := SplitReward(largest, governancePercent); err != nil {
+		return fmt.Errorf("largest block reward %d: %w", largest, err)
+	}
+	return nil
 }
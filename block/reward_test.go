@@ -1,6 +1,9 @@
 package block
 
 import (
+	"math"
+	"math/big"
+	"math/rand/v2"
 	"still-blockchain/config"
 	"still-blockchain/util"
 	"testing"
@@ -39,3 +42,140 @@ func TestReward(t *testing.T) {
 	}
 	t.Logf("block reward discrepancy: %.9f %%", (1-float64(supply)/float64(config.MAX_SUPPLY))*100)
 }
+
+func TestRewardSchedule(t *testing.T) {
+	// the emission schedule is defined in days, so it doesn't depend on the target block time
+	const day = 60 * 60 * 24
+	if config.BLOCKS_PER_DAY*config.TARGET_BLOCK_TIME != day {
+		t.Fatalf("%d blocks of %d seconds don't last a day", config.BLOCKS_PER_DAY, config.TARGET_BLOCK_TIME)
+	}
+	if config.REDUCTION_INTERVAL*config.TARGET_BLOCK_TIME != 90*day {
+		t.Fatalf("reward reduction interval of %d blocks doesn't last 90 days", config.REDUCTION_INTERVAL)
+	}
+
+	// the daily emission of the first phase is half the reward of the following one
+	if Reward(config.REDUCTION_INTERVAL-1)*2 != Reward(config.REDUCTION_INTERVAL) {
+		t.Fatalf("first phase reward %d is not half of %d", Reward(config.REDUCTION_INTERVAL-1),
+			Reward(config.REDUCTION_INTERVAL))
+	}
+}
+
+func TestCustomRewardSchedule(t *testing.T) {
+	if err := Schedule.Validate(); err != nil {
+		t.Fatalf("configured schedule is invalid: %v", err)
+	}
+	exact := RewardSchedule{LaunchReward: config.COIN, InitialReward: config.COIN, ReductionInterval: 10,
+		ReductionPercent: 100, MaxSupply: 20 * config.COIN}
+	if err := exact.Validate(); err != nil {
+		t.Fatalf("schedule %+v is invalid: %v", exact, err)
+	}
+
+	// a testnet with fast halvings and a tail emission
+	s := RewardSchedule{
+		LaunchReward:      50 * config.COIN,
+		InitialReward:     100 * config.COIN,
+		ReductionInterval: 10,
+		ReductionPercent:  50,
+		TailEmission:      config.COIN,
+		MaxSupply:         math.MaxUint64,
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var supply uint64
+	for height := uint64(0); height < 200; height++ {
+		reward := s.Reward(height)
+		supply += reward
+		if s.SupplyAtHeight(height) != supply {
+			t.Fatalf("height %d: supply %d, but the rewards sum to %d", height, s.SupplyAtHeight(height), supply)
+		}
+
+		var expected uint64
+		switch interval := height / s.ReductionInterval; interval {
+		case 0:
+			expected = s.LaunchReward
+		default:
+			expected = max(s.InitialReward>>(interval-1), s.TailEmission)
+		}
+		if reward != expected {
+			t.Fatalf("height %d: reward %d, expected %d", height, reward, expected)
+		}
+	}
+	if s.Reward(1_000_000_000) != s.TailEmission {
+		t.Fatalf("reward %d after many halvings, expected the tail emission", s.Reward(1_000_000_000))
+	}
+
+	for _, invalid := range []RewardSchedule{
+		{LaunchReward: config.COIN, InitialReward: config.COIN, ReductionInterval: 0, ReductionPercent: 50},
+		{LaunchReward: config.COIN, InitialReward: config.COIN, ReductionInterval: 10, ReductionPercent: 101},
+		{LaunchReward: config.COIN, InitialReward: config.COIN, ReductionInterval: 10, ReductionPercent: 0},
+		// the max supply must match the emission
+		{LaunchReward: 50 * config.COIN, InitialReward: 100 * config.COIN, ReductionInterval: 10,
+			ReductionPercent: 50, TailEmission: config.COIN, MaxSupply: 1_000_000 * config.COIN},
+		{LaunchReward: config.COIN, InitialReward: config.COIN, ReductionInterval: 10, ReductionPercent: 100,
+			MaxSupply: 19 * config.COIN},
+		{LaunchReward: config.COIN, InitialReward: config.COIN, ReductionInterval: 10, ReductionPercent: 100,
+			MaxSupply: 21 * config.COIN},
+		{LaunchReward: Schedule.LaunchReward, InitialReward: Schedule.InitialReward,
+			ReductionInterval: Schedule.ReductionInterval, ReductionPercent: 20, MaxSupply: Schedule.MaxSupply},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("schedule %+v is valid", invalid)
+		}
+	}
+}
+
+func TestValidateRewardSplit(t *testing.T) {
+	if err := ValidateRewardSplit(config.BLOCK_REWARD_FEE_PERCENT); err != nil {
+		t.Fatalf("configured reward split is invalid: %v", err)
+	}
+	for _, percent := range []uint64{0, 100} {
+		if err := ValidateRewardSplit(percent); err != nil {
+			t.Errorf("%d%% governance reward is invalid: %v", percent, err)
+		}
+	}
+	for _, percent := range []uint64{101, 1000} {
+		if err := ValidateRewardSplit(percent); err == nil {
+			t.Errorf("%d%% governance reward is valid", percent)
+		}
+	}
+
+	miner, governance, err := SplitReward(config.COIN+5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if governance != (config.COIN+5)/10 || miner+governance != config.COIN+5 {
+		t.Fatalf("reward split is %d miner, %d governance", miner, governance)
+	}
+}
+
+// TestSplitRewardRounding locks the rounding policy of SplitReward: the governance share is rounded down and the
+// miner receives the remainder, so that no coin is created or lost by the split
+func TestSplitRewardRounding(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	totals := []uint64{0, 1, 9, 10, 11, 99, 100, 101, config.COIN - 1, config.COIN, config.COIN + 1,
+		math.MaxUint64 / 100}
+	for i := 0; i < 1000; i++ {
+		totals = append(totals, rng.Uint64N(math.MaxUint64/100+1))
+	}
+
+	for percent := uint64(0); percent <= 100; percent++ {
+		for _, total := range totals {
+			miner, governance, err := SplitReward(total, percent)
+			if err != nil {
+				t.Fatalf("splitting %d with %d%%: %v", total, percent, err)
+			}
+			if miner+governance != total {
+				t.Fatalf("splitting %d with %d%%: miner %d plus governance %d is not the total", total, percent,
+					miner, governance)
+			}
+			expected := new(big.Int).Mul(new(big.Int).SetUint64(total), new(big.Int).SetUint64(percent))
+			expected.Quo(expected, big.NewInt(100))
+			if expected.Uint64() != governance {
+				t.Fatalf("splitting %d with %d%%: governance %d, expected %s", total, percent, governance, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package block
+
+import (
+	"encoding/binary"
+	"math"
+	"still-blockchain/config"
+	"sync"
+
+	"github.com/still-project/go-randomstill"
+	"github.com/zeebo/blake3"
+)
+
+// seedCache holds the seeds of the most recent seedhash epochs, so they are derived once per epoch instead
+// of once per block or share verification. It's safe for concurrent use. A plain sync.RWMutex is used
+// instead of util.RWMutex, as deadlock detection would cost more than deriving the seed.
+var seedCache = struct {
+	sync.RWMutex
+	seeds map[uint64]randomstill.Seed
+}{
+	seeds: make(map[uint64]randomstill.Seed, config.SEED_CACHE_SIZE),
+}
+
+// getSeed returns the seed of the given seedhash id, using the cache if possible
+func getSeed(seedhashId uint64) randomstill.Seed {
+	seedCache.RLock()
+	seed, ok := seedCache.seeds[seedhashId]
+	seedCache.RUnlock()
+	if ok {
+		return seed
+	}
+
+	seed = computeSeed(seedhashId)
+
+	seedCache.Lock()
+	defer seedCache.Unlock()
+	if _, ok := seedCache.seeds[seedhashId]; ok {
+		// added by a concurrent call
+		return seed
+	}
+	if len(seedCache.seeds) >= config.SEED_CACHE_SIZE {
+		// evict the oldest epoch, even if the new one is older
+		var oldest uint64 = math.MaxUint64
+		for id := range seedCache.seeds {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(seedCache.seeds, oldest)
+	}
+	seedCache.seeds[seedhashId] = seed
+
+	return seed
+}
+
+func computeSeed(seedhashId uint64) randomstill.Seed {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, seedhashId)
+	return blake3.Sum256(b)
+}
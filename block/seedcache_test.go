@@ -0,0 +1,84 @@
+package block
+
+import (
+	"still-blockchain/config"
+	"sync"
+	"testing"
+)
+
+func TestSeedCache(t *testing.T) {
+	const epoch = config.SEEDHASH_DURATION * 1000
+
+	for i := uint64(0); i < config.SEED_CACHE_SIZE*2; i++ {
+		// two timestamps in the same epoch have the same seed
+		mb1 := MiningBlob{Timestamp: i * epoch}
+		mb2 := MiningBlob{Timestamp: (i+1)*epoch - 1}
+
+		fresh := computeSeed(GetSeedhashId(mb1.Timestamp))
+		if seed := mb1.GetSeed(); seed != fresh {
+			t.Fatalf("epoch %d: seed %x does not match fresh seed %x", i, seed, fresh)
+		}
+		if seed := mb2.GetSeed(); seed != fresh {
+			t.Fatalf("epoch %d: cached seed %x does not match fresh seed %x", i, seed, fresh)
+		}
+	}
+
+	seedCache.RLock()
+	n := len(seedCache.seeds)
+	seedCache.RUnlock()
+	if n > config.SEED_CACHE_SIZE {
+		t.Fatalf("seed cache has %d entries, max %d", n, config.SEED_CACHE_SIZE)
+	}
+}
+
+func TestSeedCacheOlderEpoch(t *testing.T) {
+	// the cache is full of recent epochs, and an older epoch is requested, like a share of a stale block
+	for id := uint64(1000); id < 1000+config.SEED_CACHE_SIZE; id++ {
+		getSeed(id)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		if getSeed(id) != computeSeed(id) {
+			t.Fatalf("seed of epoch %d does not match", id)
+		}
+		seedCache.RLock()
+		n := len(seedCache.seeds)
+		seedCache.RUnlock()
+		if n > config.SEED_CACHE_SIZE {
+			t.Fatalf("seed cache has %d entries after requesting epoch %d, max %d", n, id, config.SEED_CACHE_SIZE)
+		}
+	}
+}
+
+func TestSeedCacheConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := uint64(0); j < 100; j++ {
+				id := j % (config.SEED_CACHE_SIZE + 1)
+				if getSeed(id) != computeSeed(id) {
+					t.Errorf("seed of epoch %d does not match", id)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkSeedCached(b *testing.B) {
+	mb := MiningBlob{Timestamp: 1_700_000_000_000}
+	mb.GetSeed()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.GetSeed()
+	}
+}
+
+func BenchmarkSeedUncached(b *testing.B) {
+	id := GetSeedhashId(1_700_000_000_000)
+	for i := 0; i < b.N; i++ {
+		computeSeed(id)
+	}
+}
@@ -1,11 +1,26 @@
 package blockchain
 
 import (
+	"fmt"
 	"still-blockchain/binary"
 	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/util"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
 )
 
-func (bc *Blockchain) SerializeFullBlock(b *block.Block) ([]byte, error) {
+func (bc *Blockchain) SerializeFullBlock(b *block.Block) (ser []byte, err error) {
+	err = bc.DB.View(func(tx *bolt.Tx) (err error) {
+		ser, err = bc.serializeFullBlock(tx, b)
+		return
+	})
+	return
+}
+
+// serializeFullBlock is like SerializeFullBlock, reading the transactions with the given database transaction
+func (bc *Blockchain) serializeFullBlock(tx *bolt.Tx, b *block.Block) ([]byte, error) {
 	s := binary.NewSer(make([]byte, 0, 80))
 
 	s.AddFixedByteArray(b.BlockHeader.Serialize())
@@ -27,8 +42,9 @@ func (bc *Blockchain) SerializeFullBlock(b *block.Block) ([]byte, error) {
 
 	s.AddUvarint(uint64(len(b.Transactions)))
 
+	btx := tx.Bucket([]byte{buck.TX})
 	for _, v := range b.Transactions {
-		txn, _, err := bc.GetTx(v)
+		txn, _, err := bc.buckGetTx(btx, v)
 		if err != nil {
 			return nil, err
 		}
@@ -37,3 +53,47 @@ func (bc *Blockchain) SerializeFullBlock(b *block.Block) ([]byte, error) {
 
 	return s.Output(), nil
 }
+
+// GetBlockRewardInfo returns the reward breakdown of a block, split like ApplyBlockToState does: the base
+// emission plus the transaction fees are the total reward, of which BLOCK_REWARD_FEE_PERCENT goes to the
+// governance address and the rest to the miner.
+func (bc *Blockchain) GetBlockRewardInfo(tx *bolt.Tx, hash [32]byte) (base, fees, governance, miner uint64,
+	err error) {
+	bl, err := bc.GetBlock(tx, hash)
+	if err != nil {
+		return
+	}
+
+	btx := tx.Bucket([]byte{buck.TX})
+	for _, v := range bl.Transactions {
+		t, _, err := bc.buckGetTx(btx, v)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("transaction %x: %w", v, err)
+		}
+		fees, err = util.SafeAdd(fees, t.Fee)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("block %x total fee: %w", hash, err)
+		}
+	}
+
+	_, miner, governance, err = splitBlockReward(bl, hash, fees)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return bl.Reward(), fees, governance, miner, nil
+}
+
+// splitBlockReward returns the total reward of a block with the given fees, and its split between the miner and
+// the governance address. ApplyBlockToState, RemoveBlockFromState and GetBlockRewardInfo MUST all use it, so
+// that removing a block subtracts exactly the amounts that applying it added.
+func splitBlockReward(bl *block.Block, hash [32]byte, totalFee uint64) (total, miner, governance uint64, err error) {
+	total, err = util.SafeAdd(bl.Reward(), totalFee)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("block %x total reward: %w", hash, err)
+	}
+	miner, governance, err = block.SplitReward(total, config.BLOCK_REWARD_FEE_PERCENT)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("block %x governance reward: %w", hash, err)
+	}
+	return total, miner, governance, nil
+}
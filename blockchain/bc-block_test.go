@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestGetBlockRewardInfo(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+	tx := newTestTx(t, pk, 1, config.COIN)
+	if _, err := bc.SubmitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	getBalance := func(addr address.Address) uint64 {
+		t.Helper()
+		var balance uint64
+		bc.DB.View(func(txn *bolt.Tx) error {
+			state, err := bc.GetState(txn, addr)
+			if err == nil {
+				balance = state.Balance
+			}
+			return nil
+		})
+		return balance
+	}
+	governanceBefore := getBalance(address.GenesisAddress)
+
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	bl := newTestBlock(t, bc, miner)
+	if len(bl.Transactions) != 1 {
+		t.Fatalf("block template has %d transactions, expected 1", len(bl.Transactions))
+	}
+	addTestBlocks(t, bc, bl)
+
+	var base, fees, governance, minerReward uint64
+	err := bc.DB.View(func(txn *bolt.Tx) (err error) {
+		if _, _, _, _, err := bc.GetBlockRewardInfo(txn, [32]byte{1}); err == nil {
+			t.Error("expected error for unknown block")
+		}
+		base, fees, governance, minerReward, err = bc.GetBlockRewardInfo(txn, bl.Hash())
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base != bl.Reward() || fees != tx.Fee {
+		t.Errorf("base reward %d and fees %d, expected %d and %d", base, fees, bl.Reward(), tx.Fee)
+	}
+	if base+fees != governance+minerReward {
+		t.Errorf("governance %d plus miner %d rewards don't sum to %d", governance, minerReward, base+fees)
+	}
+	if expected := (base + fees) * config.BLOCK_REWARD_FEE_PERCENT / 100; governance != expected {
+		t.Errorf("governance reward is %d, expected %d", governance, expected)
+	}
+
+	// the breakdown matches what was credited in state
+	if balance := getBalance(miner); balance != minerReward {
+		t.Errorf("miner balance is %d, expected the miner reward %d", balance, minerReward)
+	}
+	if credited := getBalance(address.GenesisAddress) - governanceBefore; credited != governance {
+		t.Errorf("governance address was credited %d, expected %d", credited, governance)
+	}
+}
+
+func TestEmptyBlockState(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	minerBefore := State{Balance: config.COIN, LastNonce: 2, LastIncoming: 3}
+	setTestState(t, bc, miner, &minerBefore)
+
+	bl := newTestBlock(t, bc, miner)
+	if len(bl.Transactions) != 0 {
+		t.Fatalf("block has %d transactions, expected none", len(bl.Transactions))
+	}
+	hash := bl.Hash()
+	minerReward, governanceReward, err := block.SplitReward(bl.Reward(), config.BLOCK_REWARD_FEE_PERCENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minerReward+governanceReward != bl.Reward() {
+		t.Fatalf("miner reward %d plus governance reward %d is not the block reward %d", minerReward,
+			governanceReward, bl.Reward())
+	}
+
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		governanceBefore, _ := bc.GetState(tx, address.GenesisAddress)
+		statsBefore := *bc.GetStats(tx)
+
+		// only the base reward is credited, split between the miner and the governance address
+		if err := bc.ApplyBlockToState(tx, bl, hash); err != nil {
+			return err
+		}
+		minerState, err := bc.GetState(tx, miner)
+		if err != nil {
+			return err
+		}
+		expected := State{
+			Balance:      minerBefore.Balance + minerReward,
+			LastNonce:    minerBefore.LastNonce,
+			LastIncoming: minerBefore.LastIncoming + 1,
+		}
+		if *minerState != expected {
+			t.Fatalf("miner state is {%v}, expected {%v}", minerState, expected)
+		}
+		inc, err := bc.GetTxTopoInc(tx, miner, expected.LastIncoming)
+		if err != nil {
+			return err
+		}
+		if inc != hash {
+			t.Fatalf("miner incoming %d is %x, expected block %x", expected.LastIncoming, inc, hash)
+		}
+		governanceState, err := bc.GetState(tx, address.GenesisAddress)
+		if err != nil {
+			return err
+		}
+		if governanceState.Balance != governanceBefore.Balance+governanceReward {
+			t.Fatalf("governance balance is %d, expected %d", governanceState.Balance,
+				governanceBefore.Balance+governanceReward)
+		}
+		if supply := bc.GetStats(tx).Supply; supply != statsBefore.Supply+bl.Reward() {
+			t.Fatalf("supply is %d, expected %d", supply, statsBefore.Supply+bl.Reward())
+		}
+
+		// removing the block reverses it exactly
+		if err := bc.RemoveBlockFromState(tx, bl, hash); err != nil {
+			return err
+		}
+		minerState, err = bc.GetState(tx, miner)
+		if err != nil {
+			return err
+		}
+		if *minerState != minerBefore {
+			t.Fatalf("miner state after removal is {%v}, expected {%v}", minerState, minerBefore)
+		}
+		governanceState, err = bc.GetState(tx, address.GenesisAddress)
+		if err != nil {
+			return err
+		}
+		if *governanceState != *governanceBefore {
+			t.Fatalf("governance state after removal is {%v}, expected {%v}", governanceState, governanceBefore)
+		}
+		if supply := bc.GetStats(tx).Supply; supply != statsBefore.Supply {
+			t.Fatalf("supply after removal is %d, expected %d", supply, statsBefore.Supply)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,172 @@
+package blockchain
+
+import (
+	"container/list"
+	"slices"
+	"still-blockchain/block"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// blockCache keeps the most recently read blocks deserialized in memory, so that GetBlock doesn't deserialize
+// them again. The cache forgets the blocks that are deleted from the database, and the ones saved again with
+// the same hash, like an orphan block whose cumulative difficulty is updated when its parent arrives. A nil
+// blockCache is disabled.
+//
+// Blocks read by a writable database transaction are only cached when the transaction is committed, since
+// they may be rolled back with it. Bolt allows a single writable transaction at a time, so only the blocks of
+// the current one are kept pending.
+//
+// A plain sync.Mutex is used instead of util.Mutex, as deadlock detection would cost more than deserializing the
+// block. The mutex is never held while calling other code.
+type blockCache struct {
+	sync.Mutex
+
+	size int
+
+	// least recently used blocks are at the front of the list
+	order  *list.List
+	blocks map[[32]byte]*list.Element
+
+	// ID of the last transaction which deleted blocks. Read-only transactions started before it was committed
+	// still see the deleted blocks, so they can't add blocks to the cache.
+	invalidated int
+
+	pendingTx *bolt.Tx
+	pending   []cachedBlock
+}
+
+type cachedBlock struct {
+	hash [32]byte
+	bl   *block.Block
+}
+
+// newBlockCache returns a cache of the given number of blocks, or nil if size is not positive
+func newBlockCache(size int) *blockCache {
+	if size <= 0 {
+		return nil
+	}
+	return &blockCache{
+		size:   size,
+		order:  list.New(),
+		blocks: make(map[[32]byte]*list.Element, size),
+	}
+}
+
+// cloneBlock returns a deep copy of the block, so that the callers of GetBlock can't modify the cached block
+func cloneBlock(bl *block.Block) *block.Block {
+	c := *bl
+	c.OtherChains = slices.Clone(bl.OtherChains)
+	c.SideBlocks = slices.Clone(bl.SideBlocks)
+	for i := range c.SideBlocks {
+		c.SideBlocks[i].OtherChains = slices.Clone(c.SideBlocks[i].OtherChains)
+	}
+	c.Transactions = slices.Clone(bl.Transactions)
+	return &c
+}
+
+// get returns a copy of the cached block with the given hash, or nil if it's not cached
+func (c *blockCache) get(hash [32]byte) *block.Block {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.blocks[hash]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToBack(el)
+	return cloneBlock(el.Value.(cachedBlock).bl)
+}
+
+// add caches a block read from the database by the given transaction
+func (c *blockCache) add(tx *bolt.Tx, hash [32]byte, bl *block.Block) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	entry := cachedBlock{hash, cloneBlock(bl)}
+	if !tx.Writable() {
+		if tx.ID() >= c.invalidated {
+			c.insert(entry)
+		}
+		return
+	}
+
+	if c.pendingTx != tx {
+		// the previous writable transaction has been either committed or rolled back
+		c.pendingTx = tx
+		c.pending = c.pending[:0]
+		tx.OnCommit(func() {
+			c.commit(tx)
+		})
+	}
+	if len(c.pending) >= c.size {
+		// only the last blocks read would stay in the cache
+		c.pending = slices.Delete(c.pending, 0, 1)
+	}
+	c.pending = append(c.pending, entry)
+}
+
+// the cache MUST be locked before calling this
+func (c *blockCache) insert(entry cachedBlock) {
+	if el, ok := c.blocks[entry.hash]; ok {
+		el.Value = entry
+		c.order.MoveToBack(el)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.blocks, oldest.Value.(cachedBlock).hash)
+	}
+	c.blocks[entry.hash] = c.order.PushBack(entry)
+}
+
+func (c *blockCache) commit(tx *bolt.Tx) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.pendingTx != tx {
+		return
+	}
+	for _, entry := range c.pending {
+		c.insert(entry)
+	}
+	c.pendingTx = nil
+	c.pending = c.pending[:0]
+}
+
+// remove forgets a block deleted or saved again by the given writable transaction. The block is removed again when the
+// transaction is committed, in case a concurrent read-only transaction cached it in the meantime.
+func (c *blockCache) remove(tx *bolt.Tx, hash [32]byte) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	c.forget(hash)
+	c.invalidated = max(c.invalidated, tx.ID())
+	tx.OnCommit(func() {
+		c.Lock()
+		defer c.Unlock()
+		c.forget(hash)
+	})
+}
+
+// the cache MUST be locked before calling this
+func (c *blockCache) forget(hash [32]byte) {
+	if el, ok := c.blocks[hash]; ok {
+		c.order.Remove(el)
+		delete(c.blocks, hash)
+	}
+	c.pending = slices.DeleteFunc(c.pending, func(entry cachedBlock) bool {
+		return entry.hash == hash
+	})
+}
@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"errors"
+	"reflect"
+	"still-blockchain/block"
+	"still-blockchain/util/buck"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// readBlock deserializes a block from the database, bypassing the cache
+func readBlock(t testing.TB, bc *Blockchain, hash [32]byte) *block.Block {
+	t.Helper()
+
+	bl := &block.Block{}
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		return bl.Deserialize(tx.Bucket([]byte{buck.BLOCK}).Get(hash[:]))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bl
+}
+
+func TestBlockCache(t *testing.T) {
+	bc := newTestBlockchain(t)
+	bc.blockCache = newBlockCache(2)
+
+	blocks := newTestChain(t, nil, 4)
+	addTestBlocks(t, bc, blocks...)
+	getBlock := func(hash [32]byte) *block.Block {
+		t.Helper()
+		var bl *block.Block
+		err := bc.DB.View(func(tx *bolt.Tx) (err error) {
+			bl, err = bc.GetBlock(tx, hash)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bl
+	}
+	isCached := func(hash [32]byte) bool {
+		bc.blockCache.Lock()
+		defer bc.blockCache.Unlock()
+		_, ok := bc.blockCache.blocks[hash]
+		return ok
+	}
+
+	// the cached block matches the one in the database, and can't be modified through the returned copy
+	hash := blocks[3].Hash()
+	getBlock(hash).Transactions = append(getBlock(hash).Transactions, [32]byte{1})
+	if !isCached(hash) {
+		t.Fatal("block is not cached after reading it")
+	}
+	cached := getBlock(hash)
+	if fresh := readBlock(t, bc, hash); !reflect.DeepEqual(cached, fresh) || cached.Hash() != hash {
+		t.Fatalf("cached block %v doesn't match the block in the database %v", cached, fresh)
+	}
+
+	// the least recently read block is evicted
+	getBlock(blocks[2].Hash())
+	getBlock(blocks[1].Hash())
+	if isCached(hash) || !isCached(blocks[2].Hash()) || !isCached(blocks[1].Hash()) {
+		t.Fatal("least recently read block is still cached")
+	}
+
+	// blocks read by a rolled back transaction are not cached
+	errRollback := errors.New("rollback")
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := bc.GetBlock(tx, blocks[0].Hash()); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) || isCached(blocks[0].Hash()) {
+		t.Fatalf("block read by a rolled back transaction is cached, error %v", err)
+	}
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		_, err := bc.GetBlock(tx, blocks[0].Hash())
+		return err
+	})
+	if err != nil || !isCached(blocks[0].Hash()) {
+		t.Fatalf("block read by a committed transaction is not cached, error %v", err)
+	}
+
+	// a block saved again, like an orphan whose cumulative difficulty is updated, replaces the cached one, also
+	// when it was read by the same transaction
+	rewritten := getBlock(blocks[0].Hash())
+	rewritten.CumulativeDiff = rewritten.CumulativeDiff.Add64(1)
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := bc.GetBlock(tx, blocks[0].Hash()); err != nil {
+			return err
+		}
+		return bc.insertBlock(tx, rewritten, blocks[0].Hash())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bl := getBlock(blocks[0].Hash()); !bl.CumulativeDiff.Equals(rewritten.CumulativeDiff) {
+		t.Fatalf("cached block has cumulative diff %s after saving it with %s", bl.CumulativeDiff,
+			rewritten.CumulativeDiff)
+	}
+	bc.blockCache.Lock()
+	bc.blockCache.insert(cachedBlock{blocks[0].Hash(), blocks[0]})
+	bc.blockCache.Unlock()
+	if bl := getBlock(blocks[0].Hash()); !bl.CumulativeDiff.Equals(blocks[0].CumulativeDiff) {
+		t.Fatalf("cached block has cumulative diff %s after replacing it with %s", bl.CumulativeDiff,
+			blocks[0].CumulativeDiff)
+	}
+
+	// blocks deleted by a rewind are no longer returned
+	getBlock(blocks[3].Hash())
+	if err := bc.RewindTo(blocks[2].Height); err != nil {
+		t.Fatal(err)
+	}
+	if isCached(blocks[3].Hash()) {
+		t.Fatal("rewound block is still cached")
+	}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if _, err := bc.GetBlock(tx, blocks[3].Hash()); err == nil {
+			t.Error("rewound block is returned")
+		}
+		return nil
+	})
+}
+
+func BenchmarkGetBlock(b *testing.B) {
+	bc := newTestBlockchain(b)
+	var hashes [][32]byte
+	for _, bl := range newTestChain(b, nil, 10) {
+		addTestBlocks(b, bc, bl)
+		hashes = append(hashes, bl.Hash())
+	}
+
+	for _, size := range []int{0, len(hashes)} {
+		name := "uncached"
+		if size > 0 {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			bc.blockCache = newBlockCache(size)
+			b.ReportAllocs()
+			bc.DB.View(func(tx *bolt.Tx) error {
+				for i := 0; i < b.N; i++ {
+					_, err := bc.GetBlock(tx, hashes[i%len(hashes)])
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"sync"
+	"time"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrInvalidBootstrap is returned by ImportBlocks when the data is not a block export of this network
+var ErrInvalidBootstrap = errors.New("invalid bootstrap")
+
+// bootstrapMagic starts the block exports, followed by the network ID
+var bootstrapMagic = []byte("STILL bootstrap")
+
+// maximum size of a block in a bootstrap, well above the size of the largest valid block with its transactions
+const maxBootstrapBlockSize = 4 << 20
+
+// ExportBlocks writes the mainchain blocks above the genesis to w, each followed by its transactions, and returns
+// the hash of the last block written. Every node creates the same genesis block, so it's not exported. The blocks
+// are read in a single database transaction, so that they're consistent even if the chain changes meanwhile: w
+// should be fast, like a file, since a long database transaction delays the database growth.
+func (bc *Blockchain) ExportBlocks(w io.Writer) (top [32]byte, err error) {
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		top = stats.TopHash
+
+		_, err := w.Write(append(bytes.Clone(bootstrapMagic), config.BinaryNetworkID...))
+		if err != nil || stats.TopHeight == 0 {
+			return err
+		}
+		return bc.IterateMainchain(tx, 1, stats.TopHeight, func(height uint64, hash [32]byte,
+			bl *block.Block) error {
+			ser, err := bc.serializeFullBlock(tx, bl)
+			if err != nil {
+				return fmt.Errorf("block %d %x: %w", height, hash, err)
+			}
+			_, err = w.Write(append(binary.AppendUvarint(nil, uint64(len(ser))), ser...))
+			return err
+		})
+	})
+	return
+}
+
+// ExportBootstrap exports the blocks to a new temporary file in dir, and returns its path, size and BLAKE3
+// checksum. The caller must remove the file.
+func (bc *Blockchain) ExportBootstrap(dir string) (path string, size int64, sum [32]byte, err error) {
+	f, err := os.CreateTemp(dir, "bootstrap-*")
+	if err != nil {
+		return "", 0, sum, err
+	}
+	defer f.Close()
+
+	h := blake3.New()
+	top, err := bc.ExportBlocks(io.MultiWriter(f, h))
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+
+	bc.log.Infof("Exported bootstrap up to block %x: %d bytes, checksum %x", top, size, sum)
+	return f.Name(), size, sum, nil
+}
+
+// bootstrapDir is the subdirectory of the data directory where the bootstrap served by ServeBootstrap is exported.
+// It's removed when the blockchain is opened, so the exports aren't left behind by a crash.
+const bootstrapDir = "bootstrap"
+
+// a bootstrap served by ServeBootstrap is exported again only if the chain has changed and it's older than this
+const bootstrapMaxAge = 10 * time.Minute
+
+// bootstrapExport is a bootstrap exported by ServeBootstrap. The file is removed when it's replaced by a newer
+// export and no download is reading it anymore.
+type bootstrapExport struct {
+	top     [32]byte
+	size    int64
+	sum     [32]byte
+	created time.Time
+	file    *os.File
+	refs    int // downloads reading the file, plus one while it's the cached export
+}
+
+// bootstrapCache keeps the last bootstrap exported by ServeBootstrap, so that it's shared by the downloads
+type bootstrapCache struct {
+	// exportMut is held while exporting, so that a single export runs at a time. A plain sync.Mutex is used,
+	// since exporting a long chain would be reported as a deadlock by util.Mutex.
+	exportMut sync.Mutex
+
+	util.Mutex // guards cur and the refs of the exports
+	cur        *bootstrapExport
+}
+
+// openBootstrap returns the cached bootstrap, exporting it again if it's outdated. The export must be released
+// with releaseBootstrap.
+func (bc *Blockchain) openBootstrap() (*bootstrapExport, error) {
+	c := &bc.bootstrap
+	c.exportMut.Lock()
+	defer c.exportMut.Unlock()
+
+	var top [32]byte
+	bc.DB.View(func(tx *bolt.Tx) error {
+		top = bc.GetStats(tx).TopHash
+		return nil
+	})
+
+	c.Lock()
+	if cur := c.cur; cur != nil && (cur.top == top || time.Since(cur.created) < bootstrapMaxAge) {
+		cur.refs++
+		c.Unlock()
+		return cur, nil
+	}
+	c.Unlock()
+
+	dir := filepath.Join(bc.DataDir, bootstrapDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path, size, sum, err := bc.ExportBootstrap(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	e := &bootstrapExport{
+		top:     top,
+		size:    size,
+		sum:     sum,
+		created: time.Now(),
+		file:    f,
+		refs:    2, // cached and returned
+	}
+
+	c.Lock()
+	old := c.cur
+	c.cur = e
+	c.Unlock()
+	if old != nil {
+		bc.releaseBootstrap(old)
+	}
+	return e, nil
+}
+
+// releaseBootstrap releases an export returned by openBootstrap, removing its file if it's not used anymore
+func (bc *Blockchain) releaseBootstrap(e *bootstrapExport) {
+	c := &bc.bootstrap
+	c.Lock()
+	e.refs--
+	unused := e.refs == 0
+	c.Unlock()
+
+	if unused {
+		e.file.Close()
+		if err := os.Remove(e.file.Name()); err != nil {
+			bc.log.Warn("failed to remove bootstrap export:", err)
+		}
+	}
+}
+
+// ServeBootstrap serves the blocks exported by ExportBlocks over HTTP, with their BLAKE3 checksum in the
+// X-Checksum-Blake3 header. The export is cached and shared by the downloads, and it's only exported again when
+// the chain has changed and it's older than bootstrapMaxAge: the nodes importing it download the last blocks from
+// their peers. Range requests are supported, so that an interrupted download can be resumed.
+func (bc *Blockchain) ServeBootstrap(w http.ResponseWriter, r *http.Request) {
+	e, err := bc.openBootstrap()
+	if err != nil {
+		bc.log.Err("bootstrap export failed:", err)
+		http.Error(w, "bootstrap export failed", http.StatusInternalServerError)
+		return
+	}
+	defer bc.releaseBootstrap(e)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Checksum-Blake3", hex.EncodeToString(e.sum[:]))
+	http.ServeContent(w, r, "", e.created, io.NewSectionReader(e.file, 0, e.size))
+}
+
+// ImportBlocks adds the blocks written by ExportBlocks, validating them like the blocks received from peers, and
+// returns the number of blocks added. Blocks which are already known are skipped, so a bootstrap can be imported
+// into a node which is partially synced.
+func (bc *Blockchain) ImportBlocks(r io.Reader) (imported int, err error) {
+	br := bufio.NewReader(r)
+
+	head := make([]byte, len(bootstrapMagic)+len(config.BinaryNetworkID))
+	if _, err := io.ReadFull(br, head); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidBootstrap, err)
+	}
+	if !bytes.Equal(head, append(bytes.Clone(bootstrapMagic), config.BinaryNetworkID...)) {
+		return 0, fmt.Errorf("%w: not a block export of this network", ErrInvalidBootstrap)
+	}
+
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("%w: %w", ErrInvalidBootstrap, err)
+		}
+		if size > maxBootstrapBlockSize {
+			return imported, fmt.Errorf("%w: block of %d bytes", ErrInvalidBootstrap, size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return imported, fmt.Errorf("%w: %w", ErrInvalidBootstrap, err)
+		}
+
+		bl := &block.Block{}
+		txs, err := bl.DeserializeFull(data)
+		if err != nil {
+			return imported, fmt.Errorf("%w: %w", ErrInvalidBootstrap, err)
+		}
+		added, err := bc.importBlock(bl, txs)
+		if err != nil {
+			return imported, fmt.Errorf("block %d %x: %w", bl.Height, bl.Hash(), err)
+		}
+		if added {
+			imported++
+			if imported%1000 == 0 {
+				bc.log.Infof("Imported %d blocks, height %d", imported, bl.Height)
+			}
+		}
+	}
+}
+
+// importBlock adds a block read from a bootstrap, and returns false if it's already known
+func (bc *Blockchain) importBlock(bl *block.Block, txs []*transaction.Transaction) (bool, error) {
+	if err := bc.beginBlock(); err != nil {
+		return false, err
+	}
+	defer bc.endBlock()
+
+	hash := bl.Hash()
+	var known bool
+	bc.DB.View(func(tx *bolt.Tx) error {
+		_, err := bc.GetBlockHeader(tx, hash)
+		known = err == nil
+		return nil
+	})
+	if known {
+		return false, nil
+	}
+
+	if err := bl.Prevalidate(); err != nil {
+		return false, err
+	}
+	if err := prevalidateTxs(txs); err != nil {
+		return false, err
+	}
+	return true, bc.DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range txs {
+			err := bc.AddTransaction(tx, v, v.Hash(), false)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := bc.AddBlock(tx, bl)
+		return err
+	})
+}
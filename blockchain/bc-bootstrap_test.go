@@ -0,0 +1,175 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"testing"
+	"time"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBootstrap(t *testing.T) {
+	skipTestPoW(t)
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+
+	// the sender mines the blocks, and spends some of the reward in block 3
+	for i := 1; i <= 5; i++ {
+		if i == 3 {
+			if _, err := bc.SubmitTx(newTestTx(t, pk, 1, config.COIN)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bl := newTestBlock(t, bc, sender)
+		addTestBlocks(t, bc, bl)
+	}
+
+	path, size, sum, err := bc.ExportBootstrap(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != size || blake3.Sum256(data) != sum {
+		t.Fatalf("bootstrap has %d bytes and checksum %x, reported %d bytes and checksum %x", len(data),
+			blake3.Sum256(data), size, sum)
+	}
+
+	// a fresh node importing the bootstrap reaches the same top block and state
+	fresh := newTestBlockchain(t)
+	imported, err := fresh.ImportBlocks(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 5 {
+		t.Fatalf("imported %d blocks, expected 5", imported)
+	}
+	var stats, freshStats *Stats
+	var state, freshState *State
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats = bc.GetStats(tx)
+		state, _ = bc.GetState(tx, sender)
+		return nil
+	})
+	fresh.DB.View(func(tx *bolt.Tx) error {
+		freshStats = fresh.GetStats(tx)
+		freshState, _ = fresh.GetState(tx, sender)
+		return nil
+	})
+	if freshStats.TopHash != stats.TopHash || freshStats.TopHeight != stats.TopHeight {
+		t.Fatalf("imported top block is %d %x, expected %d %x", freshStats.TopHeight, freshStats.TopHash,
+			stats.TopHeight, stats.TopHash)
+	}
+	if *freshState != *state {
+		t.Fatalf("imported sender state is {%v}, expected {%v}", freshState, state)
+	}
+
+	// importing it again skips the known blocks
+	imported, err = fresh.ImportBlocks(bytes.NewReader(data))
+	if err != nil || imported != 0 {
+		t.Fatalf("imported %d blocks again, error %v", imported, err)
+	}
+
+	// truncated or foreign data is rejected
+	if _, err := fresh.ImportBlocks(bytes.NewReader(data[:len(data)-1])); !errors.Is(err, ErrInvalidBootstrap) {
+		t.Fatalf("truncated bootstrap: unexpected error %v", err)
+	}
+	if _, err := fresh.ImportBlocks(bytes.NewReader([]byte("not a bootstrap"))); !errors.Is(err,
+		ErrInvalidBootstrap) {
+		t.Fatalf("foreign data: unexpected error %v", err)
+	}
+}
+
+func TestServeBootstrap(t *testing.T) {
+	skipTestPoW(t)
+	bc := newTestBlockchain(t)
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	addBlock := func() {
+		t.Helper()
+		addTestBlocks(t, bc, newTestBlock(t, bc, miner))
+	}
+	for range 3 {
+		addBlock()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(bc.ServeBootstrap))
+	defer server.Close()
+	download := func() ([]byte, string) {
+		t.Helper()
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status %s: %s", res.Status, data)
+		}
+		sum := blake3.Sum256(data)
+		if res.Header.Get("X-Checksum-Blake3") != hex.EncodeToString(sum[:]) {
+			t.Fatalf("checksum header %s, data checksum %x", res.Header.Get("X-Checksum-Blake3"), sum)
+		}
+		return data, res.Header.Get("X-Checksum-Blake3")
+	}
+	exports := func() int {
+		t.Helper()
+		files, err := os.ReadDir(filepath.Join(bc.DataDir, bootstrapDir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	// the served bytes can be imported by a fresh node
+	data, sum := download()
+	fresh := newTestBlockchain(t)
+	imported, err := fresh.ImportBlocks(bytes.NewReader(data))
+	if err != nil || imported != 3 {
+		t.Fatalf("imported %d blocks, error %v", imported, err)
+	}
+
+	// a recent export is reused, even if the chain changed meanwhile
+	addBlock()
+	if _, again := download(); again != sum {
+		t.Fatal("bootstrap exported again before it's outdated")
+	}
+
+	// an outdated export is replaced, and its file is removed
+	bc.bootstrap.cur.created = time.Now().Add(-bootstrapMaxAge)
+	data, again := download()
+	if again == sum {
+		t.Fatal("outdated bootstrap is not exported again")
+	}
+	if n := exports(); n != 1 {
+		t.Fatalf("%d bootstrap exports in the data directory, expected 1", n)
+	}
+	imported, err = fresh.ImportBlocks(bytes.NewReader(data))
+	if err != nil || imported != 1 {
+		t.Fatalf("imported %d new blocks, error %v", imported, err)
+	}
+
+	// the exports left by a crash are removed when the blockchain is opened
+	bc.Close()
+	bc = NewWithOptions(bc.DataDir, Options{Log: Log})
+	defer bc.Close()
+	if n := exports(); n != 0 {
+		t.Fatalf("%d bootstrap exports left after opening the blockchain", n)
+	}
+}
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maximum size of the data copied in a single transaction of the compacted database
+const compactTxMaxSize = 64 * 1024 * 1024
+
+// Compact writes a compacted copy of the database to destPath, which must not exist. The database file never
+// shrinks by itself, so the space freed by pruning and reorgs is only reclaimed by replacing the database file
+// with the compacted copy while the node is stopped.
+func (bc *Blockchain) Compact(destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("compaction destination %s already exists", destPath)
+	}
+
+	before, err := os.Stat(bc.DB.Path())
+	if err != nil {
+		return err
+	}
+
+	dst, err := bolt.Open(destPath, 0o666, &bolt.Options{
+		Timeout:        4 * time.Second,
+		NoFreelistSync: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.log.Infof("Compacting database %s to %s", bc.DB.Path(), destPath)
+	err = bolt.Compact(dst, bc.DB, compactTxMaxSize)
+	if err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to compact database: %w", err)
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	after, err := os.Stat(destPath)
+	if err != nil {
+		return err
+	}
+	bc.log.Infof("Database compacted: %.2f MiB -> %.2f MiB", float64(before.Size())/1024/1024,
+		float64(after.Size())/1024/1024)
+
+	return nil
+}
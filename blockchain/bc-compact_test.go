@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"still-blockchain/util/buck"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCompact(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	addTestBlocks(t, bc, newTestChain(t, nil, 10)...)
+	if err := bc.RewindTo(6); err != nil {
+		t.Fatal(err)
+	}
+
+	// data that is written and then deleted leaves free pages in the database file
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("churn"))
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < 2000; i++ {
+			err := b.Put(binary.LittleEndian.AppendUint64(nil, i), make([]byte, 1024))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("churn"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "compact.db")
+	if err := bc.Compact(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Compact(dest); err == nil {
+		t.Fatal("compaction overwrote an existing file")
+	}
+
+	before, err := os.Stat(bc.DB.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() > before.Size() {
+		t.Fatalf("compacted database is %d bytes, larger than the original %d bytes", after.Size(),
+			before.Size())
+	}
+
+	db, err := bolt.Open(dest, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	compacted := &Blockchain{DB: db, log: Log}
+
+	var stats, compactedStats *Stats
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats = bc.GetStats(tx)
+		return nil
+	})
+	db.View(func(tx *bolt.Tx) error {
+		compactedStats = compacted.GetStats(tx)
+		return nil
+	})
+	if compactedStats.TopHash != stats.TopHash || compactedStats.TopHeight != stats.TopHeight ||
+		!compactedStats.CumulativeDiff.Equals(stats.CumulativeDiff) || compactedStats.Supply != stats.Supply {
+		t.Fatalf("compacted stats %+v don't match %+v", compactedStats, stats)
+	}
+
+	// every bucket has the same number of keys
+	for _, name := range []byte{buck.INFO, buck.BLOCK, buck.TOPO, buck.STATE, buck.TX, buck.INTX, buck.OUTTX} {
+		var n, compactedN int
+		bc.DB.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte{name}).Stats().KeyN
+			return nil
+		})
+		db.View(func(tx *bolt.Tx) error {
+			compactedN = tx.Bucket([]byte{name}).Stats().KeyN
+			return nil
+		})
+		if n != compactedN {
+			t.Fatalf("bucket %d has %d keys after compaction, expected %d", name, compactedN, n)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"math/rand/v2"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"still-blockchain/p2p/packet"
+)
+
+// blockSource is a connected peer that queued blocks can be requested from
+type blockSource struct {
+	conn    *p2p.Connection
+	height  uint64 // height advertised by the peer
+	pending int    // requests the peer hasn't answered yet
+}
+
+// blockSources returns the connected peers in random order, with their advertised height and pending requests
+func (bc *Blockchain) blockSources() []blockSource {
+	var sources []blockSource
+	bc.P2P.RLock()
+	for _, conn := range bc.P2P.Connections {
+		conn.PeerData(func(d *p2p.PeerData) {
+			sources = append(sources, blockSource{conn, d.Stats.Height, len(d.Requests)})
+		})
+	}
+	bc.P2P.RUnlock()
+
+	rand.Shuffle(len(sources), func(i, j int) {
+		sources[i], sources[j] = sources[j], sources[i]
+	})
+	return sources
+}
+
+// assignBlockRequests chooses the peer each block is requested from, and returns the index of its source, or -1
+// if no peer has the block. Blocks go to the peers with the fewest pending requests, which are usually the
+// fastest ones, but no peer gets more than its share of the blocks when SYNC_MIN_SOURCES peers have them, so
+// that a single fast peer can't feed the node the whole chain. Ties go to the first source.
+func assignBlockRequests(blocks []*QueuedBlock, sources []blockSource) []int {
+	perSource := (len(blocks) + config.SYNC_MIN_SOURCES - 1) / config.SYNC_MIN_SOURCES
+	assigned := make([]int, len(sources))
+
+	res := make([]int, len(blocks))
+	for i, bl := range blocks {
+		best, bestFull := -1, false
+		for j, s := range sources {
+			// a block of unknown height can be requested to any peer
+			if bl.Height != 0 && s.height < bl.Height {
+				continue
+			}
+			// peers which had their share are only used if no other peer has the block
+			full := assigned[j] >= perSource
+			if best == -1 || (!full && bestFull) || (full == bestFull &&
+				s.pending+assigned[j] < sources[best].pending+assigned[best]) {
+				best, bestFull = j, full
+			}
+		}
+		res[i] = best
+		if best != -1 {
+			assigned[best]++
+		}
+	}
+	return res
+}
+
+// requestBlocks requests the queued blocks to the connected peers, spread by assignBlockRequests
+func (bc *Blockchain) requestBlocks(blocks []*QueuedBlock) {
+	sources := bc.blockSources()
+	for i, j := range assignBlockRequests(blocks, sources) {
+		if j == -1 {
+			continue
+		}
+		if bc.IsShuttingDown() {
+			return
+		}
+		req := packet.PacketBlockRequest{
+			Height: blocks[i].Height,
+			Hash:   blocks[i].Hash,
+		}
+		conn := sources[j].conn
+		conn.PeerData(func(d *p2p.PeerData) {
+			conn.SendPacket(&p2p.Packet{
+				Type: packet.BLOCK_REQUEST,
+				Data: req.Serialize(),
+			})
+			recordBlockRequest(d, req)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"still-blockchain/config"
+	"testing"
+)
+
+func TestAssignBlockRequests(t *testing.T) {
+	blocks := make([]*QueuedBlock, 30)
+	for i := range blocks {
+		blocks[i] = NewQueuedBlock(uint64(i+1), [32]byte{})
+	}
+	perSource := len(blocks) / config.SYNC_MIN_SOURCES
+
+	count := func(assigned []int, n int) []int {
+		t.Helper()
+		c := make([]int, n)
+		for i, j := range assigned {
+			if j == -1 {
+				t.Fatalf("block %d is not assigned", blocks[i].Height)
+			}
+			c[j]++
+		}
+		return c
+	}
+
+	// the first peer answers fastest, but the blocks are spread across the other peers too
+	sources := []blockSource{
+		{height: 100, pending: 0},
+		{height: 100, pending: 20},
+		{height: 100, pending: 20},
+		{height: 100, pending: 20},
+		{height: 100, pending: 20},
+	}
+	c := count(assignBlockRequests(blocks, sources), len(sources))
+	distinct := 0
+	for j, n := range c {
+		if n > perSource {
+			t.Fatalf("peer %d was assigned %d blocks, more than its share %d", j, n, perSource)
+		}
+		if n > 0 {
+			distinct++
+		}
+	}
+	if distinct < config.SYNC_MIN_SOURCES {
+		t.Fatalf("blocks are requested from %d peers, expected at least %d: %v", distinct,
+			config.SYNC_MIN_SOURCES, c)
+	}
+	if c[0] != perSource {
+		t.Fatalf("fastest peer was assigned %d blocks, expected %d", c[0], perSource)
+	}
+
+	// a single peer gets all the blocks
+	c = count(assignBlockRequests(blocks, sources[:1]), 1)
+	if c[0] != len(blocks) {
+		t.Fatalf("single peer was assigned %d blocks, expected %d", c[0], len(blocks))
+	}
+
+	// blocks are only requested from the peers which advertised them
+	sources = []blockSource{
+		{height: 10},
+		{height: 100},
+		{height: 5},
+	}
+	for i, j := range assignBlockRequests(blocks, sources) {
+		if j == -1 || sources[j].height < blocks[i].Height {
+			t.Fatalf("block %d assigned to peer %d", blocks[i].Height, j)
+		}
+	}
+	if res := assignBlockRequests(blocks[10:], sources[:1]); res[0] != -1 {
+		t.Fatalf("block %d assigned to a peer at height %d", blocks[10].Height, sources[0].height)
+	}
+}
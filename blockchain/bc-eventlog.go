@@ -0,0 +1,156 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/util"
+	"time"
+)
+
+type EventType uint8
+
+const (
+	EventBlockAdded  EventType = iota + 1 // a block was applied to the mainchain
+	EventTxConfirmed                      // a transaction was included in a mainchain block
+	EventReorg                            // mainchain blocks were removed, by a reorg or a rewind
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventBlockAdded:
+		return "block_added"
+	case EventTxConfirmed:
+		return "tx_confirmed"
+	case EventReorg:
+		return "reorg"
+	}
+	return "unknown"
+}
+
+// Event is a change of the mainchain state, meant for external indexers. Events are numbered by a sequence
+// number that grows by one for every event, so an indexer can resume from the last event it has seen.
+type Event struct {
+	Seq  uint64
+	Type EventType
+
+	// For EventBlockAdded and EventTxConfirmed, the block which was applied. For EventReorg, the last block
+	// that wasn't removed.
+	Height uint64
+	Hash   [32]byte
+
+	// only for EventTxConfirmed
+	Txid   [32]byte
+	From   address.Address
+	To     address.Address
+	Amount uint64
+	Fee    uint64
+
+	// only for EventReorg: heights of the removed mainchain blocks, from the highest to the lowest. The blocks
+	// applied after a reorg have their own EventBlockAdded.
+	RolledBack []uint64
+}
+
+// eventLog is an append-only log of the recent events, kept in memory. Only the last EVENT_LOG_SIZE events are
+// kept, older ones are overwritten.
+type eventLog struct {
+	util.Mutex
+
+	events  []Event // ring buffer, events[start] is the oldest event
+	start   int
+	nextSeq uint64        // sequence number of the next event; the first event has sequence number 1
+	wait    chan struct{} // closed when new events are appended
+}
+
+// append adds events whose sequence numbers were assigned by recordEvents
+func (l *eventLog) append(evs []Event) {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, ev := range evs {
+		l.nextSeq = ev.Seq + 1
+
+		if len(l.events) < config.EVENT_LOG_SIZE {
+			l.events = append(l.events, ev)
+		} else {
+			l.events[l.start] = ev
+			l.start = (l.start + 1) % len(l.events)
+		}
+	}
+	if l.wait != nil {
+		close(l.wait)
+		l.wait = nil
+	}
+}
+
+// since returns at most limit events starting from sequence number cursor, and the cursor to use for the next
+// call. If some of the requested events are no longer in the log, missed is true and the events start from the
+// oldest one available. A cursor of 0 returns all the events in the log.
+func (l *eventLog) since(cursor uint64, limit int) (evs []Event, next uint64, missed bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.sinceLocked(cursor, limit)
+}
+
+func (l *eventLog) sinceLocked(cursor uint64, limit int) (evs []Event, next uint64, missed bool) {
+	next = max(l.nextSeq, 1)
+	if len(l.events) == 0 {
+		// the events before the restart of the node are lost
+		return []Event{}, next, cursor != 0 && cursor != next
+	}
+
+	oldest := l.events[l.start].Seq
+	if cursor == 0 {
+		cursor = oldest
+	} else if cursor < oldest || cursor > next {
+		cursor = oldest
+		missed = true
+	}
+
+	n := min(int(next-cursor), limit)
+	evs = make([]Event, 0, n)
+	for i := 0; i < n; i++ {
+		evs = append(evs, l.events[(l.start+int(cursor-oldest)+i)%len(l.events)])
+	}
+	return evs, cursor + uint64(n), missed
+}
+
+// waitChan returns a channel which is closed when the next event is appended
+func (l *eventLog) waitChan() chan struct{} {
+	if l.wait == nil {
+		l.wait = make(chan struct{})
+	}
+	return l.wait
+}
+
+// GetEvents returns at most limit events starting from sequence number cursor, and the cursor of the following
+// event. The sequence numbers are saved in the database, so they keep growing when the node restarts, but the
+// events are only kept in memory. If the events requested are no longer in memory, for example because the node
+// restarted, missed is true and the oldest events available are returned instead.
+func (bc *Blockchain) GetEvents(cursor uint64, limit int) (evs []Event, next uint64, missed bool) {
+	return bc.events.log.since(cursor, limit)
+}
+
+// WaitForEvents is like GetEvents, but if there are no new events it waits for them for at most timeout.
+func (bc *Blockchain) WaitForEvents(cursor uint64, limit int, timeout time.Duration) (evs []Event, next uint64,
+	missed bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		bc.events.log.Lock()
+		evs, next, missed = bc.events.log.sinceLocked(cursor, limit)
+		if len(evs) > 0 || missed {
+			bc.events.log.Unlock()
+			return
+		}
+		wait := bc.events.log.waitChan()
+		bc.events.log.Unlock()
+
+		select {
+		case <-wait:
+		case <-timer.C:
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package blockchain
+
+import (
+	"reflect"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"testing"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+// eventSummary is the part of an event compared by the tests
+type eventSummary struct {
+	Type       EventType
+	Height     uint64
+	Txid       [32]byte
+	RolledBack []uint64
+}
+
+func summarizeEvents(t *testing.T, evs []Event, firstSeq uint64) []eventSummary {
+	t.Helper()
+
+	s := make([]eventSummary, 0, len(evs))
+	for i, ev := range evs {
+		if ev.Seq != firstSeq+uint64(i) {
+			t.Fatalf("event %d has sequence number %d, expected %d", i, ev.Seq, firstSeq+uint64(i))
+		}
+		s = append(s, eventSummary{ev.Type, ev.Height, ev.Txid, ev.RolledBack})
+	}
+	return s
+}
+
+func TestEventLog(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+
+	// the sender mines the blocks, and spends some of the reward in block 3
+	tx := newTestTx(t, pk, 1, config.COIN)
+	var hashes [][32]byte
+	for i := 1; i <= 3; i++ {
+		if i == 3 {
+			if _, err := bc.SubmitTx(tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bl := newTestBlock(t, bc, sender)
+		addTestBlocks(t, bc, bl)
+		hashes = append(hashes, bl.Hash())
+	}
+
+	evs, next, missed := bc.GetEvents(0, 100)
+	if missed {
+		t.Fatal("no events should be missed")
+	}
+	expected := []eventSummary{
+		{Type: EventBlockAdded, Height: 0},
+		{Type: EventBlockAdded, Height: 1},
+		{Type: EventBlockAdded, Height: 2},
+		{Type: EventBlockAdded, Height: 3},
+		{Type: EventTxConfirmed, Height: 3, Txid: tx.Hash()},
+	}
+	if s := summarizeEvents(t, evs, 1); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("events are %+v, expected %+v", s, expected)
+	}
+	if next != 6 {
+		t.Fatalf("next cursor is %d, expected 6", next)
+	}
+	if evs[2].Hash != hashes[1] {
+		t.Fatalf("block event has hash %x, expected %x", evs[2].Hash, hashes[1])
+	}
+	if ev := evs[4]; ev.From != sender || ev.To != tx.Recipient || ev.Amount != tx.Amount || ev.Fee != tx.Fee ||
+		ev.Hash != hashes[2] {
+		t.Fatalf("unexpected transaction event %+v", ev)
+	}
+
+	// the events are returned in pages
+	evs, next, _ = bc.GetEvents(2, 2)
+	if len(evs) != 2 || evs[0].Seq != 2 || next != 4 {
+		t.Fatalf("page starting from 2 has %d events, next cursor %d", len(evs), next)
+	}
+
+	// waiting at the end of the log times out without events
+	evs, next, missed = bc.WaitForEvents(6, 100, 10*time.Millisecond)
+	if len(evs) != 0 || next != 6 || missed {
+		t.Fatalf("wait returned %d events, next cursor %d, missed %v", len(evs), next, missed)
+	}
+
+	// a waiting indexer receives the event of the rewind
+	done := make(chan []Event)
+	go func() {
+		evs, _, _ := bc.WaitForEvents(6, 100, time.Minute)
+		done <- evs
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := bc.RewindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	evs = <-done
+	expected = []eventSummary{
+		{Type: EventReorg, Height: 1, RolledBack: []uint64{3, 2}},
+	}
+	if s := summarizeEvents(t, evs, 6); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("events are %+v, expected %+v", s, expected)
+	}
+	if evs[0].Hash != hashes[0] {
+		t.Fatalf("reorg event has hash %x, expected %x", evs[0].Hash, hashes[0])
+	}
+}
+
+func TestEventLogReorg(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 1)
+	chainA := newTestChain(t, base, 1)
+	chainB := newTestChain(t, base, 2)
+
+	addTestBlocks(t, bc, []*block.Block{base[0], chainA[0], chainB[0], chainB[1]}...)
+
+	// the reorg event comes before the events of the blocks that replace the removed ones
+	evs, _, _ := bc.GetEvents(0, 100)
+	expected := []eventSummary{
+		{Type: EventBlockAdded, Height: 0},
+		{Type: EventBlockAdded, Height: 1},
+		{Type: EventBlockAdded, Height: 2},
+		{Type: EventReorg, Height: 1, RolledBack: []uint64{2}},
+		{Type: EventBlockAdded, Height: 2},
+		{Type: EventBlockAdded, Height: 3},
+	}
+	if s := summarizeEvents(t, evs, 1); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("events are %+v, expected %+v", s, expected)
+	}
+	hashes := [][32]byte{base[0].Hash(), chainA[0].Hash(), base[0].Hash(), chainB[0].Hash(), chainB[1].Hash()}
+	for i, hash := range hashes {
+		if evs[i+1].Hash != hash {
+			t.Fatalf("event %d has hash %x, expected %x", i+1, evs[i+1].Hash, hash)
+		}
+	}
+}
+
+func TestEventLogMissed(t *testing.T) {
+	l := &eventLog{}
+	for i := 0; i < config.EVENT_LOG_SIZE+5; i++ {
+		l.append([]Event{{Seq: uint64(i + 1), Type: EventBlockAdded, Height: uint64(i)}})
+	}
+
+	// the oldest events were overwritten
+	evs, next, missed := l.since(1, 10)
+	if !missed || len(evs) != 10 || evs[0].Seq != 6 || evs[0].Height != 5 || next != 16 {
+		t.Fatalf("since 1: %d events from %d, next cursor %d, missed %v", len(evs), evs[0].Seq, next, missed)
+	}
+
+	// a cursor above the next sequence number comes from before a restart
+	_, _, missed = l.since(config.EVENT_LOG_SIZE+100, 10)
+	if !missed {
+		t.Fatal("cursor above the next event is not reported as missed")
+	}
+
+	evs, next, missed = l.since(config.EVENT_LOG_SIZE+5, 10)
+	if missed || len(evs) != 1 || evs[0].Height != config.EVENT_LOG_SIZE+4 || next != config.EVENT_LOG_SIZE+6 {
+		t.Fatalf("last event: %+v, next cursor %d, missed %v", evs, next, missed)
+	}
+}
+
+// TestEventSeqRestart checks that the sequence numbers keep growing when the node restarts, so that an indexer
+// resuming from its cursor doesn't skip the new events
+func TestEventSeqRestart(t *testing.T) {
+	chain := newTestChain(t, nil, 3)
+
+	bc := NewWithOptions(t.TempDir(), Options{Log: Log, Durable: true})
+	bc.P2P = p2p.Start(nil)
+	addTestBlocks(t, bc, chain[0])
+	addTestBlocks(t, bc, chain[1])
+	_, next, _ := bc.GetEvents(0, 100)
+	bc.Close()
+
+	bc = NewWithOptions(bc.DataDir, Options{Log: Log, Durable: true})
+	bc.P2P = p2p.Start(nil)
+	defer bc.Close()
+
+	// the events before the restart are lost, but an indexer which has seen all of them misses nothing
+	if evs, cursor, missed := bc.GetEvents(next, 100); len(evs) != 0 || cursor != next || missed {
+		t.Fatalf("after the restart: %d events, next cursor %d, missed %v", len(evs), cursor, missed)
+	}
+	if _, _, missed := bc.GetEvents(next-1, 100); !missed {
+		t.Fatal("event lost by the restart is not reported as missed")
+	}
+
+	addTestBlocks(t, bc, chain[2])
+	evs, _, missed := bc.GetEvents(next, 100)
+	expected := []eventSummary{{Type: EventBlockAdded, Height: 3}}
+	if s := summarizeEvents(t, evs, next); missed || !reflect.DeepEqual(s, expected) {
+		t.Fatalf("events after the restart are %+v, missed %v, expected %+v", s, missed, expected)
+	}
+}
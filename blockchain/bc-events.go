@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"still-blockchain/block"
+	"still-blockchain/util"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ReorgCallback is called after a reorg or a rewind (see RewindTo), with the previous and the new top block hash,
+// and the height of the last block that both chains have in common. Mainchain blocks above commonHeight are no
+// longer valid.
+type ReorgCallback func(oldTop, newTop [32]byte, commonHeight uint64)
+
+// NewBlockCallback is called after a block is added on top of the mainchain. Blocks that become mainchain
+// because of a reorg are reported by ReorgCallback instead.
+type NewBlockCallback func(bl *block.Block, hash [32]byte)
+
+// bcEvents dispatches the changes of the mainchain once their database transaction is committed: to the
+// callbacks registered by OnReorg and OnNewBlock, and to the event log read by GetEvents
+type bcEvents struct {
+	util.RWMutex
+
+	reorg    []ReorgCallback
+	newBlock []NewBlockCallback
+
+	log eventLog
+}
+
+// eventSeqKey is the key of the INFO bucket holding the sequence number of the last event recorded
+var eventSeqKey = []byte("eventseq")
+
+// OnReorg registers a callback called after every reorg. Callbacks are called once the database
+// transaction is committed, so they can safely read from the database.
+func (bc *Blockchain) OnReorg(f ReorgCallback) {
+	bc.events.Lock()
+	defer bc.events.Unlock()
+
+	bc.events.reorg = append(bc.events.reorg, f)
+}
+
+// OnNewBlock registers a callback called after every new mainchain block. Callbacks are called once the
+// database transaction is committed, so they can safely read from the database.
+func (bc *Blockchain) OnNewBlock(f NewBlockCallback) {
+	bc.events.Lock()
+	defer bc.events.Unlock()
+
+	bc.events.newBlock = append(bc.events.newBlock, f)
+}
+
+// emitReorg calls the reorg callbacks after tx is committed. Nothing is called if tx is rolled back.
+func (bc *Blockchain) emitReorg(tx *bolt.Tx, oldTop, newTop [32]byte, commonHeight uint64) {
+	bc.events.RLock()
+	callbacks := bc.events.reorg
+	bc.events.RUnlock()
+
+	if len(callbacks) == 0 {
+		return
+	}
+	tx.OnCommit(func() {
+		for _, f := range callbacks {
+			f(oldTop, newTop, commonHeight)
+		}
+	})
+}
+
+// emitNewBlock calls the new block callbacks after tx is committed. Nothing is called if tx is rolled back.
+func (bc *Blockchain) emitNewBlock(tx *bolt.Tx, bl *block.Block, hash [32]byte) {
+	bc.events.RLock()
+	callbacks := bc.events.newBlock
+	bc.events.RUnlock()
+
+	if len(callbacks) == 0 {
+		return
+	}
+	tx.OnCommit(func() {
+		for _, f := range callbacks {
+			f(bl, hash)
+		}
+	})
+}
+
+// recordEvents assigns the next sequence numbers to the events, saving the last one in the database, and appends
+// them to the event log once tx is committed. Nothing is recorded if tx is rolled back.
+func (bc *Blockchain) recordEvents(tx *bolt.Tx, evs ...Event) error {
+	b := tx.Bucket([]byte{buck.INFO})
+	seq := getEventSeq(b)
+	for i := range evs {
+		seq++
+		evs[i].Seq = seq
+	}
+	err := b.Put(eventSeqKey, binary.LittleEndian.AppendUint64(nil, seq))
+	if err != nil {
+		return err
+	}
+
+	tx.OnCommit(func() {
+		bc.events.log.append(evs)
+	})
+	return nil
+}
+
+// getEventSeq returns the sequence number of the last event recorded, or 0 if there is none
+func getEventSeq(b *bolt.Bucket) uint64 {
+	v := b.Get(eventSeqKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(v)
+}
+
+// loadEventSeq makes the event log continue from the sequence number saved in the database
+func (bc *Blockchain) loadEventSeq() {
+	bc.DB.View(func(tx *bolt.Tx) error {
+		bc.events.log.Lock()
+		bc.events.log.nextSeq = getEventSeq(tx.Bucket([]byte{buck.INFO})) + 1
+		bc.events.log.Unlock()
+		return nil
+	})
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"cmp"
+	"math/bits"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/config"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// txPackage is a run of consecutive transactions of a sender, which have to be mined together: a transaction
+// can't be mined before the ones of the same sender with lower nonces, so a transaction paying a high fee lifts
+// its predecessors paying a lower one, like child-pays-for-parent
+type txPackage struct {
+	entries []*MempoolEntry
+	fee     uint64
+	size    uint64
+}
+
+// compareFeeRates compares the fee per byte of two transactions or packages, without rounding
+func compareFeeRates(feeA, sizeA, feeB, sizeB uint64) int {
+	hiA, loA := bits.Mul64(feeA, max(sizeB, 1))
+	hiB, loB := bits.Mul64(feeB, max(sizeA, 1))
+	if hiA != hiB {
+		return cmp.Compare(hiA, hiB)
+	}
+	return cmp.Compare(loA, loB)
+}
+
+// splitPackages splits the transactions of a sender, in nonce order, into packages with decreasing fee per byte:
+// each package is the run of the following transactions with the highest fee per byte
+func splitPackages(entries []*MempoolEntry) []txPackage {
+	var pkgs []txPackage
+	for len(entries) > 0 {
+		best := txPackage{entries: entries[:1], fee: entries[0].Fee, size: entries[0].Size}
+		fee, size := best.fee, best.size
+		for i := 1; i < len(entries); i++ {
+			fee += entries[i].Fee
+			size += entries[i].Size
+			if compareFeeRates(fee, size, best.fee, best.size) > 0 {
+				best = txPackage{entries: entries[:i+1], fee: fee, size: size}
+			}
+		}
+		pkgs = append(pkgs, best)
+		entries = entries[len(best.entries):]
+	}
+	return pkgs
+}
+
+// sortPackages returns the packages of all the senders, sorted by fee per byte, highest first. The packages of
+// the same sender keep their nonce order, since their fee per byte is decreasing.
+func sortPackages(senders []address.Address, bySender map[address.Address][]*MempoolEntry) []txPackage {
+	var pkgs []txPackage
+	for _, sender := range senders {
+		pkgs = append(pkgs, splitPackages(bySender[sender])...)
+	}
+	slices.SortStableFunc(pkgs, func(a, b txPackage) int {
+		return compareFeeRates(b.fee, b.size, a.fee, a.size)
+	})
+	return pkgs
+}
+
+// SelectForBlock returns the transactions that can be included in the next block, like ReadyTransactions, sorted
+// by the fee per byte of their package, so that miners include the transactions paying more first
+func (m *Mempool) SelectForBlock(stateNonce func(addr address.Address) uint64) []*MempoolEntry {
+	ready := &Mempool{Entries: m.ReadyTransactions(stateNonce)}
+
+	selected := make([]*MempoolEntry, 0, len(ready.Entries))
+	for _, pkg := range sortPackages(ready.bySender()) {
+		selected = append(selected, pkg.entries...)
+	}
+	return selected
+}
+
+// relayFeePerByte returns the minimum fee per byte required to admit a transaction in a mempool of the given
+// vsize. It's config.FEE_PER_BYTE while the mempool is less than half full, then it rises linearly up to
+// config.MEMPOOL_MAX_FEE_MULTIPLIER times that when the mempool is full.
+func relayFeePerByte(mempoolSize uint64) uint64 {
+	const start = config.MEMPOOL_CONGESTION_SIZE / 2
+	const span = config.MEMPOOL_CONGESTION_SIZE - start
+
+	if mempoolSize <= start {
+		return config.FEE_PER_BYTE
+	}
+	excess := min(mempoolSize-start, span)
+	return config.FEE_PER_BYTE + config.FEE_PER_BYTE*(config.MEMPOOL_MAX_FEE_MULTIPLIER-1)*excess/span
+}
+
+// MinRelayFee returns the minimum fee per byte required to admit a transaction in mempool
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) MinRelayFee(tx *bolt.Tx) uint64 {
+	return relayFeePerByte(bc.GetMempool(tx).Size())
+}
+
+// EstimateFee returns the minimum fee a transaction of the given vsize has to pay to be admitted in mempool.
+// It opens its own read-only database transaction.
+func (bc *Blockchain) EstimateFee(vsize uint64) (fee uint64) {
+	bc.DB.View(func(tx *bolt.Tx) error {
+		fee = bc.MinRelayFee(tx) * vsize
+		return nil
+	})
+	return
+}
+
+// feePerByteWithin returns the fee per byte a new transaction needs to be mined within the given number of blocks,
+// assuming miners include the mempool transactions with the highest package fee per byte first, like
+// SelectForBlock. It's never lower than the relay fee.
+func feePerByteWithin(mem *Mempool, blocks int) uint64 {
+	relay := relayFeePerByte(mem.Size())
+
+	space := uint64(blocks) * config.MAX_BLOCK_SIZE
+	var used uint64
+	var count int
+	for _, pkg := range sortPackages(mem.bySender()) {
+		if used+pkg.size > space || count+len(pkg.entries) > blocks*config.MAX_TX_PER_BLOCK {
+			// the blocks are full before this package, which has to be outbid
+			return max(relay, pkg.fee/max(pkg.size, 1)+1)
+		}
+		used += pkg.size
+		count += len(pkg.entries)
+	}
+	return relay
+}
+
+// EstimateFeeWithin returns the fee a transaction of the given vsize should pay to be mined within the given
+// number of blocks. It opens its own read-only database transaction.
+func (bc *Blockchain) EstimateFeeWithin(vsize uint64, blocks int) (fee uint64) {
+	blocks = max(min(blocks, config.FEE_ESTIMATE_MAX_BLOCKS), 1)
+	bc.DB.View(func(tx *bolt.Tx) error {
+		fee = feePerByteWithin(bc.GetMempool(tx), blocks) * vsize
+		return nil
+	})
+	return
+}
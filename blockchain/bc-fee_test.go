@@ -0,0 +1,168 @@
+package blockchain
+
+import (
+	"errors"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/transaction"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRelayFeePerByte(t *testing.T) {
+	tests := []struct {
+		size uint64
+		fee  uint64
+	}{
+		{0, config.FEE_PER_BYTE},
+		{config.MEMPOOL_CONGESTION_SIZE / 2, config.FEE_PER_BYTE},
+		{config.MEMPOOL_CONGESTION_SIZE, config.FEE_PER_BYTE * config.MEMPOOL_MAX_FEE_MULTIPLIER},
+		{config.MEMPOOL_CONGESTION_SIZE * 10, config.FEE_PER_BYTE * config.MEMPOOL_MAX_FEE_MULTIPLIER},
+	}
+	for _, v := range tests {
+		if fee := relayFeePerByte(v.size); fee != v.fee {
+			t.Errorf("mempool size %d: fee per byte is %d, expected %d", v.size, fee, v.fee)
+		}
+	}
+
+	prev := relayFeePerByte(0)
+	for size := uint64(0); size <= config.MEMPOOL_CONGESTION_SIZE; size += config.MAX_BLOCK_SIZE / 2 {
+		fee := relayFeePerByte(size)
+		if fee < prev {
+			t.Fatalf("fee per byte decreased from %d to %d at mempool size %d", prev, fee, size)
+		}
+		prev = fee
+	}
+}
+
+func TestMempoolCongestionFee(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+
+	// the minimum fee is enough when the mempool is empty
+	tx := newTestTx(t, pk, 1, config.COIN)
+	if fee := bc.EstimateFee(tx.GetVirtualSize()); fee != tx.MinFee() {
+		t.Fatalf("estimated fee with empty mempool is %d, expected %d", fee, tx.MinFee())
+	}
+	if _, err := bc.SubmitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// fill the mempool with transactions of another sender
+	bc.DB.Update(func(txn *bolt.Tx) error {
+		mem := bc.GetMempool(txn)
+		mem.Entries = append(mem.Entries, &MempoolEntry{
+			TXID:   blake3.Sum256([]byte("congestion")),
+			Size:   config.MEMPOOL_CONGESTION_SIZE,
+			Sender: recipient,
+		})
+		bc.SetMempool(txn, mem)
+		return nil
+	})
+
+	// the minimum fee isn't enough when the mempool is congested
+	_, err := bc.SubmitTx(newTestTx(t, pk, 2, config.COIN))
+	if !errors.Is(err, ErrFeeTooLow) {
+		t.Fatalf("expected ErrFeeTooLow, got %v", err)
+	}
+
+	// the estimated fee is enough
+	tx = newTestTx(t, pk, 2, config.COIN)
+	fee := bc.EstimateFee(tx.GetVirtualSize())
+	if fee <= tx.MinFee() {
+		t.Fatalf("estimated fee %d is not higher than the minimum fee %d", fee, tx.MinFee())
+	}
+	tx, err = transaction.NewWithFee(pk, tx.Recipient, config.COIN, 2, fee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.SubmitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeePerByteWithin(t *testing.T) {
+	const size = config.MAX_BLOCK_SIZE / 2
+
+	// two blocks of transactions of different senders, not sorted by fee
+	mem := &Mempool{}
+	for i, rate := range []uint64{6, 10, 4, 8} {
+		mem.Entries = append(mem.Entries, &MempoolEntry{
+			Size:   size,
+			Fee:    rate * config.FEE_PER_BYTE * size,
+			Sender: address.Address{byte(i + 1)},
+		})
+	}
+
+	tests := []struct {
+		blocks int
+		fee    uint64
+	}{
+		{1, 6*config.FEE_PER_BYTE + 1}, // outbids the best transaction left out of the next block
+		{2, config.FEE_PER_BYTE},       // every transaction fits
+		{10, config.FEE_PER_BYTE},
+	}
+	for _, v := range tests {
+		if fee := feePerByteWithin(mem, v.blocks); fee != v.fee {
+			t.Errorf("within %d blocks: fee per byte is %d, expected %d", v.blocks, fee, v.fee)
+		}
+	}
+
+	if fee := feePerByteWithin(&Mempool{}, 1); fee != config.FEE_PER_BYTE {
+		t.Errorf("empty mempool: fee per byte is %d, expected %d", fee, config.FEE_PER_BYTE)
+	}
+}
+
+func TestPackageFeeRate(t *testing.T) {
+	const size = config.MAX_BLOCK_SIZE / 4
+	entry := func(sender byte, nonce, rate uint64) *MempoolEntry {
+		return &MempoolEntry{
+			TXID:   blake3.Sum256([]byte{sender, byte(nonce)}),
+			Size:   size,
+			Fee:    rate * config.FEE_PER_BYTE * size,
+			Nonce:  nonce,
+			Sender: address.Address{sender},
+		}
+	}
+
+	// the first transaction of sender 1 pays a low fee, but the next one pays enough for both of them to be
+	// preferred to the transactions of sender 2. The last transaction of sender 1 pays less than them.
+	low, high, last := entry(1, 1, 1), entry(1, 2, 20), entry(1, 3, 3)
+	other1, other2 := entry(2, 1, 5), entry(2, 2, 5)
+	mem := &Mempool{Entries: []*MempoolEntry{other1, other2, low, high, last}}
+
+	selected := mem.SelectForBlock(func(address.Address) uint64 {
+		return 0
+	})
+	expected := []*MempoolEntry{low, high, other1, other2, last}
+	if len(selected) != len(expected) {
+		t.Fatalf("%d transactions selected, expected %d", len(selected), len(expected))
+	}
+	for i := range expected {
+		if selected[i] != expected[i] {
+			t.Fatalf("transaction %d is %+v, expected %+v", i, selected[i], expected[i])
+		}
+	}
+
+	// a block fits four transactions: the package of sender 1 and the ones of sender 2, so the fee per byte
+	// needed to be mined in the next block outbids the last transaction of sender 1
+	if fee := feePerByteWithin(mem, 1); fee != 3*config.FEE_PER_BYTE+1 {
+		t.Errorf("fee per byte is %d, expected %d", fee, 3*config.FEE_PER_BYTE+1)
+	}
+
+	// without the high fee transaction, the low fee one is selected last
+	mem.Entries = []*MempoolEntry{low, other1, other2}
+	selected = mem.SelectForBlock(func(address.Address) uint64 {
+		return 0
+	})
+	if len(selected) != 3 || selected[2] != low {
+		t.Fatalf("low fee transaction is not selected last: %+v", selected)
+	}
+}
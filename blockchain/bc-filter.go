@@ -0,0 +1,41 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/transaction"
+	"still-blockchain/util/bloom"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// FilteredTx is a transaction of a block matching a light client's bloom filter
+type FilteredTx struct {
+	Txid transaction.TXID
+	Tx   *transaction.Transaction
+}
+
+// MatchesFilter returns true if the filter contains the sender or the recipient address of the transaction
+func MatchesFilter(txn *transaction.Transaction, filter *bloom.Filter) bool {
+	sender := address.FromPubKey(txn.Sender)
+	return filter.Contains(sender[:]) || filter.Contains(txn.Recipient[:])
+}
+
+// GetFilteredTxs returns the transactions of the block whose sender or recipient matches the filter, in block
+// order. Because of false positives, they may include transactions that don't involve the client's addresses.
+func (bc *Blockchain) GetFilteredTxs(tx *bolt.Tx, bl *block.Block, filter *bloom.Filter) ([]FilteredTx, error) {
+	b := tx.Bucket([]byte{buck.TX})
+
+	var txs []FilteredTx
+	for _, txid := range bl.Transactions {
+		txn, _, err := bc.buckGetTx(b, txid)
+		if err != nil {
+			return nil, err
+		}
+		if MatchesFilter(txn, filter) {
+			txs = append(txs, FilteredTx{txid, txn})
+		}
+	}
+	return txs, nil
+}
@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/transaction"
+	"still-blockchain/util/bloom"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestGetFilteredTxs(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	// three senders, the first one sending two transactions
+	var addrs []address.Address
+	var expected []transaction.TXID
+	for i := 0; i < 3; i++ {
+		pk := address.GenerateKeypair(blake3.Sum256(binary.LittleEndian.AppendUint64([]byte("sender"), uint64(i))))
+		addr := address.FromPubKey(pk.Public())
+		addrs = append(addrs, addr)
+		setTestState(t, bc, addr, &State{
+			Balance: 10 * config.COIN,
+		})
+
+		count := uint64(1)
+		if i == 0 {
+			count = 2
+		}
+		for nonce := uint64(1); nonce <= count; nonce++ {
+			txid, err := bc.SubmitTx(newTestTx(t, pk, nonce, config.COIN))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				expected = append(expected, txid)
+			}
+		}
+	}
+
+	bl := newTestBlock(t, bc, addrs[1])
+	if len(bl.Transactions) != 4 {
+		t.Fatalf("block has %d transactions, expected 4", len(bl.Transactions))
+	}
+
+	filter := bloom.New(1, 0.0001, 7)
+	filter.Add(addrs[0][:])
+
+	var txs []FilteredTx
+	err := bc.DB.View(func(tx *bolt.Tx) (err error) {
+		txs, err = bc.GetFilteredTxs(tx, bl, filter)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != len(expected) {
+		t.Fatalf("filter matches %d transactions, expected %d", len(txs), len(expected))
+	}
+	for i, v := range txs {
+		if v.Txid != expected[i] {
+			t.Fatalf("transaction %d is %x, expected %x", i, v.Txid, expected[i])
+		}
+		if address.FromPubKey(v.Tx.Sender) != addrs[0] {
+			t.Fatalf("transaction %d is sent by %s, expected %s", i, address.FromPubKey(v.Tx.Sender), addrs[0])
+		}
+	}
+	if filter.Contains(bl.Recipient[:]) {
+		t.Fatal("filter matches the block reward recipient")
+	}
+}
@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"still-blockchain/block"
+	"still-blockchain/config"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// GetHeaderProof returns the mainchain blocks from the anchor height up to the given height, at most
+// config.HEADER_PROOF_MAX_BLOCKS. A light client passes the height of the last block it trusts, and verifies the
+// proof with VerifyHeaderProof; longer ranges are fetched by anchoring each proof at the end of the previous one.
+// If the trusted block is no longer in the mainchain, the proof starts at a different hash and fails to verify.
+func (bc *Blockchain) GetHeaderProof(tx *bolt.Tx, anchor, height uint64) (*block.HeaderProof, error) {
+	stats := bc.GetStats(tx)
+	if height > stats.TopHeight {
+		return nil, fmt.Errorf("height %d is above top height %d", height, stats.TopHeight)
+	}
+	if anchor > height {
+		return nil, fmt.Errorf("anchor %d is above height %d", anchor, height)
+	}
+	if height-anchor >= config.HEADER_PROOF_MAX_BLOCKS {
+		return nil, fmt.Errorf("height %d is more than %d blocks above anchor %d", height,
+			config.HEADER_PROOF_MAX_BLOCKS-1, anchor)
+	}
+
+	proof := &block.HeaderProof{
+		Anchor: anchor,
+		Blocks: make([]block.Block, 0, height-anchor+1),
+	}
+	if anchor > 0 {
+		parent, err := bc.GetBlockByHeight(tx, anchor-1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %d: %w", anchor-1, err)
+		}
+		proof.Parent = parent
+	}
+	for h := anchor; h <= height; h++ {
+		bl, err := bc.GetBlockByHeight(tx, h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %d: %w", h, err)
+		}
+		proof.Blocks = append(proof.Blocks, *bl)
+	}
+	return proof, nil
+}
+
+// VerifyHeaderChain verifies that the proof starts at the block with the trusted hash, and that every block
+// links to the previous one with a correct height, difficulty and cumulative difficulty. It doesn't verify PoW.
+func VerifyHeaderChain(p *block.HeaderProof, trusted [32]byte) error {
+	if len(p.Blocks) == 0 {
+		return errors.New("header proof is empty")
+	}
+	if p.Blocks[0].Height != p.Anchor {
+		return fmt.Errorf("header proof starts at height %d, expected anchor %d", p.Blocks[0].Height, p.Anchor)
+	}
+	prevHash := p.Blocks[0].Hash()
+	if prevHash != trusted {
+		return fmt.Errorf("header proof starts at block %x, expected %x", prevHash, trusted)
+	}
+
+	// the difficulty of a block depends on the timestamps of the two previous blocks, so the parent of the anchor
+	// is needed to verify the block after it
+	var parent *block.Block
+	if p.Anchor > 0 {
+		if p.Parent == nil {
+			return errors.New("header proof has no parent of the anchor block")
+		}
+		if p.Parent.Height != p.Anchor-1 || p.Parent.Hash() != p.Blocks[0].PrevHash() {
+			return fmt.Errorf("header proof has invalid parent %d %x", p.Parent.Height, p.Parent.Hash())
+		}
+		parent = p.Parent
+	}
+
+	for i := 1; i < len(p.Blocks); i++ {
+		prev, bl := &p.Blocks[i-1], &p.Blocks[i]
+
+		if bl.Height != prev.Height+1 {
+			return fmt.Errorf("block %d has invalid height %d", prev.Height+1, bl.Height)
+		}
+		if bl.PrevHash() != prevHash {
+			return fmt.Errorf("block %d has previous hash %x, expected %x", bl.Height, bl.PrevHash(), prevHash)
+		}
+		if bl.Timestamp < prev.Timestamp {
+			return fmt.Errorf("block %d has timestamp older than previous block", bl.Height)
+		}
+		recent := []DifficultyPoint{{Timestamp: prev.Timestamp, Difficulty: prev.Difficulty}}
+		if parent != nil {
+			recent = append([]DifficultyPoint{{Timestamp: parent.Timestamp}}, recent...)
+		}
+		expectDiff := NextDifficulty(prev.Height, recent)
+		if !bl.Difficulty.Equals(expectDiff) {
+			return fmt.Errorf("block %d has invalid difficulty: %s, expected: %s", bl.Height, bl.Difficulty,
+				expectDiff)
+		}
+		expectCumDiff := bl.ExpectedCumulativeDiff(prev.CumulativeDiff)
+		if !bl.CumulativeDiff.Equals(expectCumDiff) {
+			return fmt.Errorf("block %d has invalid cumulative diff: %s, expected: %s", bl.Height,
+				bl.CumulativeDiff, expectCumDiff)
+		}
+
+		parent = prev
+		prevHash = bl.Hash()
+	}
+	return nil
+}
+
+// VerifyHeaderProof is like VerifyHeaderChain, but it also verifies the PoW of every block after the trusted one.
+// It's what a light client should use, since VerifyHeaderChain alone can't tell real blocks from made-up ones.
+func VerifyHeaderProof(p *block.HeaderProof, trusted [32]byte) error {
+	err := VerifyHeaderChain(p, trusted)
+	if err != nil {
+		return err
+	}
+	for _, bl := range p.Blocks[1:] {
+		err := bl.PrevalidateFull()
+		if err != nil {
+			return fmt.Errorf("block %d: %w", bl.Height, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Info summarizes the node status
+type Info struct {
+	Height         uint64
+	TopHash        util.Hash
+	CumulativeDiff Uint128
+	TopDifficulty  Uint128 // difficulty of the top block
+	Difficulty     Uint128 // difficulty of the next block
+	Hashrate       Uint128 // network hashrate estimated from Difficulty, in hashes per second
+
+	// mean and median interval between the last config.BLOCK_TIME_WINDOW mainchain blocks, in seconds. Zero if
+	// there are less than two blocks after the genesis.
+	AverageBlockTime float64
+	MedianBlockTime  float64
+
+	NetworkID   uint64
+	Version     string
+	Peers       int    // number of connected peers
+	MempoolSize int    // number of transactions in mempool
+	RelayFee    uint64 // minimum fee per byte required to admit a transaction in mempool
+	Synced      bool
+
+	// percentages of the block rewards, fees included, paid to the miner and to the governance address
+	MinerPercent      uint64
+	GovernancePercent uint64
+}
+
+// GetInfo returns the node status. It opens its own read-only database transaction.
+func (bc *Blockchain) GetInfo() (*Info, error) {
+	info := &Info{
+		NetworkID:         config.NETWORK_ID,
+		Version:           config.VERSION,
+		MinerPercent:      100 - config.BLOCK_REWARD_FEE_PERCENT,
+		GovernancePercent: config.BLOCK_REWARD_FEE_PERCENT,
+	}
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		top, err := bc.GetBlock(tx, stats.TopHash)
+		if err != nil {
+			return err
+		}
+		diff, err := bc.GetNextDifficulty(tx, top)
+		if err != nil {
+			return err
+		}
+
+		info.Height = stats.TopHeight
+		info.TopHash = stats.TopHash
+		info.CumulativeDiff = stats.CumulativeDiff
+		info.TopDifficulty = top.Difficulty
+		info.Difficulty = diff
+		info.Hashrate = NetworkHashrate(diff)
+		intervals, err := bc.blockIntervals(tx, config.BLOCK_TIME_WINDOW)
+		if err == nil {
+			info.AverageBlockTime = meanInterval(intervals)
+			info.MedianBlockTime = medianInterval(intervals)
+		}
+		mem := bc.GetMempool(tx)
+		info.MempoolSize = len(mem.Entries)
+		info.RelayFee = relayFeePerByte(mem.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bc.P2P.RLock()
+	info.Peers = len(bc.P2P.Connections)
+	bc.P2P.RUnlock()
+
+	info.Synced = bc.IsSynced()
+
+	return info, nil
+}
+
+// ErrNotEnoughBlocks is returned when the block time is requested before two blocks have been mined after the
+// genesis block
+var ErrNotEnoughBlocks = errors.New("not enough blocks to compute the block time")
+
+// GetAverageBlockTime returns the mean interval between consecutive mainchain blocks, in seconds, over the last
+// overBlocks intervals. If the chain is shorter, all of it is used. The genesis block is skipped, since its
+// timestamp is fixed in the configuration rather than set when it's mined.
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) GetAverageBlockTime(tx *bolt.Tx, overBlocks uint64) (float64, error) {
+	intervals, err := bc.blockIntervals(tx, overBlocks)
+	if err != nil {
+		return 0, err
+	}
+	return meanInterval(intervals), nil
+}
+
+// GetMedianBlockTime is like GetAverageBlockTime, but it returns the median interval, which isn't skewed by a
+// few blocks with a wrong timestamp
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) GetMedianBlockTime(tx *bolt.Tx, overBlocks uint64) (float64, error) {
+	intervals, err := bc.blockIntervals(tx, overBlocks)
+	if err != nil {
+		return 0, err
+	}
+	return medianInterval(intervals), nil
+}
+
+// blockIntervals returns the intervals in milliseconds between the last overBlocks+1 mainchain blocks, genesis
+// excluded, oldest first
+func (bc *Blockchain) blockIntervals(tx *bolt.Tx, overBlocks uint64) ([]uint64, error) {
+	if overBlocks == 0 {
+		return nil, fmt.Errorf("invalid block time window: %d", overBlocks)
+	}
+	top := bc.GetStats(tx).TopHeight
+	if top < 2 {
+		return nil, ErrNotEnoughBlocks
+	}
+	from := uint64(1)
+	if top-from > overBlocks {
+		from = top - overBlocks
+	}
+
+	intervals := make([]uint64, 0, top-from)
+	var prev uint64
+	err := bc.IterateMainchain(tx, from, top, func(height uint64, _ [32]byte, bl *block.Block) error {
+		if height > from {
+			// timestamps never decrease along the mainchain
+			intervals = append(intervals, bl.Timestamp-prev)
+		}
+		prev = bl.Timestamp
+		return nil
+	})
+	return intervals, err
+}
+
+func meanInterval(intervals []uint64) float64 {
+	var sum float64
+	for _, v := range intervals {
+		sum += float64(v)
+	}
+	return sum / float64(len(intervals)) / 1000
+}
+
+func medianInterval(intervals []uint64) float64 {
+	sorted := slices.Clone(intervals)
+	slices.Sort(sorted)
+
+	n := len(sorted)
+	if n%2 == 0 {
+		return (float64(sorted[n/2-1]) + float64(sorted[n/2])) / 2 / 1000
+	}
+	return float64(sorted[n/2]) / 1000
+}
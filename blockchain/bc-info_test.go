@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"errors"
+	"math"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/util"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestGetInfo(t *testing.T) {
+	bc := newTestBlockchain(t)
+	addTestBlocks(t, bc, newTestChain(t, nil, 3)...)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+	if _, err := bc.SubmitTx(newTestTx(t, pk, 1, config.COIN)); err != nil {
+		t.Fatal(err)
+	}
+	addTestPeer(t, bc, "127.0.0.1:1")
+
+	info, err := bc.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		top, err := bc.GetBlock(tx, stats.TopHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, err := bc.GetNextDifficulty(tx, top)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Height != 3 || info.Height != stats.TopHeight {
+			t.Errorf("height is %d, expected %d", info.Height, stats.TopHeight)
+		}
+		if info.TopHash != stats.TopHash {
+			t.Errorf("top hash is %x, expected %x", info.TopHash, stats.TopHash)
+		}
+		if !info.CumulativeDiff.Equals(stats.CumulativeDiff) {
+			t.Errorf("cumulative diff is %s, expected %s", info.CumulativeDiff, stats.CumulativeDiff)
+		}
+		if !info.TopDifficulty.Equals(top.Difficulty) {
+			t.Errorf("top difficulty is %s, expected %s", info.TopDifficulty, top.Difficulty)
+		}
+		if !info.Difficulty.Equals(diff) {
+			t.Errorf("difficulty is %s, expected %s", info.Difficulty, diff)
+		}
+		return nil
+	})
+
+	if info.NetworkID != config.NETWORK_ID || info.Version != config.VERSION {
+		t.Errorf("network id %x and version %s don't match the config", info.NetworkID, info.Version)
+	}
+	if info.Peers != 1 {
+		t.Errorf("peer count is %d, expected 1", info.Peers)
+	}
+	if info.MempoolSize != 1 {
+		t.Errorf("mempool size is %d, expected 1", info.MempoolSize)
+	}
+	if info.RelayFee != config.FEE_PER_BYTE {
+		t.Errorf("relay fee is %d with an almost empty mempool, expected %d", info.RelayFee, config.FEE_PER_BYTE)
+	}
+	if info.Synced {
+		t.Error("node with a single peer is synced")
+	}
+	if info.GovernancePercent != config.BLOCK_REWARD_FEE_PERCENT || info.MinerPercent+info.GovernancePercent != 100 {
+		t.Errorf("reward split is %d%% miner, %d%% governance", info.MinerPercent, info.GovernancePercent)
+	}
+}
+
+func TestGetAverageBlockTime(t *testing.T) {
+	bc := newTestBlockchain(t)
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	blockTime := func(overBlocks uint64) (avg, median float64, err error) {
+		err = bc.DB.View(func(tx *bolt.Tx) error {
+			avg, err = bc.GetAverageBlockTime(tx, overBlocks)
+			if err != nil {
+				return err
+			}
+			median, err = bc.GetMedianBlockTime(tx, overBlocks)
+			return err
+		})
+		return
+	}
+
+	// the interval between the genesis and the first block is not a block time
+	intervals := []uint64{10, 20, 30, 60, 10}
+	timestamp := util.Time() - 3600*1000
+	for i := 0; i <= len(intervals); i++ {
+		if i > 0 {
+			timestamp += intervals[i-1] * 1000
+		}
+		bl := newTestBlock(t, bc, miner)
+		bl.Timestamp = timestamp
+		addTestBlocks(t, bc, bl)
+		if i == 0 {
+			if _, _, err := blockTime(10); !errors.Is(err, ErrNotEnoughBlocks) {
+				t.Fatalf("expected ErrNotEnoughBlocks with a single block, got %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		overBlocks  uint64
+		avg, median float64
+	}{
+		{100, 26, 20}, // the whole chain is used
+		{5, 26, 20},
+		{3, 100.0 / 3, 30},
+		{2, 35, 35},
+		{1, 10, 10},
+	}
+	for _, test := range tests {
+		avg, median, err := blockTime(test.overBlocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(avg-test.avg) > 1e-9 || median != test.median {
+			t.Errorf("block time over %d blocks is %v (median %v), expected %v (median %v)", test.overBlocks,
+				avg, median, test.avg, test.median)
+		}
+	}
+
+	if _, _, err := blockTime(0); err == nil {
+		t.Error("block time over 0 blocks is computed")
+	}
+
+	info, err := bc.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AverageBlockTime != 26 || info.MedianBlockTime != 20 {
+		t.Errorf("info block time is %v (median %v), expected 26 (median 20)", info.AverageBlockTime,
+			info.MedianBlockTime)
+	}
+}
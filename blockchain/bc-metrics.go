@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"still-blockchain/util/metrics"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type bcMetrics struct {
+	blocksAdded     *metrics.Counter
+	blocksPerMinute *metrics.Meter
+	reorgs          *metrics.Counter
+	mempoolAdded    *metrics.Counter
+}
+
+func (bc *Blockchain) initMetrics() {
+	r := metrics.NewRegistry()
+	bc.Metrics = r
+
+	// statsGauge registers a gauge reading a value from the blockchain stats
+	statsGauge := func(name, help string, f func(s *Stats) float64) {
+		r.Gauge(name, help, func() float64 {
+			var v float64
+			bc.DB.View(func(tx *bolt.Tx) error {
+				v = f(bc.GetStats(tx))
+				return nil
+			})
+			return v
+		})
+	}
+
+	statsGauge("still_height", "Height of the mainchain top block", func(s *Stats) float64 {
+		return float64(s.TopHeight)
+	})
+	statsGauge("still_cumulative_difficulty", "Cumulative difficulty of the mainchain", func(s *Stats) float64 {
+		return s.CumulativeDiff.Float64()
+	})
+	statsGauge("still_orphans", "Number of orphan blocks", func(s *Stats) float64 {
+		return float64(len(s.Orphans))
+	})
+	statsGauge("still_tips", "Number of altchain tips", func(s *Stats) float64 {
+		return float64(len(s.Tips))
+	})
+	r.Gauge("still_mempool_transactions", "Number of transactions in mempool", func() float64 {
+		var v float64
+		bc.DB.View(func(tx *bolt.Tx) error {
+			v = float64(len(bc.GetMempool(tx).Entries))
+			return nil
+		})
+		return v
+	})
+	r.Gauge("still_peers", "Number of connected P2P peers", func() float64 {
+		if bc.P2P == nil {
+			return 0
+		}
+		bc.P2P.RLock()
+		defer bc.P2P.RUnlock()
+		return float64(len(bc.P2P.Connections))
+	})
+
+	r.Gauge("still_block_propagation_delay_seconds",
+		"Moving average of the delay between a block's timestamp and when it's first received", func() float64 {
+			return bc.propagation.AvgDelay().Seconds()
+		})
+	r.Gauge("still_last_block_age_seconds", "Time elapsed since the last mainchain block was added",
+		func() float64 {
+			return bc.LastBlockAge().Seconds()
+		})
+	r.Gauge("still_chain_stalled", "1 if no mainchain block has been added for longer than the stall timeout",
+		func() float64 {
+			if bc.IsStalled() {
+				return 1
+			}
+			return 0
+		})
+	r.Gauge("still_stale_block_rate", "Moving average of the fraction of blocks added as altchain or orphan",
+		bc.propagation.StaleRate)
+
+	bc.metrics = bcMetrics{
+		blocksAdded: r.Counter("still_blocks_added_total", "Number of blocks added to mainchain"),
+		blocksPerMinute: r.Meter("still_blocks_added_last_minute",
+			"Number of blocks added to mainchain in the last minute", time.Minute),
+		reorgs:       r.Counter("still_reorgs_total", "Number of chain reorganizations"),
+		mempoolAdded: r.Counter("still_mempool_added_total", "Number of transactions admitted to mempool"),
+	}
+}
+
+// countBlockAdded counts a new mainchain block once tx is committed
+func (bc *Blockchain) countBlockAdded(tx *bolt.Tx) {
+	tx.OnCommit(func() {
+		bc.metrics.blocksAdded.Inc()
+		bc.metrics.blocksPerMinute.Mark(time.Now())
+	})
+}
+
+// countReorg counts a reorg once tx is committed
+func (bc *Blockchain) countReorg(tx *bolt.Tx) {
+	tx.OnCommit(bc.metrics.reorgs.Inc)
+}
+
+// countMempoolAdded counts a transaction admitted to mempool once tx is committed
+func (bc *Blockchain) countMempoolAdded(tx *bolt.Tx) {
+	tx.OnCommit(bc.metrics.mempoolAdded.Inc)
+}
@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"still-blockchain/address"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMetrics(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	srv := httptest.NewServer(bc.Metrics)
+	defer srv.Close()
+
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	for i := 0; i < 3; i++ {
+		bl := newTestBlock(t, bc, miner)
+		addTestBlocks(t, bc, bl)
+	}
+
+	// a block added by a transaction which is rolled back isn't counted
+	errRollback := errors.New("rollback")
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := bc.AddBlock(tx, newTestBlock(t, bc, miner)); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+
+	res, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{
+		"still_height 3\n",
+		"still_blocks_added_total 3\n",
+		"still_blocks_added_last_minute 3\n",
+		"still_reorgs_total 0\n",
+		"# TYPE still_blocks_added_total counter\n",
+	} {
+		if !strings.Contains(string(body), v) {
+			t.Errorf("metrics don't contain %q:\n%s", v, body)
+		}
+	}
+}
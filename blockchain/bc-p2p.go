@@ -1,21 +1,32 @@
 package blockchain
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
 	"still-blockchain/block"
 	"still-blockchain/config"
 	"still-blockchain/p2p"
 	"still-blockchain/p2p/packet"
 	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"still-blockchain/util/buck"
+	"sync"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// pinger periodically pings all the peers, and disconnects the ones which haven't sent anything within the read
+// timeout
 func (bc *Blockchain) pinger() {
 	for {
 		func() {
 			time.Sleep(config.P2P_PING_INTERVAL * time.Second)
 
+			bc.P2P.KickUnresponsive()
+
 			bc.P2P.RLock()
 
 			for _, v := range bc.P2P.Connections {
@@ -33,37 +44,55 @@ func (bc *Blockchain) newConnections() {
 	for {
 		conn := <-bc.P2P.NewConnections
 
-		var stats *Stats
+		var st packet.PacketStatsProof
 		bc.DB.View(func(tx *bolt.Tx) error {
-			stats = bc.GetStats(tx)
+			st = bc.statsProof(tx, bc.GetStats(tx))
 			return nil
 		})
 
 		conn.SendPacket(&p2p.Packet{
 			Type: packet.STATS,
-			Data: packet.PacketStats{
-				Height:         stats.TopHeight,
-				CumulativeDiff: stats.CumulativeDiff,
-				Hash:           stats.TopHash,
-			}.Serialize(),
+			Data: st.Serialize(),
+		})
+		conn.SendPacket(&p2p.Packet{
+			Type: packet.TIME,
+			Data: packet.PacketTime{Time: util.Time()}.Serialize(),
 		})
 	}
 }
+
+// statsBroadcaster periodically sends the stats to all the peers, so they can check them against the ones
+// advertised by other peers
+func (bc *Blockchain) statsBroadcaster() {
+	for {
+		time.Sleep(config.P2P_STATS_INTERVAL * time.Second)
+
+		bc.SendStats()
+	}
+}
 func (bc *Blockchain) incomingP2P() {
 	for {
 		pack := <-bc.P2P.PacketsIn
 
 		if pack.Type == packet.BLOCK {
-			Log.Debug("Received new block packet")
+			bc.log.Debug("Received new block packet")
 			bc.packetBlock(pack)
 		} else if pack.Type == packet.TX {
-			Log.Debug("Received new transaction packet")
+			bc.log.Debug("Received new transaction packet")
 			bc.packetTx(pack)
 		} else if pack.Type == packet.STATS {
 			bc.packetStats(pack)
 		} else if pack.Type == packet.BLOCK_REQUEST {
-			Log.Debug("Received block request packet")
+			bc.log.Debug("Received block request packet")
 			go bc.packetBlockRequest(pack)
+		} else if pack.Type == packet.INV {
+			bc.log.Debug("Received inventory packet")
+			go bc.packetInv(pack)
+		} else if pack.Type == packet.TX_REQUEST {
+			bc.log.Debug("Received transaction request packet")
+			go bc.packetTxRequest(pack)
+		} else if pack.Type == packet.TIME {
+			bc.packetTime(pack)
 		}
 	}
 }
@@ -73,40 +102,207 @@ func (bc *Blockchain) packetTx(pack p2p.Packet) {
 
 	err := tx.Deserialize(pack.Data)
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
+		return
+	}
+	// transactions are announced with an inventory first, so a peer only sends the ones requested to it
+	hash := tx.Hash()
+	if !bc.txRequests.received(pack.Conn, hash) {
+		bc.log.Debugf("ignoring transaction %x which wasn't requested to the peer", hash)
 		return
 	}
 	err = tx.Prevalidate()
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
 		return
 	}
 
 	err = bc.DB.Update(func(txn *bolt.Tx) error {
-		return bc.AddTransaction(txn, tx, tx.Hash(), true)
+		return bc.AddTransaction(txn, tx, hash, true)
 	})
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
 		return
 	}
 }
 
+// packetInv requests the announced transactions that aren't known yet, and aren't already requested to another
+// peer
+func (bc *Blockchain) packetInv(pack p2p.Packet) {
+	inv := packet.PacketInv{}
+	err := inv.Deserialize(pack.Data)
+	if err != nil {
+		bc.log.Warn(err)
+		return
+	}
+
+	missing := make([][32]byte, 0, len(inv.Hashes))
+	bc.DB.View(func(txn *bolt.Tx) error {
+		b := txn.Bucket([]byte{buck.TX})
+		for _, v := range inv.Hashes {
+			if b.Get(v[:]) == nil && !slices.Contains(missing, v) {
+				missing = append(missing, v)
+			}
+		}
+		return nil
+	})
+	missing = bc.txRequests.request(pack.Conn, missing)
+	if len(missing) == 0 {
+		return
+	}
+
+	bc.log.Debugf("requesting %d transactions out of %d announced", len(missing), len(inv.Hashes))
+	pack.Conn.SendPacket(&p2p.Packet{
+		Type: packet.TX_REQUEST,
+		Data: packet.PacketInv{Hashes: missing}.Serialize(),
+	})
+}
+
+// packetTxRequest sends the requested transactions to the peer
+func (bc *Blockchain) packetTxRequest(pack p2p.Packet) {
+	req := packet.PacketInv{}
+	err := req.Deserialize(pack.Data)
+	if err != nil {
+		bc.log.Warn(err)
+		return
+	}
+
+	txs := make([][]byte, 0, len(req.Hashes))
+	bc.DB.View(func(txn *bolt.Tx) error {
+		b := txn.Bucket([]byte{buck.TX})
+		for _, v := range req.Hashes {
+			tx, _, err := bc.buckGetTx(b, v)
+			if err != nil {
+				bc.log.Debug("received invalid transaction request:", err)
+				continue
+			}
+			txs = append(txs, tx.Serialize())
+		}
+		return nil
+	})
+
+	for _, v := range txs {
+		pack.Conn.SendPacket(&p2p.Packet{
+			Type: packet.TX,
+			Data: v,
+		})
+	}
+}
+
+// ErrUnexpectedBlock is returned when a peer sends a block which doesn't match the request it answers
+var ErrUnexpectedBlock = errors.New("unexpected block")
+
+// ErrUnrequestedBlock is returned when a peer which has height requests to answer sends a block, which wasn't
+// requested, below its advertised height. It's likely the response to one of them with the wrong height, but it
+// may also be a block the peer relayed before its stats were updated, so the block is dropped and the peer kept.
+var ErrUnrequestedBlock = errors.New("unrequested block")
+
+// block requests older than this (in seconds) are forgotten, so a late response is handled like a relayed block
+const blockRequestExpiry = 2 * 60
+
+// recordBlockRequest remembers that a block was requested to a peer, to check the response.
+// PeerData MUST be locked before calling this
+func recordBlockRequest(d *p2p.PeerData, req packet.PacketBlockRequest) {
+	now := time.Now().Unix()
+	if d.Requests == nil {
+		d.Requests = make(map[packet.PacketBlockRequest]int64)
+	}
+	for k, t := range d.Requests {
+		if now-t > blockRequestExpiry {
+			delete(d.Requests, k)
+		}
+	}
+	d.Requests[req] = now
+}
+
+// checkBlockResponse checks a block received from a peer against the blocks requested to it. A block requested
+// by height must not be above the height advertised by the peer, otherwise ErrUnexpectedBlock is returned.
+// Blocks that weren't requested are relayed by the peer after adding them on top of its chain, so an unrequested
+// block below the advertised height of a peer which has height requests to answer returns ErrUnrequestedBlock.
+// PeerData MUST be locked before calling this
+func checkBlockResponse(d *p2p.PeerData, bl *block.Block, hash [32]byte) error {
+	if _, ok := d.Requests[packet.PacketBlockRequest{Height: bl.Height}]; ok {
+		delete(d.Requests, packet.PacketBlockRequest{Height: bl.Height})
+		if bl.Height > d.Stats.Height {
+			return fmt.Errorf("%w: block %d %x is above the height %d advertised by the peer",
+				ErrUnexpectedBlock, bl.Height, hash, d.Stats.Height)
+		}
+		return nil
+	}
+	if _, ok := d.Requests[packet.PacketBlockRequest{Hash: hash}]; ok {
+		delete(d.Requests, packet.PacketBlockRequest{Hash: hash})
+		return nil
+	}
+
+	pendingHeights := false
+	for req := range d.Requests {
+		if req.Height != 0 {
+			pendingHeights = true
+			break
+		}
+	}
+	// the stats of the peer may already include the block after the relayed one
+	if pendingHeights && bl.Height+1 < d.Stats.Height {
+		return fmt.Errorf("%w: block %d %x is below the height %d advertised by the peer",
+			ErrUnrequestedBlock, bl.Height, hash, d.Stats.Height)
+	}
+	return nil
+}
+
 func (bc *Blockchain) packetBlock(pack p2p.Packet) {
+	// the block stays in the download queue, which is saved on shutdown, so it's requested again at startup
+	if bc.beginBlock() != nil {
+		return
+	}
+	defer bc.endBlock()
+
 	bl := &block.Block{}
 
-	txs, err := bl.DeserializeFull(pack.Data)
+	// the transactions are collected to be prevalidated in parallel; they take no more memory than the packet
+	var txs []*transaction.Transaction
+	err := bl.DeserializeFullStream(bytes.NewReader(pack.Data), func(tx *transaction.Transaction) error {
+		txs = append(txs, tx)
+		return nil
+	})
 	if err != nil {
-		Log.Warn("invalid block received:", err)
+		bc.log.Warn("invalid block received:", err)
+		return
+	}
+
+	// a block with a different height than the requested one would take its place in the download queue
+	pack.Conn.PeerData(func(d *p2p.PeerData) {
+		err = checkBlockResponse(d, bl, bl.Hash())
+	})
+	if errors.Is(err, ErrUnrequestedBlock) {
+		bc.log.Debug("dropping block:", err)
+		return
+	}
+	if err != nil {
+		bc.log.Warn("dropping peer:", err)
+		bc.P2P.Kick(pack.Conn)
 		return
 	}
 
 	err = bl.Prevalidate()
 	if err != nil {
-		Log.Warn("invalid block received:", err)
+		bc.log.Warn("invalid block received:", err)
+		return
+	}
+	bc.propagation.seen(bl.Hash(), time.Now())
+
+	// transactions in blocks are only prevalidated here, so their signatures are verified in parallel before
+	// the block is applied to state
+	err = prevalidateTxs(txs)
+	if err != nil {
+		bc.log.Warn("invalid block received:", err)
+		bc.BlockQueue.Update(func(qt *QueueTx) {
+			qt.RemoveBlock(bl.Height, bl.Hash())
+		})
 		return
 	}
 
 	var hash [32]byte
+	var isMainchain bool
 	err = bc.DB.Update(func(tx *bolt.Tx) error {
 		for _, v := range txs {
 			err := bc.AddTransaction(tx, v, v.Hash(), false)
@@ -115,47 +311,254 @@ func (bc *Blockchain) packetBlock(pack p2p.Packet) {
 			}
 		}
 		hash, err = bc.AddBlock(tx, bl)
-		return err
+		if err != nil {
+			return err
+		}
+		topo, _ := bc.GetTopo(tx, bl.Height)
+		isMainchain = topo == hash
+		return nil
 	})
 	if err != nil {
-		Log.Warn("could not add block to chain:", err)
+		bc.log.Warn("could not add block to chain:", err)
+		if errors.Is(err, ErrMissingTx) {
+			// keep the block in queue, so it's requested again with its transactions
+			return
+		}
 		bc.BlockQueue.Update(func(qt *QueueTx) {
 			qt.RemoveBlock(bl.Height, hash)
 		})
 		return
 	} else {
+		if isMainchain {
+			go bc.relayBlock(bl, hash, pack.Conn)
+		}
+
 		// TODO: remove this, it's only for debug purposes
 		err := bc.DB.View(func(tx *bolt.Tx) error {
 			bc.CheckSupply(tx)
 			return nil
 		})
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 		}
 	}
 }
 
 func (bc *Blockchain) packetStats(pack p2p.Packet) {
-	st := packet.PacketStats{}
+	st := packet.PacketStatsProof{}
 
 	err := st.Deserialize(pack.Data)
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
+		return
+	}
+
+	bc.log.Dev("peer has stats", st.PacketStats)
+
+	// a peer could advertise a fake cumulative difficulty to make the node believe it's not synced, or to
+	// make it follow the peer; only stats backed by a valid top block are trusted
+	verified, err := bc.verifyStatsProof(st, pack.Conn)
+	if err != nil {
+		bc.log.Warn("ignoring peer stats:", err)
 		return
 	}
 
-	Log.Dev("peer has stats", st)
 	pack.Conn.PeerData(func(d *p2p.PeerData) {
-		d.Stats = st
+		d.Stats = st.PacketStats
+		d.StatsVerified = verified
 	})
 
 	bc.SyncMut.Lock()
-	if st.CumulativeDiff.Cmp(bc.SyncDiff) > 0 {
-		Log.Infof("New target: height %d, cumulative diff %s", st.Height, st.CumulativeDiff)
-		bc.SyncHeight = st.Height
-		bc.SyncDiff = st.CumulativeDiff
+	defer bc.SyncMut.Unlock()
+
+	target, ok := syncTarget(bc.peerStats(false))
+	if ok && target.CumulativeDiff.Cmp(bc.SyncDiff) > 0 {
+		bc.log.Infof("New target: height %d, cumulative diff %s", target.Height, target.CumulativeDiff)
+		bc.SyncHeight = target.Height
+		bc.SyncDiff = target.CumulativeDiff
+	}
+
+	// the cumulative difficulty of a top block with an unknown parent can't be checked, so those stats only
+	// make the node download the blocks up to their height: SyncDiff grows as the downloaded blocks are added
+	height, ok := syncHeight(bc.peerStats(true))
+	if ok && height > bc.SyncHeight {
+		bc.log.Infof("New target: height %d", height)
+		bc.SyncHeight = height
+	}
+}
+
+// verifyStatsProof checks that the top block sent with the stats matches them, and that the block is valid:
+// its PoW must meet its difficulty, and if its parent is known, its difficulty and cumulative difficulty must
+// be the expected ones. If the parent is unknown, the cumulative difficulty can't be checked, so false is
+// returned, and the difficulty must be at least the one of the block after the local top, so that a cheap
+// block can't advertise any height. Since the PoW hash is expensive, it's verified at most once every
+// P2P_STATS_PROOF_INTERVAL for each peer.
+func (bc *Blockchain) verifyStatsProof(st packet.PacketStatsProof, conn *p2p.Connection) (bool, error) {
+	if len(st.Tip) == 0 {
+		return false, errors.New("stats have no top block")
+	}
+	bl := &block.Block{}
+	err := bl.Deserialize(st.Tip)
+	if err != nil {
+		return false, fmt.Errorf("invalid top block: %w", err)
+	}
+	hash := bl.Hash()
+	if hash != st.Hash || bl.Height != st.Height || !bl.CumulativeDiff.Equals(st.CumulativeDiff) {
+		return false, fmt.Errorf("top block %d %x cumulative diff %s does not match stats %v", bl.Height, hash,
+			bl.CumulativeDiff, st.PacketStats)
+	}
+
+	var known, parentKnown bool
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		// blocks already in the database have been validated, unless they're orphans
+		if _, err := bc.GetBlockHeader(tx, hash); err == nil && bc.GetStats(tx).Orphans[hash] == nil {
+			known = true
+			return nil
+		}
+
+		prev, err := bc.GetBlock(tx, bl.PrevHash())
+		if err != nil {
+			// the parent is unknown, so the difficulty is compared with the local one
+			top, err := bc.GetBlock(tx, bc.GetStats(tx).TopHash)
+			if err != nil {
+				return err
+			}
+			diff, err := bc.GetNextDifficulty(tx, top)
+			if err != nil {
+				return err
+			}
+			if bl.Difficulty.Cmp(diff) < 0 {
+				return fmt.Errorf("top block with unknown parent has difficulty %s, lower than the local one %s",
+					bl.Difficulty, diff)
+			}
+			return nil
+		}
+		parentKnown = true
+		if bl.Height != prev.Height+1 {
+			return fmt.Errorf("top block has height %d, expected %d", bl.Height, prev.Height+1)
+		}
+		diff, err := bc.GetNextDifficulty(tx, prev)
+		if err != nil {
+			return err
+		}
+		if !bl.Difficulty.Equals(diff) {
+			return fmt.Errorf("top block has difficulty %s, expected %s", bl.Difficulty, diff)
+		}
+		cumDiff := bl.ExpectedCumulativeDiff(prev.CumulativeDiff)
+		if !bl.CumulativeDiff.Equals(cumDiff) {
+			return fmt.Errorf("top block has cumulative diff %s, expected %s", bl.CumulativeDiff, cumDiff)
+		}
+		return nil
+	})
+	if err != nil || known {
+		return known, err
+	}
+
+	now := time.Now().UnixMilli()
+	var limited bool
+	conn.PeerData(func(d *p2p.PeerData) {
+		limited = now-d.LastStatsProof < config.P2P_STATS_PROOF_INTERVAL*1000
+		if !limited {
+			d.LastStatsProof = now
+		}
+	})
+	if limited {
+		return false, errors.New("stats sent too often")
+	}
+
+	return parentKnown, bl.Prevalidate()
+}
+
+// peerStats returns the last stats advertised by each connected peer. The stats whose cumulative difficulty
+// couldn't be verified are only included if unverified is true.
+func (bc *Blockchain) peerStats(unverified bool) []packet.PacketStats {
+	peers := []packet.PacketStats{}
+	bc.P2P.RLock()
+	for _, conn := range bc.P2P.Connections {
+		conn.PeerData(func(d *p2p.PeerData) {
+			if d.StatsVerified || unverified {
+				peers = append(peers, d.Stats)
+			}
+		})
+	}
+	bc.P2P.RUnlock()
+	return peers
+}
+
+// IsSynced returns true if at least SYNCED_MIN_PEERS connected peers agree that the local top block is the
+// best one, and no better chain is advertised by a quorum of peers
+func (bc *Blockchain) IsSynced() bool {
+	var local, tolerance Uint128
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		top, err := bc.GetBlock(tx, stats.TopHash)
+		if err != nil {
+			return err
+		}
+		local = stats.CumulativeDiff
+		tolerance = top.Difficulty.Mul64(config.SYNCED_TOLERANCE_BLOCKS)
+		return nil
+	})
+	if err != nil {
+		bc.log.Err(err)
+		return false
+	}
+
+	return isSynced(local.Add(tolerance), bc.peerStats(false))
+}
+
+// isSynced returns true if at least SYNCED_MIN_PEERS peers have a cumulative difficulty not higher than
+// maxDiff, and the sync target isn't higher than maxDiff. Peers that didn't send their stats yet are ignored.
+func isSynced(maxDiff Uint128, peers []packet.PacketStats) bool {
+	agree := 0
+	for _, v := range peers {
+		if !v.CumulativeDiff.IsZero() && v.CumulativeDiff.Cmp(maxDiff) <= 0 {
+			agree++
+		}
+	}
+	if agree < config.SYNCED_MIN_PEERS {
+		return false
+	}
+
+	target, ok := syncTarget(peers)
+	return !ok || target.CumulativeDiff.Cmp(maxDiff) <= 0
+}
+
+// syncTarget returns the highest stats that are supported by at least SYNC_QUORUM_PEERS peers, that is
+// the stats of the SYNC_QUORUM_PEERS-th peer ordered by cumulative difficulty. If there are fewer peers than
+// that, the lowest of them is used. Peers which haven't sent their stats yet are ignored.
+func syncTarget(peers []packet.PacketStats) (packet.PacketStats, bool) {
+	peers = slices.DeleteFunc(slices.Clone(peers), func(s packet.PacketStats) bool {
+		return s.CumulativeDiff.IsZero()
+	})
+	if len(peers) == 0 {
+		return packet.PacketStats{}, false
 	}
-	bc.SyncMut.Unlock()
+
+	slices.SortFunc(peers, func(a, b packet.PacketStats) int {
+		return b.CumulativeDiff.Cmp(a.CumulativeDiff)
+	})
+
+	return peers[min(config.SYNC_QUORUM_PEERS, len(peers))-1], true
+}
+
+// syncHeight is like syncTarget, but it returns the highest height supported by at least SYNC_QUORUM_PEERS
+// peers, regardless of their cumulative difficulty
+func syncHeight(peers []packet.PacketStats) (uint64, bool) {
+	var heights []uint64
+	for _, v := range peers {
+		if !v.CumulativeDiff.IsZero() {
+			heights = append(heights, v.Height)
+		}
+	}
+	if len(heights) == 0 {
+		return 0, false
+	}
+
+	slices.Sort(heights)
+	slices.Reverse(heights)
+
+	return heights[min(config.SYNC_QUORUM_PEERS, len(heights))-1], true
 }
 
 func (bc *Blockchain) packetBlockRequest(pack p2p.Packet) {
@@ -163,11 +566,11 @@ func (bc *Blockchain) packetBlockRequest(pack p2p.Packet) {
 
 	err := st.Deserialize(pack.Data)
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
 		return
 	}
 
-	Log.Devf("received block request with height %d hash %x", st.Height, st.Hash)
+	bc.log.Devf("received block request with height %d hash %x", st.Height, st.Hash)
 
 	var bl *block.Block
 	err = bc.DB.View(func(tx *bolt.Tx) (err error) {
@@ -179,13 +582,13 @@ func (bc *Blockchain) packetBlockRequest(pack p2p.Packet) {
 		return
 	})
 	if err != nil {
-		Log.Debug("received invalid block request:", err)
+		bc.log.Debug("received invalid block request:", err)
 		return
 	}
 
 	d, err := bc.SerializeFullBlock(bl)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return
 	}
 
@@ -195,25 +598,102 @@ func (bc *Blockchain) packetBlockRequest(pack p2p.Packet) {
 	})
 }
 
-func (bc *Blockchain) SendStats(stats *Stats) {
-	for _, v := range bc.P2P.Connections {
-		v.SendPacket(&p2p.Packet{
+// statsSender makes sure that the stats are sent to the peers in the order they're set, although each of them
+// is sent by its own goroutine once committed: older stats are not sent after newer ones
+type statsSender struct {
+	seq  uint64 // sequence number of the last stats set
+	sent uint64 // sequence number of the last stats sent
+
+	// a plain sync.Mutex is used, since it's held while the stats are sent to all the peers, which would be
+	// reported as a deadlock by util.Mutex
+	sync.Mutex
+}
+
+// next returns the sequence number of new stats
+func (s *statsSender) next() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.seq++
+	return s.seq
+}
+
+// SendStats sends the latest committed stats to all the peers
+func (bc *Blockchain) SendStats() {
+	// the sequence number is read first, so that stats set meanwhile are never considered older than these
+	bc.statsSender.Lock()
+	seq := bc.statsSender.seq
+	bc.statsSender.Unlock()
+
+	var stats *Stats
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats = bc.GetStats(tx)
+		return nil
+	})
+	bc.sendStats(stats, seq)
+}
+
+// sendStats sends the stats with the given sequence number to all the peers, unless newer stats were sent
+func (bc *Blockchain) sendStats(stats *Stats, seq uint64) {
+	bc.statsSender.Lock()
+	defer bc.statsSender.Unlock()
+	if seq < bc.statsSender.sent {
+		return
+	}
+	bc.statsSender.sent = seq
+
+	var st packet.PacketStatsProof
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		st = bc.statsProof(tx, stats)
+		return nil
+	})
+	if err != nil {
+		bc.log.Warn(err)
+		return
+	}
+	data := st.Serialize()
+
+	// connections must not be locked while P2P is locked
+	bc.P2P.RLock()
+	conns := make([]*p2p.Connection, 0, len(bc.P2P.Connections))
+	for _, c := range bc.P2P.Connections {
+		conns = append(conns, c)
+	}
+	bc.P2P.RUnlock()
+
+	// the packets are queued in order on each connection
+	for _, c := range conns {
+		c.SendPacket(&p2p.Packet{
 			Type: packet.STATS,
-			Data: packet.PacketStats{
-				Height:         stats.TopHeight,
-				CumulativeDiff: stats.CumulativeDiff,
-				Hash:           stats.TopHash,
-			}.Serialize(),
+			Data: data,
 		})
 	}
 }
 
+// statsProof returns the stats packet for the given stats, including their top block as proof of work
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) statsProof(tx *bolt.Tx, stats *Stats) packet.PacketStatsProof {
+	st := packet.PacketStatsProof{
+		PacketStats: packet.PacketStats{
+			Height:         stats.TopHeight,
+			CumulativeDiff: stats.CumulativeDiff,
+			Hash:           stats.TopHash,
+		},
+	}
+	bl, err := bc.GetBlock(tx, stats.TopHash)
+	if err != nil {
+		bc.log.Warn("stats top block not found:", err)
+		return st
+	}
+	st.Tip = bl.Serialize()
+	return st
+}
+
 func (bc *Blockchain) BroadcastBlock(bl *block.Block) {
-	Log.Debug("broadcasting block")
+	bc.log.Debug("broadcasting block")
 
 	ser, err := bc.SerializeFullBlock(bl)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return
 	}
 
@@ -0,0 +1,585 @@
+package blockchain
+
+import (
+	"errors"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"still-blockchain/p2p/packet"
+	"still-blockchain/transaction"
+	"still-blockchain/util/uint128"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSyncTarget(t *testing.T) {
+	stats := func(height, diff uint64) packet.PacketStats {
+		return packet.PacketStats{
+			Height:         height,
+			CumulativeDiff: uint128.From64(diff),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		peers  []packet.PacketStats
+		target packet.PacketStats
+		ok     bool
+	}{
+		{"no peers", nil, packet.PacketStats{}, false},
+		{"no stats yet", []packet.PacketStats{{}, {}}, packet.PacketStats{}, false},
+		{"single peer", []packet.PacketStats{stats(100, 1000)}, stats(100, 1000), true},
+		{
+			"bogus peer",
+			[]packet.PacketStats{stats(100, 1000), stats(1<<60, 1<<62), stats(101, 1010), stats(99, 990)},
+			stats(101, 1010),
+			true,
+		},
+		{
+			"agreeing peers",
+			[]packet.PacketStats{stats(101, 1010), stats(100, 1000), stats(101, 1010), {}},
+			stats(101, 1010),
+			true,
+		},
+	}
+
+	for _, v := range tests {
+		target, ok := syncTarget(v.peers)
+		if ok != v.ok || target != v.target {
+			t.Errorf("%s: got target %v %v, expected %v %v", v.name, target, ok, v.target, v.ok)
+		}
+	}
+}
+
+func TestTxInventory(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	tx := newTestTx(t, pk, 1, config.COIN)
+	known := tx.Hash()
+	unknown := blake3.Sum256([]byte("unknown"))
+
+	err := bc.DB.Update(func(txn *bolt.Tx) error {
+		return bc.SetTx(txn, tx, known, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, peer := addTestPeer(t, bc, "127.0.0.1:1")
+
+	receive := func() (testPeerPacket, bool) {
+		select {
+		case pk := <-peer:
+			return pk, true
+		case <-time.After(200 * time.Millisecond):
+			return testPeerPacket{}, false
+		}
+	}
+
+	// a known transaction is not requested again
+	bc.packetInv(p2p.Packet{
+		Type: packet.INV,
+		Data: packet.PacketInv{Hashes: [][32]byte{known}}.Serialize(),
+		Conn: conn,
+	})
+	if pk, ok := receive(); ok {
+		t.Fatalf("peer received packet of type %d after announcing a known transaction", pk.Type)
+	}
+
+	// only the unknown transaction is requested
+	bc.packetInv(p2p.Packet{
+		Type: packet.INV,
+		Data: packet.PacketInv{Hashes: [][32]byte{known, unknown, unknown}}.Serialize(),
+		Conn: conn,
+	})
+	pk1, ok := receive()
+	if !ok {
+		t.Fatal("unknown transaction was not requested")
+	}
+	if pk1.Type != uint16(packet.TX_REQUEST)+2 {
+		t.Fatalf("peer received packet type %d, expected TX_REQUEST", pk1.Type)
+	}
+	req := packet.PacketInv{}
+	if err := req.Deserialize(pk1.Data); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Hashes) != 1 || req.Hashes[0] != unknown {
+		t.Fatalf("unexpected requested hashes %x", req.Hashes)
+	}
+
+	// requests are answered with the known transactions
+	bc.packetTxRequest(p2p.Packet{
+		Type: packet.TX_REQUEST,
+		Data: packet.PacketInv{Hashes: [][32]byte{unknown, known}}.Serialize(),
+		Conn: conn,
+	})
+	pk2, ok := receive()
+	if !ok {
+		t.Fatal("requested transaction was not sent")
+	}
+	if pk2.Type != uint16(packet.TX)+2 {
+		t.Fatalf("peer received packet type %d, expected TX", pk2.Type)
+	}
+	sent := &transaction.Transaction{}
+	if err := sent.Deserialize(pk2.Data); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Hash() != known {
+		t.Fatalf("peer received transaction %x, expected %x", sent.Hash(), known)
+	}
+	if pk, ok := receive(); ok {
+		t.Fatalf("peer received unexpected packet of type %d", pk.Type)
+	}
+}
+
+func TestTxRequests(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+	tx := newTestTx(t, pk, 1, config.COIN)
+	hash := tx.Hash()
+
+	conn1, peer1 := addTestPeer(t, bc, "127.0.0.1:1")
+	conn2, peer2 := addTestPeer(t, bc, "127.0.0.1:2")
+	receive := func(peer <-chan testPeerPacket) (testPeerPacket, bool) {
+		select {
+		case pk := <-peer:
+			return pk, true
+		case <-time.After(200 * time.Millisecond):
+			return testPeerPacket{}, false
+		}
+	}
+	inMempool := func() bool {
+		var found bool
+		bc.DB.View(func(txn *bolt.Tx) error {
+			found = bc.GetMempool(txn).GetEntry(hash) != nil
+			return nil
+		})
+		return found
+	}
+	announce := func(conn *p2p.Connection) {
+		bc.packetInv(p2p.Packet{
+			Type: packet.INV,
+			Data: packet.PacketInv{Hashes: [][32]byte{hash}}.Serialize(),
+			Conn: conn,
+		})
+	}
+	push := func(conn *p2p.Connection) {
+		bc.packetTx(p2p.Packet{
+			Type: packet.TX,
+			Data: tx.Serialize(),
+			Conn: conn,
+		})
+	}
+
+	// a transaction that wasn't requested is ignored
+	push(conn1)
+	if inMempool() {
+		t.Fatal("unsolicited transaction was added to mempool")
+	}
+
+	// a transaction announced by two peers is only requested to the first one
+	announce(conn1)
+	announce(conn2)
+	if pk, ok := receive(peer1); !ok || pk.Type != uint16(packet.TX_REQUEST)+2 {
+		t.Fatal("the transaction was not requested to the first peer")
+	}
+	if pk, ok := receive(peer2); ok {
+		t.Fatalf("second peer received packet of type %d", pk.Type)
+	}
+
+	// only the peer the transaction was requested to can send it
+	push(conn2)
+	if inMempool() {
+		t.Fatal("transaction requested to another peer was added to mempool")
+	}
+	push(conn1)
+	if !inMempool() {
+		t.Fatal("requested transaction was not added to mempool")
+	}
+
+	// the transaction is announced to the peers once committed, and only then
+	for _, peer := range []<-chan testPeerPacket{peer1, peer2} {
+		if pk, ok := receive(peer); !ok || pk.Type != uint16(packet.INV)+2 {
+			t.Fatal("the added transaction was not announced")
+		}
+	}
+	tx2 := newTestTx(t, pk, 2, config.COIN)
+	errRollback := errors.New("rollback")
+	err := bc.DB.Update(func(txn *bolt.Tx) error {
+		if err := bc.AddTransaction(txn, tx2, tx2.Hash(), true); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+	if pk, ok := receive(peer1); ok {
+		t.Fatalf("peer received packet of type %d for a rolled back transaction", pk.Type)
+	}
+}
+
+func TestIsSynced(t *testing.T) {
+	bc := newTestBlockchain(t)
+	addTestBlocks(t, bc, newTestChain(t, nil, 2)...)
+
+	var local packet.PacketStats
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		local = packet.PacketStats{
+			Height:         stats.TopHeight,
+			CumulativeDiff: stats.CumulativeDiff,
+			Hash:           stats.TopHash,
+		}
+		return nil
+	})
+
+	addPeer := func(ipPort string, stats packet.PacketStats) {
+		conn, _ := addTestPeer(t, bc, ipPort)
+		conn.PeerData(func(d *p2p.PeerData) {
+			d.Stats = stats
+			d.StatsVerified = true
+		})
+	}
+
+	if bc.IsSynced() {
+		t.Fatal("node without peers is synced")
+	}
+
+	// a single peer at the same height isn't enough
+	addPeer("127.0.0.1:1", local)
+	if config.SYNCED_MIN_PEERS > 1 && bc.IsSynced() {
+		t.Fatalf("node with 1 peer is synced, %d peers are required", config.SYNCED_MIN_PEERS)
+	}
+
+	for i := 2; i <= config.SYNCED_MIN_PEERS; i++ {
+		addPeer("127.0.0.1:"+strconv.Itoa(i), local)
+	}
+	if !bc.IsSynced() {
+		t.Fatalf("node with %d agreeing peers is not synced", config.SYNCED_MIN_PEERS)
+	}
+
+	// a quorum of peers advertising a better chain makes the node not synced
+	better := local
+	better.Height += 100
+	better.CumulativeDiff = local.CumulativeDiff.Mul64(100)
+	for i := 0; i < config.SYNC_QUORUM_PEERS; i++ {
+		addPeer("127.0.0.2:"+strconv.Itoa(i), better)
+	}
+	if bc.IsSynced() {
+		t.Fatal("node is synced while peers advertise a better chain")
+	}
+}
+
+func TestStatsProof(t *testing.T) {
+	skipTestPoW(t)
+	bc := newTestBlockchain(t)
+	blocks := newTestChain(t, nil, 3)
+	addTestBlocks(t, bc, blocks[:2]...)
+	tip := blocks[2]
+
+	conn, _ := addTestPeer(t, bc, "127.0.0.1:1")
+	send := func(st packet.PacketStatsProof) {
+		bc.packetStats(p2p.Packet{
+			Type: packet.STATS,
+			Data: st.Serialize(),
+			Conn: conn,
+		})
+	}
+	proof := func(bl *block.Block) packet.PacketStatsProof {
+		return packet.PacketStatsProof{
+			PacketStats: packet.PacketStats{
+				Height:         bl.Height,
+				CumulativeDiff: bl.CumulativeDiff,
+				Hash:           bl.Hash(),
+			},
+			Tip: bl.Serialize(),
+		}
+	}
+	checkPeer := func(msg string, expected packet.PacketStats) {
+		t.Helper()
+		conn.PeerData(func(d *p2p.PeerData) {
+			if d.Stats != expected {
+				t.Fatalf("%s: peer has stats %v, expected %v", msg, d.Stats, expected)
+			}
+		})
+	}
+	syncDiff := bc.SyncDiff
+	checkSyncDiff := func(msg string, expected uint128.Uint128) {
+		t.Helper()
+		bc.SyncMut.Lock()
+		defer bc.SyncMut.Unlock()
+		if !bc.SyncDiff.Equals(expected) {
+			t.Fatalf("%s: sync diff is %s, expected %s", msg, bc.SyncDiff, expected)
+		}
+	}
+	allowProof := func() {
+		conn.PeerData(func(d *p2p.PeerData) {
+			d.LastStatsProof -= config.P2P_STATS_PROOF_INTERVAL * 1000
+		})
+	}
+	highDiff := tip.CumulativeDiff.Mul64(1000)
+
+	// stats without a top block are ignored
+	noTip := proof(tip)
+	noTip.CumulativeDiff = highDiff
+	noTip.Tip = nil
+	send(noTip)
+	checkPeer("stats without top block", packet.PacketStats{})
+	checkSyncDiff("stats without top block", syncDiff)
+
+	// the advertised cumulative diff must be the one of the top block
+	mismatch := proof(tip)
+	mismatch.CumulativeDiff = highDiff
+	send(mismatch)
+	checkPeer("stats not matching the top block", packet.PacketStats{})
+	checkSyncDiff("stats not matching the top block", syncDiff)
+
+	// a top block claiming a higher difficulty than the expected one is invalid
+	forged := *tip
+	forged.Difficulty = tip.Difficulty.Mul64(1000)
+	forged.CumulativeDiff = highDiff
+	send(proof(&forged))
+	checkPeer("forged top block", packet.PacketStats{})
+	checkSyncDiff("forged top block", syncDiff)
+
+	// a cheap top block with an unknown parent is not trusted: the second block of another chain has the
+	// minimum difficulty, below the one of the next local block. The difficulty is constant on regtest.
+	other := newTestChain(t, nil, 2)
+	if other[0].Hash() == blocks[0].Hash() {
+		t.Fatal("the other chain is the same as the local one")
+	}
+	var nextDiff uint128.Uint128
+	bc.DB.View(func(tx *bolt.Tx) (err error) {
+		nextDiff, err = bc.GetNextDifficulty(tx, blocks[1])
+		return
+	})
+	if !config.IS_REGTEST {
+		if other[1].Difficulty.Cmp(nextDiff) >= 0 {
+			t.Fatalf("other chain has difficulty %s, not lower than %s", other[1].Difficulty, nextDiff)
+		}
+		unknownParent := *other[1]
+		unknownParent.CumulativeDiff = highDiff
+		send(proof(&unknownParent))
+		checkPeer("top block with unknown parent", packet.PacketStats{})
+		checkSyncDiff("top block with unknown parent", syncDiff)
+	}
+
+	// the cumulative difficulty of a top block with an unknown parent can't be verified, so it only raises the
+	// sync height: the node downloads the blocks, and trusts their cumulative difficulty once they're added
+	unverified := *other[1]
+	unverified.Height = 50
+	unverified.Difficulty = nextDiff
+	unverified.CumulativeDiff = highDiff
+	send(proof(&unverified))
+	checkPeer("unverified stats", proof(&unverified).PacketStats)
+	checkSyncDiff("unverified stats", syncDiff)
+	bc.SyncMut.Lock()
+	if bc.SyncHeight != unverified.Height {
+		t.Errorf("unverified stats: sync height is %d, expected %d", bc.SyncHeight, unverified.Height)
+	}
+	bc.SyncMut.Unlock()
+	if bc.IsSynced() {
+		t.Error("unverified stats: the node is synced")
+	}
+	allowProof()
+
+	// valid stats are trusted
+	valid := proof(tip)
+	send(valid)
+	checkPeer("valid stats", valid.PacketStats)
+	checkSyncDiff("valid stats", tip.CumulativeDiff)
+
+	// the PoW of the stats of a peer is verified at most once every P2P_STATS_PROOF_INTERVAL
+	conn.PeerData(func(d *p2p.PeerData) {
+		d.Stats = packet.PacketStats{}
+	})
+	send(valid)
+	checkPeer("stats sent too often", packet.PacketStats{})
+	allowProof()
+	send(valid)
+	checkPeer("stats after the interval", valid.PacketStats)
+}
+
+func TestSendStatsOrder(t *testing.T) {
+	bc := newTestBlockchain(t)
+	_, packets := addTestPeer(t, bc, "127.0.0.1:1")
+
+	// the stats of each block are sent by their own goroutine once committed
+	blocks := newTestChain(t, nil, 2)
+	addTestBlocks(t, bc, blocks...)
+
+	// stats older than the last ones sent are dropped, while the periodic stats are the latest ones
+	time.Sleep(100 * time.Millisecond)
+	older := &Stats{
+		TopHeight:      blocks[0].Height,
+		TopHash:        blocks[0].Hash(),
+		CumulativeDiff: blocks[0].CumulativeDiff,
+	}
+	bc.sendStats(older, 1)
+	bc.SendStats()
+
+	var heights []uint64
+	for {
+		var pk testPeerPacket
+		select {
+		case pk = <-packets:
+		case <-time.After(300 * time.Millisecond):
+		}
+		if pk.Data == nil {
+			break
+		}
+		st := packet.PacketStatsProof{}
+		if err := st.Deserialize(pk.Data); err != nil {
+			t.Fatal(err)
+		}
+		heights = append(heights, st.Height)
+	}
+	if len(heights) == 0 || !slices.IsSorted(heights) || heights[len(heights)-1] != blocks[1].Height {
+		t.Fatalf("stats sent with heights %v, expected increasing heights up to %d", heights, blocks[1].Height)
+	}
+}
+
+func TestBlockRelay(t *testing.T) {
+	bc := newTestBlockchain(t)
+	if n := bc.SetBlockFanout(2); n != 2 {
+		t.Fatalf("fanout set to %d, expected 2", n)
+	}
+
+	bl := newTestChain(t, nil, 1)[0]
+	data, err := bc.SerializeFullBlock(bl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, sourcePackets := addTestPeer(t, bc, "127.0.0.1:1")
+	peers := []<-chan testPeerPacket{sourcePackets}
+	for i := 2; i <= 5; i++ {
+		_, packets := addTestPeer(t, bc, "127.0.0.1:"+strconv.Itoa(i))
+		peers = append(peers, packets)
+	}
+
+	// the same block is received twice, and relayed again directly
+	for i := 0; i < 2; i++ {
+		bc.packetBlock(p2p.Packet{
+			Type: packet.BLOCK,
+			Data: data,
+			Conn: source,
+		})
+	}
+	bc.relayBlock(bl, bl.Hash(), source)
+
+	// counts the blocks received by each peer, until no packet is received for a while
+	relayed := make([]int, len(peers))
+	for i, packets := range peers {
+		for {
+			var pk testPeerPacket
+			select {
+			case pk = <-packets:
+			case <-time.After(300 * time.Millisecond):
+			}
+			if pk.Data == nil {
+				break
+			}
+			if pk.Type == uint16(packet.BLOCK)+2 {
+				relayed[i]++
+			}
+		}
+	}
+
+	if relayed[0] != 0 {
+		t.Fatalf("block was relayed back to the peer it was received from")
+	}
+	total := 0
+	for i, n := range relayed {
+		if n > 1 {
+			t.Fatalf("peer %d received the block %d times", i, n)
+		}
+		total += n
+	}
+	if total != 2 {
+		t.Fatalf("block was relayed to %d peers, expected the fanout 2", total)
+	}
+}
+
+func TestBlockResponseHeight(t *testing.T) {
+	bc := newTestBlockchain(t)
+	chain := newTestChain(t, nil, 3)
+
+	source, packets := addTestPeer(t, bc, "127.0.0.1:1")
+	source.PeerData(func(d *p2p.PeerData) {
+		d.Stats.Height = 10
+		recordBlockRequest(d, packet.PacketBlockRequest{Height: 3})
+		recordBlockRequest(d, packet.PacketBlockRequest{Hash: chain[1].Hash()})
+	})
+
+	source.PeerData(func(d *p2p.PeerData) {
+		// the block requested by hash is expected
+		if err := checkBlockResponse(d, chain[1], chain[1].Hash()); err != nil {
+			t.Errorf("block requested by hash: %v", err)
+		}
+
+		// a block requested by height is expected, but not above the height advertised by the peer
+		d.Stats.Height = 2
+		if err := checkBlockResponse(d, chain[2], chain[2].Hash()); !errors.Is(err, ErrUnexpectedBlock) {
+			t.Errorf("block above the advertised height: got %v, expected %v", err, ErrUnexpectedBlock)
+		}
+		d.Stats.Height = 10
+
+		// unrequested blocks below the advertised height aren't accepted while a height request is pending
+		recordBlockRequest(d, packet.PacketBlockRequest{Height: 3})
+		if err := checkBlockResponse(d, chain[0], chain[0].Hash()); !errors.Is(err, ErrUnrequestedBlock) {
+			t.Errorf("unrequested block: got %v, expected %v", err, ErrUnrequestedBlock)
+		}
+		delete(d.Requests, packet.PacketBlockRequest{Height: 3})
+
+		// relayed blocks are accepted when the peer has no height requests to answer
+		if err := checkBlockResponse(d, chain[0], chain[0].Hash()); err != nil {
+			t.Errorf("relayed block: %v", err)
+		}
+	})
+
+	// the peer answers the request of height 3 with the block at height 1
+	source.PeerData(func(d *p2p.PeerData) {
+		recordBlockRequest(d, packet.PacketBlockRequest{Height: 3})
+	})
+	data, err := bc.SerializeFullBlock(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.packetBlock(p2p.Packet{
+		Type: packet.BLOCK,
+		Data: data,
+		Conn: source,
+	})
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if _, err := bc.GetBlock(tx, chain[0].Hash()); err == nil {
+			t.Error("block with a mismatched height was added")
+		}
+		return nil
+	})
+
+	// the block is dropped, but the peer may have relayed it, so it stays connected
+	for {
+		select {
+		case _, ok := <-packets:
+			if !ok {
+				t.Fatal("peer which sent an unrequested block was disconnected")
+			}
+		case <-time.After(time.Second):
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package blockchain
+
+import (
+	"math"
+	"slices"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"still-blockchain/p2p/packet"
+	"still-blockchain/util"
+	"time"
+)
+
+// peerTime collects the clock offsets of the peers, measured from the TIME packet they send when connecting.
+// Their median is used, so that a few peers with a wrong clock don't affect it.
+type peerTime struct {
+	util.Mutex
+
+	offsets []peerOffset // least recent first
+	skewed  bool         // the operator has been warned that the local clock is skewed
+}
+
+type peerOffset struct {
+	peer   string
+	offset time.Duration // peer clock minus local clock
+}
+
+// add records the clock offset of a peer, replacing its previous one, and returns the median offset of the
+// peers and the number of peers it's computed from
+func (p *peerTime) add(peer string, offset time.Duration) (time.Duration, int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.offsets = slices.DeleteFunc(p.offsets, func(o peerOffset) bool {
+		return o.peer == peer
+	})
+	if len(p.offsets) >= config.PEER_TIME_SAMPLES {
+		p.offsets = slices.Delete(p.offsets, 0, 1)
+	}
+	p.offsets = append(p.offsets, peerOffset{peer, offset})
+
+	sorted := make([]time.Duration, len(p.offsets))
+	for i, v := range p.offsets {
+		sorted[i] = v.offset
+	}
+	slices.Sort(sorted)
+
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2, n
+	}
+	return sorted[n/2], n
+}
+
+// addPeerTime records the clock offset of a peer. When enough peers are known, the operator is warned if their
+// median offset exceeds MaxClockSkew, and if UsePeerTime is set the median offset corrects the time used to
+// check block timestamps. It returns true if the warning has been logged.
+func (bc *Blockchain) addPeerTime(peer string, offset time.Duration) bool {
+	median, n := bc.peerTime.add(peer, offset)
+	if n < config.PEER_TIME_MIN_SAMPLES {
+		return false
+	}
+
+	if bc.UsePeerTime {
+		if median.Abs() <= config.MAX_PEER_TIME_ADJUSTMENT {
+			util.SetTimeOffset(median.Milliseconds())
+		} else {
+			// the peers can't be trusted to correct the clock by this much
+			util.SetTimeOffset(0)
+		}
+	}
+
+	skewed := median.Abs() > bc.MaxClockSkew
+
+	bc.peerTime.Lock()
+	changed := skewed != bc.peerTime.skewed
+	bc.peerTime.skewed = skewed
+	bc.peerTime.Unlock()
+
+	if !changed {
+		return false
+	}
+	if !skewed {
+		bc.log.Infof("Local clock agrees with the median time of %d peers again", n)
+		return false
+	}
+	if median > 0 {
+		bc.log.Warnf("Local clock is %v behind the median time of %d peers, check that the system clock is "+
+			"synchronized", median.Round(time.Millisecond), n)
+	} else {
+		bc.log.Warnf("Local clock is %v ahead of the median time of %d peers, check that the system clock is "+
+			"synchronized", (-median).Round(time.Millisecond), n)
+	}
+	return true
+}
+
+func (bc *Blockchain) packetTime(pack p2p.Packet) {
+	st := packet.PacketTime{}
+	err := st.Deserialize(pack.Data)
+	if err != nil {
+		bc.log.Warn(err)
+		return
+	}
+	if st.Time > math.MaxInt64/uint64(time.Millisecond) {
+		bc.log.Warnf("invalid peer time %d", st.Time)
+		return
+	}
+
+	var ip string
+	pack.Conn.View(func(c *p2p.ConnData) error {
+		ip = c.IP()
+		return nil
+	})
+
+	// the time the packet was read is used, since it may have waited for other packets to be handled
+	offset := time.Duration(int64(st.Time)-pack.Received.UnixMilli()) * time.Millisecond
+	bc.log.Debugf("peer %s clock offset: %v", ip, offset)
+	bc.addPeerTime(ip, offset)
+}
@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"fmt"
+	"still-blockchain/config"
+	"still-blockchain/util"
+	"testing"
+	"time"
+)
+
+func TestPeerTimeSkew(t *testing.T) {
+	bc := newTestBlockchain(t)
+	bc.MaxClockSkew = 5 * time.Second
+
+	// the peers agree that the local clock is one minute behind
+	for i := 0; i < config.PEER_TIME_MIN_SAMPLES-1; i++ {
+		if bc.addPeerTime(fmt.Sprintf("10.0.0.%d", i), time.Minute) {
+			t.Fatalf("warning logged with only %d peers", i+1)
+		}
+	}
+	if !bc.addPeerTime("10.0.0.100", time.Minute+time.Second) {
+		t.Fatal("large median offset doesn't trigger the warning")
+	}
+	// the warning is logged once
+	if bc.addPeerTime("10.0.0.101", time.Minute) {
+		t.Fatal("warning logged again")
+	}
+
+	// a single peer with a wrong clock doesn't trigger the warning
+	bc = newTestBlockchain(t)
+	bc.MaxClockSkew = 5 * time.Second
+	for i := 0; i < config.PEER_TIME_MIN_SAMPLES; i++ {
+		offset := time.Duration(i) * 100 * time.Millisecond
+		if i == 0 {
+			offset = -time.Hour
+		}
+		if bc.addPeerTime(fmt.Sprintf("10.0.0.%d", i), offset) {
+			t.Fatal("warning logged because of a single peer")
+		}
+	}
+
+	// the offset of a peer replaces its previous one
+	for i := 0; i < config.PEER_TIME_MIN_SAMPLES; i++ {
+		bc.addPeerTime("10.0.0.1", time.Hour)
+	}
+	if median, n := bc.peerTime.add("10.0.0.1", time.Hour); n != config.PEER_TIME_MIN_SAMPLES ||
+		median != 300*time.Millisecond {
+		t.Fatalf("median offset is %v of %d peers, expected 300ms of %d", median, n, config.PEER_TIME_MIN_SAMPLES)
+	}
+}
+
+func TestUsePeerTime(t *testing.T) {
+	defer util.SetTimeOffset(0)
+
+	bc := newTestBlockchain(t)
+	bc.MaxClockSkew = 5 * time.Second
+	bc.UsePeerTime = true
+
+	for i := 0; i < config.PEER_TIME_MIN_SAMPLES; i++ {
+		bc.addPeerTime(fmt.Sprintf("10.0.0.%d", i), 20*time.Second)
+	}
+	if diff := int64(util.AdjustedTime()) - int64(util.Time()); diff < 19_000 || diff > 21_000 {
+		t.Fatalf("adjusted time differs by %d ms from the local time, expected 20000", diff)
+	}
+
+	// the peers can't move the clock by more than MAX_PEER_TIME_ADJUSTMENT
+	for i := 0; i < config.PEER_TIME_MIN_SAMPLES; i++ {
+		bc.addPeerTime(fmt.Sprintf("10.0.0.%d", i), config.MAX_PEER_TIME_ADJUSTMENT+time.Minute)
+	}
+	if diff := int64(util.AdjustedTime()) - int64(util.Time()); diff < -1000 || diff > 1000 {
+		t.Fatalf("adjusted time differs by %d ms from the local time, expected 0", diff)
+	}
+}
@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"still-blockchain/config"
+	"still-blockchain/util"
+	"time"
+)
+
+// propagationStats tracks when blocks are first seen, to measure how long blocks take to reach this node
+// and how many of them end up outside the mainchain. It's not consensus data, so it's only kept in memory.
+type propagationStats struct {
+	util.Mutex
+
+	firstSeen map[[32]byte]time.Time
+
+	avgDelay  float64 // moving average of the propagation delay, in seconds
+	staleRate float64 // moving average of the fraction of blocks that are not added to mainchain
+	samples   uint64  // number of delay samples
+	blocks    uint64  // number of blocks classified as mainchain or stale
+}
+
+// max number of blocks whose first-seen time is kept
+const maxFirstSeen = 1000
+
+// ema updates a moving average with the given sample. The first sample initializes the average.
+func ema(avg, sample float64, n uint64) float64 {
+	if n == 0 {
+		return sample
+	}
+	const alpha = 1.0 / config.PROPAGATION_SAMPLES
+	return avg + alpha*(sample-avg)
+}
+
+// seen records the first time a block is received from the network
+func (p *propagationStats) seen(hash [32]byte, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.firstSeen == nil {
+		p.firstSeen = make(map[[32]byte]time.Time)
+	}
+	if _, ok := p.firstSeen[hash]; ok {
+		return
+	}
+	if len(p.firstSeen) >= maxFirstSeen {
+		// forget blocks which were never added, like invalid ones
+		for k, v := range p.firstSeen {
+			if now.Sub(v) > config.PROPAGATION_MAX_DELAY {
+				delete(p.firstSeen, k)
+			}
+		}
+		if len(p.firstSeen) >= maxFirstSeen {
+			return
+		}
+	}
+	p.firstSeen[hash] = now
+}
+
+// mainchain records that a block has been added to mainchain. timestamp is the block timestamp in UNIX
+// milliseconds.
+func (p *propagationStats) mainchain(hash [32]byte, timestamp uint64) {
+	p.added(hash, timestamp, false)
+}
+
+// stale records that a block has been added as an altchain or orphan block
+func (p *propagationStats) stale(hash [32]byte, timestamp uint64) {
+	p.added(hash, timestamp, true)
+}
+
+// Blocks seen too long after their timestamp are being synchronized, not propagated, so they are ignored.
+// Blocks that were never seen from the network (like the ones mined by this node) only count for the stale
+// rate.
+func (p *propagationStats) added(hash [32]byte, timestamp uint64, isStale bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	seen, ok := p.firstSeen[hash]
+	if ok {
+		delete(p.firstSeen, hash)
+
+		delay := seen.Sub(time.UnixMilli(int64(timestamp)))
+		if delay < 0 {
+			delay = 0
+		}
+		if delay > config.PROPAGATION_MAX_DELAY {
+			return
+		}
+		if !isStale {
+			p.avgDelay = ema(p.avgDelay, delay.Seconds(), p.samples)
+			p.samples++
+		}
+	}
+
+	var sample float64
+	if isStale {
+		sample = 1
+	}
+	p.staleRate = ema(p.staleRate, sample, p.blocks)
+	p.blocks++
+}
+
+// AvgDelay returns the moving average of the block propagation delay
+func (p *propagationStats) AvgDelay() time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	return time.Duration(p.avgDelay * float64(time.Second))
+}
+
+// StaleRate returns the moving average of the fraction of blocks which are not added to mainchain
+func (p *propagationStats) StaleRate() float64 {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.staleRate
+}
+
+// PropagationStats returns the moving averages of the block propagation delay and of the fraction of blocks
+// added as altchain or orphan blocks
+func (bc *Blockchain) PropagationStats() (time.Duration, float64) {
+	return bc.propagation.AvgDelay(), bc.propagation.StaleRate()
+}
@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"math"
+	"still-blockchain/config"
+	"testing"
+	"time"
+)
+
+func TestPropagationStats(t *testing.T) {
+	p := &propagationStats{}
+
+	base := time.UnixMilli(1_700_000_000_000)
+	delays := []time.Duration{2 * time.Second, 4 * time.Second, 500 * time.Millisecond}
+
+	// compute the expected moving average
+	const alpha = 1.0 / config.PROPAGATION_SAMPLES
+	var expected float64
+	for i, d := range delays {
+		hash := [32]byte{byte(i)}
+		timestamp := base.Add(time.Duration(i) * time.Minute)
+
+		p.seen(hash, timestamp.Add(d))
+		// the first time is kept if the block is received again
+		p.seen(hash, timestamp.Add(d+time.Second))
+		p.mainchain(hash, uint64(timestamp.UnixMilli()))
+
+		if i == 0 {
+			expected = d.Seconds()
+		} else {
+			expected += alpha * (d.Seconds() - expected)
+		}
+	}
+	if got := p.AvgDelay().Seconds(); math.Abs(got-expected) > 1e-6 {
+		t.Fatalf("average delay is %f, expected %f", got, expected)
+	}
+
+	// blocks received long after their timestamp are being synchronized, and don't count
+	old := [32]byte{0xff}
+	p.seen(old, base.Add(config.PROPAGATION_MAX_DELAY+time.Hour))
+	p.mainchain(old, uint64(base.UnixMilli()))
+	if got := p.AvgDelay().Seconds(); math.Abs(got-expected) > 1e-6 {
+		t.Fatalf("synchronized block changed the average delay to %f", got)
+	}
+
+	if rate := p.StaleRate(); rate != 0 {
+		t.Fatalf("stale rate is %f, expected 0", rate)
+	}
+
+	// an altchain block is stale, and doesn't change the delay
+	stale := [32]byte{0xfe}
+	p.seen(stale, base.Add(time.Second))
+	p.stale(stale, uint64(base.UnixMilli()))
+	if rate := p.StaleRate(); math.Abs(rate-alpha) > 1e-9 {
+		t.Fatalf("stale rate is %f, expected %f", rate, alpha)
+	}
+	if got := p.AvgDelay().Seconds(); math.Abs(got-expected) > 1e-6 {
+		t.Fatalf("stale block changed the average delay to %f", got)
+	}
+	if len(p.firstSeen) != 0 {
+		t.Fatalf("%d first-seen times were not removed", len(p.firstSeen))
+	}
+}
@@ -0,0 +1,66 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/transaction"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrNotRegtest = errors.New("blocks can only be generated on regtest")
+
+// GenerateBlock builds a block on top of the mainchain which pays the reward to recipient and includes the
+// given transactions, and adds it to the blockchain. The transactions must be already known, for example
+// submitted to the mempool, and can be in any order. It only works on regtest, where blocks don't need a
+// valid PoW.
+func (bc *Blockchain) GenerateBlock(recipient address.Address, txids []transaction.TXID) (*block.Block, error) {
+	if !config.IS_REGTEST {
+		return nil, ErrNotRegtest
+	}
+	err := bc.beginBlock()
+	if err != nil {
+		return nil, err
+	}
+	defer bc.endBlock()
+
+	var bl *block.Block
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		bl, _, err = bc.GetBlockTemplate(tx, recipient)
+		if err != nil {
+			return err
+		}
+
+		// the transactions must be sorted like in every other block
+		btx := tx.Bucket([]byte{buck.TX})
+		txs := make(map[transaction.TXID]*transaction.Transaction, len(txids))
+		for _, txid := range txids {
+			t, _, err := bc.buckGetTx(btx, txid)
+			if err != nil {
+				return fmt.Errorf("transaction %x: %w", txid, err)
+			}
+			txs[txid] = t
+		}
+		bl.Transactions = slices.Clone(txids)
+		slices.SortFunc(bl.Transactions, func(a, b transaction.TXID) int {
+			return compareTxOrder(txs[a], txs[b])
+		})
+
+		err = bl.Prevalidate()
+		if err != nil {
+			return err
+		}
+		_, err = bc.AddBlock(tx, bl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"errors"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/transaction"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestGenerateBlock(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+
+	if !config.IS_REGTEST {
+		if _, err := bc.GenerateBlock(sender, nil); !errors.Is(err, ErrNotRegtest) {
+			t.Fatalf("got error %v, expected %v", err, ErrNotRegtest)
+		}
+		t.Skip("generating blocks requires the regtest build tag")
+	}
+
+	// the sender mines the blocks, and spends some of the reward in block 3
+	var blocks []*block.Block
+	for i := 1; i <= 3; i++ {
+		var txids []transaction.TXID
+		if i == 3 {
+			txid, err := bc.SubmitTx(newTestTx(t, pk, 1, config.COIN))
+			if err != nil {
+				t.Fatal(err)
+			}
+			txids = append(txids, txid)
+		}
+		bl, err := bc.GenerateBlock(sender, txids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bl.Height != uint64(i) || bl.Difficulty.Cmp64(config.MIN_DIFFICULTY) != 0 {
+			t.Fatalf("generated block %d has height %d and difficulty %s", i, bl.Height, bl.Difficulty)
+		}
+		blocks = append(blocks, bl)
+	}
+
+	fee := newTestTx(t, pk, 1, config.COIN).Fee
+	var expected uint64
+	for _, bl := range blocks {
+		reward := bl.Reward()
+		if len(bl.Transactions) > 0 {
+			reward += fee
+		}
+		miner, _, err := block.SplitReward(reward, config.BLOCK_REWARD_FEE_PERCENT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected += miner
+	}
+	expected -= config.COIN + fee
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if top := bc.GetStats(tx).TopHash; top != blocks[2].Hash() {
+			t.Errorf("top block is %x, expected %x", top, blocks[2].Hash())
+		}
+		state, err := bc.GetState(tx, sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Balance != expected || state.LastNonce != 1 {
+			t.Errorf("sender has balance %d and nonce %d, expected %d and 1", state.Balance, state.LastNonce,
+				expected)
+		}
+		recipient := newTestTx(t, pk, 1, config.COIN).Recipient
+		state, err = bc.GetState(tx, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Balance != config.COIN {
+			t.Errorf("recipient has balance %d, expected %d", state.Balance, config.COIN)
+		}
+		return nil
+	})
+}
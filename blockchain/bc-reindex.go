@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrStateDiverged is returned by Reindex when the stored state doesn't match the state rebuilt from the blocks
+var ErrStateDiverged = errors.New("stored state diverges from the mainchain blocks")
+
+// maximum number of diverging addresses listed in the error returned by Reindex
+const maxReindexDivergences = 20
+
+// errReindexRollback rolls back the database transaction of Reindex
+var errReindexRollback = errors.New("reindex rollback")
+
+// Reindex verifies the stored state without trusting it: the state is rebuilt from the genesis by applying the
+// mainchain blocks again, and compared with the stored balances, nonces, supply and top block. The database is
+// not modified, since the rebuilt state is discarded. It reads every block and transaction of the mainchain, so
+// it's slow.
+func (bc *Blockchain) Reindex() error {
+	var diverged []error
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		stored := make(map[address.Address]State)
+		err := tx.Bucket([]byte{buck.STATE}).ForEach(func(k, v []byte) error {
+			state := State{}
+			if err := state.Deserialize(v); err != nil {
+				diverged = append(diverged, fmt.Errorf("stored state of %s: %w", address.Address(k), err))
+			}
+			stored[address.Address(k)] = state
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stats := bc.GetStats(tx)
+
+		for _, name := range []byte{buck.STATE, buck.INTX, buck.OUTTX} {
+			if err := tx.DeleteBucket([]byte{name}); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte{name}); err != nil {
+				return err
+			}
+		}
+		rebuilt := *stats
+		rebuilt.Supply = 0
+		bc.setStatsNoBroadcast(tx, &rebuilt)
+
+		var prevHash [32]byte
+		var top *block.Block
+		err = bc.IterateMainchain(tx, 0, stats.TopHeight, func(height uint64, hash [32]byte, bl *block.Block) error {
+			if bl.Height != height {
+				return fmt.Errorf("mainchain block %x at height %d has height %d", hash, height, bl.Height)
+			}
+			if height > 0 && bl.PrevHash() != prevHash {
+				return fmt.Errorf("mainchain block %d %x doesn't follow block %x", height, hash, prevHash)
+			}
+			err := bc.ApplyBlockToState(tx, bl, hash)
+			if err != nil {
+				return fmt.Errorf("applying mainchain block %d %x: %w", height, hash, err)
+			}
+			if height%1000 == 0 {
+				bc.log.Infof("Reindexed %d/%d blocks", height, stats.TopHeight)
+			}
+			prevHash = hash
+			top = bl
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if prevHash != stats.TopHash {
+			diverged = append(diverged, fmt.Errorf("top block at height %d is %x, stats have %x", stats.TopHeight,
+				prevHash, stats.TopHash))
+		}
+		if !top.CumulativeDiff.Equals(stats.CumulativeDiff) {
+			diverged = append(diverged, fmt.Errorf("top block cumulative diff is %s, stats have %s",
+				top.CumulativeDiff, stats.CumulativeDiff))
+		}
+		if supply := bc.GetStats(tx).Supply; supply != stats.Supply {
+			diverged = append(diverged, fmt.Errorf("rebuilt supply is %d, stats have %d", supply, stats.Supply))
+		}
+
+		// addresses missing from either state are compared as empty, since removing blocks from the state
+		// leaves the addresses they created
+		var addrCount, addrDiverged int
+		err = tx.Bucket([]byte{buck.STATE}).ForEach(func(k, v []byte) error {
+			addr := address.Address(k)
+			state := State{}
+			if err := state.Deserialize(v); err != nil {
+				return fmt.Errorf("rebuilt state of %s: %w", addr, err)
+			}
+			if state != stored[addr] {
+				addrDiverged++
+				if addrDiverged <= maxReindexDivergences {
+					diverged = append(diverged, fmt.Errorf("state of %s is {%v}, stored {%v}", addr, state,
+						stored[addr]))
+				}
+			}
+			delete(stored, addr)
+			addrCount++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for addr, state := range stored {
+			if state != (State{}) {
+				addrDiverged++
+				if addrDiverged <= maxReindexDivergences {
+					diverged = append(diverged, fmt.Errorf("state of %s is empty, stored {%v}", addr, state))
+				}
+			}
+		}
+		if addrDiverged > maxReindexDivergences {
+			diverged = append(diverged, fmt.Errorf("and %d more diverging addresses",
+				addrDiverged-maxReindexDivergences))
+		}
+
+		bc.log.Infof("Reindexed %d blocks and %d addresses", stats.TopHeight+1, addrCount)
+		return errReindexRollback
+	})
+	if err != errReindexRollback {
+		return err
+	}
+	if len(diverged) > 0 {
+		return fmt.Errorf("%w:\n%w", ErrStateDiverged, errors.Join(diverged...))
+	}
+	return nil
+}
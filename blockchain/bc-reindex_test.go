@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"errors"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestReindex(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+
+	// the sender mines the blocks, and spends some of the reward in blocks 4 and 6
+	for i := 1; i <= 8; i++ {
+		if i == 4 || i == 6 {
+			if _, err := bc.SubmitTx(newTestTx(t, pk, uint64(i/2-1), config.COIN)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bl := newTestBlock(t, bc, sender)
+		addTestBlocks(t, bc, bl)
+	}
+
+	getState := func(addr address.Address) (state State) {
+		err := bc.DB.View(func(tx *bolt.Tx) error {
+			s, err := bc.GetState(tx, addr)
+			if err != nil {
+				return err
+			}
+			state = *s
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	before := getState(recipient)
+	if before.Balance != 2*config.COIN {
+		t.Fatalf("recipient balance is %d, expected %d", before.Balance, 2*config.COIN)
+	}
+
+	// reindexing a valid chain reproduces the same state, and doesn't modify it
+	if err := bc.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if after := getState(recipient); after != before {
+		t.Fatalf("recipient state is %v after reindexing, expected %v", after, before)
+	}
+
+	// a corrupted balance is detected
+	corrupted := before
+	corrupted.Balance += config.COIN
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		return bc.SetState(tx, recipient, &corrupted)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Reindex(); !errors.Is(err, ErrStateDiverged) {
+		t.Fatalf("corrupted balance is not detected, error %v", err)
+	}
+	if got := getState(recipient); got != corrupted {
+		t.Errorf("reindex modified the stored state to %v", got)
+	}
+}
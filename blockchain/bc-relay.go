@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"container/list"
+	"math/rand/v2"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"still-blockchain/p2p/packet"
+	"still-blockchain/util"
+	"time"
+)
+
+// blockRelay remembers the blocks that have been relayed recently, so that a block received more than once
+// isn't relayed again, and the number of peers each block is relayed to
+type blockRelay struct {
+	util.Mutex
+
+	fanout int
+
+	// least recently relayed blocks are at the front of the list
+	order *list.List
+	seen  map[[32]byte]*list.Element
+}
+
+// markRelayed returns false if the block has been relayed recently, otherwise it records the block as relayed
+func (r *blockRelay) markRelayed(hash [32]byte) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[[32]byte]*list.Element)
+		r.order = list.New()
+	}
+	if el, ok := r.seen[hash]; ok {
+		r.order.MoveToBack(el)
+		return false
+	}
+	if r.order.Len() >= config.RELAYED_BLOCKS_CACHE {
+		oldest := r.order.Front()
+		r.order.Remove(oldest)
+		delete(r.seen, oldest.Value.([32]byte))
+	}
+	r.seen[hash] = r.order.PushBack(hash)
+	return true
+}
+
+// transaction requests older than this (in seconds) are forgotten, so the transaction can be requested to
+// another peer which announces it
+const txRequestExpiry = 30
+
+// txRequests remembers the transactions requested to the peers and not received yet, so that a transaction
+// announced by several peers is only requested to one of them, and that a peer can only send the transactions
+// requested to it
+type txRequests struct {
+	util.Mutex
+
+	pending map[[32]byte]txRequest
+}
+
+type txRequest struct {
+	conn *p2p.Connection
+	time int64 // UNIX seconds
+}
+
+// request returns the hashes that aren't requested to any peer yet, and records them as requested to conn
+func (r *txRequests) request(conn *p2p.Connection, hashes [][32]byte) [][32]byte {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now().Unix()
+	if r.pending == nil {
+		r.pending = make(map[[32]byte]txRequest)
+	}
+	for k, v := range r.pending {
+		if now-v.time > txRequestExpiry {
+			delete(r.pending, k)
+		}
+	}
+
+	requested := make([][32]byte, 0, len(hashes))
+	for _, v := range hashes {
+		if _, ok := r.pending[v]; ok {
+			continue
+		}
+		r.pending[v] = txRequest{conn, now}
+		requested = append(requested, v)
+	}
+	return requested
+}
+
+// received returns false if the transaction wasn't requested to conn, otherwise it forgets the request
+func (r *txRequests) received(conn *p2p.Connection, hash [32]byte) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	req, ok := r.pending[hash]
+	if !ok || req.conn != conn || time.Now().Unix()-req.time > txRequestExpiry {
+		return false
+	}
+	delete(r.pending, hash)
+	return true
+}
+
+// SetBlockFanout sets the number of peers a new block is relayed to. The value is clamped between
+// BLOCK_RELAY_FANOUT_MIN and BLOCK_RELAY_FANOUT_MAX, and the value set is returned.
+func (bc *Blockchain) SetBlockFanout(n int) int {
+	n = max(config.BLOCK_RELAY_FANOUT_MIN, min(config.BLOCK_RELAY_FANOUT_MAX, n))
+
+	bc.relay.Lock()
+	bc.relay.fanout = n
+	bc.relay.Unlock()
+
+	return n
+}
+
+func (bc *Blockchain) GetBlockFanout() int {
+	bc.relay.Lock()
+	defer bc.relay.Unlock()
+	return bc.relay.fanout
+}
+
+// relayBlock sends a block received from the given peer to at most GetBlockFanout() random peers, skipping
+// the peer it was received from and the ones that are most likely ahead of it. A block is relayed only once.
+func (bc *Blockchain) relayBlock(bl *block.Block, hash [32]byte, from *p2p.Connection) {
+	if !bc.relay.markRelayed(hash) {
+		bc.log.Debugf("block %x already relayed", hash)
+		return
+	}
+
+	ser, err := bc.SerializeFullBlock(bl)
+	if err != nil {
+		bc.log.Err(err)
+		return
+	}
+
+	// if remote peers have a cumulative difficulty larger than this, then most likely they aren't interested in the block
+	maxCumDiff := bl.CumulativeDiff.Add(bl.Difficulty.Mul64(config.MINIDAG_ANCESTORS + 2))
+
+	// connections must not be locked while P2P is locked
+	bc.P2P.RLock()
+	conns := make([]*p2p.Connection, 0, len(bc.P2P.Connections))
+	for _, c := range bc.P2P.Connections {
+		if c != from {
+			conns = append(conns, c)
+		}
+	}
+	bc.P2P.RUnlock()
+
+	rand.Shuffle(len(conns), func(i, j int) {
+		conns[i], conns[j] = conns[j], conns[i]
+	})
+
+	fanout := bc.GetBlockFanout()
+	sent := 0
+	for _, c := range conns {
+		if sent >= fanout {
+			break
+		}
+		interested := false
+		c.PeerData(func(d *p2p.PeerData) {
+			interested = d.Stats.CumulativeDiff.Cmp(maxCumDiff) <= 0
+		})
+		if !interested {
+			continue
+		}
+		c.SendPacket(&p2p.Packet{
+			Type: packet.BLOCK,
+			Data: ser,
+		})
+		sent++
+	}
+	bc.log.Debugf("relayed block %x to %d peers", hash, sent)
+}
@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RepairTopo rebuilds the topo index of the mainchain from the blocks: it walks back from the top block following
+// the previous hashes down to the genesis, and rewrites the topo entries that are missing or point to another
+// block. It returns the number of entries rewritten. Entries above the top height, which are left over by reorgs
+// to a shorter chain, are never read and aren't changed.
+// Blockchain MUST be locked before calling this
+func (bc *Blockchain) RepairTopo(tx *bolt.Tx) (repaired int, err error) {
+	stats := bc.GetStats(tx)
+	buckTopo := tx.Bucket([]byte{buck.TOPO})
+
+	hash := [32]byte(stats.TopHash)
+	for height := stats.TopHeight; ; height-- {
+		bl, err := bc.GetBlockHeader(tx, hash)
+		if err != nil {
+			return repaired, fmt.Errorf("mainchain block at height %d: %w", height, err)
+		}
+		if bl.Height != height {
+			return repaired, fmt.Errorf("mainchain block %x at height %d has height %d", hash, height, bl.Height)
+		}
+
+		topo, err := bc.buckGetTopo(buckTopo, height)
+		if err != nil || topo != hash {
+			bc.log.Warnf("Repairing topo entry of height %d: %x -> %x", height, topo, hash)
+			heightBin := make([]byte, 8)
+			binary.LittleEndian.PutUint64(heightBin, height)
+			// bolt keeps the value until the transaction ends, so it can't be the hash variable
+			err = buckTopo.Put(heightBin, bytes.Clone(hash[:]))
+			if err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+
+		if height == 0 {
+			return repaired, nil
+		}
+		hash = bl.PrevHash()
+	}
+}
@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"still-blockchain/util/buck"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRepairTopo(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	chain := newTestChain(t, nil, 5)
+	addTestBlocks(t, bc, chain...)
+
+	// delete the entry of a block, and point another one to the wrong block
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte{buck.TOPO})
+		if err := b.Delete(binary.LittleEndian.AppendUint64(nil, chain[1].Height)); err != nil {
+			return err
+		}
+		wrong := chain[0].Hash()
+		return b.Put(binary.LittleEndian.AppendUint64(nil, chain[3].Height), wrong[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []int{2, 0} {
+		var repaired int
+		err = bc.DB.Update(func(tx *bolt.Tx) (err error) {
+			repaired, err = bc.RepairTopo(tx)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repaired != expected {
+			t.Fatalf("repaired %d topo entries, expected %d", repaired, expected)
+		}
+	}
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		for _, bl := range chain {
+			hash, err := bc.GetTopo(tx, bl.Height)
+			if err != nil {
+				t.Fatalf("topo of height %d: %v", bl.Height, err)
+			}
+			if hash != bl.Hash() {
+				t.Fatalf("topo of height %d is %x, expected %x", bl.Height, hash, bl.Hash())
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,154 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/checkpoints"
+	"still-blockchain/config"
+	"still-blockchain/util/buck"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrRewindCheckpoint = errors.New("cannot rewind below the deepest checkpoint")
+
+// RewindTo rolls back the mainchain to the given height, removing all the blocks above it from the state and
+// the topo. The transactions of the removed blocks are moved back to the mempool. The removed blocks are
+// deleted, so that they can be downloaded again by the sync, and the altchain tips above the height are
+// forgotten, so that the next CheckReorgs doesn't move the mainchain back up. The rewind is reported to the
+// OnReorg callbacks like a reorg.
+func (bc *Blockchain) RewindTo(height uint64) error {
+	if last := checkpoints.Last(); height < last {
+		return fmt.Errorf("%w: height %d < %d", ErrRewindCheckpoint, height, last)
+	}
+
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		if height > stats.TopHeight {
+			return fmt.Errorf("cannot rewind to height %d above the top height %d", height, stats.TopHeight)
+		}
+		if height == stats.TopHeight {
+			return nil
+		}
+		oldTop := stats.TopHash
+
+		buckTopo := tx.Bucket([]byte{buck.TOPO})
+		buckBlock := tx.Bucket([]byte{buck.BLOCK})
+
+		// removed blocks, from the highest to the lowest
+		removed := make([]*block.Block, 0, stats.TopHeight-height)
+
+		for h := stats.TopHeight; h > height; h-- {
+			hash, err := bc.buckGetTopo(buckTopo, h)
+			if err != nil {
+				err = fmt.Errorf("rewind: block at height %d not found: %w", h, err)
+				bc.log.Err(err)
+				return err
+			}
+			bl, err := bc.GetBlock(tx, hash)
+			if err != nil {
+				bc.log.Err(err)
+				return err
+			}
+
+			bc.log.Infof("Rewinding block %d %x", h, hash)
+
+			err = bc.RemoveBlockFromState(tx, bl, hash)
+			if err != nil {
+				bc.log.Err(err)
+				return err
+			}
+
+			heightBin := make([]byte, 8)
+			binary.LittleEndian.PutUint64(heightBin, h)
+			err = buckTopo.Delete(heightBin)
+			if err != nil {
+				bc.log.Err(err)
+				return err
+			}
+			err = buckBlock.Delete(hash[:])
+			if err != nil {
+				bc.log.Err(err)
+				return err
+			}
+			bc.blockCache.remove(tx, hash)
+
+			removed = append(removed, bl)
+		}
+
+		// move the removed transactions back to the mempool, in the order they were included in the chain
+		btx := tx.Bucket([]byte{buck.TX})
+		mem := bc.GetMempool(tx)
+		for i := len(removed) - 1; i >= 0; i-- {
+			for _, txid := range removed[i].Transactions {
+				if mem.GetEntry(txid) != nil {
+					continue
+				}
+				t, _, err := bc.buckGetTx(btx, txid)
+				if err != nil {
+					bc.log.Err(err)
+					return err
+				}
+				mem.Entries = append(mem.Entries, &MempoolEntry{
+					TXID:      txid,
+					Size:      t.GetVirtualSize(),
+					Fee:       t.Fee,
+					Nonce:     t.Nonce,
+					Expires:   time.Now().Add(config.MEMPOOL_EXPIRATION).Unix(),
+					Sender:    address.FromPubKey(t.Sender),
+					Recipient: t.Recipient,
+				})
+			}
+		}
+		bc.SetMempool(tx, mem)
+
+		// RemoveBlockFromState updated the supply, so the stats are read again
+		stats = bc.GetStats(tx)
+
+		topHash, err := bc.buckGetTopo(buckTopo, height)
+		if err != nil {
+			bc.log.Err(err)
+			return err
+		}
+		top, err := bc.GetBlock(tx, topHash)
+		if err != nil {
+			bc.log.Err(err)
+			return err
+		}
+
+		rolledBack := make([]uint64, len(removed))
+		for i, bl := range removed {
+			rolledBack[i] = bl.Height
+		}
+		err = bc.recordEvents(tx, Event{
+			Type:       EventReorg,
+			Height:     height,
+			Hash:       topHash,
+			RolledBack: rolledBack,
+		})
+		if err != nil {
+			bc.log.Err(err)
+			return err
+		}
+
+		// altchain tips above the new top can't be reorganized to anymore
+		for i, tip := range stats.Tips {
+			if tip.Height > height {
+				delete(stats.Tips, i)
+			}
+		}
+
+		stats.TopHash = topHash
+		stats.TopHeight = height
+		stats.CumulativeDiff = top.CumulativeDiff
+		bc.SetStats(tx, stats)
+		bc.emitReorg(tx, oldTop, topHash, height)
+
+		bc.log.Infof("Rewound chain to height %d %x", height, topHash)
+		return nil
+	})
+}
@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"errors"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/block"
+	"still-blockchain/checkpoints"
+	"still-blockchain/config"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRewindTo(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	addrs := []address.Address{sender, recipient, address.GenesisAddress}
+
+	type snapshot struct {
+		stats  Stats
+		states []State
+	}
+	takeSnapshot := func() (s snapshot) {
+		bc.DB.View(func(tx *bolt.Tx) error {
+			s.stats = *bc.GetStats(tx)
+			for _, addr := range addrs {
+				// addresses not in state yet have a zero state
+				state, _ := bc.GetState(tx, addr)
+				s.states = append(s.states, *state)
+			}
+			return nil
+		})
+		return
+	}
+
+	// the sender mines the first blocks, and spends some of the reward in block 7
+	tx := newTestTx(t, pk, 1, config.COIN)
+	var blocks []*block.Block
+	var atFive snapshot
+	for i := 1; i <= 10; i++ {
+		if i == 7 {
+			if _, err := bc.SubmitTx(tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bl := newTestBlock(t, bc, sender)
+		addTestBlocks(t, bc, bl)
+		blocks = append(blocks, bl)
+		if i == 5 {
+			atFive = takeSnapshot()
+		}
+	}
+	if len(blocks[6].Transactions) != 1 {
+		t.Fatalf("block 7 has %d transactions, expected 1", len(blocks[6].Transactions))
+	}
+	atTen := takeSnapshot()
+
+	// rewinding below the deepest checkpoint is refused
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 3, 2
+	if err := bc.RewindTo(5); !errors.Is(err, ErrRewindCheckpoint) {
+		t.Fatalf("rewind below the deepest checkpoint returned %v, expected %v", err, ErrRewindCheckpoint)
+	}
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 0, 0
+
+	if err := bc.RewindTo(11); err == nil {
+		t.Fatal("rewind above the top height should fail")
+	}
+	if err := bc.RewindTo(5); err != nil {
+		t.Fatal(err)
+	}
+
+	rewound := takeSnapshot()
+	if rewound.stats.TopHash != atFive.stats.TopHash || rewound.stats.TopHeight != 5 {
+		t.Fatalf("top is %d %x, expected 5 %x", rewound.stats.TopHeight, rewound.stats.TopHash,
+			atFive.stats.TopHash)
+	}
+	if !rewound.stats.CumulativeDiff.Equals(atFive.stats.CumulativeDiff) {
+		t.Fatalf("cumulative diff is %s, expected %s", rewound.stats.CumulativeDiff, atFive.stats.CumulativeDiff)
+	}
+	if rewound.stats.Supply != atFive.stats.Supply {
+		t.Fatalf("supply is %d, expected %d", rewound.stats.Supply, atFive.stats.Supply)
+	}
+	for i, addr := range addrs {
+		if rewound.states[i] != atFive.states[i] {
+			t.Fatalf("state of %s is %+v, expected %+v", addr, rewound.states[i], atFive.states[i])
+		}
+	}
+	bc.DB.View(func(txn *bolt.Tx) error {
+		if _, err := bc.GetTopo(txn, 6); err == nil {
+			t.Fatal("topo of height 6 was not deleted")
+		}
+		if bc.GetMempool(txn).GetEntry(tx.Hash()) == nil {
+			t.Fatal("removed transaction was not moved back to the mempool")
+		}
+		return nil
+	})
+
+	// the removed blocks can be added again
+	for _, bl := range blocks[5:] {
+		addTestBlocks(t, bc, bl)
+	}
+	readded := takeSnapshot()
+	if readded.stats.TopHash != atTen.stats.TopHash {
+		t.Fatalf("top hash after adding the blocks again is %x, expected %x", readded.stats.TopHash,
+			atTen.stats.TopHash)
+	}
+	for i, addr := range addrs {
+		if readded.states[i] != atTen.states[i] {
+			t.Fatalf("state of %s is %+v, expected %+v", addr, readded.states[i], atTen.states[i])
+		}
+	}
+}
+
+// TestRewindAltchainTips rewinds below an altchain tip with more work than the new top: the tip is forgotten, so
+// the rewind isn't undone by the next reorg check, and the rewind is reported to the reorg callbacks
+func TestRewindAltchainTips(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 3)
+	chainA := newTestChain(t, base, 5)
+	chainB := newTestChain(t, base, 3)
+	addTestBlocks(t, bc, slices.Concat(base, chainA, chainB)...)
+
+	type reorgEvent struct {
+		oldTop, newTop [32]byte
+		commonHeight   uint64
+	}
+	var reorgs []reorgEvent
+	bc.OnReorg(func(oldTop, newTop [32]byte, commonHeight uint64) {
+		reorgs = append(reorgs, reorgEvent{oldTop, newTop, commonHeight})
+	})
+
+	if err := bc.RewindTo(5); err != nil {
+		t.Fatal(err)
+	}
+	expected := reorgEvent{chainA[4].Hash(), chainA[1].Hash(), 5}
+	if len(reorgs) != 1 || reorgs[0] != expected {
+		t.Fatalf("reorg events %+v, expected %+v", reorgs, expected)
+	}
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		if _, ok := stats.Tips[chainB[2].Hash()]; ok {
+			t.Error("altchain tip above the rewound height is kept")
+		}
+		_, err := bc.CheckReorgs(tx, stats)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if stats := bc.GetStats(tx); stats.TopHash != chainA[1].Hash() {
+			t.Fatalf("top block after the reorg check is %d %x, expected %x", stats.TopHeight, stats.TopHash,
+				chainA[1].Hash())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TxSimulation is the outcome of a transaction that hasn't been sent yet, computed by SimulateTx
+type TxSimulation struct {
+	SenderBalance    uint64 // balance of the sender after the transaction
+	RecipientBalance uint64 // balance of the recipient after the transaction
+	BalanceValid     bool   // the sender can afford the amount plus the fee
+
+	ExpectedNonce uint64 // nonce the transaction should use
+	NonceValid    bool
+
+	MinFee   uint64 // minimum fee to admit the transaction in mempool
+	FeeValid bool
+}
+
+// SimulateTx computes the balances after a transaction from sender to recipient would be applied to the current
+// state, and checks its nonce and fee. Pending mempool transactions are not taken into account, and nothing is
+// written to the database.
+func (bc *Blockchain) SimulateTx(tx *bolt.Tx, sender, recipient address.Address, amount, fee,
+	nonce uint64) *TxSimulation {
+	sim := &TxSimulation{}
+
+	senderState, err := bc.GetState(tx, sender)
+	if err != nil {
+		bc.log.Debug("simulated transaction sender not in state:", err)
+	}
+	recState, err := bc.GetState(tx, recipient)
+	if err != nil {
+		bc.log.Debug("simulated transaction recipient not in state:", err)
+	}
+
+	sim.ExpectedNonce = senderState.LastNonce + 1
+	sim.NonceValid = nonce == sim.ExpectedNonce
+
+	sim.MinFee = bc.MinRelayFee(tx) * transaction.Transaction{}.GetVirtualSize()
+	sim.FeeValid = fee >= sim.MinFee
+
+	sim.SenderBalance = senderState.Balance
+	sim.RecipientBalance = recState.Balance
+
+	spent, err := util.SafeAdd(amount, fee)
+	if err != nil || senderState.Balance < spent {
+		return sim
+	}
+	received, err := util.SafeAdd(recState.Balance, amount)
+	if err != nil {
+		return sim
+	}
+	sim.BalanceValid = true
+
+	// like in ApplyBlockToState, the recipient is credited after the sender is debited
+	sim.SenderBalance = senderState.Balance - spent
+	if recipient == sender {
+		sim.SenderBalance += amount
+		sim.RecipientBalance = sim.SenderBalance
+	} else {
+		sim.RecipientBalance = received
+	}
+	return sim
+}
@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSimulateTx(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	addBlock := func(minerAddr address.Address) {
+		addTestBlocks(t, bc, newTestBlock(t, bc, minerAddr))
+	}
+	balance := func(addr address.Address) (b uint64) {
+		bc.DB.View(func(tx *bolt.Tx) error {
+			state, _ := bc.GetState(tx, addr)
+			b = state.Balance
+			return nil
+		})
+		return
+	}
+
+	addBlock(sender)
+
+	txn := newTestTx(t, pk, 1, config.COIN)
+	simulate := func(amount, fee, nonce uint64) (sim *TxSimulation) {
+		bc.DB.View(func(tx *bolt.Tx) error {
+			sim = bc.SimulateTx(tx, sender, txn.Recipient, amount, fee, nonce)
+			return nil
+		})
+		return
+	}
+
+	senderBefore := balance(sender)
+	sim := simulate(txn.Amount, txn.Fee, txn.Nonce)
+	if !sim.BalanceValid || !sim.NonceValid || !sim.FeeValid || sim.ExpectedNonce != 1 ||
+		sim.MinFee != txn.MinFee() {
+		t.Fatalf("unexpected simulation %+v", sim)
+	}
+	if balance(sender) != senderBefore || balance(txn.Recipient) != 0 {
+		t.Fatal("simulation changed the state")
+	}
+
+	if sim := simulate(txn.Amount, txn.Fee, 2); sim.NonceValid {
+		t.Error("nonce 2 is valid for a sender with no transactions")
+	}
+	if sim := simulate(txn.Amount, txn.Fee-1, txn.Nonce); sim.FeeValid {
+		t.Error("fee below the minimum is valid")
+	}
+	if sim := simulate(senderBefore, txn.Fee, txn.Nonce); sim.BalanceValid || sim.SenderBalance != senderBefore {
+		t.Errorf("spending more than the balance: %+v", sim)
+	}
+
+	// the simulated balances are the ones after the transaction is mined by someone else
+	if _, err := bc.SubmitTx(txn); err != nil {
+		t.Fatal(err)
+	}
+	addBlock(miner)
+	if b := balance(sender); b != sim.SenderBalance {
+		t.Errorf("sender balance is %d, simulated %d", b, sim.SenderBalance)
+	}
+	if b := balance(txn.Recipient); b != sim.RecipientBalance {
+		t.Errorf("recipient balance is %d, simulated %d", b, sim.RecipientBalance)
+	}
+}
@@ -0,0 +1,101 @@
+package blockchain
+
+import (
+	"still-blockchain/config"
+	"still-blockchain/util"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// stallMonitor tracks when the mainchain last grew, to warn the operator when no blocks are received for much
+// longer than the target block time, for example because the node lost all its peers.
+type stallMonitor struct {
+	util.Mutex
+
+	lastBlock time.Time // when the last mainchain block was added, or when the node started
+	stalled   bool
+}
+
+// blockAdded records that the mainchain has grown. If the chain was stalled, it returns how long it was stalled
+// for, otherwise 0.
+func (s *stallMonitor) blockAdded(now time.Time) (stalledFor time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stalled {
+		stalledFor = now.Sub(s.lastBlock)
+	}
+	s.lastBlock = now
+	s.stalled = false
+	return stalledFor
+}
+
+// check updates the stall flag, and returns true if the chain has just stalled
+func (s *stallMonitor) check(now time.Time, timeout time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lastBlock.IsZero() {
+		s.lastBlock = now
+	}
+	if s.stalled || now.Sub(s.lastBlock) <= timeout {
+		return false
+	}
+	s.stalled = true
+	return true
+}
+
+// age returns the time elapsed since the last mainchain block was added
+func (s *stallMonitor) age(now time.Time) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lastBlock.IsZero() {
+		return 0
+	}
+	return now.Sub(s.lastBlock)
+}
+
+func (s *stallMonitor) isStalled() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.stalled
+}
+
+// recordBlockAdded resets the stall timer once the transaction adding a mainchain block is committed
+func (bc *Blockchain) recordBlockAdded(tx *bolt.Tx) {
+	tx.OnCommit(func() {
+		if d := bc.stall.blockAdded(time.Now()); d != 0 {
+			bc.log.Infof("Chain is no longer stalled, new block after %s", d.Round(time.Second))
+		}
+	})
+}
+
+// LastBlockAge returns the time elapsed since the mainchain last grew. Blocks added before the node started
+// are not taken into account.
+func (bc *Blockchain) LastBlockAge() time.Duration {
+	return bc.stall.age(time.Now())
+}
+
+// IsStalled returns true if no mainchain block has been added for longer than StallTimeout
+func (bc *Blockchain) IsStalled() bool {
+	return bc.stall.isStalled()
+}
+
+func (bc *Blockchain) checkStall() {
+	if bc.stall.check(time.Now(), bc.StallTimeout) {
+		bc.log.Warnf("Chain is stalled: no new blocks in the last %s, check the node's connections",
+			bc.LastBlockAge().Round(time.Second))
+	}
+}
+
+// stallWatcher periodically checks whether the chain has stalled
+func (bc *Blockchain) stallWatcher() {
+	for {
+		time.Sleep(config.TARGET_BLOCK_TIME * time.Second)
+
+		bc.checkStall()
+	}
+}
@@ -0,0 +1,44 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"testing"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+func TestStallMonitor(t *testing.T) {
+	bc := newTestBlockchain(t)
+	bc.StallTimeout = 50 * time.Millisecond
+
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	addBlock := func() {
+		addTestBlocks(t, bc, newTestBlock(t, bc, miner))
+	}
+
+	addBlock()
+	bc.checkStall()
+	if bc.IsStalled() {
+		t.Fatal("chain is stalled right after a new block")
+	}
+
+	// no blocks for longer than the timeout
+	time.Sleep(2 * bc.StallTimeout)
+	bc.checkStall()
+	if !bc.IsStalled() {
+		t.Fatal("chain is not stalled after the timeout")
+	}
+	if age := bc.LastBlockAge(); age < 2*bc.StallTimeout {
+		t.Fatalf("last block age is %s, expected at least %s", age, 2*bc.StallTimeout)
+	}
+
+	// a new block clears the flag
+	addBlock()
+	if bc.IsStalled() {
+		t.Fatal("chain is still stalled after a new block")
+	}
+	if age := bc.LastBlockAge(); age >= bc.StallTimeout {
+		t.Fatalf("last block age is %s after a new block", age)
+	}
+}
@@ -2,11 +2,15 @@ package blockchain
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/gob"
-	"io"
+	"slices"
 	"still-blockchain/address"
 	"still-blockchain/util"
+	"still-blockchain/util/buck"
 	"still-blockchain/util/uint128"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 type Stats struct {
@@ -15,6 +19,7 @@ type Stats struct {
 	CumulativeDiff uint128.Uint128
 	Tips           map[util.Hash]*AltchainTip
 	Orphans        map[util.Hash]*Orphan // hash -> orphan
+	Supply         uint64                // sum of all the balances, updated when blocks are applied or removed
 }
 
 type AltchainTip struct {
@@ -26,21 +31,94 @@ type Orphan struct {
 	Expires  int64 // expiration time (UNIX seconds)
 	Hash     util.Hash
 	PrevHash util.Hash
+	Height   uint64
+}
+
+// GetTips returns the altchain tips, sorted by height and then by hash
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) GetTips(tx *bolt.Tx) []AltchainTip {
+	stats := bc.GetStats(tx)
+
+	tips := make([]AltchainTip, 0, len(stats.Tips))
+	for _, v := range stats.Tips {
+		tips = append(tips, *v)
+	}
+	slices.SortFunc(tips, func(a, b AltchainTip) int {
+		if c := cmp.Compare(a.Height, b.Height); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.Hash[:], b.Hash[:])
+	})
+	return tips
+}
+
+// GetOrphans returns the orphan blocks, sorted by height and then by hash
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) GetOrphans(tx *bolt.Tx) []Orphan {
+	stats := bc.GetStats(tx)
+
+	orphans := make([]Orphan, 0, len(stats.Orphans))
+	for _, v := range stats.Orphans {
+		orphans = append(orphans, *v)
+	}
+	slices.SortFunc(orphans, func(a, b Orphan) int {
+		if c := cmp.Compare(a.Height, b.Height); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.Hash[:], b.Hash[:])
+	})
+	return orphans
+}
+
+// Block statuses returned by GetBlockStatus
+const (
+	BlockMainchain = "mainchain" // the block is in the mainchain
+	BlockAltchain  = "altchain"  // the block is an altchain tip, or in the branch of one
+	BlockOrphan    = "orphan"    // the block's parent is not known yet
+	BlockUnknown   = "unknown"   // the block is not in the database
+)
+
+// GetBlockStatus returns whether the block with the given hash is in the mainchain, in an altchain or orphaned,
+// along with its height. Mainchain blocks also have their number of confirmations, counting the block itself;
+// the other blocks have zero confirmations. An unknown hash is not an error, and returns BlockUnknown.
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) GetBlockStatus(tx *bolt.Tx, hash [32]byte) (status string, height uint64, confirmations int,
+	err error) {
+	bl, err := bc.GetBlockHeader(tx, hash)
+	if err != nil {
+		if tx.Bucket([]byte{buck.BLOCK}).Get(hash[:]) == nil {
+			return BlockUnknown, 0, 0, nil
+		}
+		return "", 0, 0, err
+	}
+
+	stats := bc.GetStats(tx)
+	if stats.Orphans[hash] != nil {
+		return BlockOrphan, bl.Height, 0, nil
+	}
+	// topo entries above the top height may be left over by a reorg to a shorter chain
+	if bl.Height <= stats.TopHeight {
+		topo, err := bc.GetTopo(tx, bl.Height)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if topo == hash {
+			return BlockMainchain, bl.Height, int(stats.TopHeight-bl.Height) + 1, nil
+		}
+	}
+	return BlockAltchain, bl.Height, 0, nil
 }
 
 func (s *Stats) Serialize() []byte {
 	var network bytes.Buffer        // Stand-in for a network connection
 	enc := gob.NewEncoder(&network) // Will write to network.
 
+	// encoding to a buffer only fails if the type can't be encoded
 	err := enc.Encode(s)
 	if err != nil {
-		Log.Fatal(err)
-	}
-	d, err := io.ReadAll(&network)
-	if err != nil {
-		Log.Fatal(err)
+		panic(err)
 	}
-	return d
+	return network.Bytes()
 }
 
 func DeserializeStats(d []byte) (*Stats, error) {
@@ -76,6 +154,7 @@ type MempoolEntry struct {
 	TXID      [32]byte
 	Size      uint64
 	Fee       uint64
+	Nonce     uint64
 	Expires   int64
 	Sender    address.Address
 	Recipient address.Address
@@ -85,15 +164,12 @@ func (s *Mempool) Serialize() []byte {
 	var network bytes.Buffer        // Stand-in for a network connection
 	enc := gob.NewEncoder(&network) // Will write to network.
 
+	// encoding to a buffer only fails if the type can't be encoded
 	err := enc.Encode(s)
 	if err != nil {
-		Log.Fatal(err)
+		panic(err)
 	}
-	d, err := io.ReadAll(&network)
-	if err != nil {
-		Log.Fatal(err)
-	}
-	return d
+	return network.Bytes()
 }
 
 func DeserializeMempool(d []byte) (*Mempool, error) {
@@ -119,6 +195,15 @@ func DeserializeMempool(d []byte) (*Mempool, error) {
 	return &s, err
 }
 
+// Size returns the total vsize of the mempool transactions
+func (m *Mempool) Size() uint64 {
+	var size uint64
+	for _, v := range m.Entries {
+		size += v.Size
+	}
+	return size
+}
+
 func (m *Mempool) GetEntry(hash [32]byte) *MempoolEntry {
 	for _, v := range m.Entries {
 		if v.TXID == hash {
@@ -128,12 +213,78 @@ func (m *Mempool) GetEntry(hash [32]byte) *MempoolEntry {
 	return nil
 }
 
-func (m *Mempool) DeleteEntry(hash [32]byte) {
+// DeleteEntry removes the transaction from mempool, and returns false if it's not in mempool
+func (m *Mempool) DeleteEntry(hash [32]byte) bool {
 	for i, v := range m.Entries {
 		if v.TXID == hash {
-			Log.Debugf("Removing transaction %x from mempool", v.TXID)
 			m.Entries = append(m.Entries[:i], m.Entries[i+1:]...)
-			return
+			return true
+		}
+	}
+	return false
+}
+
+// NextNonce returns the nonce the next transaction of addr should use, given the last nonce of addr in state.
+// Pending mempool transactions with consecutive nonces raise it; transactions after a nonce gap don't. pending
+// is the number of mempool transactions sent by addr.
+func (m *Mempool) NextNonce(addr address.Address, lastNonce uint64) (next uint64, pending int) {
+	used := make(map[uint64]bool)
+	for _, v := range m.Entries {
+		if v.Sender == addr {
+			used[v.Nonce] = true
+			pending++
+		}
+	}
+
+	next = lastNonce + 1
+	for used[next] {
+		next++
+	}
+	return next, pending
+}
+
+// ReadyTransactions returns the entries that can be included in the next block: for each sender, the
+// transactions with consecutive nonces starting from the sender's last nonce in state plus one, in nonce order.
+// Transactions after a nonce gap are parked in mempool until the missing nonce arrives.
+// Senders are in the order of their first entry in mempool.
+func (m *Mempool) ReadyTransactions(stateNonce func(addr address.Address) uint64) []*MempoolEntry {
+	senders, bySender := m.bySender()
+
+	ready := make([]*MempoolEntry, 0, len(m.Entries))
+	for _, sender := range senders {
+		entries := bySender[sender]
+		next := stateNonce(sender) + 1
+		for _, v := range entries {
+			if v.Nonce < next {
+				// nonce already used
+				continue
+			}
+			if v.Nonce > next {
+				// nonce gap, the next transactions aren't ready yet
+				break
+			}
+			ready = append(ready, v)
+			next++
 		}
 	}
+	return ready
+}
+
+// bySender returns the entries of each sender in nonce order, and the senders in the order of their first entry
+// in mempool
+func (m *Mempool) bySender() ([]address.Address, map[address.Address][]*MempoolEntry) {
+	bySender := make(map[address.Address][]*MempoolEntry)
+	senders := make([]address.Address, 0)
+	for _, v := range m.Entries {
+		if _, ok := bySender[v.Sender]; !ok {
+			senders = append(senders, v.Sender)
+		}
+		bySender[v.Sender] = append(bySender[v.Sender], v)
+	}
+	for _, entries := range bySender {
+		slices.SortStableFunc(entries, func(a, b *MempoolEntry) int {
+			return cmp.Compare(a.Nonce, b.Nonce)
+		})
+	}
+	return senders, bySender
 }
@@ -31,7 +31,7 @@ func (bc *Blockchain) StartStratum(bindIp string, bindPort uint16) {
 	go func() {
 		err := bc.Stratum.StartStratum(bindIp, bindPort)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return
 		}
 	}()
@@ -41,7 +41,7 @@ func (bc *Blockchain) StartStratum(bindIp string, bindPort uint16) {
 		go func() {
 			err := bc.handleConn(conn)
 			if err != nil {
-				Log.Warn(err)
+				bc.log.Warn(err)
 				bc.Stratum.Kick(conn)
 			}
 		}()
@@ -54,7 +54,7 @@ func (bc *Blockchain) NewStratumJob(force bool) {
 	bc.mergesUpdated = true
 	now := time.Now()
 	if !force && now.Sub(bc.lastJob) < 500*time.Millisecond {
-		Log.Debug("not sending new job because not forced")
+		bc.log.Debug("not sending new job because not forced")
 		bc.MergesMut.Unlock()
 		return
 	}
@@ -68,15 +68,15 @@ func (bc *Blockchain) NewStratumJob(force bool) {
 		return err
 	})
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
 		return
 	}
 
-	Log.Dev("Sending stratum job with diff", mindiff)
+	bc.log.Dev("Sending stratum job with diff", mindiff)
 
 	if !config.IS_MASTERCHAIN {
 		if len(bl.OtherChains) != 0 {
-			Log.Err("bl.OtherChains should be ZERO when outside masterchain")
+			bc.log.Err("bl.OtherChains should be ZERO when outside masterchain")
 		}
 	}
 	bc.Stratum.SendJob(bl, uint128.From64(mindiff))
@@ -126,12 +126,14 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 				},
 			})
 		})
-		Log.Warn(err)
+		bc.log.Warn(err)
 		return err
 	}
+	mergeMining := false
 	addr, err := address.FromString(loginParams.Login)
 	if err != nil {
 		if len(loginParams.Login) > len(merge_prefix) && loginParams.Login[:len(merge_prefix)] == merge_prefix {
+			mergeMining = true
 			if config.IS_MASTERCHAIN {
 				v.Update(func(c *stratumsrv.ConnData) error {
 					return c.WriteJSON(rpc.ResponseOut{
@@ -146,7 +148,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 			} else {
 				addr, err = address.FromString(loginParams.Login[len(merge_prefix):])
 				if err != nil {
-					Log.Warn(err)
+					bc.log.Warn(err)
 					v.Update(func(c *stratumsrv.ConnData) error {
 						return c.WriteJSON(rpc.ResponseOut{
 							JsonRpc: "2.0",
@@ -184,8 +186,25 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 		})
 		return errors.New("invalid wallet address")
 	}
+	err = bc.checkRecipient(addr.Addr)
+	if err != nil {
+		v.Update(func(c *stratumsrv.ConnData) error {
+			return c.WriteJSON(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    -1,
+					Message: "wallet address is not allowed on this node",
+				},
+			})
+		})
+		return err
+	}
 	v.Update(func(c *stratumsrv.ConnData) error {
 		c.Address = addr.Addr
+		// merge mining connections need the actual minimum difficulty, so vardiff is only used by miners
+		if !mergeMining {
+			c.Vardiff = stratumsrv.NewVardiff(bc.Stratum.SharesPerMinute, time.Now())
+		}
 		return nil
 	})
 
@@ -211,22 +230,27 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 		blob := bl.Commitment().MiningBlob()
 		seed := blob.GetSeed()
 		jobid := strconv.FormatUint(util.RandomUint64(), 36)
-		target := util.GetTargetBytes(bc.Stratum.LastMinDiff)
+		minDiff := bc.Stratum.LastMinDiff
 
 		if !config.IS_MASTERCHAIN {
 			if len(blob.Chains) != 1 {
-				Log.Errf("blob.Chains MUST be 1, got %d %x", len(blob.Chains), blob.Chains)
+				bc.log.Errf("blob.Chains MUST be 1, got %d %x", len(blob.Chains), blob.Chains)
 			}
 		}
 
 		err = v.Update(func(c *stratumsrv.ConnData) error {
+			shareDiff := c.ShareDiff(minDiff)
+			target := util.GetTargetBytes(shareDiff)
+
 			if len(c.Jobs) >= config.STRATUM_JOBS_HISTORY {
 				c.Jobs = c.Jobs[1:]
 			}
 			c.Jobs = append(c.Jobs, &stratumsrv.MinerJob{
-				JobID: jobid,
-				Block: bl,
-				Seed:  seed,
+				JobID:     jobid,
+				Block:     bl,
+				Seed:      seed,
+				ShareDiff: shareDiff,
+				MinDiff:   minDiff,
 			})
 			return c.WriteJSON(rpc.ResponseOut{
 				JsonRpc: "2.0",
@@ -247,7 +271,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 			})
 		})
 		if err != nil {
-			Log.Warn(err)
+			bc.log.Warn(err)
 			return err
 		}
 	}
@@ -278,7 +302,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 						},
 						Id: req.Id,
 					})
-					Log.Warn(err)
+					bc.log.Warn(err)
 					return err
 				}
 				nonceBin, err := hex.DecodeString(params.Nonce)
@@ -306,7 +330,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 					return nil
 				})
 				if job == nil {
-					Log.Debug("miner submit stale job")
+					bc.log.Debug("miner submit stale job")
 					v.WriteJSON(rpc.ResponseOut{
 						JsonRpc: "2.0",
 						Error: &rpc.Error{
@@ -372,6 +396,39 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 				jb.Nonce = nonce
 				commitment := jb.Commitment()
 				powhash := commitment.PowHash(commitment.MiningBlob().GetSeed())
+				powValue := uint128.FromBytes(powhash[:])
+
+				if !block.ValidPowValue(powValue, job.ShareDiff) {
+					v.WriteJSON(rpc.ResponseOut{
+						JsonRpc: "2.0",
+						Error: &rpc.Error{
+							Code:    -1,
+							Message: "low difficulty share",
+						},
+						Id: req.Id,
+					})
+					bc.log.Debug("stratum miner submit low difficulty share")
+					return nil
+				}
+				v.Update(func(c *stratumsrv.ConnData) error {
+					if c.Vardiff != nil {
+						c.Vardiff.OnShare(time.Now())
+					}
+					return nil
+				})
+
+				// the share is valid, but it's not a block
+				if !block.ValidPowValue(powValue, job.MinDiff) {
+					return v.WriteJSON(rpc.ResponseOut{
+						JsonRpc: "2.0",
+						Result: stratum.SubmitResponse{
+							Status: "OK",
+							Blocks: []stratum.FoundBlockInfo{},
+						},
+						Id: req.Id,
+					})
+				}
+
 				blocks, err = bc.blockFound(&jb, powhash)
 				if err != nil {
 					v.WriteJSON(rpc.ResponseOut{
@@ -382,7 +439,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 						},
 						Id: req.Id,
 					})
-					Log.Debug("stratum miner submit invalid block:", err.Error())
+					bc.log.Debug("stratum miner submit invalid block:", err.Error())
 					return nil
 				}
 
@@ -396,7 +453,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 				})
 				return err
 			}()
-			Log.Debug("submit request handled in", time.Since(t0))
+			bc.log.Debug("submit request handled in", time.Since(t0))
 			if err != nil {
 				return err
 			}
@@ -412,7 +469,7 @@ func (bc *Blockchain) handleConn(v *stratumsrv.Conn) error {
 				return err
 			}
 		default:
-			Log.Debug("unknown method", req.Method)
+			bc.log.Debug("unknown method", req.Method)
 		}
 	}
 }
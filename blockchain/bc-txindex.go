@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"still-blockchain/address"
+	"still-blockchain/binary"
+	"still-blockchain/block"
+	"still-blockchain/util/buck"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrOutTxIndexMismatch is returned by VerifyOutTxIndex when the OUTTX index has entries pointing to the wrong
+// transactions
+var ErrOutTxIndexMismatch = errors.New("outgoing transaction index is inconsistent")
+
+// maximum number of inconsistent entries listed in the error returned by VerifyOutTxIndex
+const maxOutTxMismatches = 20
+
+// RebuildTxIndexes clears the INTX and OUTTX buckets and derives them again from the mainchain blocks, replaying
+// the incoming and outgoing bookkeeping of ApplyBlockToState. The rebuilt counters must match the ones stored in
+// the state, otherwise an error is returned and the transaction should be rolled back.
+func (bc *Blockchain) RebuildTxIndexes(tx *bolt.Tx) error {
+	for _, name := range []byte{buck.INTX, buck.OUTTX} {
+		err := tx.DeleteBucket([]byte{name})
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte{name})
+		if err != nil {
+			return err
+		}
+	}
+
+	incoming := make(map[address.Address]uint64)
+	outgoing := make(map[address.Address]uint64)
+
+	btx := tx.Bucket([]byte{buck.TX})
+	stats := bc.GetStats(tx)
+	err := bc.IterateMainchain(tx, 0, stats.TopHeight, func(_ uint64, hash [32]byte, bl *block.Block) error {
+
+		for _, txid := range bl.Transactions {
+			txn, _, err := bc.buckGetTx(btx, txid)
+			if err != nil {
+				return err
+			}
+			sender := address.FromPubKey(txn.Sender)
+
+			incoming[txn.Recipient]++
+			err = bc.SetTxTopoInc(tx, txid, txn.Recipient, incoming[txn.Recipient])
+			if err != nil {
+				return err
+			}
+			outgoing[sender]++
+			err = bc.SetTxTopoOut(tx, txid, sender, outgoing[sender])
+			if err != nil {
+				return err
+			}
+		}
+
+		// the coinbase transaction is identified by the block hash
+		incoming[bl.Recipient]++
+		return bc.SetTxTopoInc(tx, hash, bl.Recipient, incoming[bl.Recipient])
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte{buck.STATE}).ForEach(func(k, v []byte) error {
+		addr := address.Address(k)
+		state := &State{}
+		err := state.Deserialize(v)
+		if err != nil {
+			return fmt.Errorf("state of %s: %w", addr, err)
+		}
+		if state.LastIncoming != incoming[addr] || state.LastNonce != outgoing[addr] {
+			return fmt.Errorf("rebuilt indexes of %s have %d incoming and %d outgoing transactions, state has %d and %d",
+				addr, incoming[addr], outgoing[addr], state.LastIncoming, state.LastNonce)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := bc.VerifyOutTxIndex(tx); err != nil {
+		return err
+	}
+
+	bc.log.Infof("Rebuilt transaction indexes of %d blocks", stats.TopHeight+1)
+	return nil
+}
+
+// VerifyOutTxIndex checks that every entry of the OUTTX bucket, keyed by sender address and nonce, points to a
+// transaction with that sender and nonce. SetTxTopoOut overwrites the previous entry of the same key, so a bug
+// indexing two transactions with the same nonce would otherwise go unnoticed.
+func (bc *Blockchain) VerifyOutTxIndex(tx *bolt.Tx) error {
+	btx := tx.Bucket([]byte{buck.TX})
+
+	var mismatches []error
+	var entries, mismatched int
+	err := tx.Bucket([]byte{buck.OUTTX}).ForEach(func(k, v []byte) error {
+		entries++
+		err := func() error {
+			if len(k) <= address.SIZE || len(v) != 32 {
+				return fmt.Errorf("malformed entry %x: %x", k, v)
+			}
+			addr := address.Address(k[:address.SIZE])
+			d := binary.NewDes(k[address.SIZE:])
+			outid := d.ReadUvarint()
+			if d.Error() != nil {
+				return fmt.Errorf("malformed entry %x: %w", k, d.Error())
+			}
+
+			txn, _, err := bc.buckGetTx(btx, [32]byte(v))
+			if err != nil {
+				return fmt.Errorf("outgoing transaction %d of %s: %w", outid, addr, err)
+			}
+			if sender := address.FromPubKey(txn.Sender); sender != addr || txn.Nonce != outid {
+				return fmt.Errorf("outgoing transaction %d of %s is %x, sent by %s with nonce %d", outid, addr,
+					v, sender, txn.Nonce)
+			}
+			return nil
+		}()
+		if err != nil {
+			mismatched++
+			if mismatched <= maxOutTxMismatches {
+				mismatches = append(mismatches, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if mismatched > maxOutTxMismatches {
+		mismatches = append(mismatches, fmt.Errorf("and %d more inconsistent entries",
+			mismatched-maxOutTxMismatches))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w:\n%w", ErrOutTxIndexMismatch, errors.Join(mismatches...))
+	}
+	bc.log.Debugf("Verified %d outgoing transaction index entries", entries)
+	return nil
+}
+
+// GetAddressTransactions returns the incoming and outgoing transactions of an address, oldest first. Coinbase
+// transactions are included in the incoming list as the hash of their block.
+func (bc *Blockchain) GetAddressTransactions(tx *bolt.Tx, addr address.Address) (incoming, outgoing [][32]byte,
+	err error) {
+	state, err := bc.GetState(tx, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	incoming = make([][32]byte, 0, state.LastIncoming)
+	for i := uint64(1); i <= state.LastIncoming; i++ {
+		txid, err := bc.GetTxTopoInc(tx, addr, i)
+		if err != nil {
+			return nil, nil, fmt.Errorf("incoming transaction %d of %s: %w", i, addr, err)
+		}
+		incoming = append(incoming, txid)
+	}
+	outgoing = make([][32]byte, 0, state.LastNonce)
+	for i := uint64(1); i <= state.LastNonce; i++ {
+		txid, err := bc.GetTxTopoOut(tx, addr, i)
+		if err != nil {
+			return nil, nil, fmt.Errorf("outgoing transaction %d of %s: %w", i, addr, err)
+		}
+		outgoing = append(outgoing, txid)
+	}
+	return incoming, outgoing, nil
+}
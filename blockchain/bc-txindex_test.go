@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"errors"
+	"reflect"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/util/buck"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRebuildTxIndexes(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	addrs := []address.Address{sender, recipient, address.GenesisAddress}
+
+	// the sender mines the blocks, and spends some of the reward in blocks 4 and 6
+	for i := 1; i <= 8; i++ {
+		if i == 4 || i == 6 {
+			if _, err := bc.SubmitTx(newTestTx(t, pk, uint64(i/2-1), config.COIN)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bl := newTestBlock(t, bc, sender)
+		addTestBlocks(t, bc, bl)
+	}
+
+	type lists struct {
+		incoming, outgoing [][32]byte
+	}
+	getLists := func() (l []lists) {
+		err := bc.DB.View(func(tx *bolt.Tx) error {
+			for _, addr := range addrs {
+				inc, out, err := bc.GetAddressTransactions(tx, addr)
+				if err != nil {
+					return err
+				}
+				l = append(l, lists{inc, out})
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	before := getLists()
+	if len(before[0].incoming) != 8 || len(before[0].outgoing) != 2 || len(before[1].incoming) != 2 {
+		t.Fatalf("unexpected transaction lists before rebuilding: %+v", before)
+	}
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []byte{buck.INTX, buck.OUTTX} {
+			if err := tx.DeleteBucket([]byte{name}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		return bc.RebuildTxIndexes(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := getLists()
+	for i, addr := range addrs {
+		if !reflect.DeepEqual(after[i], before[i]) {
+			t.Fatalf("transactions of %s are %+v after rebuilding, expected %+v", addr, after[i], before[i])
+		}
+	}
+}
+
+func TestVerifyOutTxIndex(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+
+	// the sender mines the blocks, and spends some of the reward in blocks 3 and 4
+	for i := 1; i <= 4; i++ {
+		if i >= 3 {
+			if _, err := bc.SubmitTx(newTestTx(t, pk, uint64(i-2), config.COIN)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bl := newTestBlock(t, bc, sender)
+		addTestBlocks(t, bc, bl)
+	}
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		return bc.VerifyOutTxIndex(tx)
+	})
+	if err != nil {
+		t.Fatal("consistent index:", err)
+	}
+
+	// the first outgoing transaction is overwritten by the second one
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		second, err := bc.GetTxTopoOut(tx, sender, 2)
+		if err != nil {
+			return err
+		}
+		return bc.SetTxTopoOut(tx, second, sender, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		return bc.VerifyOutTxIndex(tx)
+	})
+	if !errors.Is(err, ErrOutTxIndexMismatch) {
+		t.Fatalf("got error %v, expected %v", err, ErrOutTxIndexMismatch)
+	}
+
+	// rebuilding the indexes fixes the entry
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		return bc.RebuildTxIndexes(tx)
+	})
+	if err != nil {
+		t.Fatal("rebuilt index:", err)
+	}
+}
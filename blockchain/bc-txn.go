@@ -1,20 +1,61 @@
 package blockchain
 
 import (
+	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
+	"runtime"
+	"slices"
 	"still-blockchain/address"
 	"still-blockchain/binary"
+	"still-blockchain/block"
 	"still-blockchain/config"
 	"still-blockchain/p2p"
 	"still-blockchain/p2p/packet"
 	"still-blockchain/transaction"
 	"still-blockchain/util/buck"
+	"sync"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrInvalidNonce        = errors.New("invalid nonce")
+	ErrDuplicateTx         = errors.New("duplicate transaction")
+	ErrTxConfirmed         = errors.New("transaction already mined")
+	ErrMissingTx           = errors.New("missing transaction")
+	ErrTxOrder             = errors.New("transactions are not in canonical order")
+	ErrDustAmount          = errors.New("amount below dust threshold")
+	ErrFeeTooLow           = errors.New("fee below the minimum relay fee")
+)
+
+// SubmitTx validates a transaction received from an external source (like RPC), and adds it to mempool,
+// relaying it to the peers. The returned error can be checked with errors.Is against
+// transaction.ErrInvalidSignature, ErrInsufficientBalance, ErrInvalidNonce, ErrDuplicateTx, ErrTxConfirmed,
+// ErrDustAmount and ErrFeeTooLow.
+func (bc *Blockchain) SubmitTx(tx *transaction.Transaction) (transaction.TXID, error) {
+	hash := tx.Hash()
+
+	err := tx.Prevalidate()
+	if err != nil {
+		return hash, err
+	}
+
+	err = bc.DB.Update(func(txn *bolt.Tx) error {
+		if confirmed, height := bc.IsTxConfirmed(txn, hash); confirmed {
+			return fmt.Errorf("%w: %x in block %d", ErrTxConfirmed, hash, height)
+		}
+		if txn.Bucket([]byte{buck.TX}).Get(hash[:]) != nil {
+			return fmt.Errorf("%w: %x is already known", ErrDuplicateTx, hash)
+		}
+		return bc.AddTransaction(txn, tx, hash, true)
+	})
+	return hash, err
+}
+
 // Adds a transaction to mempool.
 // Transaction must be already prevalidated.
 // Blockchain MUST be locked before calling this
@@ -23,7 +64,11 @@ func (bc *Blockchain) AddTransaction(txn *bolt.Tx, tx *transaction.Transaction,
 
 	// check that transaction is not duplicate
 	if b.Get(hash[:]) != nil {
-		Log.Debug("transaction is already in database")
+		// transactions that are already mined can't be added to mempool again
+		if confirmed, height := bc.IsTxConfirmed(txn, hash); mempool && confirmed {
+			return fmt.Errorf("%w: %x in block %d", ErrTxConfirmed, hash, height)
+		}
+		bc.log.Debug("transaction is already in database")
 		return nil
 	}
 
@@ -33,16 +78,19 @@ func (bc *Blockchain) AddTransaction(txn *bolt.Tx, tx *transaction.Transaction,
 		// validate the transaction
 		err := bc.validateMempoolTx(txn, tx, hash)
 		if err != nil {
-			Log.Err("transaction is not valid in mempool:", err)
+			bc.log.Err("transaction is not valid in mempool:", err)
 			return err
 		}
 
-		go bc.BroadcastTx(hash, tx)
+		// a transaction is only announced once it's committed to mempool
+		txn.OnCommit(func() {
+			go bc.BroadcastTx(hash)
+		})
 	}
 
 	err := bc.SetTx(txn, tx, hash, 0)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
 
@@ -52,21 +100,23 @@ func (bc *Blockchain) AddTransaction(txn *bolt.Tx, tx *transaction.Transaction,
 		mem := bc.buckGetMempool(b)
 		if mem.GetEntry(hash) != nil {
 			err := fmt.Errorf("transaction %x already in mempool", hash)
-			Log.Warn(err)
+			bc.log.Warn(err)
 			return nil
 		}
 		mem.Entries = append(mem.Entries, &MempoolEntry{
 			TXID:      hash,
 			Size:      tx.GetVirtualSize(),
 			Fee:       tx.Fee,
+			Nonce:     tx.Nonce,
 			Expires:   time.Now().Add(config.MEMPOOL_EXPIRATION).Unix(),
 			Sender:    address.FromPubKey(tx.Sender),
 			Recipient: tx.Recipient,
 		})
 		bc.buckSetMempool(b, mem)
-		Log.Debugf("Added transaction %x to mempool", hash)
+		bc.countMempoolAdded(txn)
+		bc.log.Debugf("Added transaction %x to mempool", hash)
 	} else {
-		Log.Debugf("Added transaction %x", hash)
+		bc.log.Debugf("Added transaction %x", hash)
 	}
 
 	return nil
@@ -104,6 +154,108 @@ func (bc *Blockchain) buckGetTx(buck *bolt.Bucket, hash transaction.TXID) (*tran
 	return tx, height, tx.Deserialize(des.RemainingData())
 }
 
+// checkBlockTxs verifies that all the transactions referenced by the block are in the database.
+// The returned error wraps ErrMissingTx, so the block can be requested again along with its transactions.
+func (bc *Blockchain) checkBlockTxs(txn *bolt.Tx, bl *block.Block) error {
+	b := txn.Bucket([]byte{buck.TX})
+	for _, v := range bl.Transactions {
+		if b.Get(v[:]) == nil {
+			return fmt.Errorf("%w %x in block height %d", ErrMissingTx, v, bl.Height)
+		}
+	}
+	return nil
+}
+
+// compareTxOrder compares two transactions by their canonical order in a block: by sender, then by nonce
+func compareTxOrder(a, b *transaction.Transaction) int {
+	if c := bytes.Compare(a.Sender[:], b.Sender[:]); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Nonce, b.Nonce)
+}
+
+// checkTxOrder verifies that the block's transactions are sorted by sender, and that the transactions of each
+// sender have strictly increasing nonces. The transactions must be already in the database. The rule has no
+// activation height, since the network hasn't launched yet (see the config package).
+func (bc *Blockchain) checkTxOrder(txn *bolt.Tx, bl *block.Block) error {
+	btx := txn.Bucket([]byte{buck.TX})
+	var prev *transaction.Transaction
+	for _, v := range bl.Transactions {
+		t, _, err := bc.buckGetTx(btx, v)
+		if err != nil {
+			return err
+		}
+		if prev != nil && compareTxOrder(prev, t) >= 0 {
+			return fmt.Errorf("%w: transaction %x in block height %d", ErrTxOrder, v, bl.Height)
+		}
+		prev = t
+	}
+	return nil
+}
+
+// prevalidateTxs prevalidates the transactions of a block, verifying their signatures in parallel on
+// runtime.NumCPU() workers. State checks (balances and nonces) are not done here, since they depend on the
+// transaction order and are done later, when the block is applied to state.
+func prevalidateTxs(txs []*transaction.Transaction) error {
+	workers := min(runtime.NumCPU(), len(txs))
+	if workers <= 1 {
+		for _, tx := range txs {
+			if err := tx.Prevalidate(); err != nil {
+				return fmt.Errorf("transaction %x: %w", tx.Hash(), err)
+			}
+		}
+		return nil
+	}
+
+	jobs := make(chan *transaction.Transaction)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tx := range jobs {
+				if err := tx.Prevalidate(); err != nil {
+					errs <- fmt.Errorf("transaction %x: %w", tx.Hash(), err)
+					return
+				}
+			}
+		}()
+	}
+
+	// stop feeding transactions as soon as one of them is invalid
+	var err error
+	for _, tx := range txs {
+		select {
+		case jobs <- tx:
+		case err = <-errs:
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// IsTxConfirmed returns true and the inclusion height if the transaction is included in a mainchain block
+func (bc *Blockchain) IsTxConfirmed(txn *bolt.Tx, hash transaction.TXID) (bool, uint64) {
+	txbin := txn.Bucket([]byte{buck.TX}).Get(hash[:])
+	if len(txbin) < 8 {
+		return false, 0
+	}
+	height := binary.LittleEndian.Uint64(txbin[:8])
+	return height != 0, height
+}
+
 func (bc *Blockchain) SetTx(txn *bolt.Tx, tx *transaction.Transaction, hash transaction.TXID, height uint64) error {
 	b := txn.Bucket([]byte{buck.TX})
 
@@ -115,7 +267,7 @@ func (bc *Blockchain) SetTx(txn *bolt.Tx, tx *transaction.Transaction, hash tran
 
 	err := b.Put(hash[:], ser.Output())
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
 	return nil
@@ -124,82 +276,171 @@ func (bc *Blockchain) SetTx(txn *bolt.Tx, tx *transaction.Transaction, hash tran
 func (bc *Blockchain) SetTxHeight(txn *bolt.Tx, hash transaction.TXID, height uint64) error {
 	b := txn.Bucket([]byte{buck.TX})
 
-	txbin := b.Get(hash[:])
+	// values returned by Get point to read-only memory, so they must be copied before being modified
+	txbin := slices.Clone(b.Get(hash[:]))
 	if len(txbin) < 8 {
 		return errors.New("cannot SetTxHeight: transaction not in database")
 	}
 
 	binary.LittleEndian.PutUint64(txbin[:8], height)
 
-	b.Put(hash[:], txbin)
-
-	return nil
+	return b.Put(hash[:], txbin)
 }
 
-// use this method to validate that a transaction in mempool is valid
+// validateMempoolTx checks that a transaction can be added to mempool. Transactions with a nonce gap of up to
+// config.MEMPOOL_MAX_NONCE_GAP are accepted, and parked until the missing nonces arrive (see
+// Mempool.ReadyTransactions). The balance must be enough for this and all the other mempool transactions of
+// the sender.
 func (bc *Blockchain) validateMempoolTx(txn *bolt.Tx, tx *transaction.Transaction, hash [32]byte) error {
 	bstate := txn.Bucket([]byte{buck.STATE})
 	btx := txn.Bucket([]byte{buck.TX})
 
 	senderAddr := address.FromPubKey(tx.Sender)
 
+	// dust transactions are valid in blocks, but they are not relayed nor mined by this node
+	if tx.Amount < config.DUST_THRESHOLD {
+		err := fmt.Errorf("%w: transaction %x amount %d is less than %d", ErrDustAmount, hash, tx.Amount,
+			config.DUST_THRESHOLD)
+		bc.log.Warn(err)
+		return err
+	}
+
+	// the minimum relay fee rises with mempool congestion, while blocks only require the static minimum fee
+	mem := bc.GetMempool(txn)
+	if minFee := relayFeePerByte(mem.Size()) * tx.GetVirtualSize(); tx.Fee < minFee {
+		err := fmt.Errorf("%w: transaction %x fee %d is less than %d", ErrFeeTooLow, hash, tx.Fee, minFee)
+		bc.log.Warn(err)
+		return err
+	}
+
 	// get sender state
 	senderState, err := bc.buckGetState(bstate, senderAddr)
 	if err != nil {
-		Log.Err(err)
+		// sender is not in state, so it doesn't have any balance
+		err = fmt.Errorf("%w: %v", ErrInsufficientBalance, err)
+		bc.log.Warn(err)
 		return err
 	}
 
-	// apply all the previous mempool transactions to sender state
-	Log.Dev("sender state before applying all the mempool transactions:", senderState)
-	mem := bc.GetMempool(txn)
+	if tx.Nonce <= senderState.LastNonce || tx.Nonce > senderState.LastNonce+config.MEMPOOL_MAX_NONCE_GAP {
+		err = fmt.Errorf("%w: transaction %x has unexpected nonce: %d, previous nonce: %d", ErrInvalidNonce,
+			hash, tx.Nonce, senderState.LastNonce)
+		bc.log.Warn(err)
+		return err
+	}
+
+	// sum the sender's pending mempool transactions
+	bc.log.Dev("sender state before applying all the mempool transactions:", senderState)
+	var outgoing, incoming uint64
 	for _, v := range mem.Entries {
-		if v.TXID == hash {
-			// avoid applying this tx (or future transactions) - mempool is guaranteed to be ordered correctly
-			break
+		if v.TXID == hash || (v.Sender != senderAddr && v.Recipient != senderAddr) {
+			continue
+		}
+		if v.Sender == senderAddr && v.Nonce == tx.Nonce {
+			err = fmt.Errorf("%w: nonce %d is already used by mempool transaction %x", ErrInvalidNonce,
+				tx.Nonce, v.TXID)
+			bc.log.Warn(err)
+			return err
 		}
 
-		// apply this transaction if it modifies sender state
-		if v.Sender == senderAddr || v.Recipient == senderAddr {
-			vt, _, err := bc.buckGetTx(btx, v.TXID)
-			if err != nil {
-				Log.Err(err)
-				return err
-			}
-
-			if v.Sender == senderAddr {
-				senderState.Balance -= vt.Amount
-				senderState.Balance -= vt.Fee
-				senderState.LastNonce++
-			} else if v.Recipient == senderAddr {
-				senderState.Balance += vt.Amount
-			}
+		vt, _, err := bc.buckGetTx(btx, v.TXID)
+		if err != nil {
+			bc.log.Err(err)
+			return err
+		}
+		if v.Sender == senderAddr {
+			outgoing += vt.Amount + vt.Fee
+		} else {
+			incoming += vt.Amount
 		}
 	}
-	Log.Dev("sender state after applying all the mempool transactions:", senderState)
+	bc.log.Devf("sender mempool transactions: outgoing %d, incoming %d", outgoing, incoming)
 
-	if senderState.Balance < tx.Amount+tx.Fee {
-		err = fmt.Errorf("transaction %x spends too much money: balance: %d, amount: %d, fee: %d", hash,
-			senderState.Balance, tx.Amount, tx.Fee)
-		Log.Warn(err)
-		return err
-	}
-	if tx.Nonce != senderState.LastNonce+1 {
-		err = fmt.Errorf("transaction %x has unexpected nonce: %d, previous nonce: %d", hash,
-			tx.Nonce, senderState.LastNonce)
-		Log.Warn(err)
+	if senderState.Balance+incoming < outgoing+tx.Amount+tx.Fee {
+		err = fmt.Errorf("%w: transaction %x spends too much money: balance: %d, pending: %d, amount: %d, "+
+			"fee: %d", ErrInsufficientBalance, hash, senderState.Balance+incoming, outgoing, tx.Amount, tx.Fee)
+		bc.log.Warn(err)
 		return err
 	}
 
 	return nil
 }
 
-func (bc *Blockchain) BroadcastTx(hash [32]byte, tx *transaction.Transaction) {
-	Log.Debugf("broadcasting transaction %x", hash)
+// BroadcastTx announces the transaction to all the peers with an INV packet. Peers that don't have the
+// transaction yet request it with a TX_REQUEST packet.
+func (bc *Blockchain) BroadcastTx(hash [32]byte) {
+	bc.log.Debugf("broadcasting transaction %x", hash)
+
+	bc.P2P.RLock()
+	conns := make([]*p2p.Connection, 0, len(bc.P2P.Connections))
 	for _, c := range bc.P2P.Connections {
+		conns = append(conns, c)
+	}
+	bc.P2P.RUnlock()
+
+	inv := packet.PacketInv{Hashes: [][32]byte{hash}}.Serialize()
+	for _, c := range conns {
 		c.SendPacket(&p2p.Packet{
-			Type: packet.TX,
-			Data: tx.Serialize(),
+			Type: packet.INV,
+			Data: inv,
 		})
 	}
 }
+
+// RebroadcastMempool relays every mempool transaction to all the connected peers again, for example
+// after the peers have restarted and lost their mempool. The transactions are relayed in the background, and the
+// number of transactions being relayed is returned.
+func (bc *Blockchain) RebroadcastMempool() int {
+	hashes := bc.mempoolTxsOlderThan(0)
+	go bc.rebroadcastTxs(hashes)
+	return len(hashes)
+}
+
+// mempoolTxsOlderThan returns the hashes of the transactions that have been in mempool for at least minAge
+func (bc *Blockchain) mempoolTxsOlderThan(minAge time.Duration) [][32]byte {
+	var hashes [][32]byte
+	bc.DB.View(func(txn *bolt.Tx) error {
+		// entries expire MEMPOOL_EXPIRATION after being added
+		maxExpires := time.Now().Add(config.MEMPOOL_EXPIRATION - minAge).Unix()
+
+		for _, v := range bc.GetMempool(txn).Entries {
+			if v.Expires <= maxExpires {
+				hashes = append(hashes, v.TXID)
+			}
+		}
+		return nil
+	})
+	return hashes
+}
+
+// rebroadcastTxs relays the given transactions, sending at most config.MEMPOOL_REBROADCAST_RATE transactions per
+// second. It stops early if the blockchain is shutting down.
+func (bc *Blockchain) rebroadcastTxs(hashes [][32]byte) {
+	if len(hashes) == 0 {
+		return
+	}
+	bc.log.Debugf("rebroadcasting %d mempool transactions", len(hashes))
+
+	ticker := time.NewTicker(time.Second / config.MEMPOOL_REBROADCAST_RATE)
+	defer ticker.Stop()
+	for _, hash := range hashes {
+		if bc.IsShuttingDown() {
+			return
+		}
+		bc.BroadcastTx(hash)
+		<-ticker.C
+	}
+}
+
+// mempoolRebroadcaster periodically relays the transactions which haven't been mined for a while, until the
+// blockchain is shut down
+func (bc *Blockchain) mempoolRebroadcaster() {
+	for {
+		time.Sleep(config.MEMPOOL_REBROADCAST_AGE)
+		if bc.IsShuttingDown() {
+			return
+		}
+
+		bc.rebroadcastTxs(bc.mempoolTxsOlderThan(config.MEMPOOL_REBROADCAST_AGE))
+	}
+}
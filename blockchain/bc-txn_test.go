@@ -0,0 +1,598 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
+	"still-blockchain/block"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"still-blockchain/p2p/packet"
+	"still-blockchain/transaction"
+	"testing"
+	"time"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestTx(t testing.TB, pk bitcrypto.Privkey, nonce, amount uint64) *transaction.Transaction {
+	t.Helper()
+
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	tx, err := transaction.New(pk, recipient, amount, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestSubmitTx(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+
+	tx := newTestTx(t, pk, 1, config.COIN)
+	txid, err := bc.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != tx.Hash() {
+		t.Fatalf("unexpected txid %x, expected %x", txid, tx.Hash())
+	}
+
+	bc.DB.View(func(txn *bolt.Tx) error {
+		if bc.GetMempool(txn).GetEntry(txid) == nil {
+			t.Fatal("transaction was not added to mempool")
+		}
+		return nil
+	})
+
+	// the next transaction must account for the one in mempool
+	_, err = bc.SubmitTx(newTestTx(t, pk, 2, config.COIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitTxRejected(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance:   10 * config.COIN,
+		LastNonce: 3,
+	})
+
+	accepted := newTestTx(t, pk, 4, config.COIN)
+	_, err := bc.SubmitTx(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badSig := newTestTx(t, pk, 5, config.COIN)
+	badSig.Amount++
+
+	unfunded := address.GenerateKeypair(blake3.Sum256([]byte("unfunded")))
+
+	tests := []struct {
+		name string
+		tx   *transaction.Transaction
+		err  error
+	}{
+		{"invalid signature", badSig, transaction.ErrInvalidSignature},
+		{"insufficient balance", newTestTx(t, pk, 5, 9*config.COIN), ErrInsufficientBalance},
+		{"unknown sender", newTestTx(t, unfunded, 1, config.COIN), ErrInsufficientBalance},
+		{"nonce too low", newTestTx(t, pk, 3, config.COIN), ErrInvalidNonce},
+		{"nonce too high", newTestTx(t, pk, 3+config.MEMPOOL_MAX_NONCE_GAP+1, config.COIN), ErrInvalidNonce},
+		{"nonce in mempool", newTestTx(t, pk, 4, 2*config.COIN), ErrInvalidNonce},
+		{"duplicate", accepted, ErrDuplicateTx},
+	}
+
+	for _, v := range tests {
+		_, err := bc.SubmitTx(v.tx)
+		if !errors.Is(err, v.err) {
+			t.Errorf("%s: got error %v, expected %v", v.name, err, v.err)
+		}
+	}
+}
+
+func TestSubmitConfirmedTx(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+
+	tx := newTestTx(t, pk, 1, config.COIN)
+	txid, err := bc.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mine the transaction
+	bl := newTestBlock(t, bc, address.GenesisAddress)
+	if len(bl.Transactions) != 1 || bl.Transactions[0] != txid {
+		t.Fatalf("block template should include the transaction, got %x", bl.Transactions)
+	}
+	addTestBlocks(t, bc, bl)
+
+	bc.DB.View(func(txn *bolt.Tx) error {
+		confirmed, height := bc.IsTxConfirmed(txn, txid)
+		if !confirmed || height != bl.Height {
+			t.Fatalf("transaction should be confirmed at height %d, got %v %d", bl.Height, confirmed, height)
+		}
+		return nil
+	})
+
+	_, err = bc.SubmitTx(tx)
+	if !errors.Is(err, ErrTxConfirmed) {
+		t.Fatalf("got error %v, expected %v", err, ErrTxConfirmed)
+	}
+	err = bc.DB.Update(func(txn *bolt.Tx) error {
+		return bc.AddTransaction(txn, tx, txid, true)
+	})
+	if !errors.Is(err, ErrTxConfirmed) {
+		t.Fatalf("got error %v, expected %v", err, ErrTxConfirmed)
+	}
+
+	_, err = bc.SubmitTx(newTestTx(t, pk, 2, config.COIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testPeerPacket struct {
+	Type uint16
+	Data []byte
+}
+
+// addTestPeer connects a mock peer to the blockchain's P2P, returning the connection and a channel with the
+// decrypted packets the peer receives
+func addTestPeer(t *testing.T, bc *Blockchain, ipPort string) (*p2p.Connection, <-chan testPeerPacket) {
+	t.Helper()
+
+	cip, err := bitcrypto.NewCipher(blake3.Sum256([]byte(ipPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	conn := p2p.NewConnection(local, true)
+	conn.Update(func(c *p2p.ConnData) error {
+		c.Cipher = cip
+		return nil
+	})
+	t.Cleanup(func() {
+		conn.View(func(c *p2p.ConnData) error {
+			c.Close()
+			return nil
+		})
+	})
+
+	bc.P2P.Lock()
+	bc.P2P.Connections[ipPort] = conn
+	bc.P2P.Unlock()
+
+	packets := make(chan testPeerPacket, 100)
+	go func() {
+		defer close(packets)
+		for {
+			lenBuf := make([]byte, 4)
+			if _, err := io.ReadFull(remote, lenBuf); err != nil {
+				return
+			}
+			data := make([]byte, binary.LittleEndian.Uint32(lenBuf))
+			if _, err := io.ReadFull(remote, data); err != nil {
+				return
+			}
+			data, err := cip.Decrypt(data)
+			if err != nil || len(data) < 2 {
+				t.Errorf("invalid packet: %v", err)
+				return
+			}
+			packets <- testPeerPacket{
+				Type: binary.LittleEndian.Uint16(data),
+				Data: data[2:],
+			}
+		}
+	}()
+
+	return conn, packets
+}
+
+func TestRebroadcastMempool(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+
+	// add the transactions directly to mempool, without relaying them
+	txs := make(map[transaction.TXID]bool)
+	err := bc.DB.Update(func(txn *bolt.Tx) error {
+		mem := bc.GetMempool(txn)
+		for i := uint64(1); i <= 3; i++ {
+			tx := newTestTx(t, pk, i, config.COIN)
+			hash := tx.Hash()
+
+			// the first transaction has been in mempool for longer than MEMPOOL_REBROADCAST_AGE
+			added := time.Now()
+			if i == 1 {
+				added = added.Add(-2 * config.MEMPOOL_REBROADCAST_AGE)
+			}
+
+			err := bc.SetTx(txn, tx, hash, 0)
+			if err != nil {
+				return err
+			}
+			mem.Entries = append(mem.Entries, &MempoolEntry{
+				TXID:    hash,
+				Expires: added.Add(config.MEMPOOL_EXPIRATION).Unix(),
+			})
+			txs[hash] = true
+		}
+		bc.SetMempool(txn, mem)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, peer1 := addTestPeer(t, bc, "127.0.0.1:1")
+	_, peer2 := addTestPeer(t, bc, "127.0.0.1:2")
+	peers := []<-chan testPeerPacket{peer1, peer2}
+
+	receive := func(expected int) []transaction.TXID {
+		t.Helper()
+
+		var received []transaction.TXID
+		for i, peer := range peers {
+			for j := 0; j < expected; j++ {
+				var pk testPeerPacket
+				select {
+				case pk = <-peer:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("peer %d received %d packets, expected %d", i, j, expected)
+				}
+				if pk.Type != uint16(packet.INV)+2 {
+					t.Fatalf("peer %d received packet type %d, expected INV", i, pk.Type)
+				}
+				inv := packet.PacketInv{}
+				if err := inv.Deserialize(pk.Data); err != nil {
+					t.Fatal(err)
+				}
+				if len(inv.Hashes) != 1 {
+					t.Fatalf("peer %d received inventory with %d hashes, expected 1", i, len(inv.Hashes))
+				}
+				received = append(received, inv.Hashes[0])
+			}
+			select {
+			case pk := <-peer:
+				t.Fatalf("peer %d received unexpected packet of type %d", i, pk.Type)
+			default:
+			}
+		}
+		return received
+	}
+
+	n := bc.RebroadcastMempool()
+	if n != len(txs) {
+		t.Fatalf("relayed %d transactions, expected %d", n, len(txs))
+	}
+	received := receive(len(txs))
+	for _, hash := range received {
+		if !txs[hash] {
+			t.Fatalf("peer received unknown transaction %x", hash)
+		}
+	}
+	if len(received) != len(txs)*len(peers) {
+		t.Fatalf("peers received %d transactions, expected %d", len(received), len(txs)*len(peers))
+	}
+
+	// the periodic rebroadcast only relays the old transactions
+	old := bc.mempoolTxsOlderThan(config.MEMPOOL_REBROADCAST_AGE)
+	if len(old) != 1 {
+		t.Fatalf("found %d old transactions, expected 1", len(old))
+	}
+	bc.rebroadcastTxs(old)
+	receive(1)
+
+	// nothing is relayed once the blockchain is shutting down
+	bc.shutdownInfo.Lock()
+	bc.shutdownInfo.ShuttingDown = true
+	bc.shutdownInfo.Unlock()
+	bc.rebroadcastTxs(old)
+	receive(0)
+	bc.shutdownInfo.Lock()
+	bc.shutdownInfo.ShuttingDown = false
+	bc.shutdownInfo.Unlock()
+}
+
+func TestAddBlockMissingTx(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	addr := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	bl := newTestBlock(t, bc, addr)
+	bl.Transactions = append(bl.Transactions, blake3.Sum256([]byte("missing")))
+
+	err := bc.DB.Update(func(txn *bolt.Tx) error {
+		_, err := bc.AddBlock(txn, bl)
+		return err
+	})
+	if !errors.Is(err, ErrMissingTx) {
+		t.Fatalf("expected ErrMissingTx, got %v", err)
+	}
+
+	bc.DB.View(func(txn *bolt.Tx) error {
+		if _, err := bc.GetBlock(txn, bl.Hash()); err == nil {
+			t.Fatal("block with missing transaction was added")
+		}
+		if h := bc.GetStats(txn).TopHeight; h != 0 {
+			t.Fatalf("top height is %d, expected 0", h)
+		}
+		return nil
+	})
+
+	err = bc.DB.Update(func(txn *bolt.Tx) error {
+		return bc.ApplyBlockToState(txn, bl, bl.Hash())
+	})
+	if !errors.Is(err, ErrMissingTx) {
+		t.Fatalf("expected ErrMissingTx when applying state, got %v", err)
+	}
+}
+
+func TestSubmitTxDust(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+		Balance: 10 * config.COIN,
+	})
+
+	_, err := bc.SubmitTx(newTestTx(t, pk, 1, config.DUST_THRESHOLD-1))
+	if !errors.Is(err, ErrDustAmount) {
+		t.Fatalf("expected ErrDustAmount, got %v", err)
+	}
+
+	_, err = bc.SubmitTx(newTestTx(t, pk, 1, config.DUST_THRESHOLD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.SubmitTx(newTestTx(t, pk, 2, config.DUST_THRESHOLD+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMempoolNonceGap(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	setTestState(t, bc, sender, &State{
+		Balance: 10 * config.COIN,
+	})
+
+	readyTxs := func() []transaction.TXID {
+		var ready []transaction.TXID
+		bc.DB.View(func(txn *bolt.Tx) error {
+			entries := bc.GetMempool(txn).ReadyTransactions(func(addr address.Address) uint64 {
+				state, err := bc.GetState(txn, addr)
+				if err != nil {
+					return 0
+				}
+				return state.LastNonce
+			})
+			for _, v := range entries {
+				ready = append(ready, v.TXID)
+			}
+			return nil
+		})
+		return ready
+	}
+	templateTxs := func() []transaction.TXID {
+		var bl *block.Block
+		err := bc.DB.View(func(txn *bolt.Tx) (err error) {
+			bl, _, err = bc.GetBlockTemplate(txn, sender)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bl.Transactions
+	}
+
+	tx1 := newTestTx(t, pk, 1, config.COIN)
+	tx2 := newTestTx(t, pk, 2, config.COIN)
+	tx3 := newTestTx(t, pk, 3, config.COIN)
+
+	// transactions 1 and 3 are accepted, but 3 is parked because nonce 2 is missing
+	for _, tx := range []*transaction.Transaction{tx1, tx3} {
+		if _, err := bc.SubmitTx(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []transaction.TXID{tx1.Hash()}
+	if ready := readyTxs(); !slices.Equal(ready, expected) {
+		t.Fatalf("ready transactions are %x, expected %x", ready, expected)
+	}
+	if txs := templateTxs(); !slices.Equal(txs, expected) {
+		t.Fatalf("block template transactions are %x, expected %x", txs, expected)
+	}
+
+	// once the missing nonce arrives, all the transactions are ready in nonce order
+	if _, err := bc.SubmitTx(tx2); err != nil {
+		t.Fatal(err)
+	}
+	expected = []transaction.TXID{tx1.Hash(), tx2.Hash(), tx3.Hash()}
+	if ready := readyTxs(); !slices.Equal(ready, expected) {
+		t.Fatalf("ready transactions are %x, expected %x", ready, expected)
+	}
+	if txs := templateTxs(); !slices.Equal(txs, expected) {
+		t.Fatalf("block template transactions are %x, expected %x", txs, expected)
+	}
+}
+
+func TestGetNextNonce(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	setTestState(t, bc, sender, &State{
+		Balance:   10 * config.COIN,
+		LastNonce: 4,
+	})
+
+	check := func(lastNonce, next uint64, pending int) {
+		t.Helper()
+		bc.DB.View(func(txn *bolt.Tx) error {
+			l, n, p := bc.GetNextNonce(txn, sender)
+			if l != lastNonce || n != next || p != pending {
+				t.Fatalf("last nonce %d, next nonce %d, pending %d; expected %d, %d, %d", l, n, p, lastNonce,
+					next, pending)
+			}
+			return nil
+		})
+	}
+
+	check(4, 5, 0)
+
+	// the pending transaction uses nonce 5
+	if _, err := bc.SubmitTx(newTestTx(t, pk, 5, config.COIN)); err != nil {
+		t.Fatal(err)
+	}
+	check(4, 6, 1)
+
+	// a transaction after a nonce gap doesn't change the next nonce
+	if _, err := bc.SubmitTx(newTestTx(t, pk, 7, config.COIN)); err != nil {
+		t.Fatal(err)
+	}
+	check(4, 6, 2)
+
+	// addresses not in state start from nonce 1
+	bc.DB.View(func(txn *bolt.Tx) error {
+		recipient := newTestTx(t, pk, 1, 1).Recipient
+		if l, n, p := bc.GetNextNonce(txn, recipient); l != 0 || n != 1 || p != 0 {
+			t.Fatalf("unknown address: last nonce %d, next nonce %d, pending %d", l, n, p)
+		}
+		return nil
+	})
+}
+
+func TestBlockTxOrder(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pkA := address.GenerateKeypair(blake3.Sum256([]byte("sender A")))
+	pkB := address.GenerateKeypair(blake3.Sum256([]byte("sender B")))
+	for _, pk := range []bitcrypto.Privkey{pkA, pkB} {
+		setTestState(t, bc, address.FromPubKey(pk.Public()), &State{
+			Balance: 10 * config.COIN,
+		})
+	}
+
+	txs := map[transaction.TXID]*transaction.Transaction{}
+	for _, tx := range []*transaction.Transaction{
+		newTestTx(t, pkA, 1, config.COIN),
+		newTestTx(t, pkB, 1, config.COIN),
+		newTestTx(t, pkA, 2, config.COIN),
+		newTestTx(t, pkB, 2, config.COIN),
+	} {
+		if _, err := bc.SubmitTx(tx); err != nil {
+			t.Fatal(err)
+		}
+		txs[tx.Hash()] = tx
+	}
+
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	bl := newTestBlock(t, bc, miner)
+	if len(bl.Transactions) != len(txs) {
+		t.Fatalf("block template has %d transactions, expected %d", len(bl.Transactions), len(txs))
+	}
+	if !slices.IsSortedFunc(bl.Transactions, func(a, b transaction.TXID) int {
+		return compareTxOrder(txs[a], txs[b])
+	}) {
+		t.Fatal("block template transactions are not in canonical order")
+	}
+
+	// swap the two transactions of the first sender, so that their nonces are out of order
+	invalid := *bl
+	invalid.Transactions = slices.Clone(bl.Transactions)
+	invalid.Transactions[0], invalid.Transactions[1] = invalid.Transactions[1], invalid.Transactions[0]
+	err := bc.DB.Update(func(txn *bolt.Tx) error {
+		_, err := bc.AddBlock(txn, &invalid)
+		return err
+	})
+	if !errors.Is(err, ErrTxOrder) {
+		t.Fatalf("expected ErrTxOrder, got %v", err)
+	}
+
+	addTestBlocks(t, bc, bl)
+}
+
+// newTestTxs returns n valid transactions from different senders
+func newTestTxs(t testing.TB, n int) []*transaction.Transaction {
+	t.Helper()
+
+	txs := make([]*transaction.Transaction, n)
+	for i := range txs {
+		pk := address.GenerateKeypair(blake3.Sum256(binary.LittleEndian.AppendUint64([]byte("sender"), uint64(i))))
+		txs[i] = newTestTx(t, pk, 1, config.COIN)
+	}
+	return txs
+}
+
+func TestPrevalidateTxs(t *testing.T) {
+	txs := newTestTxs(t, 64)
+	if err := prevalidateTxs(txs); err != nil {
+		t.Fatal(err)
+	}
+	if err := prevalidateTxs(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a single invalid signature makes the whole block invalid, wherever it is
+	for _, i := range []int{0, len(txs) / 2, len(txs) - 1} {
+		bad := slices.Clone(txs)
+		tx := *bad[i]
+		tx.Signature[0] ^= 0xff
+		bad[i] = &tx
+
+		err := prevalidateTxs(bad)
+		if !errors.Is(err, transaction.ErrInvalidSignature) {
+			t.Fatalf("invalid signature at index %d: expected ErrInvalidSignature, got %v", i, err)
+		}
+	}
+}
+
+func BenchmarkPrevalidateTxs(b *testing.B) {
+	txs := newTestTxs(b, 256)
+
+	b.Run("Sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, tx := range txs {
+				if err := tx.Prevalidate(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := prevalidateTxs(txs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/block"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The View methods are safe to call concurrently: each of them opens its own read-only database
+// transaction, so the caller doesn't need to hold one. Use the variants taking a *bolt.Tx to read multiple
+// values consistently within a single transaction.
+
+// ViewBlock returns the block given its hash
+func (bc *Blockchain) ViewBlock(hash [32]byte) (bl *block.Block, err error) {
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		bl, err = bc.GetBlock(tx, hash)
+		return err
+	})
+	return
+}
+
+// ViewBlockHeader returns the header of the block given its hash
+func (bc *Blockchain) ViewBlockHeader(hash [32]byte) (bl *block.BlockHeader, err error) {
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		bl, err = bc.GetBlockHeader(tx, hash)
+		return err
+	})
+	return
+}
+
+// ViewState returns the state of the given address
+func (bc *Blockchain) ViewState(addr address.Address) (s *State, err error) {
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		s, err = bc.GetState(tx, addr)
+		return err
+	})
+	return
+}
+
+// ViewStats returns the blockchain stats
+func (bc *Blockchain) ViewStats() (s *Stats) {
+	bc.DB.View(func(tx *bolt.Tx) error {
+		s = bc.GetStats(tx)
+		return nil
+	})
+	return
+}
+
+// ViewMempool returns the mempool
+func (bc *Blockchain) ViewMempool() (m *Mempool) {
+	bc.DB.View(func(tx *bolt.Tx) error {
+		m = bc.GetMempool(tx)
+		return nil
+	})
+	return
+}
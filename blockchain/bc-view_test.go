@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"reflect"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestViewMethods(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	addTestBlocks(t, bc, newTestChain(t, nil, 2)...)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	addr := address.FromPubKey(pk.Public())
+	setTestState(t, bc, addr, &State{
+		Balance: 10 * config.COIN,
+	})
+	_, err := bc.SubmitTx(newTestTx(t, pk, 1, config.COIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		if v := bc.ViewStats(); !reflect.DeepEqual(v, stats) {
+			t.Errorf("ViewStats returned %+v, expected %+v", v, stats)
+		}
+
+		bl, err := bc.GetBlock(tx, stats.TopHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := bc.ViewBlock(stats.TopHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Hash() != bl.Hash() || !v.CumulativeDiff.Equals(bl.CumulativeDiff) {
+			t.Errorf("ViewBlock returned %x, expected %x", v.Hash(), bl.Hash())
+		}
+
+		header, err := bc.ViewBlockHeader(stats.TopHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(header.Serialize()) != string(bl.BlockHeader.Serialize()) {
+			t.Error("ViewBlockHeader does not match the block header")
+		}
+
+		state, err := bc.GetState(tx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vstate, err := bc.ViewState(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *vstate != *state {
+			t.Errorf("ViewState returned %+v, expected %+v", vstate, state)
+		}
+
+		if mem := bc.ViewMempool(); !reflect.DeepEqual(mem, bc.GetMempool(tx)) {
+			t.Errorf("ViewMempool returned %+v, expected %+v", mem, bc.GetMempool(tx))
+		}
+		return nil
+	})
+
+	// errors are returned like in the tx variants
+	if _, err := bc.ViewBlock([32]byte{1}); err == nil {
+		t.Error("expected error for unknown block")
+	}
+	if _, err := bc.ViewState(address.Address{1}); err == nil {
+		t.Error("expected error for unknown address")
+	}
+}
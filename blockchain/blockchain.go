@@ -3,17 +3,20 @@ package blockchain
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"still-blockchain/address"
 	"still-blockchain/binary"
+	"still-blockchain/bitcrypto"
 	"still-blockchain/block"
 	"still-blockchain/config"
 	"still-blockchain/logger"
 	"still-blockchain/p2p"
-	"still-blockchain/p2p/packet"
 	"still-blockchain/stratum/stratumsrv"
 	"still-blockchain/transaction"
 	"still-blockchain/util"
 	"still-blockchain/util/buck"
+	"still-blockchain/util/metrics"
 	"still-blockchain/util/uint128"
 	"sync"
 	"time"
@@ -27,14 +30,21 @@ type Uint128 = uint128.Uint128
 
 // Blockchain represents a Blockchain structure, for storing transactions
 type Blockchain struct {
+	DataDir string // directory where the database and other node files are saved
 	DB      *bolt.DB
 	P2P     *p2p.P2P
 	Stratum *stratumsrv.Server
 
+	log      logger.Logger
+	fastSync bool // if true, database writes are not synced to disk immediately, see Options
+
 	shutdownInfo shutdownInfo
 
 	Mining bool // locked by MergesMut
 
+	// if not empty, blocks can only be mined to one of these addresses
+	AllowedRecipients []address.Address
+
 	Merges        []*mergestratum
 	MergesMut     util.RWMutex
 	mergesUpdated bool
@@ -42,9 +52,30 @@ type Blockchain struct {
 
 	BlockQueue *BlockQueue
 
-	SyncHeight uint64  // top height seen from remote nodes
-	SyncDiff   Uint128 // top cumulative diff seen from remote nodes
-	SyncMut    util.RWMutex
+	SyncHeight        uint64  // top height seen from remote nodes
+	SyncDiff          Uint128 // top cumulative diff seen from remote nodes
+	parallelDownloads int     // max number of blocks downloaded in parallel
+	SyncMut           util.RWMutex
+
+	statsSender statsSender
+
+	Metrics *metrics.Registry
+	metrics bcMetrics
+
+	events      bcEvents
+	propagation propagationStats
+	relay       blockRelay
+	txRequests  txRequests
+	bootstrap   bootstrapCache
+
+	StallTimeout time.Duration // the chain is reported as stalled after this long without new blocks
+	stall        stallMonitor
+
+	MaxClockSkew time.Duration // the operator is warned when the median clock of the peers differs more than this
+	UsePeerTime  bool          // if true, block timestamps are checked against the median time of the peers
+	peerTime     peerTime
+
+	blockCache *blockCache // recently read blocks, nil if disabled
 }
 
 func (bc *Blockchain) IsShuttingDown() bool {
@@ -54,20 +85,79 @@ func (bc *Blockchain) IsShuttingDown() bool {
 	return bc.shutdownInfo.ShuttingDown
 }
 
-const FAST_SYNC = true
+// in fast sync mode, the database is flushed to disk with this interval
+const fastSyncFlushInterval = 60 * time.Second
+
+// Options are the construction-time options of a Blockchain
+type Options struct {
+	Log logger.Logger // if nil, the package-global Log is used
+
+	// By default (fast sync), database writes are not synced to disk, and the database is only flushed every
+	// fastSyncFlushInterval and on Close: on power loss, the last blocks can be lost. If Durable is true,
+	// every write is synced to disk before it's committed, which is much slower.
+	Durable bool
+
+	// Number of recently read blocks kept deserialized in memory. Zero uses config.BLOCK_CACHE_SIZE, a negative
+	// value disables the cache.
+	BlockCacheSize int
+}
+
+// New opens the blockchain database in the given data directory, creating it if it doesn't exist. The
+// blockchain logs to the package-global Log.
+func New(dataDir string) *Blockchain {
+	return NewWithOptions(dataDir, Options{})
+}
+
+// NewWithLogger is like New, but the blockchain logs to the given logger
+func NewWithLogger(dataDir string, log logger.Logger) *Blockchain {
+	return NewWithOptions(dataDir, Options{Log: log})
+}
+
+// NewWithOptions is like New, with the given options
+func NewWithOptions(dataDir string, opts Options) *Blockchain {
+	log := opts.Log
+	if log == nil {
+		log = Log
+	}
 
-func New() *Blockchain {
 	bc := &Blockchain{
+		log:      log,
+		fastSync: !opts.Durable,
+		DataDir:  dataDir,
 		Stratum: &stratumsrv.Server{
-			NewConnections: make(chan *stratumsrv.Conn),
+			NewConnections:  make(chan *stratumsrv.Conn),
+			SharesPerMinute: config.STRATUM_SHARES_PER_MINUTE,
 		},
+		StallTimeout: config.STALL_TIMEOUT_BLOCKS * config.TARGET_BLOCK_TIME * time.Second,
+		MaxClockSkew: config.MAX_CLOCK_SKEW,
+	}
+	if opts.BlockCacheSize == 0 {
+		opts.BlockCacheSize = config.BLOCK_CACHE_SIZE
+	}
+	bc.blockCache = newBlockCache(opts.BlockCacheSize)
+
+	err := block.Schedule.Validate()
+	if err == nil {
+		err = block.ValidateRewardSplit(config.BLOCK_REWARD_FEE_PERCENT)
+	}
+	if err != nil {
+		bc.log.Fatal("invalid block reward configuration:", err)
 	}
 
-	var err error
-	bc.DB, err = bolt.Open("./"+config.NETWORK_NAME+".db", 0666, &bolt.Options{
+	err = os.MkdirAll(dataDir, 0o755)
+	if err != nil {
+		panic(err)
+	}
+	// bootstrap exports left by a crash
+	err = os.RemoveAll(filepath.Join(dataDir, bootstrapDir))
+	if err != nil {
+		bc.log.Warn("failed to remove bootstrap exports:", err)
+	}
+
+	bc.DB, err = bolt.Open(filepath.Join(dataDir, config.NETWORK_NAME+".db"), 0666, &bolt.Options{
 		Timeout:        4 * time.Second,
 		NoFreelistSync: true,
-		NoSync:         FAST_SYNC,
+		NoSync:         bc.fastSync,
 	})
 	if err != nil {
 		panic(err)
@@ -83,6 +173,41 @@ func New() *Blockchain {
 
 	// add genesis block if it doesn't exist
 	bc.addGenesis()
+	bc.loadEventSeq()
+
+	// databases created before the supply was saved in stats need to compute it once
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		if stats.Supply == 0 && stats.TopHeight != 0 {
+			bc.log.Info("Computing supply, this may take a while")
+			stats.Supply = bc.ScanSupply(tx)
+			bc.setStatsNoBroadcast(tx, stats)
+		}
+
+		// mempool entries saved before their nonce was tracked need to read it from the transaction
+		mem := bc.GetMempool(tx)
+		btx := tx.Bucket([]byte{buck.TX})
+		for _, v := range mem.Entries {
+			if v.Nonce != 0 {
+				continue
+			}
+			memtx, _, err := bc.buckGetTx(btx, v.TXID)
+			if err != nil {
+				bc.log.Warn(err)
+				continue
+			}
+			v.Nonce = memtx.Nonce
+		}
+		bc.SetMempool(tx, mem)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	bc.initMetrics()
+
+	bc.BlockQueue = NewBlockQueue(bc)
 
 	var stats *Stats
 	var mempool *Mempool
@@ -92,40 +217,52 @@ func New() *Blockchain {
 		return nil
 	})
 
-	Log.Info("Started blockchain")
-	Log.Infof("Height: %d", stats.TopHeight)
-	Log.Infof("Cumulative diff: %.3fk\n", stats.CumulativeDiff.Float64()/1000)
-	Log.Infof("Top hash: %x", stats.TopHash)
-	Log.Debugf("Tips: %x", stats.Tips)
-	Log.Debugf("Orphans: %x", stats.Orphans)
-	Log.Debugf("Mempool: %d transactions", len(mempool.Entries))
+	bc.log.Info("Started blockchain")
+	bc.log.Infof("Height: %d", stats.TopHeight)
+	bc.log.Infof("Cumulative diff: %.3fk\n", stats.CumulativeDiff.Float64()/1000)
+	bc.log.Infof("Top hash: %x", stats.TopHash)
+	bc.log.Debugf("Tips: %x", stats.Tips)
+	bc.log.Debugf("Orphans: %x", stats.Orphans)
+	bc.log.Debugf("Mempool: %d transactions", len(mempool.Entries))
 
 	bc.SyncDiff = stats.CumulativeDiff
 	bc.SyncHeight = stats.TopHeight
+	bc.parallelDownloads = config.PARALLEL_BLOCKS_DOWNLOAD
+	bc.relay.fanout = config.BLOCK_RELAY_FANOUT
 
-	bc.BlockQueue = NewBlockQueue(bc)
-
-	if FAST_SYNC {
-		go func() {
-			// in case fast sync mode is enabled, we flush database to disk every minute
-			for {
-				time.Sleep(60 * time.Second)
-				err = bc.DB.Sync()
-				if err != nil {
-					Log.Err("failed to sync database to disk:", err)
-				}
-			}
-		}()
+	if bc.fastSync {
+		go bc.flushDatabase()
+	} else {
+		bc.log.Info("Durable mode enabled: every database write is synced to disk")
 	}
 
 	return bc
 }
 
+// flushDatabase periodically flushes the database to disk in fast sync mode, until the blockchain is closed
+func (bc *Blockchain) flushDatabase() {
+	for {
+		time.Sleep(fastSyncFlushInterval)
+
+		// the database is closed after ShuttingDown is set, so it's never synced after being closed
+		bc.shutdownInfo.RLock()
+		if bc.shutdownInfo.ShuttingDown {
+			bc.shutdownInfo.RUnlock()
+			return
+		}
+		err := bc.DB.Sync()
+		bc.shutdownInfo.RUnlock()
+		if err != nil {
+			bc.log.Err("failed to sync database to disk:", err)
+		}
+	}
+}
+
 func (bc *Blockchain) Synchronize() {
-	Log.Debug("Synchronization thread started")
+	bc.log.Debug("Synchronization thread started")
 	for {
 		if bc.IsShuttingDown() {
-			Log.Info("Synchronization thread stopped")
+			bc.log.Info("Synchronization thread stopped")
 			return
 		}
 
@@ -144,7 +281,7 @@ func (bc *Blockchain) Synchronize() {
 				if reqbl == nil {
 					break
 				}
-				Log.Debugf("requesting block %d %x", reqbl.Height, reqbl.Hash)
+				bc.log.Debugf("requesting block %d %x", reqbl.Height, reqbl.Hash)
 				if reqbl.Height != 0 && reqbl.Height < stats.TopHeight {
 					qt.RemoveBlockByHeight(reqbl.Height)
 					continue
@@ -152,29 +289,7 @@ func (bc *Blockchain) Synchronize() {
 				reqbls = append(reqbls, reqbl)
 			}
 
-			go func() {
-				// TODO: shuffle P2P.Connections order
-				for _, reqbl := range reqbls {
-					for _, conn := range bc.P2P.Connections {
-						sent := false
-						conn.PeerData(func(d *p2p.PeerData) {
-							if reqbl.Height == 0 || d.Stats.Height >= reqbl.Height {
-								conn.SendPacket(&p2p.Packet{
-									Type: packet.BLOCK_REQUEST,
-									Data: packet.PacketBlockRequest{
-										Height: reqbl.Height,
-										Hash:   reqbl.Hash,
-									}.Serialize(),
-								})
-								sent = true
-							}
-						})
-						if sent {
-							break
-						}
-					}
-				}
-			}()
+			go bc.requestBlocks(reqbls)
 		})
 
 		time.Sleep(250 * time.Millisecond)
@@ -187,53 +302,129 @@ func (bc *Blockchain) Synchronize() {
 func (bc *Blockchain) fillQueue(qt *QueueTx, topHeight uint64) {
 	bc.SyncMut.RLock()
 	syncHeight := bc.SyncHeight
+	parallel := bc.parallelDownloads
 	bc.SyncMut.RUnlock()
 
-	if qt.Length() < config.PARALLEL_BLOCKS_DOWNLOAD {
+	if qt.Length() < parallel {
 		if syncHeight > topHeight {
 			n := qt.Length()
 			for i := topHeight + 1; i <= syncHeight; i++ {
-				if n > config.PARALLEL_BLOCKS_DOWNLOAD {
+				if n > parallel {
 					break
 				}
 				n++
-				qt.SetBlock(NewQueuedBlock(i, [32]byte{}), false)
+				// when the queue is full, the next heights are queued once some space is freed
+				if !qt.SetBlock(NewQueuedBlock(i, [32]byte{}), false) {
+					break
+				}
 			}
 		}
 	}
 }
 
+// SetParallelDownloads sets the maximum number of blocks downloaded in parallel during sync. The value is
+// clamped between PARALLEL_BLOCKS_DOWNLOAD_MIN and PARALLEL_BLOCKS_DOWNLOAD_MAX, and the value set is returned.
+func (bc *Blockchain) SetParallelDownloads(n int) int {
+	n = max(config.PARALLEL_BLOCKS_DOWNLOAD_MIN, min(config.PARALLEL_BLOCKS_DOWNLOAD_MAX, n))
+
+	bc.SyncMut.Lock()
+	bc.parallelDownloads = n
+	bc.SyncMut.Unlock()
+
+	return n
+}
+
+func (bc *Blockchain) GetParallelDownloads() int {
+	bc.SyncMut.RLock()
+	defer bc.SyncMut.RUnlock()
+	return bc.parallelDownloads
+}
+
 type shutdownInfo struct {
 	ShuttingDown bool
 	sync.RWMutex
+
+	blocks sync.WaitGroup // blocks being added, see beginBlock
 }
 
+// ErrShuttingDown is returned when a block is received or mined after shutdown has begun
+var ErrShuttingDown = errors.New("blockchain is shutting down")
+
+// beginBlock is called before adding a block, so that Close waits for it. Once shutdown has begun, no block is
+// started and ErrShuttingDown is returned; otherwise endBlock must be called when the block has been added. Each
+// block is added in a single database transaction, so it's either added completely or not at all.
+func (bc *Blockchain) beginBlock() error {
+	bc.shutdownInfo.RLock()
+	defer bc.shutdownInfo.RUnlock()
+
+	if bc.shutdownInfo.ShuttingDown {
+		return ErrShuttingDown
+	}
+	bc.shutdownInfo.blocks.Add(1)
+	return nil
+}
+
+func (bc *Blockchain) endBlock() {
+	bc.shutdownInfo.blocks.Done()
+}
+
+// Close shuts down the blockchain. The blocks already being added are completed, but no new block is started.
 func (bc *Blockchain) Close() {
 	bc.shutdownInfo.Lock()
 	bc.shutdownInfo.ShuttingDown = true
 	bc.shutdownInfo.Unlock()
-	Log.Info("Stopping integrated miner if started")
+	bc.log.Info("Stopping integrated miner if started")
 	bc.MergesMut.Lock()
 	bc.Mining = false
 	bc.MergesMut.Unlock()
-	Log.Info("Shutting down P2P server")
-	bc.P2P.Close()
-	Log.Info("Saving block download queue")
+	if bc.P2P != nil {
+		bc.log.Info("Shutting down P2P server")
+		bc.P2P.Close()
+	}
+	bc.log.Info("Waiting for the blocks being added")
+	bc.shutdownInfo.blocks.Wait()
+	bc.log.Info("Saving block download queue")
 	bc.BlockQueue.Lock()
 	bc.BlockQueue.Save()
 	bc.BlockQueue.Unlock()
-	if FAST_SYNC {
-		Log.Info("Flushing database to disk")
-		bc.DB.Sync()
+	if bc.fastSync {
+		bc.log.Info("Flushing database to disk")
+		err := bc.DB.Sync()
+		if err != nil {
+			bc.log.Err("failed to sync database to disk:", err)
+		}
 	}
-	Log.Info("Closing database")
+	bc.log.Info("Closing database")
 	bc.DB.Close()
-	Log.Info("STILL daemon shutdown complete. Bye!")
+	bc.bootstrap.Lock()
+	cachedBootstrap := bc.bootstrap.cur
+	bc.bootstrap.cur = nil
+	bc.bootstrap.Unlock()
+	if cachedBootstrap != nil {
+		bc.releaseBootstrap(cachedBootstrap)
+	}
+	bc.log.Info("STILL daemon shutdown complete. Bye!")
+}
+
+// WaitGenesis blocks until the given genesis timestamp (in milliseconds), logging the remaining time
+// periodically. It allows starting the nodes of a new network before a coordinated launch; without it, starting
+// a node before the genesis timestamp is a fatal error.
+func WaitGenesis(log logger.Logger, timestamp uint64) {
+	for {
+		now := util.Time()
+		if now >= timestamp {
+			return
+		}
+		remaining := time.Duration(timestamp-now) * time.Millisecond
+		log.Infof("Waiting for genesis block, %s remaining", remaining.Round(time.Second))
+		time.Sleep(min(remaining, config.GENESIS_WAIT_LOG_INTERVAL))
+	}
 }
 
 func (bc *Blockchain) addGenesis() {
 	if util.Time() < config.GENESIS_TIMESTAMP {
-		Log.Fatal("genesis block in future of", (config.GENESIS_TIMESTAMP-int64(util.Time()))/1000, "seconds")
+		bc.log.Fatal("genesis block in future of", (config.GENESIS_TIMESTAMP-int64(util.Time()))/1000,
+			"seconds, use --wait-genesis to wait for it")
 	}
 
 	genesis := &block.Block{
@@ -253,15 +444,15 @@ func (bc *Blockchain) addGenesis() {
 
 	hash := genesis.Hash()
 
-	Log.Debugf("genesis block hash is %x", hash)
+	bc.log.Debugf("genesis block hash is %x", hash)
 
 	err := bc.DB.Update(func(tx *bolt.Tx) error {
 		bl, err := bc.GetBlock(tx, hash)
 		if err != nil {
-			Log.Debug("genesis block is not in chain:", err)
+			bc.log.Debug("genesis block is not in chain:", err)
 			err := bc.insertBlockMain(tx, genesis)
 			if err != nil {
-				Log.Fatal(fmt.Errorf("failed adding genesis to chain: %v", err))
+				bc.log.Fatal(fmt.Errorf("failed adding genesis to chain: %v", err))
 			}
 			bc.SetStats(tx, &Stats{
 				TopHash:        hash,
@@ -279,12 +470,12 @@ func (bc *Blockchain) addGenesis() {
 			if bl == nil {
 				return errors.New("bl is nil")
 			}
-			Log.Debug("genesis is already in chain:", bl.String())
+			bc.log.Debug("genesis is already in chain:", bl.String())
 		}
 		return nil
 	})
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 }
 
@@ -314,8 +505,17 @@ func (bc *Blockchain) checkBlock(tx *bolt.Tx, bl, prevBl *block.Block) error {
 	}
 
 	// validate block's SideBlocks
-	sideDiff := bl.Difficulty.Mul64(2 * uint64(len(bl.SideBlocks))).Div64(3)
-	newCumDiff := prevBl.CumulativeDiff.Add(bl.Difficulty).Add(sideDiff)
+	if len(bl.SideBlocks) > 0 {
+		windowSides, err := bc.windowSideBlocks(tx, prevBl)
+		if err != nil {
+			return err
+		}
+		if windowSides+len(bl.SideBlocks) > config.MAX_WINDOW_SIDE_BLOCKS {
+			return fmt.Errorf("%w: %d in the block, %d in the previous %d blocks", ErrTooManySideBlocks,
+				len(bl.SideBlocks), windowSides, config.MINIDAG_ANCESTORS-1)
+		}
+	}
+	newCumDiff := bl.ExpectedCumulativeDiff(prevBl.CumulativeDiff)
 	// since SideBlocks's Ancestors are derived from height, we don't have to check them here
 	for _, side := range bl.SideBlocks {
 
@@ -324,11 +524,12 @@ func (bc *Blockchain) checkBlock(tx *bolt.Tx, bl, prevBl *block.Block) error {
 		var heightDiff int = -1 //
 		for ancid, anc := range side.Ancestors {
 			if heightDiff == -1 { // common not found
-				// scan if we can find the ancestor
+				// scan if we can find the ancestor. The ancestors of blocks near the genesis are padded with zero
+				// hashes, which don't reference any block.
 				for vid, v := range bl.Ancestors {
-					if vid >= ancid && v == anc {
+					if vid >= ancid && v == anc && anc != (util.Hash{}) {
 						heightDiff = vid - ancid
-						Log.Debug("found ancestor at height difference:", heightDiff)
+						bc.log.Debug("found ancestor at height difference:", heightDiff)
 					}
 				}
 			} else { // common found, verify that subsequent blocks match
@@ -341,7 +542,13 @@ func (bc *Blockchain) checkBlock(tx *bolt.Tx, bl, prevBl *block.Block) error {
 			}
 		}
 		if heightDiff == -1 {
-			return fmt.Errorf("common block not found")
+			return fmt.Errorf("%w: common block not found", ErrSideBlockWindow)
+		}
+		// the side block is at height bl.Height-heightDiff, which must be one of the MINIDAG_ANCESTORS-1 heights
+		// preceding the block. It's enforced from genesis, since the network hasn't launched yet.
+		if heightDiff < 1 || heightDiff > config.MINIDAG_ANCESTORS-1 {
+			return fmt.Errorf("%w: side block height %d, block height %d", ErrSideBlockWindow,
+				int64(bl.Height)-int64(heightDiff), bl.Height)
 		}
 
 		// check that the side block hasn't been already included
@@ -357,7 +564,7 @@ func (bc *Blockchain) checkBlock(tx *bolt.Tx, bl, prevBl *block.Block) error {
 			for _, anc := range bl.Ancestors[1:] { // then check in previous ancestors
 				ancBl, err := bc.GetBlock(tx, anc)
 				if err != nil {
-					Log.Err(err)
+					bc.log.Err(err)
 					return err
 				}
 				if side.Equals(ancBl.Commitment()) {
@@ -380,7 +587,32 @@ func (bc *Blockchain) checkBlock(tx *bolt.Tx, bl, prevBl *block.Block) error {
 			newCumDiff)
 	}
 
-	return nil
+	return bc.checkTxOrder(tx, bl)
+}
+
+var ErrTooManySideBlocks = errors.New("too many side blocks")
+
+// ErrSideBlockWindow is returned when a side block doesn't share an ancestor with the block referencing it in
+// the MINIDAG_ANCESTORS window, or isn't at one of the heights preceding it in the window
+var ErrSideBlockWindow = errors.New("side block is outside the ancestor window")
+
+// windowSideBlocks returns the number of side blocks referenced by prevBl and its ancestors, in the
+// MINIDAG_ANCESTORS-1 blocks preceding a new block
+func (bc *Blockchain) windowSideBlocks(tx *bolt.Tx, prevBl *block.Block) (int, error) {
+	count := len(prevBl.SideBlocks)
+	height := prevBl.Height
+	for _, anc := range prevBl.Ancestors[:config.MINIDAG_ANCESTORS-2] {
+		if height == 0 {
+			break
+		}
+		ancBl, err := bc.GetBlockHeader(tx, anc)
+		if err != nil {
+			return 0, err
+		}
+		count += len(ancBl.SideBlocks)
+		height = ancBl.Height
+	}
+	return count, nil
 }
 
 // AddBlock attempts adding a block to the blockchain.
@@ -391,11 +623,18 @@ func (bc *Blockchain) AddBlock(tx *bolt.Tx, bl *block.Block) (util.Hash, error)
 	hash := bl.Hash()
 
 	// check if block is duplicate
-	_, err := bc.GetBlock(tx, hash)
+	_, err := bc.GetBlockHeader(tx, hash)
 	if err == nil {
 		return hash, fmt.Errorf("received duplicate block %x height %d", hash, bl.Height)
 	}
 
+	// all the transactions must be known before the block is added, or state application will fail later
+	err = bc.checkBlockTxs(tx, bl)
+	if err != nil {
+		bc.log.Warn(err)
+		return hash, err
+	}
+
 	prevHash := bl.PrevHash()
 
 	// check if block is orphaned
@@ -403,11 +642,12 @@ func (bc *Blockchain) AddBlock(tx *bolt.Tx, bl *block.Block) (util.Hash, error)
 	if err != nil {
 		err := bc.addOrphanBlock(tx, bl, hash, false)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return hash, err
 		}
 		// mark orphan block as downloaded in queue
 		bc.queuedBlockDownloaded(hash, bl.Height)
+		bc.recordPropagation(tx, bl, hash, true)
 		return hash, nil
 	}
 
@@ -417,17 +657,18 @@ func (bc *Blockchain) AddBlock(tx *bolt.Tx, bl *block.Block) (util.Hash, error)
 		// this block's parent is orphaned; add this block as an orphan
 		err := bc.addOrphanBlock(tx, bl, hash, true)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return hash, err
 		}
 		// mark orphan block as downloaded in queue
 		bc.queuedBlockDownloaded(hash, bl.Height)
+		bc.recordPropagation(tx, bl, hash, true)
 		return hash, nil
 	}
 
 	err = bc.checkBlock(tx, bl, prevBl)
 	if err != nil {
-		Log.Warn("block is invalid:", err)
+		bc.log.Warn("block is invalid:", err)
 		return hash, err
 	}
 
@@ -444,18 +685,34 @@ func (bc *Blockchain) AddBlock(tx *bolt.Tx, bl *block.Block) (util.Hash, error)
 		err = bc.addAltchainBlock(tx, bl, hash)
 	}
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return hash, err
 	}
 	err = bc.checkDeorphanage(tx, bl, hash)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return hash, err
 	}
 
+	// an altchain block can become mainchain with a reorg
+	topo, _ := bc.GetTopo(tx, bl.Height)
+	bc.recordPropagation(tx, bl, hash, topo != hash)
+
 	return hash, nil
 }
 
+// recordPropagation updates the block propagation statistics once tx is committed
+func (bc *Blockchain) recordPropagation(tx *bolt.Tx, bl *block.Block, hash [32]byte, isStale bool) {
+	timestamp := bl.Timestamp
+	tx.OnCommit(func() {
+		if isStale {
+			bc.propagation.stale(hash, timestamp)
+		} else {
+			bc.propagation.mainchain(hash, timestamp)
+		}
+	})
+}
+
 func (bc *Blockchain) removeFromQueue(hash [32]byte, height uint64) {
 	bc.BlockQueue.Update(func(qt *QueueTx) {
 		qt.RemoveBlock(height, hash)
@@ -471,7 +728,7 @@ func (bc *Blockchain) queuedBlockDownloaded(hash [32]byte, height uint64) {
 // use parentKnown = true if this block has a known parent which is orphaned
 // Blockchain MUST be locked before calling this
 func (bc *Blockchain) addOrphanBlock(txn *bolt.Tx, bl *block.Block, hash [32]byte, parentKnown bool) error {
-	Log.Infof("Adding orphan block %d %x diff: %s sides: %d parent known: %v", bl.Height, hash,
+	bc.log.Infof("Adding orphan block %d %x diff: %s sides: %d parent known: %v", bl.Height, hash,
 		bl.Difficulty, len(bl.SideBlocks), parentKnown)
 	stats := bc.GetStats(txn)
 
@@ -483,12 +740,15 @@ func (bc *Blockchain) addOrphanBlock(txn *bolt.Tx, bl *block.Block, hash [32]byt
 		Expires:  time.Now().Add(time.Hour).Unix(), // orphan blocks expire after 1 hour
 		Hash:     hash,
 		PrevHash: bl.PrevHash(),
+		Height:   bl.Height,
 	}
 
 	// add orphan prevhash to queued blocks, if it is not known already
 	if !parentKnown {
 		bc.BlockQueue.Update(func(qt *QueueTx) {
-			qt.SetBlock(NewQueuedBlock(0, bl.PrevHash()), false)
+			if !qt.SetBlock(NewQueuedBlock(0, bl.PrevHash()), false) {
+				bc.log.Debugf("block queue is full, not requesting orphan parent %x", bl.PrevHash())
+			}
 		})
 	}
 
@@ -504,7 +764,7 @@ func (bc *Blockchain) addOrphanBlock(txn *bolt.Tx, bl *block.Block, hash [32]byt
 // addAltchainBlock should only be called by the addBlock method
 // Blockchain MUST be locked before calling this
 func (bc *Blockchain) addAltchainBlock(txn *bolt.Tx, bl *block.Block, hash [32]byte) error {
-	Log.Infof("Adding block as alternative on height: %d hash: %x diff: %s", bl.Height, hash, bl.Difficulty)
+	bc.log.Infof("Adding block as alternative on height: %d hash: %x diff: %s", bl.Height, hash, bl.Difficulty)
 	stats := bc.GetStats(txn)
 
 	// check if the block extends one of the tips
@@ -512,13 +772,13 @@ func (bc *Blockchain) addAltchainBlock(txn *bolt.Tx, bl *block.Block, hash [32]b
 
 	if extendTip != nil {
 		// block extends one of the tips, update that tip
-		Log.Debugf("block %x extends tip %x", hash, extendTip.Hash)
+		bc.log.Debugf("block %x extends tip %x", hash, extendTip.Hash)
 		extendTip.Hash = hash
 		extendTip.Height++
 		extendTip.CumulativeDiff = bl.CumulativeDiff
 	} else {
 		// if the block doesn't extend tips, then it's creating a new tip
-		Log.Debugf("new tip: %x", hash)
+		bc.log.Debugf("new tip: %x", hash)
 		stats.Tips[hash] = &AltchainTip{
 			Hash:           hash,
 			Height:         bl.Height,
@@ -529,14 +789,18 @@ func (bc *Blockchain) addAltchainBlock(txn *bolt.Tx, bl *block.Block, hash [32]b
 	// insert block and save stats
 	err := bc.insertBlock(txn, bl, hash)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
 	// broadcasting stats isn't necessary, altchain blocks don't affect our tophash
 	bc.setStatsNoBroadcast(txn, stats)
 
-	// check for reorgs
-	bc.CheckReorgs(txn, stats)
+	// check for reorgs; if the reorg fails, the whole transaction must be rolled back, as the state
+	// might have been partially reorganized
+	_, err = bc.CheckReorgs(txn, stats)
+	if err != nil {
+		return err
+	}
 
 	if bl.Height+config.MINIDAG_ANCESTORS >= stats.TopHeight {
 		go bc.NewStratumJob(false)
@@ -545,7 +809,12 @@ func (bc *Blockchain) addAltchainBlock(txn *bolt.Tx, bl *block.Block, hash [32]b
 	return nil
 }
 
-// returns true if a reorg has happened
+// returns true if a reorg has happened. If an error is returned, the bolt transaction must not be committed.
+//
+// A reorg needs no journal to survive a crash: all its steps run in the caller's transaction, and bolt commits a
+// transaction by switching its meta page, so the database contains either the whole reorg or none of it. In fast
+// sync mode a power loss can still lose or corrupt the last commits, reorg or not, since they aren't synced to
+// disk; a journal written by the same unsynced commit wouldn't survive it either.
 func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 	type hashInfo struct {
 		Hash  [32]byte
@@ -565,19 +834,22 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 	}
 	// If the reorg is not needed, then return
 	if altHash == stats.TopHash {
-		Log.Debug("reorg not needed")
+		bc.log.Debug("reorg not needed")
 		return false, nil
 	}
-	Log.Infof("Reorg needed: height %d -> %d, hash %x, cumulative diff %s -> %s",
+	bc.log.Infof("Reorg needed: height %d -> %d, hash %x, cumulative diff %s -> %s",
 		stats.TopHeight, altHeight, altHash, stats.CumulativeDiff.String(), altDiff.String())
 
+	var oldTop [32]byte
+	var commonHeight uint64
+
 	// reorganize the chain
 	err := func() error {
 		// step 1: iterate the altchain blocks in reverse order to find out the common block with mainchain
 		commonBlockHash := altHash
 		commonBlock, err := bc.GetBlock(tx, commonBlockHash)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		buckTopo := tx.Bucket([]byte{buck.TOPO})
@@ -597,22 +869,26 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 				err := fmt.Errorf("reorg step 1: failed to get common block %x: %v", commonBlockHash, err)
 				return err
 			}
-			Log.Debugf("reorg step 1: scanning altchain block %d %x", commonBlock.Height, commonBlockHash)
+			bc.log.Debugf("reorg step 1: scanning altchain block %d %x", commonBlock.Height, commonBlockHash)
 
 			if commonBlock.Height == 0 {
 				err = errors.New("could not find common block")
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 
 			topohash, err := bc.buckGetTopo(buckTopo, commonBlock.Height)
-			// a block doesn't exist in mainchain at this height, just print the error and go on
-			if err != nil {
-				Log.Debug("a block doesn't exist in mainchain at this height (probably fine), err:", err)
+			// a block doesn't exist in mainchain at this height, just print the error and go on; below the top
+			// height the mainchain always has a block, so the topo index is corrupt
+			if err != nil && commonBlock.Height <= stats.TopHeight {
+				bc.log.Warnf("reorg step 1: mainchain has no topo entry at height %d, the topo index may be "+
+					"corrupt; restart with --repair-topo to rebuild it", commonBlock.Height)
+			} else if err != nil {
+				bc.log.Debug("a block doesn't exist in mainchain at this height (probably fine), err:", err)
 			}
 
 			if topohash == commonBlockHash {
-				Log.Debugf("stopping just before block common: %x", commonBlockHash)
+				bc.log.Debugf("stopping just before block common: %x", commonBlockHash)
 				break
 			}
 
@@ -625,66 +901,82 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 		// step 2: iterate the mainchain blocks in reverse order until common block to reverse the state
 		// changes and remove the topoheight data (only do this if TopHash is not the common block's hash,
 		// which can happen after a deorphanage)
+		var rolledBack []uint64
 		if stats.TopHash != commonBlockHash {
 			nHash := stats.TopHash
 			n, err := bc.GetBlock(tx, nHash)
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 
 			if n.Hash() == commonBlockHash {
-				Log.Debugf("reorg step 2 not needed")
+				bc.log.Debugf("reorg step 2 not needed")
 			} else {
 				for {
 					if nHash == commonBlockHash {
-						Log.Debugf("reorg step 2 done")
+						bc.log.Debugf("reorg step 2 done")
 						break
 					}
 					if n.Height == 0 {
 						err := fmt.Errorf("reorg: Block has height 0! Could not find common hash %x; nHash %x",
 							commonBlockHash, nHash)
-						Log.Err(err)
+						bc.log.Err(err)
 						return err
 					}
 
 					n, err = bc.GetBlock(tx, nHash)
 					if err != nil {
 						err := fmt.Errorf("failed to get block %x: %v", nHash, err)
-						Log.Err(err)
+						bc.log.Err(err)
 						return err
 					}
 
-					Log.Debugf("reorg step 2: reversing changes of block %d %x", n.Height, nHash)
+					bc.log.Debugf("reorg step 2: reversing changes of block %d %x", n.Height, nHash)
 
 					// delete this block's topo
 					heightBin := make([]byte, 8)
 					binary.LittleEndian.PutUint64(heightBin, n.Height)
 					err := buckTopo.Delete(heightBin)
 					if err != nil {
-						Log.Err(err)
+						bc.log.Err(err)
 						return err
 					}
 
 					// remove block from state
 					err = bc.RemoveBlockFromState(tx, n, nHash)
 					if err != nil {
-						Log.Err(err)
+						bc.log.Err(err)
 						return err
 					}
+					rolledBack = append(rolledBack, n.Height)
 
 					nHash = n.PrevHash()
 				}
 			}
 		}
 
+		// the reorg event is recorded before the events of the altchain blocks applied in step 3
+		if len(rolledBack) > 0 {
+			err = bc.recordEvents(tx, Event{
+				Type:       EventReorg,
+				Height:     commonBlock.Height,
+				Hash:       commonBlockHash,
+				RolledBack: rolledBack,
+			})
+			if err != nil {
+				bc.log.Err(err)
+				return err
+			}
+		}
+
 		// step 3: iterate altchain blocks starting from common block to validate and apply them to the state
 		// and to the topo; if any of these blocks is invalid, delete it and undo the reorg
 
-		Log.Devf("hashes: %x", hashes)
+		bc.log.Devf("hashes: %x", hashes)
 
 		for i := len(hashes) - 1; i >= 0; i-- {
-			Log.Devf("reorg step 3: setting topo: %d (height: %d) %x", i, hashes[i].Block.Height,
+			bc.log.Devf("reorg step 3: setting topo: %d (height: %d) %x", i, hashes[i].Block.Height,
 				hashes[i].Hash)
 
 			// set this block's topo
@@ -692,7 +984,7 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 			binary.LittleEndian.PutUint64(heightBin, hashes[i].Block.Height)
 			err := buckTopo.Put(heightBin, hashes[i].Hash[:])
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 
@@ -701,19 +993,19 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 			// set the block's cumulative difficulty
 			prevBl, err := bc.GetBlock(tx, bl.PrevHash())
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 
 			err = bc.checkBlock(tx, bl, prevBl)
 			if err != nil {
-				Log.Warn("reorg invalid block:", err)
+				bc.log.Warn("reorg invalid block:", err)
 				return err
 			}
 
 			err = bc.ApplyBlockToState(tx, bl, hashes[i].Hash)
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 
@@ -722,12 +1014,17 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 			})
 		}
 
-		// step 4: update the stats
-		Log.Devf("starting reorg step 4")
+		// step 4: update the stats. altHash is still the best tip: CheckReorgs runs in the caller's write
+		// transaction, and bolt allows a single writer, so a better tip received meanwhile is only added, and
+		// reorged to, once this transaction is committed. The reorg never has to be aborted for a better tip.
+		bc.log.Devf("starting reorg step 4")
 
 		infoBuck := tx.Bucket([]byte{buck.INFO})
 		stats = bc.GetStats(tx)
 
+		oldTop = stats.TopHash
+		commonHeight = commonBlock.Height
+
 		// add the old mainchain as an altchain tip
 		delete(stats.Tips, altHash)
 		stats.Tips[stats.TopHash] = &AltchainTip{
@@ -743,15 +1040,18 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 
 		infoBuck.Put([]byte("stats"), stats.Serialize())
 
-		Log.Infof("Reorganize success, new height: %d hash: %x cumulative diff: %s", stats.TopHeight,
+		bc.log.Infof("Reorganize success, new height: %d hash: %x cumulative diff: %s", stats.TopHeight,
 			stats.TopHash, stats.CumulativeDiff)
 		return nil
 	}()
 
 	if err != nil {
-		Log.Err("Reorg failed:", err)
+		bc.log.Err("Reorg failed:", err)
 		return false, err
 	}
+	bc.countReorg(tx)
+	bc.emitReorg(tx, oldTop, altHash, commonHeight)
+	bc.recordBlockAdded(tx)
 	return true, nil
 }
 
@@ -760,11 +1060,11 @@ func (bc *Blockchain) CheckReorgs(tx *bolt.Tx, stats *Stats) (bool, error) {
 func (bc *Blockchain) addMainchainBlock(tx *bolt.Tx, bl *block.Block, hash [32]byte) error {
 	err := bc.ApplyBlockToState(tx, bl, hash)
 	if err != nil {
-		Log.Warn("block is invalid, not adding to mainchain:", err)
+		bc.log.Warn("block is invalid, not adding to mainchain:", err)
 		return err
 	}
 
-	Log.Infof("Adding mainchain block %d %x diff: %s sides: %d", bl.Height, hash, bl.Difficulty, len(bl.SideBlocks))
+	bc.log.Infof("Adding mainchain block %d %x diff: %s sides: %d", bl.Height, hash, bl.Difficulty, len(bl.SideBlocks))
 	stats := bc.GetStats(tx)
 
 	stats.TopHash = hash
@@ -775,157 +1075,220 @@ func (bc *Blockchain) addMainchainBlock(tx *bolt.Tx, bl *block.Block, hash [32]b
 	// add block to mainchain and update stats
 	err = bc.insertBlockMain(tx, bl)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
 
-	Log.Debugf("done adding block %x to mainchain", hash)
+	bc.countBlockAdded(tx)
+	bc.emitNewBlock(tx, bl, hash)
+	bc.recordBlockAdded(tx)
+
+	bc.log.Debugf("done adding block %x to mainchain", hash)
 
 	return nil
 }
 
 // Validates a block, and then adds it to the state
-func (bc *Blockchain) ApplyBlockToState(txn *bolt.Tx, bl *block.Block, _ [32]byte) error {
+func (bc *Blockchain) ApplyBlockToState(txn *bolt.Tx, bl *block.Block, hash [32]byte) error {
 	bstate := txn.Bucket([]byte{buck.STATE})
 
+	err := bc.checkBlockTxs(txn, bl)
+	if err != nil {
+		bc.log.Err(err)
+		return err
+	}
+
 	// remove transactions from mempool
 	bst := txn.Bucket([]byte{buck.INFO})
 	pool := bc.buckGetMempool(bst)
 	for _, t := range bl.Transactions {
-		pool.DeleteEntry(t)
+		if pool.DeleteEntry(t) {
+			bc.log.Debugf("Removing transaction %x from mempool", t)
+		}
 	}
 	bc.buckSetMempool(bst, pool)
 
 	var totalFee uint64 = 0
 
+	events := make([]Event, 1, len(bl.Transactions)+1)
+	events[0] = Event{
+		Type:   EventBlockAdded,
+		Height: bl.Height,
+		Hash:   hash,
+	}
+
 	// validate and apply transactions
 	btx := txn.Bucket([]byte{buck.TX})
 	for _, v := range bl.Transactions {
 		tx, _, err := bc.buckGetTx(btx, v)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		senderAddr := address.FromPubKey(tx.Sender)
 
-		Log.Debugf("Applying transaction %x to mainchain; sender: %s, recipient: %s", v,
+		bc.log.Debugf("Applying transaction %x to mainchain; sender: %s, recipient: %s", v,
 			address.FromPubKey(tx.Sender), tx.Recipient)
 
 		// check sender state
 		senderState, err := bc.buckGetState(bstate, senderAddr)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
-		Log.Dev("sender state before:", senderState)
+		bc.log.Dev("sender state before:", senderState)
 
-		if senderState.Balance < tx.Amount+tx.Fee {
+		spent, err := util.SafeAdd(tx.Amount, tx.Fee)
+		if err != nil {
+			err = fmt.Errorf("transaction %x amount plus fee: %w", v, err)
+			bc.log.Warn(err)
+			return err
+		}
+		if senderState.Balance < spent {
 			err = fmt.Errorf("transaction %x spends too much money: balance: %d, amount: %d, fee: %d", v,
 				senderState.Balance, tx.Amount, tx.Fee)
-			Log.Warn(err)
+			bc.log.Warn(err)
 			return err
 		}
 		if tx.Nonce != senderState.LastNonce+1 {
 			err = fmt.Errorf("transaction %x has unexpected nonce: %d, previous nonce: %d", v,
 				tx.Nonce, senderState.LastNonce)
-			Log.Warn(err)
+			bc.log.Warn(err)
 			return err
 		}
 
 		// apply sender state
-		senderState.Balance -= tx.Amount + tx.Fee
+		senderState.Balance -= spent
 		senderState.LastNonce++
 		err = bc.buckSetState(bstate, senderAddr, senderState)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 
-		Log.Dev("sender state after:", senderState)
+		bc.log.Dev("sender state after:", senderState)
 
 		// add the funds to recipient
 		recState, err := bc.buckGetState(bstate, tx.Recipient)
 		if err != nil {
-			Log.Debug("recipient state not previously known:", err)
+			bc.log.Debug("recipient state not previously known:", err)
 			recState = &State{
 				Balance: 0, LastNonce: 0,
 			}
 		}
-		Log.Devf("recipient %s state before: %v", tx.Recipient, recState)
+		bc.log.Devf("recipient %s state before: %v", tx.Recipient, recState)
 
-		recState.Balance += tx.Amount
+		recState.Balance, err = util.SafeAdd(recState.Balance, tx.Amount)
+		if err != nil {
+			err = fmt.Errorf("transaction %x recipient balance: %w", v, err)
+			bc.log.Warn(err)
+			return err
+		}
 		recState.LastIncoming++ // also increase recipient's LastIncoming
 
-		Log.Devf("recipient %s state after: %v", tx.Recipient, recState)
+		bc.log.Devf("recipient %s state after: %v", tx.Recipient, recState)
 
 		// add tx hash to recipient's incoming list
 		err = bc.SetTxTopoInc(txn, v, tx.Recipient, recState.LastIncoming)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		// add tx hash to sender's outgoing list
 		err = bc.SetTxTopoOut(txn, v, senderAddr, senderState.LastNonce)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		// update tx height
 		err = bc.SetTxHeight(txn, v, bl.Height)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 
 		err = bc.buckSetState(bstate, tx.Recipient, recState)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 
 		// apply tx to total fee
-		totalFee += tx.Fee
+		totalFee, err = util.SafeAdd(totalFee, tx.Fee)
+		if err != nil {
+			err = fmt.Errorf("block %x total fee: %w", bl.Hash(), err)
+			bc.log.Warn(err)
+			return err
+		}
+
+		events = append(events, Event{
+			Type:   EventTxConfirmed,
+			Height: bl.Height,
+			Hash:   hash,
+			Txid:   v,
+			From:   senderAddr,
+			To:     tx.Recipient,
+			Amount: tx.Amount,
+			Fee:    tx.Fee,
+		})
 	}
 
 	// add block reward to coinbase transaction
 	{
-		totalReward := bl.Reward() + totalFee
-		governanceReward := totalReward * config.BLOCK_REWARD_FEE_PERCENT / 100
-		minerReward := totalReward - governanceReward
+		totalReward, minerReward, governanceReward, err := splitBlockReward(bl, hash, totalFee)
+		if err != nil {
+			bc.log.Warn(err)
+			return err
+		}
 
-		Log.Debug("adding block reward", totalReward, "miner:", minerReward, "governance:", governanceReward)
+		bc.log.Debug("adding block reward", totalReward, "miner:", minerReward, "governance:", governanceReward)
 
 		// apply miner reward
 		minerState, err := bc.buckGetState(bstate, bl.Recipient)
 		if err != nil {
-			Log.Debugf("coinbase reward account not previously known: %s", err)
+			bc.log.Debugf("coinbase reward account not previously known: %s", err)
+		}
+		minerState.Balance, err = util.SafeAdd(minerState.Balance, minerReward)
+		if err != nil {
+			err = fmt.Errorf("block %x miner balance: %w", bl.Hash(), err)
+			bc.log.Warn(err)
+			return err
 		}
-		minerState.Balance += minerReward
 		minerState.LastIncoming++
 		err = bc.buckSetState(bstate, bl.Recipient, minerState)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		// add block hash to recipient's incoming list
 		err = bc.SetTxTopoInc(txn, bl.Hash(), bl.Recipient, minerState.LastIncoming)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 
 		// apply governance reward
 		governanceState, err := bc.buckGetState(bstate, address.GenesisAddress)
 		if err != nil {
-			Log.Debugf("governance reward account not previously known: %s", err)
+			bc.log.Debugf("governance reward account not previously known: %s", err)
+		}
+		governanceState.Balance, err = util.SafeAdd(governanceState.Balance, governanceReward)
+		if err != nil {
+			err = fmt.Errorf("block %x governance balance: %w", bl.Hash(), err)
+			bc.log.Warn(err)
+			return err
 		}
-		governanceState.Balance += governanceReward
 		err = bc.buckSetState(bstate, address.GenesisAddress, governanceState)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		// governance reward transactions aren't saved in incoming tx list
+
+		// fees are only moved between accounts, so supply only increases by the block reward
+		stats := bc.GetStats(txn)
+		stats.Supply += bl.Reward()
+		bc.setStatsNoBroadcast(txn, stats)
 	}
 
 	// update some stats
@@ -936,6 +1299,12 @@ func (bc *Blockchain) ApplyBlockToState(txn *bolt.Tx, bl *block.Block, _ [32]byt
 	}
 	bc.SyncMut.Unlock()
 
+	err = bc.recordEvents(txn, events...)
+	if err != nil {
+		bc.log.Err(err)
+		return err
+	}
+
 	return nil
 }
 
@@ -950,17 +1319,22 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 		Hash [32]byte
 		Tx   *transaction.Transaction
 	}
-	txs := make([]txCache, len(bl.Transactions))
+	txs := make([]txCache, 0, len(bl.Transactions))
 
 	// iterate transactions to find tx fee sum for coinbase transaction
 	var totalFee uint64
 	for _, v := range bl.Transactions {
 		tx, _, err := bc.buckGetTx(btx, v)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
+			return err
+		}
+		totalFee, err = util.SafeAdd(totalFee, tx.Fee)
+		if err != nil {
+			err = fmt.Errorf("block %x total fee: %w", blhash, err)
+			bc.log.Err(err)
 			return err
 		}
-		totalFee += tx.Fee
 		txs = append(txs, txCache{
 			Hash: v,
 			Tx:   tx,
@@ -969,35 +1343,37 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 
 	// undo coinbase transaction
 	{
-		totalReward := bl.Reward() + totalFee
-		governanceReward := totalReward * config.BLOCK_REWARD_FEE_PERCENT / 100
-		minerReward := totalReward - governanceReward
+		totalReward, minerReward, governanceReward, err := splitBlockReward(bl, blhash, totalFee)
+		if err != nil {
+			bc.log.Err(err)
+			return err
+		}
 
-		Log.Debug("removing block reward", totalReward, "miner:", minerReward, "governance:", governanceReward)
+		bc.log.Debug("removing block reward", totalReward, "miner:", minerReward, "governance:", governanceReward)
 
 		// undo miner transaction
 		minerState, err := bc.buckGetState(bstate, bl.Recipient)
 		if err != nil {
 			err := fmt.Errorf("coinbase reward account unknown: %s", err)
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		if minerState.Balance < minerReward {
 			err := fmt.Errorf("balance of coinbase account is too small! balance: %d, block reward: %d",
 				minerState.Balance, minerReward)
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		if minerState.LastIncoming == 0 {
 			err = fmt.Errorf("coinbase %s LastIncoming must not be zero in block %x", bl.Recipient, blhash)
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		minerState.Balance -= minerReward
 		minerState.LastIncoming--
 		err = bc.buckSetState(bstate, bl.Recipient, minerState)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		// removing coinbase transaction from incoming tx list is not necessary - since it's never read, and
@@ -1007,22 +1383,26 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 		governanceState, err := bc.buckGetState(bstate, address.GenesisAddress)
 		if err != nil {
 			err := fmt.Errorf("coinbase reward account unknown: %s", err)
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		if governanceState.Balance < governanceReward {
 			err := fmt.Errorf("balance of coinbase account is too small! balance: %d, block reward: %d",
 				governanceState.Balance, governanceReward)
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		governanceState.Balance -= governanceReward
 		err = bc.buckSetState(bstate, address.GenesisAddress, governanceState)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 		// governance reward transactions aren't saved in incoming tx list
+
+		stats := bc.GetStats(txn)
+		stats.Supply -= bl.Reward()
+		bc.setStatsNoBroadcast(txn, stats)
 	}
 
 	// remove transactions in reverse order
@@ -1030,7 +1410,7 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 		tx := txs[i].Tx
 		txhash := txs[i].Hash
 
-		Log.Devf("removing transaction %x (index %d) from state", txhash, i)
+		bc.log.Devf("removing transaction %x (index %d) from state", txhash, i)
 
 		senderAddr := address.FromPubKey(tx.Sender)
 
@@ -1038,27 +1418,25 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 		{
 			recState, err := bc.GetState(txn, tx.Recipient)
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
-			if recState.Balance < tx.Amount+tx.Fee {
-				err := fmt.Errorf("recipient balance is smaller than tx amount + fee: %d < %d+%d",
-					recState.Balance, tx.Amount, tx.Fee)
-				if err != nil {
-					Log.Err(err)
-					return err
-				}
+			if recState.Balance < tx.Amount {
+				err := fmt.Errorf("recipient balance is smaller than tx amount: %d < %d", recState.Balance,
+					tx.Amount)
+				bc.log.Err(err)
+				return err
 			}
 			if recState.LastIncoming == 0 {
 				err = fmt.Errorf("recipient %s LastIncoming must not be zero in tx %x", tx.Recipient, txhash)
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 			recState.Balance -= tx.Amount
 			recState.LastIncoming--
 			err = bc.SetState(txn, tx.Recipient, recState)
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 		}
@@ -1067,12 +1445,12 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 		{
 			senderState, err := bc.GetState(txn, senderAddr)
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 			if senderState.LastNonce == 0 {
 				err = fmt.Errorf("sender %s last nonce must not be zero in tx %x", senderAddr, txhash)
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 			senderState.Balance += tx.Amount
@@ -1080,15 +1458,15 @@ func (bc *Blockchain) RemoveBlockFromState(txn *bolt.Tx, bl *block.Block, blhash
 			senderState.LastNonce--
 			err = bc.SetState(txn, senderAddr, senderState)
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 		}
 
 		// set tx height to zero
-		err := bc.SetTxHeight(txn, txhash, bl.Height)
+		err := bc.SetTxHeight(txn, txhash, 0)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return err
 		}
 
@@ -1101,6 +1479,24 @@ func (bc *Blockchain) GetState(tx *bolt.Tx, addr address.Address) (s *State, err
 	b := tx.Bucket([]byte{buck.STATE})
 	return bc.buckGetState(b, addr)
 }
+
+// GetStateByPubKey returns the state of the address derived from the given public key
+func (bc *Blockchain) GetStateByPubKey(tx *bolt.Tx, pk bitcrypto.Pubkey) (*State, error) {
+	return bc.GetState(tx, address.FromPubKey(pk))
+}
+
+// GetNextNonce returns the last nonce of addr in state, and the nonce its next transaction should use taking
+// into account the pending mempool transactions, which are pending in number. Addresses not in state yet have a
+// last nonce of 0.
+func (bc *Blockchain) GetNextNonce(tx *bolt.Tx, addr address.Address) (lastNonce, next uint64, pending int) {
+	state, err := bc.GetState(tx, addr)
+	if err != nil {
+		bc.log.Debug(err)
+	}
+	next, pending = bc.GetMempool(tx).NextNonce(addr, state.LastNonce)
+	return state.LastNonce, next, pending
+}
+
 func (bc *Blockchain) buckGetState(b *bolt.Bucket, addr address.Address) (*State, error) {
 	var s = &State{}
 	bin := b.Get(addr[:])
@@ -1124,26 +1520,44 @@ func (bc *Blockchain) CreateCheckpoints(tx *bolt.Tx, maxHeight, interval uint64)
 	for height := interval; height <= maxHeight; height += interval {
 		bl, err := bc.GetTopo(tx, height)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			return nil, err
 		}
-		Log.Devf("Adding block %d %x to checkpoints", height, bl)
+		bc.log.Devf("Adding block %d %x to checkpoints", height, bl)
 		s.AddFixedByteArray(bl[:])
 	}
 	return s.Output(), nil
 }
 
+// VerifyPoW verifies the PoW of all the mainchain blocks, including the ones secured by checkpoints.
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) VerifyPoW(tx *bolt.Tx) error {
+	topHeight := bc.GetStats(tx).TopHeight
+
+	// genesis block doesn't have a valid PoW, so we start from height 1
+	return bc.IterateMainchain(tx, 1, topHeight, func(height uint64, _ [32]byte, bl *block.Block) error {
+		err := bl.PrevalidateFull()
+		if err != nil {
+			return fmt.Errorf("block at height %d is not valid: %w", height, err)
+		}
+		if height%1000 == 0 {
+			bc.log.Infof("Verified PoW of %d/%d blocks", height, topHeight)
+		}
+		return nil
+	})
+}
+
 // Blockchain MUST be locked before calling this
 func (bc *Blockchain) checkDeorphanage(tx *bolt.Tx, bl *block.Block, hash [32]byte) error {
-	Log.Debugf("checkDeorphanage %x", hash)
+	bc.log.Debugf("checkDeorphanage %x", hash)
 	stats := bc.GetStats(tx)
 
 	// no need to remove block from queue, it's removed by parent of this function
 
-	// recursively check for deorphans
+	// check for deorphans
 	err := bc.deorphanBlock(tx, bl, hash, stats)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
 
@@ -1153,7 +1567,7 @@ func (bc *Blockchain) checkDeorphanage(tx *bolt.Tx, bl *block.Block, hash [32]by
 	// now that blocks were deorphaned, there might be a reorg
 	reorg, err := bc.CheckReorgs(tx, stats)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
 	if reorg {
@@ -1167,32 +1581,46 @@ func (bc *Blockchain) checkDeorphanage(tx *bolt.Tx, bl *block.Block, hash [32]by
 
 // Blockchain MUST be locked before calling this
 func (bc *Blockchain) cleanupTips(tx *bolt.Tx, stats *Stats) {
-	Log.Debug("cleaning up tips")
+	bc.log.Debug("cleaning up tips")
 	for i, tip := range stats.Tips {
 		topo, err := bc.GetTopo(tx, tip.Height)
 		if err != nil {
-			Log.Debugf("cleanupTips error is %v; this is probably fine", err)
+			bc.log.Debugf("cleanupTips error is %v; this is probably fine", err)
 			continue
 		}
 		if topo == tip.Hash {
-			Log.Debugf("cleanupTips: tip %x is included in mainchain, discarding it", tip.Hash)
+			bc.log.Debugf("cleanupTips: tip %x is included in mainchain, discarding it", tip.Hash)
 			delete(stats.Tips, i)
 		}
 	}
 }
 
-// recursive function which finds all the orphans that are children of the given hash, and creates altchain
+// deorphanBlock finds all the orphans descending from the given block, and creates altchains with them. The
+// descendants are visited with a work queue instead of recursion, so that a long orphan chain can't exhaust the
+// stack. Every orphan is removed from stats as soon as it's visited, so each one is visited at most once, even
+// if the orphan prev-hashes form a cycle.
 // don't forget to save stats later, as this function doesn't do that
 func (bc *Blockchain) deorphanBlock(tx *bolt.Tx, prev *block.Block, prevHash [32]byte, stats *Stats) error {
-	Log.Debugf("deorphanBlock hash %x", prevHash)
+	type deorphaned struct {
+		bl   *block.Block
+		hash [32]byte
+	}
+	queue := []deorphaned{{prev, prevHash}}
+
+	for len(queue) > 0 {
+		prev, prevHash := queue[0].bl, queue[0].hash
+		queue = queue[1:]
+		bc.log.Debugf("deorphanBlock hash %x", prevHash)
 
-	for i, v := range stats.Orphans {
-		if v.PrevHash == prevHash {
-			Log.Debugf("deorphanBlock: %x is deorphaning %x", prevHash, v.Hash)
+		for i, v := range stats.Orphans {
+			if v.PrevHash != prevHash {
+				continue
+			}
+			bc.log.Debugf("deorphanBlock: %x is deorphaning %x", prevHash, v.Hash)
 			bl, err := bc.GetBlock(tx, v.Hash)
 			h2 := v.Hash
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 				return err
 			}
 
@@ -1203,7 +1631,7 @@ func (bc *Blockchain) deorphanBlock(tx *bolt.Tx, prev *block.Block, prevHash [32
 			cdiff = cdiff.Add(sideDiff)
 
 			if !cdiff.Equals(bl.CumulativeDiff) {
-				Log.Devf("deorphanBlock: block cumulative difficulty updated: %s -> %s", bl.CumulativeDiff,
+				bc.log.Devf("deorphanBlock: block cumulative difficulty updated: %s -> %s", bl.CumulativeDiff,
 					cdiff)
 				bl.CumulativeDiff = cdiff
 				bc.insertBlock(tx, bl, h2)
@@ -1221,8 +1649,8 @@ func (bc *Blockchain) deorphanBlock(tx *bolt.Tx, prev *block.Block, prevHash [32
 				CumulativeDiff: bl.CumulativeDiff,
 			}
 
-			// recall this function to find bl2's children
-			bc.deorphanBlock(tx, bl, h2, stats)
+			// bl2's children are deorphaned later
+			queue = append(queue, deorphaned{bl, h2})
 		}
 	}
 
@@ -1236,12 +1664,12 @@ func (bc *Blockchain) GetStats(tx *bolt.Tx) *Stats {
 	d := b.Get([]byte("stats"))
 
 	if len(d) == 0 {
-		Log.Fatal("stats are empty")
+		bc.log.Fatal("stats are empty")
 	}
 
 	s, err := DeserializeStats(d)
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 
 	return s
@@ -1250,7 +1678,11 @@ func (bc *Blockchain) GetStats(tx *bolt.Tx) *Stats {
 // Blockchain MUST be locked before calling this
 func (bc *Blockchain) SetStats(tx *bolt.Tx, s *Stats) {
 	if s.TopHeight != 0 {
-		go bc.SendStats(s)
+		// the top block is sent with the stats, so they can only be sent once committed
+		seq := bc.statsSender.next()
+		tx.OnCommit(func() {
+			go bc.sendStats(s, seq)
+		})
 	}
 	bc.setStatsNoBroadcast(tx, s)
 }
@@ -1260,7 +1692,7 @@ func (bc *Blockchain) setStatsNoBroadcast(tx *bolt.Tx, s *Stats) {
 	b := tx.Bucket([]byte{buck.INFO})
 	err := b.Put([]byte("stats"), s.Serialize())
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 }
 
@@ -1269,7 +1701,7 @@ func (bc *Blockchain) GetMempool(tx *bolt.Tx) *Mempool {
 	b := tx.Bucket([]byte{buck.INFO})
 	s, err := DeserializeMempool(b.Get([]byte("mempool")))
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 	return s
 }
@@ -1278,7 +1710,7 @@ func (bc *Blockchain) GetMempool(tx *bolt.Tx) *Mempool {
 func (bc *Blockchain) buckGetMempool(b *bolt.Bucket) *Mempool {
 	s, err := DeserializeMempool(b.Get([]byte("mempool")))
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 	return s
 }
@@ -1288,7 +1720,7 @@ func (bc *Blockchain) SetMempool(tx *bolt.Tx, s *Mempool) {
 	b := tx.Bucket([]byte{buck.INFO})
 	err := b.Put([]byte("mempool"), s.Serialize())
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 }
 
@@ -1296,7 +1728,7 @@ func (bc *Blockchain) SetMempool(tx *bolt.Tx, s *Mempool) {
 func (bc *Blockchain) buckSetMempool(b *bolt.Bucket, s *Mempool) {
 	err := b.Put([]byte("mempool"), s.Serialize())
 	if err != nil {
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
 }
 
@@ -1333,9 +1765,11 @@ func (bc *Blockchain) insertBlock(tx *bolt.Tx, bl *block.Block, hash [32]byte) e
 
 	err := b.Put(hash[:], bl.Serialize())
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return err
 	}
+	// the block may be saved again with a different cumulative difficulty
+	bc.blockCache.remove(tx, hash)
 
 	blData := b.Get(hash[:])
 	if len(blData) < 1 {
@@ -1347,6 +1781,10 @@ func (bc *Blockchain) insertBlock(tx *bolt.Tx, bl *block.Block, hash [32]byte) e
 // GetBlock returns the block given its hash
 // Blockchain MUST be RLocked before calling this
 func (bc *Blockchain) GetBlock(tx *bolt.Tx, hash [32]byte) (*block.Block, error) {
+	if bl := bc.blockCache.get(hash); bl != nil {
+		return bl, nil
+	}
+
 	bl := &block.Block{}
 	// read block data
 	b := tx.Bucket([]byte{buck.BLOCK})
@@ -1355,6 +1793,22 @@ func (bc *Blockchain) GetBlock(tx *bolt.Tx, hash [32]byte) (*block.Block, error)
 		return bl, fmt.Errorf("block %x not found", hash)
 	}
 	err := bl.Deserialize(blbin)
+	if err != nil {
+		return bl, err
+	}
+	bc.blockCache.add(tx, hash, bl)
+	return bl, nil
+}
+
+// GetBlockHeader returns the header of the block given its hash. It's faster than GetBlock, as the
+// difficulty and the transaction list are not deserialized.
+func (bc *Blockchain) GetBlockHeader(tx *bolt.Tx, hash [32]byte) (*block.BlockHeader, error) {
+	bl := &block.BlockHeader{}
+	blbin := tx.Bucket([]byte{buck.BLOCK}).Get(hash[:])
+	if len(blbin) == 0 {
+		return bl, fmt.Errorf("block %x not found", hash)
+	}
+	_, err := bl.Deserialize(blbin)
 	return bl, err
 }
 
@@ -1394,20 +1848,101 @@ func (bc *Blockchain) GetBlockByHeight(tx *bolt.Tx, height uint64) (*block.Block
 	return bc.GetBlock(tx, hash)
 }
 
-func (bc *Blockchain) StartP2P(peers []string, port uint16) {
-	p2p.Log = Log
+// IterateMainchain calls fn for every mainchain block from height from to height to, both included, in height
+// order. It stops at the first error returned by fn, and returns it. The TOPO keys are little-endian, so they
+// don't sort by height and the heights are looked up one by one, but the buckets are only opened once.
+// Blockchain MUST be RLocked before calling this
+func (bc *Blockchain) IterateMainchain(tx *bolt.Tx, from, to uint64,
+	fn func(height uint64, hash [32]byte, bl *block.Block) error) error {
+	buckTopo := tx.Bucket([]byte{buck.TOPO})
+	buckBlock := tx.Bucket([]byte{buck.BLOCK})
+
+	for height := from; height <= to; height++ {
+		hash, err := bc.buckGetTopo(buckTopo, height)
+		if err != nil {
+			return fmt.Errorf("topo of height %d: %w", height, err)
+		}
+		blbin := buckBlock.Get(hash[:])
+		if len(blbin) == 0 {
+			return fmt.Errorf("block %x at height %d not found", hash, height)
+		}
+		bl := &block.Block{}
+		err = bl.Deserialize(blbin)
+		if err != nil {
+			return fmt.Errorf("block %x at height %d: %w", hash, height, err)
+		}
+
+		err = fn(height, hash, bl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrCumulativeDiffNotReached is returned by FindBlockByCumulativeDiff when the mainchain doesn't have enough
+// cumulative difficulty yet
+var ErrCumulativeDiffNotReached = errors.New("cumulative difficulty not reached")
+
+// FindBlockByCumulativeDiff returns the first mainchain block whose cumulative difficulty is greater than or
+// equal to target, and its height. Cumulative difficulty only increases along the mainchain, so the height is
+// found with a binary search.
+func (bc *Blockchain) FindBlockByCumulativeDiff(tx *bolt.Tx, target Uint128) (*block.Block, uint64, error) {
+	stats := bc.GetStats(tx)
+	if stats.CumulativeDiff.Cmp(target) < 0 {
+		return nil, 0, fmt.Errorf("%w: target %s, top block %d has %s", ErrCumulativeDiffNotReached, target,
+			stats.TopHeight, stats.CumulativeDiff)
+	}
+
+	// the block at height hi always reaches the target
+	lo, hi := uint64(0), stats.TopHeight
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		bl, err := bc.GetBlockByHeight(tx, mid)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get block %d: %w", mid, err)
+		}
+		if bl.CumulativeDiff.Cmp(target) >= 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	bl, err := bc.GetBlockByHeight(tx, hi)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get block %d: %w", hi, err)
+	}
+	return bl, hi, nil
+}
+
+func (bc *Blockchain) StartP2P(peers []string, port uint16, maxInbound, maxOutbound int, timeouts p2p.Timeouts) {
+	p2p.Log = bc.log
 	bc.P2P = p2p.Start(peers)
+	bc.P2P.DataDir = bc.DataDir
+	bc.P2P.MaxInbound = maxInbound
+	bc.P2P.MaxOutbound = maxOutbound
+	bc.P2P.Timeouts = timeouts
 	bc.P2P.StartClients()
 
 	go bc.pinger()
 	go bc.incomingP2P()
 	go bc.newConnections()
+	go bc.statsBroadcaster()
 	go bc.Synchronize()
+	go bc.mempoolRebroadcaster()
+	go bc.stallWatcher()
 
 	bc.P2P.ListenServer(port)
 }
 
+// GetSupply returns the current supply, which is kept updated in the stats
 func (bc *Blockchain) GetSupply(tx *bolt.Tx) uint64 {
+	return bc.GetStats(tx).Supply
+}
+
+// ScanSupply computes the supply by iterating all the balances in the state. It's slow, so it should only be
+// used for auditing the supply returned by GetSupply.
+func (bc *Blockchain) ScanSupply(tx *bolt.Tx) uint64 {
 	var sum uint64 = 0
 	b := tx.Bucket([]byte{buck.STATE})
 
@@ -1415,13 +1950,13 @@ func (bc *Blockchain) GetSupply(tx *bolt.Tx) uint64 {
 		state := &State{}
 		err := state.Deserialize(v)
 		if err != nil {
-			Log.Warn(address.Address(k), err)
+			bc.log.Warn(address.Address(k), err)
 		}
 		sum += state.Balance
 		return nil
 	})
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 	}
 	return sum
 }
@@ -1430,9 +1965,19 @@ func (bc *Blockchain) CheckSupply(tx *bolt.Tx) {
 	supply := block.GetSupplyAtHeight(bc.GetStats(tx).TopHeight)
 	if sum != supply {
 		err := fmt.Errorf("invalid supply %d, expected %d", sum, supply)
-		Log.Fatal(err)
+		bc.log.Fatal(err)
 	}
-	Log.Debug("CheckSupply: supply is correct:", sum)
+	bc.log.Debug("CheckSupply: supply is correct:", sum)
+}
+
+// AuditSupply verifies that the supply in stats matches the sum of all the balances
+func (bc *Blockchain) AuditSupply(tx *bolt.Tx) error {
+	sum := bc.ScanSupply(tx)
+	supply := bc.GetSupply(tx)
+	if sum != supply {
+		return fmt.Errorf("supply in stats is %d, but balances sum to %d", supply, sum)
+	}
+	return nil
 }
 
 func (bc *Blockchain) SetTxTopoInc(tx *bolt.Tx, txid [32]byte, addr address.Address, incid uint64) error {
@@ -1469,6 +2014,16 @@ func (bc *Blockchain) GetTxTopoOut(tx *bolt.Tx, addr address.Address, outid uint
 	return [32]byte(bin), nil
 }
 
+// GetTxTopoIncByPubKey is like GetTxTopoInc, for the address derived from the given public key
+func (bc *Blockchain) GetTxTopoIncByPubKey(tx *bolt.Tx, pk bitcrypto.Pubkey, incid uint64) ([32]byte, error) {
+	return bc.GetTxTopoInc(tx, address.FromPubKey(pk), incid)
+}
+
+// GetTxTopoOutByPubKey is like GetTxTopoOut, for the address derived from the given public key
+func (bc *Blockchain) GetTxTopoOutByPubKey(tx *bolt.Tx, pk bitcrypto.Pubkey, outid uint64) ([32]byte, error) {
+	return bc.GetTxTopoOut(tx, address.FromPubKey(pk), outid)
+}
+
 func (bc *Blockchain) createBuck(name byte) {
 	bc.DB.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucket([]byte{name})
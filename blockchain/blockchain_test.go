@@ -0,0 +1,1305 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
+	"still-blockchain/block"
+	"still-blockchain/checkpoints"
+	"still-blockchain/config"
+	"still-blockchain/p2p"
+	"still-blockchain/p2p/packet"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Mining blocks is too slow for tests, so the test blocks are only prevalidated by the tests which call
+// skipTestPoW. The embedded checkpoints of the network are never used.
+func TestMain(m *testing.M) {
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 0, 0
+	os.Exit(m.Run())
+}
+
+// skipTestPoW considers all the blocks secured by checkpoints until the test ends, so that their PoW is not
+// checked by Prevalidate
+func skipTestPoW(t testing.TB) {
+	checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = math.MaxUint32, 1
+	t.Cleanup(func() {
+		checkpoints.CheckpointInterval, checkpoints.MaxCheckpoint = 0, 0
+	})
+}
+
+// newTestBlockchain returns a blockchain with only the genesis block, backed by a temporary data directory.
+// It's closed when the test ends, unless the test closes it first.
+func newTestBlockchain(t testing.TB) *Blockchain {
+	t.Helper()
+
+	bc := NewWithOptions(t.TempDir(), Options{Log: Log})
+	bc.P2P = p2p.Start(nil)
+	t.Cleanup(func() {
+		if !bc.IsShuttingDown() {
+			bc.Close()
+		}
+	})
+	return bc
+}
+
+// addTestBlocks adds the blocks in order, each in its own transaction
+func addTestBlocks(t testing.TB, bc *Blockchain, blocks ...*block.Block) {
+	t.Helper()
+
+	for _, bl := range blocks {
+		err := bc.DB.Update(func(tx *bolt.Tx) error {
+			_, err := bc.AddBlock(tx, bl)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setTestState overwrites the state of the given address
+func setTestState(t testing.TB, bc *Blockchain, addr address.Address, state *State) {
+	t.Helper()
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		return bc.SetState(tx, addr, state)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestBlock returns a block template on top of the current mainchain, which is not mined
+func newTestBlock(t testing.TB, bc *Blockchain, addr address.Address) *block.Block {
+	t.Helper()
+
+	var bl *block.Block
+	err := bc.DB.View(func(tx *bolt.Tx) (err error) {
+		bl, _, err = bc.GetBlockTemplate(tx, addr)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bl
+}
+
+// newTestChain returns n consecutive blocks built on top of the given base blocks
+func newTestChain(t testing.TB, base []*block.Block, n int) []*block.Block {
+	t.Helper()
+
+	bc := newTestBlockchain(t)
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	addTestBlocks(t, bc, base...)
+	blocks := make([]*block.Block, 0, n)
+	for i := 0; i < n; i++ {
+		bl := newTestBlock(t, bc, miner)
+		addTestBlocks(t, bc, bl)
+		blocks = append(blocks, bl)
+	}
+	return blocks
+}
+
+func TestReorgToBestTip(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	// reorgs can't go past the genesis block, so all the chains share the first block
+	base := newTestChain(t, nil, 1)
+	chainA := newTestChain(t, base, 1)
+	chainB := newTestChain(t, base, 2)
+	chainC := newTestChain(t, base, 3)
+
+	checkTop := func(msg string, expected *block.Block) {
+		t.Helper()
+		bc.DB.View(func(tx *bolt.Tx) error {
+			if hash := bc.GetStats(tx).TopHash; hash != expected.Hash() {
+				t.Fatalf("%s: top block is %x, expected %x", msg, hash, expected.Hash())
+			}
+			if err := bc.AuditSupply(tx); err != nil {
+				t.Fatalf("%s: %v", msg, err)
+			}
+			return nil
+		})
+	}
+
+	for _, bl := range []*block.Block{base[0], chainA[0], chainB[0], chainC[0]} {
+		addTestBlocks(t, bc, bl)
+	}
+	checkTop("first chain", chainA[0])
+
+	// chain B gets more work than chain A
+	addTestBlocks(t, bc, chainB[1])
+	checkTop("chain B with more work", chainB[1])
+
+	// chain C has the same work as chain B, so it doesn't cause a reorg
+	addTestBlocks(t, bc, chainC[1])
+	checkTop("chain C with the same work", chainB[1])
+
+	// chain C becomes the best chain
+	addTestBlocks(t, bc, chainC[2])
+	checkTop("chain C with more work", chainC[2])
+}
+
+// TestReorgInterrupted interrupts a reorg before its transaction is committed, like a crash would, and checks
+// that after a restart the database still has the previous mainchain, and the reorg can be done again
+func TestReorgInterrupted(t *testing.T) {
+	base := newTestChain(t, nil, 2)
+	chainA := newTestChain(t, base, 1)
+	chainB := newTestChain(t, base, 2)
+
+	bc := NewWithOptions(t.TempDir(), Options{Log: Log, Durable: true})
+	bc.P2P = p2p.Start(nil)
+	checkTop := func(msg string, expected *block.Block) {
+		t.Helper()
+		bc.DB.View(func(tx *bolt.Tx) error {
+			if hash := bc.GetStats(tx).TopHash; hash != expected.Hash() {
+				t.Fatalf("%s: top block is %x, expected %x", msg, hash, expected.Hash())
+			}
+			if err := bc.AuditSupply(tx); err != nil {
+				t.Fatalf("%s: %v", msg, err)
+			}
+			return nil
+		})
+	}
+	addTestBlocks(t, bc, base[0], base[1], chainA[0], chainB[0])
+
+	errCrash := errors.New("crash")
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := bc.AddBlock(tx, chainB[1]); err != nil {
+			return err
+		}
+		if hash := bc.GetStats(tx).TopHash; hash != chainB[1].Hash() {
+			t.Fatalf("top block during the reorg is %x, expected %x", hash, chainB[1].Hash())
+		}
+		return errCrash
+	})
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("reorg transaction returned %v", err)
+	}
+	bc.Close()
+
+	bc = NewWithOptions(bc.DataDir, Options{Log: Log, Durable: true})
+	bc.P2P = p2p.Start(nil)
+	defer bc.Close()
+	checkTop("after the restart", chainA[0])
+
+	addTestBlocks(t, bc, chainB[1])
+	checkTop("after the reorg is done again", chainB[1])
+}
+
+// TestReorgCompetingTip adds a better tip while a reorg is in progress: it waits for the reorg to be committed,
+// and then the better chain wins
+func TestReorgCompetingTip(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 1)
+	chainA := newTestChain(t, base, 1)
+	chainB := newTestChain(t, base, 2)
+	chainC := newTestChain(t, base, 3)
+
+	addTestBlocks(t, bc, []*block.Block{base[0], chainA[0]}...)
+
+	reorging := make(chan struct{})
+	competing := make(chan error)
+	committed := false
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		for _, bl := range chainB {
+			if _, err := bc.AddBlock(tx, bl); err != nil {
+				return err
+			}
+		}
+		if hash := bc.GetStats(tx).TopHash; hash != chainB[1].Hash() {
+			t.Errorf("top block during the reorg is %x, expected chain B %x", hash, chainB[1].Hash())
+		}
+
+		// chain C is received while the reorg to chain B is not committed yet
+		go func() {
+			close(reorging)
+			competing <- bc.DB.Update(func(tx *bolt.Tx) error {
+				if !committed {
+					t.Error("chain C was added before the reorg to chain B was committed")
+				}
+				for _, bl := range chainC {
+					if _, err := bc.AddBlock(tx, bl); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}()
+		<-reorging
+		time.Sleep(100 * time.Millisecond)
+		committed = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-competing; err != nil {
+		t.Fatal(err)
+	}
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if hash := bc.GetStats(tx).TopHash; hash != chainC[2].Hash() {
+			t.Fatalf("top block is %x, expected the best chain C %x", hash, chainC[2].Hash())
+		}
+		if err := bc.AuditSupply(tx); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	})
+}
+
+func TestForkInfo(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 1)
+	chainA := newTestChain(t, base, 2)
+	chainB := newTestChain(t, base, 1)
+	chainC := newTestChain(t, base, 2)
+
+	addTestBlocks(t, bc, []*block.Block{base[0], chainA[0], chainA[1], chainB[0], chainC[1]}...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		// the competing block of chain B is an altchain tip
+		tips := bc.GetTips(tx)
+		i := slices.IndexFunc(tips, func(tip AltchainTip) bool {
+			return tip.Hash == chainB[0].Hash()
+		})
+		if i < 0 {
+			t.Fatalf("altchain block %x is not in tips: %x", chainB[0].Hash(), tips)
+		}
+		if tips[i].Height != chainB[0].Height {
+			t.Errorf("tip height is %d, expected %d", tips[i].Height, chainB[0].Height)
+		}
+		if !tips[i].CumulativeDiff.Equals(chainB[0].CumulativeDiff) {
+			t.Errorf("tip cumulative diff is %s, expected %s", tips[i].CumulativeDiff, chainB[0].CumulativeDiff)
+		}
+
+		// the block of chain C without its parent is an orphan
+		orphans := bc.GetOrphans(tx)
+		if len(orphans) != 1 || orphans[0].Hash != chainC[1].Hash() {
+			t.Fatalf("orphans are %x, expected %x", orphans, chainC[1].Hash())
+		}
+		if orphans[0].Height != chainC[1].Height || orphans[0].PrevHash != chainC[0].Hash() {
+			t.Errorf("orphan has height %d and parent %x", orphans[0].Height, orphans[0].PrevHash)
+		}
+		return nil
+	})
+}
+
+func TestGetBlockStatus(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 1)
+	chainA := newTestChain(t, base, 2)
+	chainB := newTestChain(t, base, 1)
+	chainC := newTestChain(t, base, 2)
+
+	addTestBlocks(t, bc, []*block.Block{base[0], chainA[0], chainA[1], chainB[0], chainC[1]}...)
+
+	top := chainA[1].Height
+	tests := []struct {
+		name          string
+		hash          [32]byte
+		status        string
+		height        uint64
+		confirmations int
+	}{
+		{"mainchain", base[0].Hash(), BlockMainchain, base[0].Height, int(top-base[0].Height) + 1},
+		{"mainchain top", chainA[1].Hash(), BlockMainchain, top, 1},
+		{"altchain", chainB[0].Hash(), BlockAltchain, chainB[0].Height, 0},
+		{"orphan", chainC[1].Hash(), BlockOrphan, chainC[1].Height, 0},
+		{"unknown", blake3.Sum256([]byte("unknown")), BlockUnknown, 0, 0},
+	}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		for _, v := range tests {
+			status, height, confirmations, err := bc.GetBlockStatus(tx, v.hash)
+			if err != nil {
+				t.Fatalf("%s: %v", v.name, err)
+			}
+			if status != v.status || height != v.height || confirmations != v.confirmations {
+				t.Errorf("%s: status %s height %d confirmations %d, expected %s %d %d", v.name, status, height,
+					confirmations, v.status, v.height, v.confirmations)
+			}
+		}
+		return nil
+	})
+}
+
+func TestDeorphanLongChain(t *testing.T) {
+	const n = 200
+	bc := newTestBlockchain(t)
+	blocks := newTestChain(t, nil, n)
+
+	// all the blocks but the first are orphans until it arrives
+	addTestBlocks(t, bc, append(blocks[1:], blocks[0])...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		if len(stats.Orphans) != 0 {
+			t.Errorf("%d blocks are still orphans", len(stats.Orphans))
+		}
+		if top := blocks[n-1]; stats.TopHash != top.Hash() || stats.TopHeight != top.Height {
+			t.Errorf("top block is %d %x, expected %d %x", stats.TopHeight, stats.TopHash, top.Height, top.Hash())
+		}
+		return nil
+	})
+}
+
+func TestDeorphanCycle(t *testing.T) {
+	bc := newTestBlockchain(t)
+	blocks := newTestChain(t, nil, 3)
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		for _, bl := range blocks {
+			if err := bc.insertBlock(tx, bl, bl.Hash()); err != nil {
+				return err
+			}
+		}
+
+		// the orphan prev-hashes form the cycle 0 -> 1 -> 2 -> 0
+		stats := bc.GetStats(tx)
+		for i, bl := range blocks {
+			prev := blocks[(i+len(blocks)-1)%len(blocks)].Hash()
+			stats.Orphans[bl.Hash()] = &Orphan{Hash: bl.Hash(), PrevHash: prev, Height: bl.Height}
+		}
+
+		err := bc.deorphanBlock(tx, blocks[2], blocks[2].Hash(), stats)
+		if err != nil {
+			return err
+		}
+		if len(stats.Orphans) != 0 {
+			t.Errorf("%d blocks are still orphans", len(stats.Orphans))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTipsSorted(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	hashes := []util.Hash{{3}, {1}, {2}, {0}}
+	bc.DB.Update(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		for i, h := range hashes {
+			stats.Tips[h] = &AltchainTip{Hash: h, Height: uint64(10 + i%2)}
+			stats.Orphans[h] = &Orphan{Hash: h, Height: uint64(10 + i%2)}
+		}
+		bc.setStatsNoBroadcast(tx, stats)
+		return nil
+	})
+
+	expected := []util.Hash{{2}, {3}, {0}, {1}}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if n := len(bc.GetTips(tx)); n != len(expected) {
+			t.Fatalf("got %d tips, expected %d", n, len(expected))
+		}
+		for i, tip := range bc.GetTips(tx) {
+			if tip.Hash != expected[i] {
+				t.Fatalf("tip %d is %x, expected %x", i, tip.Hash, expected[i])
+			}
+		}
+		for i, orphan := range bc.GetOrphans(tx) {
+			if orphan.Hash != expected[i] {
+				t.Fatalf("orphan %d is %x, expected %x", i, orphan.Hash, expected[i])
+			}
+		}
+		return nil
+	})
+}
+
+func TestApplyBlockOverflow(t *testing.T) {
+	pkA := address.GenerateKeypair(blake3.Sum256([]byte("sender A")))
+	pkB := address.GenerateKeypair(blake3.Sum256([]byte("sender B")))
+	senderA, senderB := address.FromPubKey(pkA.Public()), address.FromPubKey(pkB.Public())
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	// transactions are built without transaction.New, since Prevalidate would reject some of them
+	newTx := func(pk bitcrypto.Privkey, amount, fee uint64) *transaction.Transaction {
+		tx := &transaction.Transaction{
+			Sender:    pk.Public(),
+			Recipient: recipient,
+			Amount:    amount,
+			Nonce:     1,
+			Fee:       fee,
+		}
+		if err := tx.Sign(pk); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	minFee := newTx(pkA, 1, 0).MinFee()
+
+	tests := []struct {
+		name     string
+		balances map[address.Address]uint64
+		txs      []*transaction.Transaction
+		overflow bool
+	}{
+		{
+			"valid",
+			map[address.Address]uint64{senderA: 10 * config.COIN},
+			[]*transaction.Transaction{newTx(pkA, config.COIN, minFee)},
+			false,
+		},
+		{
+			"amount plus fee",
+			map[address.Address]uint64{senderA: math.MaxUint64},
+			[]*transaction.Transaction{newTx(pkA, math.MaxUint64, minFee)},
+			true,
+		},
+		{
+			"recipient balance",
+			map[address.Address]uint64{senderA: 10 * config.COIN, recipient: math.MaxUint64},
+			[]*transaction.Transaction{newTx(pkA, config.COIN, minFee)},
+			true,
+		},
+		{
+			"total fee",
+			map[address.Address]uint64{senderA: math.MaxUint64, senderB: math.MaxUint64},
+			[]*transaction.Transaction{newTx(pkA, 1, math.MaxUint64/2+1), newTx(pkB, 1, math.MaxUint64/2+1)},
+			true,
+		},
+		{
+			"block reward plus fee",
+			map[address.Address]uint64{senderA: math.MaxUint64},
+			[]*transaction.Transaction{newTx(pkA, 1, math.MaxUint64-1)},
+			true,
+		},
+		{
+			"governance reward",
+			map[address.Address]uint64{senderA: math.MaxUint64},
+			[]*transaction.Transaction{newTx(pkA, 1, math.MaxUint64/2)},
+			true,
+		},
+		{
+			"miner balance",
+			map[address.Address]uint64{senderA: 10 * config.COIN, miner: math.MaxUint64},
+			[]*transaction.Transaction{newTx(pkA, config.COIN, minFee)},
+			true,
+		},
+	}
+
+	for _, v := range tests {
+		bc := newTestBlockchain(t)
+		for addr, balance := range v.balances {
+			setTestState(t, bc, addr, &State{Balance: balance})
+		}
+
+		bl := &block.Block{
+			BlockHeader: block.BlockHeader{
+				Height:    1,
+				Recipient: miner,
+			},
+		}
+		err := bc.DB.Update(func(txn *bolt.Tx) error {
+			for _, tx := range v.txs {
+				hash := tx.Hash()
+				if err := bc.SetTx(txn, tx, hash, 0); err != nil {
+					return err
+				}
+				bl.Transactions = append(bl.Transactions, hash)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc.DB.Update(func(txn *bolt.Tx) error {
+			return bc.ApplyBlockToState(txn, bl, bl.Hash())
+		})
+		if v.overflow && !errors.Is(err, util.ErrOverflow) {
+			t.Errorf("%s: expected overflow error, got %v", v.name, err)
+		} else if !v.overflow && err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		}
+	}
+}
+
+// TestApplyRemoveBlockReward checks, for many total rewards, that the miner and the governance address receive
+// exactly the total reward of a block, and that removing the block restores every balance and the supply
+func TestApplyRemoveBlockReward(t *testing.T) {
+	bc := newTestBlockchain(t)
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	sender := address.FromPubKey(pk.Public())
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+	setTestState(t, bc, sender, &State{Balance: 1_000_000 * config.COIN})
+	addrs := []address.Address{sender, recipient, miner, address.GenesisAddress}
+
+	fees := []uint64{0, 1, 99, 100, 101}
+	for i := 0; i < 200; i++ {
+		fees = append(fees, rng.Uint64N(10*config.COIN))
+	}
+
+	for _, fee := range fees {
+		tx := &transaction.Transaction{
+			Sender:    pk.Public(),
+			Recipient: recipient,
+			Amount:    config.COIN,
+			Nonce:     1,
+			Fee:       fee,
+		}
+		if err := tx.Sign(pk); err != nil {
+			t.Fatal(err)
+		}
+		bl := &block.Block{
+			BlockHeader: block.BlockHeader{
+				Height:    1,
+				Recipient: miner,
+			},
+			Transactions: []transaction.TXID{tx.Hash()},
+		}
+		hash := bl.Hash()
+
+		err := bc.DB.Update(func(txn *bolt.Tx) error {
+			if err := bc.SetTx(txn, tx, tx.Hash(), 0); err != nil {
+				return err
+			}
+
+			before := make(map[address.Address]State)
+			for _, addr := range addrs {
+				state, _ := bc.GetState(txn, addr)
+				before[addr] = *state
+			}
+			supply := bc.GetStats(txn).Supply
+
+			if err := bc.ApplyBlockToState(txn, bl, hash); err != nil {
+				return err
+			}
+			minerState, _ := bc.GetState(txn, miner)
+			governanceState, _ := bc.GetState(txn, address.GenesisAddress)
+			paid := minerState.Balance - before[miner].Balance + governanceState.Balance -
+				before[address.GenesisAddress].Balance
+			if paid != bl.Reward()+fee {
+				t.Fatalf("fee %d: %d paid to the miner and governance, expected %d", fee, paid, bl.Reward()+fee)
+			}
+
+			if err := bc.RemoveBlockFromState(txn, bl, hash); err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				state, _ := bc.GetState(txn, addr)
+				if *state != before[addr] {
+					t.Fatalf("fee %d: state of %s after removal is {%v}, expected {%v}", fee, addr, state,
+						before[addr])
+				}
+			}
+			if s := bc.GetStats(txn).Supply; s != supply {
+				t.Fatalf("fee %d: supply after removal is %d, expected %d", fee, s, supply)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testLogger records the log messages of all levels
+type testLogger struct {
+	util.Mutex
+	messages []string
+}
+
+func (l *testLogger) add(msg string) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, msg)
+}
+func (l *testLogger) contains(prefix string) bool {
+	l.Lock()
+	defer l.Unlock()
+	return slices.ContainsFunc(l.messages, func(msg string) bool {
+		return strings.HasPrefix(msg, prefix)
+	})
+}
+
+func (l *testLogger) Info(a ...any)                   { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) Infof(format string, a ...any)   { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) Warn(a ...any)                   { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) Warnf(format string, a ...any)   { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) Err(a ...any)                    { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) Errf(format string, a ...any)    { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) Debug(a ...any)                  { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) Debugf(format string, a ...any)  { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) Dev(a ...any)                    { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) Devf(format string, a ...any)    { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) Net(a ...any)                    { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) Netf(format string, a ...any)    { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) NetDev(a ...any)                 { l.add(fmt.Sprint(a...)) }
+func (l *testLogger) NetDevf(format string, a ...any) { l.add(fmt.Sprintf(format, a...)) }
+func (l *testLogger) Fatal(a ...any)                  { panic(fmt.Sprint(a...)) }
+
+func TestLogger(t *testing.T) {
+	bc := newTestBlockchain(t)
+	other := newTestBlockchain(t)
+
+	log := &testLogger{}
+	bc.log = log
+	otherLog := &testLogger{}
+	other.log = otherLog
+
+	bl := newTestChain(t, nil, 1)[0]
+	addTestBlocks(t, bc, bl)
+
+	if !log.contains("Adding mainchain block 1 ") {
+		t.Fatalf("mainchain block message not logged, messages: %q", log.messages)
+	}
+	if otherLog.contains("Adding mainchain block") {
+		t.Fatal("message logged to the logger of another blockchain")
+	}
+}
+
+func TestSideBlocksWindow(t *testing.T) {
+	bc := newTestBlockchain(t)
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	addBlock := func(bl *block.Block) error {
+		return bc.DB.Update(func(tx *bolt.Tx) error {
+			_, err := bc.AddBlock(tx, bl)
+			return err
+		})
+	}
+
+	// competing blocks on top of the base chain, the first one is the mainchain and the others are side
+	// block candidates
+	base := newTestChain(t, nil, 5)
+	forks := make([]*block.Block, 0, 5)
+	for i := 0; i < cap(forks); i++ {
+		forks = append(forks, newTestChain(t, base, 1)[0])
+	}
+	for _, bl := range append(slices.Clone(base), forks[:3]...) {
+		if err := addBlock(bl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the next block references the maximum number of side blocks
+	bl := newTestBlock(t, bc, miner)
+	if len(bl.SideBlocks) != config.MAX_SIDE_BLOCKS {
+		t.Fatalf("block template has %d side blocks, expected %d", len(bl.SideBlocks), config.MAX_SIDE_BLOCKS)
+	}
+	if err := addBlock(bl); err != nil {
+		t.Fatal(err)
+	}
+
+	// the following block template only references the side blocks allowed in the window
+	for _, fork := range forks[3:] {
+		if err := addBlock(fork); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allowed := config.MAX_WINDOW_SIDE_BLOCKS - config.MAX_SIDE_BLOCKS
+	bl = newTestBlock(t, bc, miner)
+	if len(bl.SideBlocks) != allowed {
+		t.Fatalf("block template has %d side blocks, expected %d", len(bl.SideBlocks), allowed)
+	}
+
+	// a block referencing more side blocks than the window allows is rejected
+	stuffed := *bl
+	stuffed.SideBlocks = slices.Clone(bl.SideBlocks)
+	for _, fork := range forks[3:] {
+		if !slices.ContainsFunc(stuffed.SideBlocks, fork.Commitment().Equals) {
+			stuffed.SideBlocks = append(stuffed.SideBlocks, fork.Commitment())
+		}
+	}
+	if len(stuffed.SideBlocks) <= allowed {
+		t.Fatal("no side blocks were added to the block")
+	}
+	stuffed.CumulativeDiff = bl.CumulativeDiff.Add(bl.Difficulty.Mul64(2 *
+		uint64(len(stuffed.SideBlocks)-len(bl.SideBlocks))).Div64(3))
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		prevBl, err := bc.GetBlock(tx, stuffed.PrevHash())
+		if err != nil {
+			return err
+		}
+		return bc.checkBlock(tx, &stuffed, prevBl)
+	})
+	if !errors.Is(err, ErrTooManySideBlocks) {
+		t.Fatalf("expected ErrTooManySideBlocks, got %v", err)
+	}
+
+	// the template itself is valid
+	if err := addBlock(bl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSideBlockAncestorWindow(t *testing.T) {
+	bc := newTestBlockchain(t)
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	// checkBlock validates the side blocks before the cumulative diff, so it's not updated
+	checkSide := func(side block.Commitment) error {
+		bl := newTestBlock(t, bc, miner)
+		bl.SideBlocks = []block.Commitment{side}
+		return bc.DB.View(func(tx *bolt.Tx) error {
+			prevBl, err := bc.GetBlock(tx, bl.PrevHash())
+			if err != nil {
+				return err
+			}
+			return bc.checkBlock(tx, bl, prevBl)
+		})
+	}
+
+	// the zero hashes padding the ancestors of blocks near the genesis don't reference any block
+	if err := checkSide(block.Commitment{Timestamp: 1}); !errors.Is(err, ErrSideBlockWindow) {
+		t.Fatalf("side block referencing blocks before the genesis: expected ErrSideBlockWindow, got %v", err)
+	}
+
+	base := newTestChain(t, nil, 5)
+	addTestBlocks(t, bc, base...)
+
+	// a side block forked below the window only references ancestors older than the window
+	old := newTestChain(t, base[:5-config.MINIDAG_ANCESTORS], config.MINIDAG_ANCESTORS)
+	if err := checkSide(old[len(old)-1].Commitment()); !errors.Is(err, ErrSideBlockWindow) {
+		t.Fatalf("side block with out-of-window ancestors: expected ErrSideBlockWindow, got %v", err)
+	}
+
+	// a side block at the height of the block doesn't precede it
+	sibling := newTestChain(t, base, 1)[0]
+	if err := checkSide(sibling.Commitment()); !errors.Is(err, ErrSideBlockWindow) {
+		t.Fatalf("side block at the same height: expected ErrSideBlockWindow, got %v", err)
+	}
+
+	// a side block in the window is accepted, apart from the cumulative diff
+	uncle := newTestChain(t, base[:4], 1)[0]
+	if err := checkSide(uncle.Commitment()); errors.Is(err, ErrSideBlockWindow) {
+		t.Fatalf("side block in the window is rejected: %v", err)
+	}
+}
+
+func TestParallelDownloads(t *testing.T) {
+	bc := newTestBlockchain(t)
+	bc.SyncHeight = 10_000
+
+	queued := func() (n int) {
+		bc.BlockQueue.Update(func(qt *QueueTx) {
+			qt.bq.blocks = qt.bq.blocks[:0]
+			bc.fillQueue(qt, 0)
+			n = qt.Length()
+		})
+		return
+	}
+
+	if n := queued(); n != config.PARALLEL_BLOCKS_DOWNLOAD+1 {
+		t.Fatalf("queued %d blocks with default setting", n)
+	}
+
+	bc.SetParallelDownloads(200)
+	if n := queued(); n != 201 {
+		t.Fatalf("queued %d blocks, expected 201", n)
+	}
+
+	if n := bc.SetParallelDownloads(0); n != config.PARALLEL_BLOCKS_DOWNLOAD_MIN {
+		t.Fatalf("parallel downloads not clamped to minimum: %d", n)
+	}
+	if n := bc.SetParallelDownloads(1 << 30); n != config.PARALLEL_BLOCKS_DOWNLOAD_MAX {
+		t.Fatalf("parallel downloads not clamped to maximum: %d", n)
+	}
+}
+
+func TestSupply(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 5)
+	chainA := newTestChain(t, base, 3)
+	chainB := newTestChain(t, base, 4)
+
+	checkSupply := func() {
+		t.Helper()
+		bc.DB.View(func(tx *bolt.Tx) error {
+			err := bc.AuditSupply(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats := bc.GetStats(tx)
+			if expected := block.GetSupplyAtHeight(stats.TopHeight); stats.Supply != expected {
+				t.Fatalf("supply at height %d is %d, expected %d", stats.TopHeight, stats.Supply, expected)
+			}
+			return nil
+		})
+	}
+
+	checkSupply()
+	for _, v := range [][]*block.Block{base, chainA, chainB} {
+		for _, bl := range v {
+			addTestBlocks(t, bc, bl)
+			checkSupply()
+		}
+	}
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if bc.GetStats(tx).TopHash != chainB[len(chainB)-1].Hash() {
+			t.Fatal("chain B should be the mainchain after reorg")
+		}
+		return nil
+	})
+}
+
+func TestDataDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	err = os.Chdir(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	dataDir := filepath.Join(t.TempDir(), "data")
+	bc := New(dataDir)
+	bc.DB.Close()
+
+	dbName := config.NETWORK_NAME + ".db"
+	if _, err := os.Stat(filepath.Join(dataDir, dbName)); err != nil {
+		t.Fatal("database was not created in data dir:", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, dbName)); err == nil {
+		t.Fatal("database should not be created in working directory")
+	}
+}
+
+func TestWaitGenesis(t *testing.T) {
+	genesis := util.Time() + 300
+
+	WaitGenesis(Log, genesis)
+	if now := util.Time(); now < genesis {
+		t.Fatalf("WaitGenesis returned %d ms before the genesis timestamp", genesis-now)
+	}
+
+	// startup proceeds normally once the genesis timestamp has passed
+	bc := newTestBlockchain(t)
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if _, err := bc.GetTopo(tx, 0); err != nil {
+			t.Fatal("genesis block was not added:", err)
+		}
+		return nil
+	})
+
+	// a genesis timestamp in the past doesn't wait
+	start := time.Now()
+	WaitGenesis(Log, 0)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("WaitGenesis waited %s for a past genesis timestamp", elapsed)
+	}
+}
+
+func TestGetBlockHeader(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	addTestBlocks(t, bc, newTestChain(t, nil, 2)...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		hash := bc.GetStats(tx).TopHash
+		bl, err := bc.GetBlock(tx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := bc.GetBlockHeader(tx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Height != bl.Height || header.Timestamp != bl.Timestamp || header.Recipient != bl.Recipient ||
+			header.Ancestors != bl.Ancestors || header.Nonce != bl.Nonce {
+			t.Fatalf("header %+v does not match block %+v", header, bl.BlockHeader)
+		}
+		if string(header.Serialize()) != string(bl.BlockHeader.Serialize()) {
+			t.Fatal("serialized header does not match the block header")
+		}
+
+		if _, err := bc.GetBlockHeader(tx, [32]byte{1}); err == nil {
+			t.Fatal("expected error for unknown block")
+		}
+		return nil
+	})
+}
+
+func TestGetHeaderProof(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	addTestBlocks(t, bc, newTestChain(t, nil, 5)...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		genesis, err := bc.GetTopo(tx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proof, err := bc.GetHeaderProof(tx, 0, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.Anchor != 0 || proof.Parent != nil || len(proof.Blocks) != 4 {
+			t.Fatalf("proof starts at %d with %d blocks, expected 0 with 4", proof.Anchor, len(proof.Blocks))
+		}
+		if err := VerifyHeaderChain(proof, genesis); err != nil {
+			t.Fatal(err)
+		}
+
+		// the proof must survive the JSON encoding used by the RPC
+		data, err := json.Marshal(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &block.HeaderProof{}
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyHeaderChain(decoded, genesis); err != nil {
+			t.Fatal("decoded proof is not valid:", err)
+		}
+
+		if err := VerifyHeaderChain(proof, [32]byte{1}); err == nil {
+			t.Error("proof is valid with an untrusted anchor")
+		}
+
+		tampered := *proof
+		tampered.Blocks = slices.Clone(proof.Blocks)
+		tampered.Blocks[2].Timestamp++
+		if err := VerifyHeaderChain(&tampered, genesis); err == nil {
+			t.Error("proof with a tampered header is valid")
+		}
+
+		tampered.Blocks = slices.Clone(proof.Blocks)
+		tampered.Blocks[3].CumulativeDiff = tampered.Blocks[3].CumulativeDiff.Add64(1)
+		if err := VerifyHeaderChain(&tampered, genesis); err == nil {
+			t.Error("proof with a tampered cumulative difficulty is valid")
+		}
+
+		// a higher difficulty with a matching cumulative difficulty is still rejected
+		tampered.Blocks = slices.Clone(proof.Blocks)
+		last := &tampered.Blocks[3]
+		last.Difficulty = last.Difficulty.Add64(1)
+		last.CumulativeDiff = last.ExpectedCumulativeDiff(tampered.Blocks[2].CumulativeDiff)
+		if err := VerifyHeaderChain(&tampered, genesis); err == nil {
+			t.Error("proof with a tampered difficulty is valid")
+		}
+
+		// a client which trusts block 3 continues from it
+		proof, err = bc.GetHeaderProof(tx, 3, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted := decoded.Blocks[3].Hash()
+		if proof.Parent == nil || len(proof.Blocks) != 3 {
+			t.Fatalf("proof anchored at 3 has parent %v and %d blocks, expected 3", proof.Parent, len(proof.Blocks))
+		}
+		if err := VerifyHeaderChain(proof, trusted); err != nil {
+			t.Fatal(err)
+		}
+		tampered = *proof
+		tampered.Parent = &decoded.Blocks[1]
+		if err := VerifyHeaderChain(&tampered, trusted); err == nil {
+			t.Error("proof with a wrong parent is valid")
+		}
+
+		if _, err := bc.GetHeaderProof(tx, 0, 6); err == nil {
+			t.Error("expected error for height above top")
+		}
+		if _, err := bc.GetHeaderProof(tx, 4, 3); err == nil {
+			t.Error("expected error for anchor above height")
+		}
+		return nil
+	})
+}
+
+func TestIterateMainchain(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	blocks := newTestChain(t, nil, 4)
+	addTestBlocks(t, bc, blocks...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		var heights []uint64
+		err := bc.IterateMainchain(tx, 1, 4, func(height uint64, hash [32]byte, bl *block.Block) error {
+			if bl.Height != height || hash != blocks[height-1].Hash() {
+				t.Errorf("height %d: got block %d %x, expected %x", height, bl.Height, hash,
+					blocks[height-1].Hash())
+			}
+			heights = append(heights, height)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(heights, []uint64{1, 2, 3, 4}) {
+			t.Fatalf("iterated heights %v, expected [1 2 3 4]", heights)
+		}
+
+		// the callback error stops the iteration
+		errStop := errors.New("stop")
+		heights = nil
+		err = bc.IterateMainchain(tx, 0, 4, func(height uint64, _ [32]byte, _ *block.Block) error {
+			heights = append(heights, height)
+			if height == 2 {
+				return errStop
+			}
+			return nil
+		})
+		if !errors.Is(err, errStop) {
+			t.Fatalf("got error %v, expected %v", err, errStop)
+		}
+		if !slices.Equal(heights, []uint64{0, 1, 2}) {
+			t.Fatalf("iterated heights %v, expected [0 1 2]", heights)
+		}
+
+		if err := bc.IterateMainchain(tx, 3, 5, func(uint64, [32]byte, *block.Block) error {
+			return nil
+		}); err == nil {
+			t.Error("expected error for height above top")
+		}
+		return nil
+	})
+}
+
+func TestFindBlockByCumulativeDiff(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	addTestBlocks(t, bc, newTestChain(t, nil, 6)...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		top := bc.GetStats(tx)
+		var blocks []*block.Block
+		err := bc.IterateMainchain(tx, 0, top.TopHeight, func(_ uint64, _ [32]byte, bl *block.Block) error {
+			blocks = append(blocks, bl)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// targets equal to a block's cumulative diff, and between two blocks
+		for i, bl := range blocks {
+			targets := []Uint128{bl.CumulativeDiff}
+			if i > 0 {
+				targets = append(targets, blocks[i-1].CumulativeDiff.Add64(1))
+			}
+			for _, target := range targets {
+				found, height, err := bc.FindBlockByCumulativeDiff(tx, target)
+				if err != nil {
+					t.Fatalf("target %s: %v", target, err)
+				}
+				if height != bl.Height || found.Hash() != bl.Hash() {
+					t.Errorf("target %s: got block %d, expected %d", target, height, bl.Height)
+				}
+				if found.CumulativeDiff.Cmp(target) < 0 || (i > 0 && blocks[i-1].CumulativeDiff.Cmp(target) >= 0) {
+					t.Errorf("target %s: block %d is not the first to reach it", target, height)
+				}
+			}
+		}
+
+		if _, _, err := bc.FindBlockByCumulativeDiff(tx, Uint128{}); err != nil {
+			t.Errorf("zero target: %v", err)
+		}
+
+		_, _, err = bc.FindBlockByCumulativeDiff(tx, top.CumulativeDiff.Add64(1))
+		if !errors.Is(err, ErrCumulativeDiffNotReached) {
+			t.Errorf("target above the top block: got error %v, expected %v", err, ErrCumulativeDiffNotReached)
+		}
+		return nil
+	})
+}
+
+func TestReorgEvents(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	base := newTestChain(t, nil, 1)
+	chainA := newTestChain(t, base, 1)
+	chainB := newTestChain(t, base, 2)
+
+	type reorgEvent struct {
+		oldTop, newTop [32]byte
+		commonHeight   uint64
+	}
+	var reorgs []reorgEvent
+	var newBlocks [][32]byte
+	bc.OnReorg(func(oldTop, newTop [32]byte, commonHeight uint64) {
+		// callbacks run after the transaction is committed, so the database can be written
+		err := bc.DB.Update(func(tx *bolt.Tx) error {
+			if top := bc.GetStats(tx).TopHash; top != newTop {
+				t.Errorf("reorg callback called before commit: top %x, expected %x", top, newTop)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		reorgs = append(reorgs, reorgEvent{oldTop, newTop, commonHeight})
+	})
+	bc.OnNewBlock(func(bl *block.Block, hash [32]byte) {
+		if bl.Hash() != hash {
+			t.Errorf("new block hash %x does not match block %x", hash, bl.Hash())
+		}
+		newBlocks = append(newBlocks, hash)
+	})
+
+	addTestBlocks(t, bc, []*block.Block{base[0], chainA[0], chainB[0], chainB[1]}...)
+
+	if len(newBlocks) != 2 || newBlocks[0] != base[0].Hash() || newBlocks[1] != chainA[0].Hash() {
+		t.Fatalf("unexpected new block events %x", newBlocks)
+	}
+
+	expected := reorgEvent{
+		oldTop:       chainA[0].Hash(),
+		newTop:       chainB[1].Hash(),
+		commonHeight: base[0].Height,
+	}
+	if len(reorgs) != 1 || reorgs[0] != expected {
+		t.Fatalf("unexpected reorg events %+v, expected %+v", reorgs, expected)
+	}
+}
+
+func TestDurableOption(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		bc := NewWithOptions(t.TempDir(), Options{Log: Log, Durable: durable})
+		if bc.DB.NoSync == durable {
+			t.Errorf("durable %v: database has NoSync %v", durable, bc.DB.NoSync)
+		}
+		if bc.fastSync == durable {
+			t.Errorf("durable %v: blockchain has fast sync %v", durable, bc.fastSync)
+		}
+		bc.Close()
+
+		// the committed blocks are still there when the database is opened again
+		bc = NewWithOptions(bc.DataDir, Options{Log: Log, Durable: durable})
+		bc.DB.View(func(tx *bolt.Tx) error {
+			if _, err := bc.GetTopo(tx, 0); err != nil {
+				t.Errorf("durable %v: genesis block not found after reopening: %v", durable, err)
+			}
+			return nil
+		})
+		bc.Close()
+	}
+}
+
+func TestGetStateByPubKey(t *testing.T) {
+	bc := newTestBlockchain(t)
+
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender"))).Public()
+	addr := address.FromPubKey(pk)
+	setTestState(t, bc, addr, &State{Balance: 10 * config.COIN, LastNonce: 2, LastIncoming: 1})
+
+	txIn, txOut := blake3.Sum256([]byte("in")), blake3.Sum256([]byte("out"))
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		if err := bc.SetTxTopoInc(tx, txIn, addr, 1); err != nil {
+			return err
+		}
+		return bc.SetTxTopoOut(tx, txOut, addr, 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		expected, err := bc.GetState(tx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := bc.GetStateByPubKey(tx, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *state != *expected {
+			t.Fatalf("state by public key is %+v, expected %+v", state, expected)
+		}
+
+		if h, err := bc.GetTxTopoIncByPubKey(tx, pk, 1); err != nil || h != txIn {
+			t.Fatalf("incoming transaction by public key is %x (%v), expected %x", h, err, txIn)
+		}
+		if h, err := bc.GetTxTopoOutByPubKey(tx, pk, 2); err != nil || h != txOut {
+			t.Fatalf("outgoing transaction by public key is %x (%v), expected %x", h, err, txOut)
+		}
+
+		// unknown public keys have no state
+		other := address.GenerateKeypair(blake3.Sum256([]byte("other"))).Public()
+		if _, err := bc.GetStateByPubKey(tx, other); err == nil {
+			t.Fatal("unknown public key has a state")
+		}
+		return nil
+	})
+}
+
+func TestShutdownWaitsForBlock(t *testing.T) {
+	bc := newTestBlockchain(t)
+	blocks := newTestChain(t, nil, 2)
+
+	// a block is being added when shutdown begins
+	if err := bc.beginBlock(); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		bc.Close()
+		close(closed)
+	}()
+	for !bc.IsShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// no new block is started
+	if err := bc.beginBlock(); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	data, err := bc.SerializeFullBlock(blocks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.packetBlock(p2p.Packet{Type: packet.BLOCK, Data: data})
+
+	// the block in flight is completed
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		_, err := bc.AddBlock(tx, blocks[0])
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if top := bc.GetStats(tx).TopHeight; top != blocks[0].Height {
+			t.Errorf("top height is %d after shutdown began, expected %d", top, blocks[0].Height)
+		}
+		return nil
+	})
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the block in flight was added")
+	case <-time.After(50 * time.Millisecond):
+	}
+	bc.endBlock()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close doesn't return after the block in flight was added")
+	}
+}
@@ -3,11 +3,14 @@ package blockchain
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"still-blockchain/binary"
 	"still-blockchain/config"
 	"still-blockchain/util"
 	"still-blockchain/util/buck"
 	"time"
 
+	"github.com/zeebo/blake3"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -26,9 +29,13 @@ type QueuedBlock struct {
 	LastRequest int64 // when was the block last requested (UNIX seconds)
 }
 
+// BlockQueue holds the blocks to download, either by height during sync or by hash, like the parents of orphan
+// blocks. It never holds more than max blocks: when it's full, blocks by height are not queued until some space
+// is freed, and a block by hash replaces the oldest block queued by hash.
 type BlockQueue struct {
 	bc     *Blockchain
 	blocks []*QueuedBlock
+	max    int
 
 	util.RWMutex
 }
@@ -41,14 +48,38 @@ func NewBlockQueue(bc *Blockchain) *BlockQueue {
 	bq := &BlockQueue{
 		bc:     bc,
 		blocks: make([]*QueuedBlock, 0, config.PARALLEL_BLOCKS_DOWNLOAD+5),
+		max:    config.BLOCK_QUEUE_MAX,
 	}
 	err := bq.load()
 	if err != nil {
-		Log.Warn("blockqueue loading failed:", err)
+		// a missing or corrupt queue is not fatal: the queue is refilled from the current top height
+		bc.log.Warn("blockqueue loading failed, starting with an empty queue:", err)
+		bq.blocks = make([]*QueuedBlock, 0, config.PARALLEL_BLOCKS_DOWNLOAD+5)
 	}
+	bq.trim()
 	return bq
 }
 
+// SetMax sets the maximum number of queued blocks, clamped between BLOCK_QUEUE_MAX_MIN and BLOCK_QUEUE_MAX_MAX,
+// and returns the value set. If the queue is longer, its oldest blocks are removed.
+func (bq *BlockQueue) SetMax(n int) int {
+	n = max(config.BLOCK_QUEUE_MAX_MIN, min(config.BLOCK_QUEUE_MAX_MAX, n))
+
+	bq.Lock()
+	defer bq.Unlock()
+
+	bq.max = n
+	bq.trim()
+	return n
+}
+
+// BlockQueue MUST be locked before calling this
+func (bq *BlockQueue) trim() {
+	if len(bq.blocks) > bq.max {
+		bq.blocks = append(bq.blocks[:0], bq.blocks[len(bq.blocks)-bq.max:]...)
+	}
+}
+
 func (bq *BlockQueue) Update(fn func(qt *QueueTx)) {
 	qt := QueueTx{
 		bq: bq,
@@ -116,14 +147,17 @@ func (bq *BlockQueue) cleanup() {
 	}
 	bq.blocks = b2
 }
-func (qt *QueueTx) SetBlock(qb *QueuedBlock, replace bool) {
+
+// SetBlock queues the block, or if it's already queued, replaces it when replace is true. It returns false if
+// the block can't be queued because the queue is full.
+func (qt *QueueTx) SetBlock(qb *QueuedBlock, replace bool) bool {
 	if qb.Hash == [32]byte{} {
 		for i, v := range qt.bq.blocks {
 			if v.Height == qb.Height {
 				if replace {
 					qt.bq.blocks[i] = qb
 				}
-				return
+				return true
 			}
 		}
 	} else {
@@ -132,17 +166,48 @@ func (qt *QueueTx) SetBlock(qb *QueuedBlock, replace bool) {
 				if replace {
 					qt.bq.blocks[i] = qb
 				}
-				return
+				return true
 			}
 		}
 	}
+	if qt.Full() {
+		qt.bq.cleanup()
+	}
+	if !qt.Full() {
+		qt.bq.blocks = append(qt.bq.blocks, qb)
+		return true
+	}
+	if qb.Hash == [32]byte{} {
+		return false
+	}
+
+	// the blocks queued by hash are evicted in the order they were queued, so that the queue keeps the parents
+	// of the newest orphan blocks. The blocks queued by height are never evicted, since they're at most the
+	// parallel downloads.
+	oldest := -1
+	for i, v := range qt.bq.blocks {
+		if v.Hash != [32]byte{} && (oldest == -1 || v.Expires < qt.bq.blocks[oldest].Expires) {
+			oldest = i
+		}
+	}
+	if oldest == -1 {
+		return false
+	}
+	qt.bq.bc.log.Debugf("block queue is full, evicting block %x", qt.bq.blocks[oldest].Hash)
+	qt.bq.blocks = append(qt.bq.blocks[:oldest], qt.bq.blocks[oldest+1:]...)
 	qt.bq.blocks = append(qt.bq.blocks, qb)
+	return true
+}
+
+// Full returns true if the queue has reached its maximum length
+func (qt *QueueTx) Full() bool {
+	return len(qt.bq.blocks) >= qt.bq.max
 }
 
 func (bq *BlockQueue) Save() {
 	err := bq.save()
 	if err != nil {
-		Log.Fatal(err)
+		bq.bc.log.Fatal(err)
 	}
 }
 func (bq *BlockQueue) save() error {
@@ -154,9 +219,9 @@ func (bq *BlockQueue) save() error {
 			blocks = append(blocks, bl)
 		}
 	}
-	data, err := json.Marshal(blocks)
+	data, err := encodeQueue(blocks)
 	if err != nil {
-		Log.Fatal(err)
+		return err
 	}
 	return bq.bc.DB.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket([]byte{buck.INFO}).Put([]byte("blocksqueue"), data)
@@ -176,6 +241,55 @@ func (bq *BlockQueue) load() error {
 		if data == nil {
 			return errors.New("blocksqueue not saved")
 		}
-		return json.Unmarshal(data, &bq.blocks)
+		blocks, err := decodeQueue(data)
+		if err != nil {
+			return err
+		}
+		bq.blocks = blocks
+		return nil
 	})
 }
+
+// the saved block queue is prefixed by a version byte and by the blake3 checksum of the JSON data, so a
+// corrupt or partially written queue can be detected and discarded
+const queue_version = 1
+
+func encodeQueue(blocks []*QueuedBlock) ([]byte, error) {
+	data, err := json.Marshal(blocks)
+	if err != nil {
+		return nil, err
+	}
+	sum := blake3.Sum256(data)
+
+	s := binary.NewSer(make([]byte, 0, 1+32+len(data)))
+	s.AddUint8(queue_version)
+	s.AddFixedByteArray(sum[:])
+	s.AddFixedByteArray(data)
+
+	return s.Output(), nil
+}
+
+func decodeQueue(d []byte) ([]*QueuedBlock, error) {
+	des := binary.NewDes(d)
+
+	version := des.ReadUint8()
+	sum := [32]byte(des.ReadFixedByteArray(32))
+	if des.Error() != nil {
+		return nil, des.Error()
+	}
+	if version != queue_version {
+		return nil, fmt.Errorf("unsupported blocksqueue version %d", version)
+	}
+
+	data := des.RemainingData()
+	if blake3.Sum256(data) != sum {
+		return nil, errors.New("blocksqueue checksum mismatch")
+	}
+
+	blocks := make([]*QueuedBlock, 0, config.PARALLEL_BLOCKS_DOWNLOAD+5)
+	err := json.Unmarshal(data, &blocks)
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"path/filepath"
+	"still-blockchain/config"
+	"still-blockchain/util/buck"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestQueueEncoding(t *testing.T) {
+	blocks := []*QueuedBlock{
+		NewQueuedBlock(0, blake3.Sum256([]byte("a"))),
+		NewQueuedBlock(0, blake3.Sum256([]byte("b"))),
+	}
+
+	data, err := encodeQueue(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks2, err := decodeQueue(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks2) != len(blocks) {
+		t.Fatalf("decoded %d blocks, expected %d", len(blocks2), len(blocks))
+	}
+	for i := range blocks {
+		if *blocks[i] != *blocks2[i] {
+			t.Fatalf("block %d does not match: %v %v", i, blocks[i], blocks2[i])
+		}
+	}
+}
+
+func TestQueueCorrupt(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	data, err := encodeQueue([]*QueuedBlock{
+		NewQueuedBlock(0, blake3.Sum256([]byte("a"))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save a truncated queue
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte{buck.INFO})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("blocksqueue"), data[:len(data)-5])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bq := NewBlockQueue(&Blockchain{DB: db, log: Log})
+
+	bq.Update(func(qt *QueueTx) {
+		if qt.Length() != 0 {
+			t.Fatalf("corrupt queue should be discarded, got %d blocks", qt.Length())
+		}
+	})
+}
+
+func TestQueueMax(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte{buck.INFO})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bq := NewBlockQueue(&Blockchain{DB: db, log: Log})
+	const queueMax = config.BLOCK_QUEUE_MAX_MIN
+	if n := bq.SetMax(10); n != queueMax {
+		t.Fatalf("queue max set to %d, expected the minimum %d", n, queueMax)
+	}
+
+	// the most heights fillQueue can queue for sync
+	const heightsMax = config.PARALLEL_BLOCKS_DOWNLOAD_MAX + 1
+	bq.Update(func(qt *QueueTx) {
+		for i := uint64(1); i <= heightsMax; i++ {
+			if !qt.SetBlock(NewQueuedBlock(i, [32]byte{}), false) {
+				t.Fatalf("height %d is not queued", i)
+			}
+		}
+	})
+
+	// a flood of orphan blocks queues their parents: the queue never exceeds its maximum, and keeps the parents
+	// of the newest orphans
+	var last [32]byte
+	for i := 0; i < 2*queueMax; i++ {
+		last = blake3.Sum256([]byte{byte(i), byte(i >> 8)})
+		bq.Update(func(qt *QueueTx) {
+			if !qt.SetBlock(NewQueuedBlock(0, last), false) {
+				t.Fatalf("orphan parent %d is not queued", i)
+			}
+			if qt.Length() > queueMax {
+				t.Fatalf("queue has %d blocks, more than the maximum %d", qt.Length(), queueMax)
+			}
+		})
+	}
+	bq.Update(func(qt *QueueTx) {
+		var heights, hashes int
+		var hasLast bool
+		for _, v := range qt.GetBlocks() {
+			if v.Hash == [32]byte{} {
+				heights++
+			} else {
+				hashes++
+			}
+			hasLast = hasLast || v.Hash == last
+		}
+		if heights != heightsMax {
+			t.Errorf("%d heights queued, expected the %d queued before the orphans", heights, heightsMax)
+		}
+		if hashes < config.BLOCK_QUEUE_MIN_HASHES {
+			t.Errorf("%d orphan parents queued, expected at least %d", hashes, config.BLOCK_QUEUE_MIN_HASHES)
+		}
+		if !hasLast {
+			t.Error("the parent of the newest orphan is not queued")
+		}
+
+		// new heights are not queued until some space is freed
+		if qt.SetBlock(NewQueuedBlock(heightsMax+1, [32]byte{}), false) {
+			t.Error("height queued while the queue is full")
+		}
+		qt.RemoveBlockByHeight(1)
+		if !qt.SetBlock(NewQueuedBlock(heightsMax+1, [32]byte{}), false) {
+			t.Error("height not queued after some space is freed")
+		}
+		if qt.Length() != queueMax {
+			t.Errorf("queue has %d blocks, expected %d", qt.Length(), queueMax)
+		}
+	})
+}
@@ -11,18 +11,58 @@ import (
 // LTTC: maximum deviation in block timestamp before the algorithm starts adjusting the difficulty
 const maxDeviation = config.TARGET_BLOCK_TIME * 1000 * 2 * config.DIFFICULTY_N
 
-// returns the difficulty of the block after the provided block
+// DifficultyPoint is the timestamp (UNIX milliseconds) and the difficulty of a block
+type DifficultyPoint struct {
+	Timestamp  uint64
+	Difficulty uint128.Uint128
+}
+
+// GetNextDifficulty returns the difficulty of the block after the provided block.
+//
+// The difficulty is an exponential moving average (EMA) of the previous difficulty, weighted by how
+// far the solve time of the provided block is from config.TARGET_BLOCK_TIME, with a half-life of
+// config.DIFFICULTY_N blocks. See NextDifficulty for the details.
 func (bc *Blockchain) GetNextDifficulty(tx *bolt.Tx, bl *block.Block) (uint128.Uint128, error) {
 	if bl.Height < 2 {
 		return uint128.From64(config.MIN_DIFFICULTY), nil
 	}
 
-	prev, err := bc.GetBlock(tx, bl.PrevHash())
+	// only the timestamp of the previous block is needed
+	prev, err := bc.GetBlockHeader(tx, bl.PrevHash())
 	if err != nil {
 		return uint128.Zero, err
 	}
 
-	diff := bl.Difficulty
+	next := NextDifficulty(bl.Height, []DifficultyPoint{
+		{Timestamp: prev.Timestamp},
+		{Timestamp: bl.Timestamp, Difficulty: bl.Difficulty},
+	})
+	bc.log.Debug("diff:", bl.Difficulty, "->", next)
+	return next, nil
+}
+
+// NetworkHashrate returns the network hashrate (hashes per second) that finds blocks of the given difficulty
+// every config.TARGET_BLOCK_TIME seconds
+func NetworkHashrate(diff uint128.Uint128) uint128.Uint128 {
+	return diff.Div64(config.TARGET_BLOCK_TIME)
+}
+
+// NextDifficulty returns the difficulty of the block after the last of the recent blocks, sorted by
+// ascending height. height is the height of the last block. Only the timestamps of the last two blocks and
+// the difficulty of the last block are used:
+//   - the solve time is the timestamp difference of the two blocks, and it's at least 100 milliseconds
+//   - if LTTC is enabled (config.GENESIS_TIMESTAMP != 0) and the last block deviates from the expected
+//     schedule by more than maxDeviation, the solve time is scaled to pull the chain back on schedule
+//   - the next difficulty is prevDiff * N * target / (N*target - target + solveTime)
+//   - the result is never lower than config.MIN_DIFFICULTY
+//
+// On regtest the difficulty is always config.MIN_DIFFICULTY.
+func NextDifficulty(height uint64, recent []DifficultyPoint) uint128.Uint128 {
+	if config.IS_REGTEST || height < 2 || len(recent) < 2 {
+		return uint128.From64(config.MIN_DIFFICULTY)
+	}
+
+	prev, bl := recent[len(recent)-2], recent[len(recent)-1]
 
 	// this is safe to do, because blocks cannot have a decreasing timestamp (protocol rule)
 	var deltaTime uint64 = (bl.Timestamp - prev.Timestamp)
@@ -34,26 +74,23 @@ func (bc *Blockchain) GetNextDifficulty(tx *bolt.Tx, bl *block.Block) (uint128.U
 
 	// LTTC enabled if GENESIS_TIMESTAMP is set
 	if config.GENESIS_TIMESTAMP != 0 {
-		expectedBlockTime := bl.Height*config.TARGET_BLOCK_TIME*1000 + config.GENESIS_TIMESTAMP
+		expectedBlockTime := height*config.TARGET_BLOCK_TIME*1000 + config.GENESIS_TIMESTAMP
 		timeDeviation := int64(bl.Timestamp) - int64(expectedBlockTime)
 		if timeDeviation > maxDeviation { // block is too old
 			deltaTime = deltaTime * 3 / 2 // multiply deltaTime by 3/2, so the difficulty decreases
 		} else if timeDeviation < -maxDeviation { // block is too recent
 			deltaTime = deltaTime * 2 / 3 // multiply deltaTime by 2/3, so the difficulty increases
 		}
-		Log.Debug("LTTC deviation:", float64(timeDeviation)/1000)
 	}
 
 	// compute difficulty using EMA algorithm
 	newDiff := difficultyEMA(deltaTime, bl.Difficulty)
 
-	Log.Debug("diff:", diff, "->", newDiff)
-
 	if newDiff.Cmp64(config.MIN_DIFFICULTY) < 0 {
 		newDiff = uint128.From64(config.MIN_DIFFICULTY)
 	}
 
-	return newDiff, nil
+	return newDiff
 }
 
 func difficultyEMA(solveTime uint64, prevDiff uint128.Uint128) uint128.Uint128 {
@@ -0,0 +1,196 @@
+package blockchain
+
+import (
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/util/uint128"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+const targetMs = config.TARGET_BLOCK_TIME * 1000
+
+// simulateDifficulty returns the difficulty after n blocks, each found after solveTime milliseconds
+func simulateDifficulty(start uint128.Uint128, solveTime uint64, n int) []uint128.Uint128 {
+	recent := []DifficultyPoint{{
+		Timestamp:  config.GENESIS_TIMESTAMP + 10*targetMs,
+		Difficulty: start,
+	}}
+	diffs := make([]uint128.Uint128, 0, n)
+	for i := 0; i < n; i++ {
+		last := recent[len(recent)-1]
+		recent = append(recent, DifficultyPoint{
+			Timestamp:  last.Timestamp + solveTime,
+			Difficulty: last.Difficulty,
+		})
+		diff := NextDifficulty(uint64(10+i+1), recent)
+		recent[len(recent)-1].Difficulty = diff
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+func TestNextDifficultyStable(t *testing.T) {
+	if config.IS_REGTEST {
+		t.Skip("the difficulty is constant on regtest")
+	}
+
+	start := uint128.From64(1_000_000)
+	for i, diff := range simulateDifficulty(start, targetMs, 1000) {
+		if !diff.Equals(start) {
+			t.Fatalf("block %d: difficulty changed with constant block time: %s -> %s", i, start, diff)
+		}
+	}
+}
+
+func TestNextDifficultyTargetTime(t *testing.T) {
+	if config.IS_REGTEST {
+		t.Skip("the difficulty is constant on regtest")
+	}
+
+	// a constant hashrate finds blocks of difficulty D after D/hashrate milliseconds. Starting from a
+	// difficulty that's too low, the difficulty must converge to the one that makes blocks take the target
+	// block time.
+	const hashrate = 50 // hashes per millisecond
+	recent := []DifficultyPoint{{
+		Timestamp:  config.GENESIS_TIMESTAMP + 10*targetMs,
+		Difficulty: uint128.From64(config.MIN_DIFFICULTY),
+	}}
+	for i := 0; i < 20*config.DIFFICULTY_N; i++ {
+		last := recent[len(recent)-1]
+		solveTime := last.Difficulty.Div64(hashrate).Lo
+		next := DifficultyPoint{Timestamp: last.Timestamp + solveTime, Difficulty: last.Difficulty}
+		next.Difficulty = NextDifficulty(uint64(10+i+1), []DifficultyPoint{last, next})
+		recent = append(recent[:0], next)
+	}
+
+	solveTime := recent[0].Difficulty.Div64(hashrate).Lo
+	if solveTime < targetMs*99/100 || solveTime > targetMs*101/100 {
+		t.Fatalf("blocks take %d ms with the converged difficulty %s, expected %d ms", solveTime,
+			recent[0].Difficulty, targetMs)
+	}
+	rate := NetworkHashrate(recent[0].Difficulty).Lo
+	if rate < hashrate*1000*99/100 || rate > hashrate*1000*101/100 {
+		t.Fatalf("network hashrate is %d, expected %d", rate, hashrate*1000)
+	}
+}
+
+func TestNextDifficultyFaster(t *testing.T) {
+	if config.IS_REGTEST {
+		t.Skip("the difficulty is constant on regtest")
+	}
+
+	start := uint128.From64(1_000_000)
+	prev := start
+	for i, diff := range simulateDifficulty(start, targetMs/2, 100) {
+		if diff.Cmp(prev) <= 0 {
+			t.Fatalf("block %d: difficulty did not increase with faster blocks: %s -> %s", i, prev, diff)
+		}
+		prev = diff
+	}
+}
+
+func TestNextDifficultySlower(t *testing.T) {
+	if config.IS_REGTEST {
+		t.Skip("the difficulty is constant on regtest")
+	}
+
+	start := uint128.From64(1_000_000)
+	prev := start
+	for i, diff := range simulateDifficulty(start, targetMs*2, 100) {
+		if diff.Cmp(prev) >= 0 {
+			t.Fatalf("block %d: difficulty did not decrease with slower blocks: %s -> %s", i, prev, diff)
+		}
+		prev = diff
+	}
+}
+
+func TestNextDifficultyMinimum(t *testing.T) {
+	// very slow blocks must never bring the difficulty below the minimum
+	diffs := simulateDifficulty(uint128.From64(config.MIN_DIFFICULTY*2), targetMs*1000, 100)
+	for i, diff := range diffs {
+		if diff.Cmp64(config.MIN_DIFFICULTY) < 0 {
+			t.Fatalf("block %d: difficulty %s is below the minimum", i, diff)
+		}
+	}
+	if last := diffs[len(diffs)-1]; !last.Equals64(config.MIN_DIFFICULTY) {
+		t.Fatalf("difficulty %s did not reach the minimum", last)
+	}
+
+	// the first blocks, and too short histories, have the minimum difficulty
+	recent := []DifficultyPoint{{Timestamp: 0, Difficulty: uint128.From64(1_000_000)}}
+	if diff := NextDifficulty(10, recent); !diff.Equals64(config.MIN_DIFFICULTY) {
+		t.Fatalf("difficulty with a single block is %s, expected the minimum", diff)
+	}
+	recent = append(recent, DifficultyPoint{Timestamp: targetMs, Difficulty: uint128.From64(1_000_000)})
+	if diff := NextDifficulty(1, recent); !diff.Equals64(config.MIN_DIFFICULTY) {
+		t.Fatalf("difficulty at height 1 is %s, expected the minimum", diff)
+	}
+}
+
+func TestNextDifficultySolveTimeClamp(t *testing.T) {
+	// blocks with the same timestamp are treated as if they took 100 milliseconds
+	start := uint128.From64(1_000_000)
+	same := NextDifficulty(10, []DifficultyPoint{
+		{Timestamp: 5000, Difficulty: start},
+		{Timestamp: 5000, Difficulty: start},
+	})
+	clamped := NextDifficulty(10, []DifficultyPoint{
+		{Timestamp: 5000, Difficulty: start},
+		{Timestamp: 5100, Difficulty: start},
+	})
+	if !same.Equals(clamped) {
+		t.Fatalf("difficulty with zero solve time is %s, expected %s", same, clamped)
+	}
+}
+
+func TestGetNextDifficulty(t *testing.T) {
+	bc := newTestBlockchain(t)
+	miner := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("miner"))).Public())
+
+	addTestBlocks(t, bc, newTestChain(t, nil, 3)...)
+
+	bc.DB.View(func(tx *bolt.Tx) error {
+		stats := bc.GetStats(tx)
+		top, err := bc.GetBlock(tx, stats.TopHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev, err := bc.GetBlock(tx, top.PrevHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := bc.GetNextDifficulty(tx, top)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := NextDifficulty(top.Height, []DifficultyPoint{
+			{Timestamp: prev.Timestamp, Difficulty: prev.Difficulty},
+			{Timestamp: top.Timestamp, Difficulty: top.Difficulty},
+		})
+		if !diff.Equals(expected) {
+			t.Fatalf("GetNextDifficulty returned %s, expected %s", diff, expected)
+		}
+		return nil
+	})
+
+	// the block template uses the same difficulty
+	bl := newTestBlock(t, bc, miner)
+	bc.DB.View(func(tx *bolt.Tx) error {
+		top, err := bc.GetBlock(tx, bc.GetStats(tx).TopHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, err := bc.GetNextDifficulty(tx, top)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bl.Difficulty.Equals(diff) {
+			t.Fatalf("block template difficulty is %s, expected %s", bl.Difficulty, diff)
+		}
+		return nil
+	})
+}
@@ -25,9 +25,7 @@ type mergestratum struct {
 }
 
 func (m *mergestratum) Start() error {
-	cl := m.Client
-	Log.Debug("starting merge stratum", m.Destination)
-	return cl.Start()
+	return m.Client.Start()
 }
 
 // AddStratum blocks until the stratum errors out if permanent, otherwise it blocks forever.
@@ -41,7 +39,7 @@ func (bc *Blockchain) AddStratum(ip, stratum_wallet string, permanent bool) {
 	}
 	cl, err := stratumclient.New(ip, stratum_wallet)
 	if err != nil {
-		Log.Err(err)
+		bc.log.Err(err)
 		return
 	}
 	m := &mergestratum{
@@ -74,9 +72,10 @@ func (bc *Blockchain) AddStratum(ip, stratum_wallet string, permanent bool) {
 		}
 	}()
 
+	bc.log.Debug("starting merge stratum", m.Destination)
 	err = m.Start()
 	if err != nil {
-		Log.Warn(err)
+		bc.log.Warn(err)
 	}
 
 	for {
@@ -87,27 +86,27 @@ func (bc *Blockchain) AddStratum(ip, stratum_wallet string, permanent bool) {
 
 		job, ok := <-m.Client.JobChan
 		if !ok {
-			Log.Debug("job chan closed")
+			bc.log.Debug("job chan closed")
 			return
 		}
 
-		Log.Dev("recv job:", job)
+		bc.log.Dev("recv job:", job)
 
 		mb := block.MiningBlob{}
 		err := mb.Deserialize(job.Blob)
 		if err != nil {
-			Log.Debug("failed to deserialize mining blob:", err)
+			bc.log.Debug("failed to deserialize mining blob:", err)
 			m.Client.Close()
 			return
 		}
 		if len(mb.Chains) != 1 {
-			Log.Warn("mining blob has", len(mb.Chains), "hashing ids, should be 1")
-			Log.Warnf("%x", mb.Chains)
+			bc.log.Warn("mining blob has", len(mb.Chains), "hashing ids, should be 1")
+			bc.log.Warnf("%x", mb.Chains)
 			m.Client.Close()
 			return
 		}
 		if len(job.Target) != 16 && len(job.Target) != 8 && len(job.Target) != 4 {
-			Log.Warn("invalid job target size", len(job.Target))
+			bc.log.Warn("invalid job target size", len(job.Target))
 			m.Client.Close()
 			return
 		}
@@ -115,7 +114,7 @@ func (bc *Blockchain) AddStratum(ip, stratum_wallet string, permanent bool) {
 		m.Difficulty = util.ByteTargetToDiff(job.Target).Lo
 		m.JobID = job.JobID
 
-		Log.Infof("Received merge-mined job network: %x difficulty: %d job id: %s", m.HashingID.NetworkID,
+		bc.log.Infof("Received merge-mined job network: %x difficulty: %d job id: %s", m.HashingID.NetworkID,
 			m.Difficulty, m.JobID)
 
 		bc.MergesMut.Lock()
@@ -144,7 +143,7 @@ func (bc *Blockchain) submitMergeMinedBlock(bl *block.Block, pow [16]byte) ([]st
 				numFounds++
 
 				go func() {
-					Log.Infof("submit merge mined block to chain %x", v.HashingID.NetworkID)
+					bc.log.Infof("submit merge mined block to chain %x", v.HashingID.NetworkID)
 					nonceHex := make([]byte, 4)
 					binary.LittleEndian.PutUint32(nonceHex, bl.Nonce)
 					res, err := v.Client.SendWork(stratum.SubmitRequest{
@@ -155,7 +154,7 @@ func (bc *Blockchain) submitMergeMinedBlock(bl *block.Block, pow [16]byte) ([]st
 					})
 
 					if err != nil {
-						Log.Err("submit merge mined block to chain", v.HashingID.NetworkID, "failed:", err)
+						bc.log.Err("submit merge mined block to chain", v.HashingID.NetworkID, "failed:", err)
 						foundsChan <- stratum.FoundBlockInfo{
 							Ok: false,
 						}
@@ -166,7 +165,7 @@ func (bc *Blockchain) submitMergeMinedBlock(bl *block.Block, pow [16]byte) ([]st
 
 					err = json.Unmarshal(res.Result, &result)
 					if err != nil || len(result.Blocks) != 1 {
-						Log.Err("submit merge mined block to chain", v.HashingID.NetworkID, "failed:", err)
+						bc.log.Err("submit merge mined block to chain", v.HashingID.NetworkID, "failed:", err)
 						foundsChan <- stratum.FoundBlockInfo{
 							Ok: false,
 						}
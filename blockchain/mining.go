@@ -2,24 +2,44 @@ package blockchain
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
+	"slices"
 	"still-blockchain/address"
 	"still-blockchain/block"
 	"still-blockchain/config"
 	"still-blockchain/stratum"
 	"still-blockchain/transaction"
 	"still-blockchain/util"
+	"still-blockchain/util/buck"
 	"still-blockchain/util/uint128"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+var ErrRecipientNotAllowed = errors.New("coinbase recipient is not allowed")
+
+// checkRecipient returns ErrRecipientNotAllowed if the address is not in the AllowedRecipients list.
+// An empty list allows any recipient.
+func (bc *Blockchain) checkRecipient(addr address.Address) error {
+	if len(bc.AllowedRecipients) == 0 || slices.Contains(bc.AllowedRecipients, addr) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrRecipientNotAllowed, addr)
+}
+
 func (bc *Blockchain) StartMining(addr address.Address) {
+	err := bc.checkRecipient(addr)
+	if err != nil {
+		bc.log.Err("cannot start mining:", err)
+		return
+	}
+
 	bc.MergesMut.Lock()
 	if bc.Mining {
-		Log.Err("cannot start mining, already mining")
+		bc.log.Err("cannot start mining, already mining")
 		bc.MergesMut.Unlock()
 		return
 	}
@@ -38,6 +58,14 @@ func (bc *Blockchain) StartMining(addr address.Address) {
 }
 
 func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*block.Block, uint64, error) {
+	// stratum templates use an invalid address, the recipient is set for each miner after login
+	if addr != address.INVALID_ADDRESS {
+		err := bc.checkRecipient(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
 	stats := bc.GetStats(tx)
 	prevBl, err := bc.GetBlock(tx, stats.TopHash)
 	if err != nil {
@@ -69,12 +97,19 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 
 	bl.CumulativeDiff = bl.CumulativeDiff.Add(bl.Difficulty)
 
+	windowSides, err := bc.windowSideBlocks(tx, prevBl)
+	if err != nil {
+		return nil, 0, err
+	}
+	maxSides := max(min(config.MAX_SIDE_BLOCKS, config.MAX_WINDOW_SIDE_BLOCKS-windowSides), 0)
+
 	for _, v := range stats.Tips {
-		if len(bl.SideBlocks) == config.MAX_SIDE_BLOCKS {
-			Log.Debug("max side blocks reached, breaking")
+		if len(bl.SideBlocks) >= maxSides {
+			bc.log.Debug("max side blocks reached, breaking")
 			break
 		}
-		if v.Height >= bl.Height || v.Height < bl.Height-config.MINIDAG_ANCESTORS-1 {
+		// checkBlock only accepts side blocks in the MINIDAG_ANCESTORS-1 heights preceding the block
+		if v.Height >= bl.Height || v.Height+config.MINIDAG_ANCESTORS-1 < bl.Height {
 			continue
 		}
 		// check if the tip can actually be used as side block, and it if does, use it!
@@ -86,11 +121,11 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 			// As a special rule, to prevent possible slowdowns during seed hash changes, the blocks must
 			// have the same seed hash
 			if block.GetSeedhashId(tip.Timestamp) != block.GetSeedhashId(bl.Timestamp) {
-				Log.Debug("tip is not applicable because the seedhash is different")
+				bc.log.Debug("tip is not applicable because the seedhash is different")
 				return nil
 			}
 			if tip.Difficulty.Cmp(bl.Difficulty.Mul64(2).Div64(3)) < 0 {
-				Log.Debug("tip is not applicable because its difficulty is too small")
+				bc.log.Debug("tip is not applicable because its difficulty is too small")
 				return nil
 			}
 
@@ -103,12 +138,12 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 
 			// check that the tip hasn't been already included
 			if side.Equals(prevBl.Commitment()) {
-				Log.Debug("side block was already included (1)")
+				bc.log.Debug("side block was already included (1)")
 				return nil
 			}
 			for _, v := range prevBl.SideBlocks { // first check in the prevBl, since we already obtained it
 				if side.Equals(v) {
-					Log.Debug("side block was already included (2)")
+					bc.log.Debug("side block was already included (2)")
 					return nil
 				}
 			}
@@ -116,16 +151,16 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 				for _, anc := range bl.Ancestors[1:] { // then check in previous ancestors
 					ancBl, err := bc.GetBlock(tx, anc)
 					if err != nil {
-						Log.Err(err)
+						bc.log.Err(err)
 						return err
 					}
 					if side.Equals(ancBl.Commitment()) {
-						Log.Debug("side block was already included (3)")
+						bc.log.Debug("side block was already included (3)")
 						return nil
 					}
 					for _, v := range ancBl.SideBlocks {
 						if side.Equals(v) {
-							Log.Debug("side block was already included (4)")
+							bc.log.Debug("side block was already included (4)")
 							return nil
 						}
 					}
@@ -134,13 +169,13 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 					}
 				}
 			}
-			Log.Debug("found valid side block")
+			bc.log.Debug("found valid side block")
 			bl.SideBlocks = append(bl.SideBlocks, side)
 
 			return nil
 		})
 		if err != nil {
-			Log.Warn(err)
+			bc.log.Warn(err)
 			continue
 		}
 	}
@@ -148,30 +183,60 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 	sideDiff := bl.Difficulty.Mul64(2 * uint64(len(bl.SideBlocks))).Div64(3)
 	bl.CumulativeDiff = bl.CumulativeDiff.Add(sideDiff)
 
-	// TODO: sort mempool transactions by Fee Per Kilobyte, to prioritize the transactions with higher fee
-	// possibly also take in account transaction age in the sorting algorithm
+	// TODO: possibly also take in account transaction age when selecting the transactions
 	mem := bc.GetMempool(tx)
+
+	// states holds the state of the addresses after applying the transactions added to the block so far
+	states := make(map[address.Address]*State)
+	getState := func(addr address.Address) *State {
+		if s, ok := states[addr]; ok {
+			return s
+		}
+		s, err := bc.GetState(tx, addr)
+		if err != nil {
+			// address is not in state, so it doesn't have any balance
+			s = &State{}
+		}
+		states[addr] = s
+		return s
+	}
+
+	btx := tx.Bucket([]byte{buck.TX})
 	var totsize uint64 = 0
-	for _, v := range mem.Entries {
-		totsize += v.Size
+	txs := make(map[transaction.TXID]*transaction.Transaction)
+	for _, v := range mem.SelectForBlock(func(addr address.Address) uint64 {
+		return getState(addr).LastNonce
+	}) {
 		if totsize+v.Size > config.MAX_BLOCK_SIZE {
-			Log.Dev("reached block max size, stop adding transactions to block")
+			bc.log.Dev("reached block max size, stop adding transactions to block")
 			break
 		}
 
 		// check that no invalid transactions are added here, as blocks received may invalidate transactions
-		memtx, _, err := bc.GetTx(v.TXID)
+		memtx, _, err := bc.buckGetTx(btx, v.TXID)
 		if err != nil {
-			Log.Err(err)
+			bc.log.Err(err)
 			continue
 		}
-		err = bc.validateMempoolTx(tx, memtx, v.TXID)
-		if err != nil {
-			Log.Warn("GetBlockTemplate: mempool tx is not valid:", err)
+		sender := getState(v.Sender)
+		if memtx.Nonce != sender.LastNonce+1 || sender.Balance < memtx.Amount+memtx.Fee ||
+			memtx.Amount < config.DUST_THRESHOLD {
+			bc.log.Warnf("GetBlockTemplate: mempool tx %x is not valid: nonce %d, amount %d, fee %d, sender state %v",
+				v.TXID, memtx.Nonce, memtx.Amount, memtx.Fee, sender)
 			continue
 		}
+		// recipients are not credited: transactions are sorted by sender below, so the funds received in this
+		// block may only be available after they are spent
+		sender.Balance -= memtx.Amount + memtx.Fee
+		sender.LastNonce++
+
+		totsize += v.Size
+		txs[v.TXID] = memtx
 		bl.Transactions = append(bl.Transactions, v.TXID)
 	}
+	slices.SortFunc(bl.Transactions, func(a, b transaction.TXID) int {
+		return compareTxOrder(txs[a], txs[b])
+	})
 
 	var min_diff uint64 = bl.Difficulty.Lo
 
@@ -186,7 +251,7 @@ func (bc *Blockchain) GetBlockTemplate(tx *bolt.Tx, addr address.Address) (*bloc
 			}
 			bl.OtherChains = append(bl.OtherChains, v.HashingID)
 			if v.Difficulty < min_diff {
-				Log.Debug("min_diff reduces from", min_diff, "to", v.Difficulty)
+				bc.log.Debug("min_diff reduces from", min_diff, "to", v.Difficulty)
 				min_diff = v.Difficulty
 			}
 			v.RUnlock()
@@ -207,7 +272,7 @@ func (bc *Blockchain) MineBlock(addr address.Address) {
 		return
 	})
 	if err != nil {
-		Log.Fatal("failed to get block template:", err)
+		bc.log.Fatal("failed to get block template:", err)
 	}
 
 	bc.findBlockSolution(bl, uint128.From64(min_diff))
@@ -242,7 +307,7 @@ func (bc *Blockchain) findBlockSolution(bl *block.Block, min_diff Uint128) {
 		if block.ValidPowValue(powHash, min_diff) {
 			_, err := bc.blockFound(bl, powHash.Bytes())
 			if err != nil {
-				Log.Err(err)
+				bc.log.Err(err)
 			}
 			return
 		}
@@ -251,7 +316,7 @@ func (bc *Blockchain) findBlockSolution(bl *block.Block, min_diff Uint128) {
 		h++
 		now := time.Now()
 		if now.Sub(t).Seconds() > 2 {
-			Log.Info("hashrate:", math.Round(float64(h)/time.Since(t).Seconds()))
+			bc.log.Info("hashrate:", math.Round(float64(h)/time.Since(t).Seconds()))
 			h = 0
 			t = now
 		}
@@ -261,6 +326,11 @@ func (bc *Blockchain) findBlockSolution(bl *block.Block, min_diff Uint128) {
 func (bc *Blockchain) blockFound(bl *block.Block, powHash [16]byte) ([]stratum.FoundBlockInfo, error) {
 	foundInfo := []stratum.FoundBlockInfo{}
 
+	err := bc.checkRecipient(bl.Recipient)
+	if err != nil {
+		return nil, err
+	}
+
 	hash := bl.Hash()
 
 	success := false
@@ -268,7 +338,7 @@ func (bc *Blockchain) blockFound(bl *block.Block, powHash [16]byte) ([]stratum.F
 		var morefound []stratum.FoundBlockInfo
 		morefound, success = bc.submitMergeMinedBlock(bl, powHash)
 		if success {
-			Log.Infof("found merge block %x with diff %s PoW %x", hash, bl.Difficulty.String(), powHash)
+			bc.log.Infof("found merge block %x with diff %s PoW %x", hash, bl.Difficulty.String(), powHash)
 		}
 		foundInfo = append(foundInfo, morefound...)
 	}
@@ -280,12 +350,17 @@ func (bc *Blockchain) blockFound(bl *block.Block, powHash [16]byte) ([]stratum.F
 			Difficulty: bl.Difficulty,
 			Ok:         true,
 		})
-		Log.Infof("Found block %x with diff %s sideblocks %v", hash, bl.Difficulty.String(), bl.SideBlocks)
+		bc.log.Infof("Found block %x with diff %s sideblocks %v", hash, bl.Difficulty.String(), bl.SideBlocks)
 		err := bl.Prevalidate()
 		if err != nil {
-			Log.Warn(err)
+			bc.log.Warn(err)
+			return nil, err
+		}
+		err = bc.beginBlock()
+		if err != nil {
 			return nil, err
 		}
+		defer bc.endBlock()
 		go bc.BroadcastBlock(bl)
 		err = bc.DB.Update(func(tx *bolt.Tx) error {
 			_, err := bc.AddBlock(tx, bl)
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"errors"
+	"still-blockchain/address"
+	"testing"
+
+	"github.com/zeebo/blake3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAllowedRecipients(t *testing.T) {
+	skipTestPoW(t)
+	bc := newTestBlockchain(t)
+
+	allowed := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("allowed"))).Public())
+	other := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("other"))).Public())
+
+	bl := newTestBlock(t, bc, other)
+
+	bc.AllowedRecipients = []address.Address{allowed}
+
+	_, err := bc.blockFound(bl, [16]byte{})
+	if !errors.Is(err, ErrRecipientNotAllowed) {
+		t.Fatalf("got error %v, expected %v", err, ErrRecipientNotAllowed)
+	}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if h := bc.GetStats(tx).TopHeight; h != 0 {
+			t.Fatalf("disallowed block was added, height %d", h)
+		}
+		return nil
+	})
+
+	// templates for a disallowed address can't be created
+	err = bc.DB.View(func(tx *bolt.Tx) error {
+		_, _, err := bc.GetBlockTemplate(tx, other)
+		return err
+	})
+	if !errors.Is(err, ErrRecipientNotAllowed) {
+		t.Fatalf("got error %v, expected %v", err, ErrRecipientNotAllowed)
+	}
+
+	bl = newTestBlock(t, bc, allowed)
+	_, err = bc.blockFound(bl, [16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.DB.View(func(tx *bolt.Tx) error {
+		if h := bc.GetStats(tx).TopHeight; h != 1 {
+			t.Fatalf("allowed block was not added, height %d", h)
+		}
+		return nil
+	})
+}
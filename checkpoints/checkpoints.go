@@ -50,3 +50,8 @@ func IsSecured(height uint64) bool {
 	}
 	return height/CheckpointInterval <= MaxCheckpoint
 }
+
+// returns the height of the deepest checkpoint, or 0 (the genesis block) if there are no checkpoints
+func Last() uint64 {
+	return MaxCheckpoint * CheckpointInterval
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 	"still-blockchain/address"
 	"still-blockchain/block"
@@ -88,9 +89,10 @@ func prompts(bc *blockchain.Blockchain) {
 
 			Log.Infof("Height: %d; Cumulative diff: %.3fk; next diff: %s; hashrate: %s", stats.TopHeight,
 				stats.CumulativeDiff.Float64()/1000,
-				diff, diff.Div64(config.TARGET_BLOCK_TIME))
+				diff, blockchain.NetworkHashrate(diff))
 
 			Log.Infof("%d tips (use print_tips for the list of tips)", len(stats.Tips))
+			Log.Infof("Synced: %v", bc.IsSynced())
 
 			Log.Infof("Mempool: %d entries", len(mem.Entries))
 
@@ -129,11 +131,20 @@ func prompts(bc *blockchain.Blockchain) {
 		Names: []string{"connections", "conns", "print_cn", "peers"},
 		Args:  "",
 		Action: func(args []string) {
-			bc.P2P.Lock()
-			defer bc.P2P.Unlock()
+			inbound, outbound := bc.P2P.ConnectionCounts()
+			Log.Infof("Incoming: %d/%d; outgoing: %d/%d", inbound, bc.P2P.MaxInbound, outbound,
+				bc.P2P.MaxOutbound)
 
-			Log.Infof("%s %s %s", util.PadC("Peer ID", 19), util.PadC("IP", 11), "direction")
+			// connections must not be locked while P2P is locked
+			bc.P2P.RLock()
+			conns := make([]*p2p.Connection, 0, len(bc.P2P.Connections))
 			for _, conn := range bc.P2P.Connections {
+				conns = append(conns, conn)
+			}
+			bc.P2P.RUnlock()
+
+			Log.Infof("%s %s %s", util.PadC("Peer ID", 19), util.PadC("IP", 11), "direction")
+			for _, conn := range conns {
 				conn.View(func(c *p2p.ConnData) error {
 					direction := "inc"
 					if c.Outgoing {
@@ -145,6 +156,84 @@ func prompts(bc *blockchain.Blockchain) {
 				})
 			}
 		},
+	}, {
+		Names: []string{"set_parallel_downloads"},
+		Args:  "<count>",
+		Action: func(args []string) {
+			if len(args) != 1 {
+				Log.Errf("Usage: set_parallel_downloads <count>; current value: %d", bc.GetParallelDownloads())
+				return
+			}
+
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				Log.Err("Invalid count:", args[0])
+				return
+			}
+			Log.Infof("Parallel block downloads set to %d", bc.SetParallelDownloads(n))
+		},
+	}, {
+		Names: []string{"set_block_fanout"},
+		Args:  "<count>",
+		Action: func(args []string) {
+			if len(args) != 1 {
+				Log.Errf("Usage: set_block_fanout <count>; current value: %d", bc.GetBlockFanout())
+				return
+			}
+
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				Log.Err("Invalid count:", args[0])
+				return
+			}
+			Log.Infof("Block relay fanout set to %d", bc.SetBlockFanout(n))
+		},
+	}, {
+		Names: []string{"rewind"},
+		Args:  "<height>",
+		Action: func(args []string) {
+			if len(args) != 1 {
+				Log.Err("Usage: rewind <height>")
+				return
+			}
+
+			height, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				Log.Err("Invalid height:", args[0])
+				return
+			}
+			err = bc.RewindTo(height)
+			if err != nil {
+				Log.Err(err)
+			}
+		},
+	}, {
+		Names: []string{"compact_db"},
+		Args:  "[<destination>]",
+		Action: func(args []string) {
+			dest := filepath.Join(bc.DataDir, config.NETWORK_NAME+".compact.db")
+			if len(args) > 0 {
+				dest = args[0]
+			}
+
+			err := bc.Compact(dest)
+			if err != nil {
+				Log.Err(err)
+				return
+			}
+			Log.Infof("Stop the node and replace %s with %s to use the compacted database", bc.DB.Path(), dest)
+		},
+	}, {
+		Names: []string{"rebuild_tx_indexes"},
+		Args:  "",
+		Action: func(args []string) {
+			err := bc.DB.Update(func(tx *bolt.Tx) error {
+				return bc.RebuildTxIndexes(tx)
+			})
+			if err != nil {
+				Log.Err(err)
+			}
+		},
 	}, {
 		Names: []string{"start_mining"},
 		Args:  "<address>",
@@ -314,11 +403,12 @@ func prompts(bc *blockchain.Blockchain) {
 
 				fmt.Printf("// checkpoints generated with: create_checkpoints %d\n", maxHeight)
 				fmt.Printf("const CHECKPOINTS_BLAKE3 = \"%x\"\n", blake3.Sum256(checkpoints))
-				err = os.WriteFile("checkpoints.bin", checkpoints, 0o666)
+				path := filepath.Join(bc.DataDir, "checkpoints.bin")
+				err = os.WriteFile(path, checkpoints, 0o666)
 				if err != nil {
 					return err
 				}
-				Log.Infof("checkpoints saved to file checkpoints.bin")
+				Log.Infof("checkpoints saved to file %s", path)
 				return nil
 			})
 			if err != nil {
@@ -347,8 +437,7 @@ func prompts(bc *blockchain.Blockchain) {
 		Args:  "",
 		Action: func(args []string) {
 			bc.DB.View(func(tx *bolt.Tx) error {
-				stats := bc.GetStats(tx)
-				for _, v := range stats.Tips {
+				for _, v := range bc.GetTips(tx) {
 					Log.Infof("- %x: Cumulative diff %s; height: %d", v.Hash, v.CumulativeDiff, v.Height)
 				}
 				return nil
@@ -2,12 +2,18 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 	"runtime/pprof"
+	"still-blockchain/address"
 	"still-blockchain/blockchain"
 	"still-blockchain/config"
 	"still-blockchain/logger"
+	"still-blockchain/p2p"
 	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 var Log = logger.New()
@@ -20,11 +26,35 @@ var cpu_profile = flag.String("cpu-profile", "", "write cpu profile to the provi
 
 func main() {
 	p2p_bind_port := flag.Uint("p2p-bind-port", config.P2P_BIND_PORT, "starts P2P server on this port")
+	p2p_max_inbound := flag.Int("p2p-max-inbound", config.P2P_MAX_INBOUND, "maximum number of incoming P2P connections")
+	p2p_max_outbound := flag.Int("p2p-max-outbound", config.P2P_MAX_OUTBOUND, "number of outgoing P2P connections the node tries to keep")
+	p2p_dial_timeout := flag.Duration("p2p-dial-timeout", config.P2P_DIAL_TIMEOUT*time.Second, "gives up outgoing P2P connections not established within this")
+	p2p_timeout := flag.Duration("p2p-timeout", config.P2P_TIMEOUT*time.Second, "disconnects P2P peers which don't send anything within this")
+	p2p_keepalive := flag.Duration("p2p-keepalive", config.P2P_KEEPALIVE*time.Second, "interval between the TCP keepalive probes of P2P connections, negative to disable them")
 	public_rpc := flag.Bool("public-rpc", false, "required for public RPC nodes: blocks private RPC calls and binds on 0.0.0.0")
 	rpc_bind_port := flag.Uint("rpc-bind-port", config.RPC_BIND_PORT, "starts RPC server on this port")
 	stratum_bind_ip := flag.String("stratum-bind-ip", "127.0.0.1", "use 0.0.0.0 to expose Stratum server")
 	stratum_bind_port := flag.Uint("stratum-bind-port", config.STRATUM_BIND_PORT, "")
+	stratum_shares := flag.Float64("stratum-shares-per-minute", config.STRATUM_SHARES_PER_MINUTE, "vardiff target number of shares per minute for each stratum miner")
+	metrics_bind := flag.String("metrics-bind", "", "exposes Prometheus metrics on this IP:PORT, for example 127.0.0.1:6320; disabled if empty")
+	block_queue_max := flag.Int("block-queue-max", config.BLOCK_QUEUE_MAX, "maximum number of blocks waiting to be downloaded, including the parents of orphan blocks")
+	parallel_downloads := flag.Int("parallel-downloads", config.PARALLEL_BLOCKS_DOWNLOAD, "maximum number of blocks downloaded in parallel during sync")
+	block_fanout := flag.Int("block-fanout", config.BLOCK_RELAY_FANOUT, "number of peers each new block received from the network is relayed to")
+	data_dir := flag.String("data-dir", ".", "directory where the blockchain database and other node files are saved")
 	log_level := flag.Uint("log-level", 1, "sets the log level")
+	log_format := flag.String("log-format", "text", "log output format: text, or json for log aggregation")
+	mining_allowlist := flag.String("mining-allowlist", "", "comma-separated list of the only addresses blocks can be mined to; empty allows any address")
+	verify_all := flag.Bool("verify-all", false, "verifies the PoW of all blocks, including checkpointed ones, the outgoing transaction index and the supply, then exits")
+	reindex := flag.Bool("reindex", false, "rebuilds the state from the genesis and checks that it matches the stored state before starting; slow")
+	repair_topo := flag.Bool("repair-topo", false, "rebuilds the mainchain height index from the blocks before starting")
+	serve_bootstrap := flag.Bool("serve-bootstrap", false, "serves the mainchain blocks at /get_bootstrap on the RPC port, for new nodes to import; bandwidth-heavy")
+	import_bootstrap := flag.String("import-bootstrap", "", "imports the blocks of a bootstrap file, downloaded from /get_bootstrap of a trusted node, before starting")
+	stall_timeout := flag.Uint("stall-timeout-blocks", config.STALL_TIMEOUT_BLOCKS, "warns that the chain is stalled after this many target block times without new blocks")
+	durable := flag.Bool("durable", false, "syncs every database write to disk, so that no block is lost on power loss; slower")
+	max_clock_skew := flag.Duration("max-clock-skew", config.MAX_CLOCK_SKEW, "warns when the local clock differs from the median clock of the peers by more than this")
+	use_peer_time := flag.Bool("use-peer-time", false, "checks block timestamps against the median clock of the peers instead of the local clock")
+	block_cache := flag.Int("block-cache", config.BLOCK_CACHE_SIZE, "number of recently read blocks kept in memory; 0 disables the cache")
+	wait_genesis := flag.Bool("wait-genesis", false, "if the genesis timestamp is in the future, waits for it instead of exiting; useful for launching new networks")
 
 	var slavechains_stratums *string
 	var stratum_wallet *string
@@ -48,8 +78,82 @@ func main() {
 	}
 
 	Log.SetLogLevel(uint8(*log_level))
+	logFormat, err := logger.ParseFormat(*log_format)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	Log.SetFormat(logFormat)
+
+	if *wait_genesis {
+		blockchain.WaitGenesis(Log, config.GENESIS_TIMESTAMP)
+	}
+
+	if *block_cache == 0 {
+		*block_cache = -1
+	}
+	bc := blockchain.NewWithOptions(*data_dir, blockchain.Options{
+		Durable:        *durable,
+		BlockCacheSize: *block_cache,
+	})
+
+	if *verify_all {
+		Log.Info("Verifying PoW of all mainchain blocks, this may take a while")
+		err := bc.DB.View(func(tx *bolt.Tx) error {
+			err := bc.VerifyPoW(tx)
+			if err != nil {
+				return err
+			}
+			err = bc.VerifyOutTxIndex(tx)
+			if err != nil {
+				return err
+			}
+			return bc.AuditSupply(tx)
+		})
+		bc.Close()
+		if err != nil {
+			Log.Fatal("verification failed:", err)
+		}
+		Log.Info("Verification completed, all blocks, the outgoing transaction index and the supply are valid")
+		return
+	}
 
-	bc := blockchain.New()
+	if *reindex {
+		Log.Info("Rebuilding the state from the genesis to verify it, this may take a while")
+		err := bc.Reindex()
+		if err != nil {
+			bc.Close()
+			Log.Fatal("reindex failed:", err)
+		}
+		Log.Info("Reindex completed, the stored state matches the mainchain blocks")
+	}
+
+	if *repair_topo {
+		var repaired int
+		err := bc.DB.Update(func(tx *bolt.Tx) (err error) {
+			repaired, err = bc.RepairTopo(tx)
+			return
+		})
+		if err != nil {
+			bc.Close()
+			Log.Fatal("topo repair failed:", err)
+		}
+		Log.Infof("Topo repair completed, %d entries rewritten", repaired)
+	}
+
+	if *import_bootstrap != "" {
+		f, err := os.Open(*import_bootstrap)
+		if err != nil {
+			bc.Close()
+			Log.Fatal(err)
+		}
+		imported, err := bc.ImportBlocks(f)
+		f.Close()
+		if err != nil {
+			bc.Close()
+			Log.Fatal("bootstrap import failed:", err)
+		}
+		Log.Infof("Bootstrap import completed, %d blocks added", imported)
+	}
 
 	if config.IS_MASTERCHAIN {
 		if len(*slavechains_stratums) > 0 {
@@ -63,14 +167,77 @@ func main() {
 		}
 	}
 
+	if *p2p_max_inbound < 0 || *p2p_max_outbound < 0 {
+		Log.Fatal("p2p-max-inbound and p2p-max-outbound must not be negative")
+	}
+	if *p2p_dial_timeout <= 0 || *p2p_timeout <= 0 {
+		Log.Fatal("p2p-dial-timeout and p2p-timeout must be positive")
+	}
+	// the peers ping every P2P_PING_INTERVAL seconds, so a shorter timeout would disconnect working peers
+	if *p2p_timeout <= config.P2P_PING_INTERVAL*time.Second {
+		Log.Fatal("p2p-timeout must be longer than the ping interval of", config.P2P_PING_INTERVAL, "seconds")
+	}
+
+	if *stall_timeout == 0 {
+		Log.Fatal("stall-timeout-blocks must be positive")
+	}
+	bc.StallTimeout = time.Duration(*stall_timeout) * config.TARGET_BLOCK_TIME * time.Second
+
+	if *max_clock_skew <= 0 {
+		Log.Fatal("max-clock-skew must be positive")
+	}
+	bc.MaxClockSkew = *max_clock_skew
+	bc.UsePeerTime = *use_peer_time
+
+	if *stratum_shares <= 0 {
+		Log.Fatal("stratum-shares-per-minute must be positive")
+	}
+	bc.Stratum.SharesPerMinute = *stratum_shares
+
+	if n := bc.SetParallelDownloads(*parallel_downloads); n != *parallel_downloads {
+		Log.Warnf("parallel-downloads out of range, using %d", n)
+	}
+
+	if n := bc.BlockQueue.SetMax(*block_queue_max); n != *block_queue_max {
+		Log.Warnf("block-queue-max out of range, using %d", n)
+	}
+
+	if n := bc.SetBlockFanout(*block_fanout); n != *block_fanout {
+		Log.Warnf("block-fanout out of range, using %d", n)
+	}
+
+	if len(*mining_allowlist) > 0 {
+		for _, v := range strings.Split(*mining_allowlist, ",") {
+			addr, err := address.FromString(strings.TrimSpace(v))
+			if err != nil {
+				Log.Fatal("invalid address in mining-allowlist:", v, err)
+			}
+			bc.AllowedRecipients = append(bc.AllowedRecipients, addr.Addr)
+		}
+		Log.Infof("Mining is restricted to %d allowed addresses", len(bc.AllowedRecipients))
+	}
+
 	bind_ip := "127.0.0.1"
 	if *public_rpc {
 		bind_ip = "0.0.0.0"
 	}
 
-	go startRpc(bc, bind_ip, uint16(*rpc_bind_port), *public_rpc)
+	go startRpc(bc, bind_ip, uint16(*rpc_bind_port), *public_rpc, *serve_bootstrap)
+	if *metrics_bind != "" {
+		go func() {
+			Log.Info("Starting metrics server on", *metrics_bind)
+			err := http.ListenAndServe(*metrics_bind, bc.Metrics)
+			if err != nil {
+				Log.Err("metrics server failed:", err)
+			}
+		}()
+	}
 	go bc.StartStratum(*stratum_bind_ip, uint16(*stratum_bind_port))
-	go bc.StartP2P(config.SEED_NODES, uint16(*p2p_bind_port))
+	go bc.StartP2P(config.SEED_NODES, uint16(*p2p_bind_port), *p2p_max_inbound, *p2p_max_outbound, p2p.Timeouts{
+		Dial:      *p2p_dial_timeout,
+		Read:      *p2p_timeout,
+		KeepAlive: *p2p_keepalive,
+	})
 	go bc.NewStratumJob(true)
 
 	prompts(bc)
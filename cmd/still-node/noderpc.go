@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
 	"still-blockchain/block"
 	"still-blockchain/blockchain"
 	"still-blockchain/config"
+	"still-blockchain/p2p"
 	"still-blockchain/rpc"
 	"still-blockchain/rpc/daemonrpc"
 	"still-blockchain/rpc/rpcserver"
 	"still-blockchain/transaction"
 	"still-blockchain/util"
+	"still-blockchain/util/bloom"
+	"still-blockchain/util/uint128"
+	"time"
 
 	"github.com/still-project/go-randomstill"
 	bolt "go.etcd.io/bbolt"
@@ -38,11 +44,21 @@ const internalValidationErr = -32000
 
 const internalReadFailed = -32001
 
-const internalInsertFailed = -32002
+// submit_transaction rejection reasons
+const txInvalidSignature = -32010
+const txInsufficientBalance = -32011
+const txInvalidNonce = -32012
+const txDuplicate = -32013
+const txConfirmed = -32014
+const txDust = -32015
 
 const TX_LIST_PAGE_SIZE = 25
 
-func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool) {
+const EVENTS_PAGE_SIZE = 100
+
+const EVENTS_MAX_WAIT = 60 // maximum timeout of wait_for_event, in seconds
+
+func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted, serveBootstrap bool) {
 	ratelimitCount := 100_000 // max 100k requests per minute for private RPC
 	if restricted {
 		ratelimitCount = 5_000 // max 5k requests per minute for public, restricted RPC
@@ -147,57 +163,112 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 			return
 		}
 
-		integr := address.FromPubKey(txn.Sender).Integrated()
-
 		c.Response(rpc.ResponseOut{
 			JsonRpc: "2.0",
-			Result: daemonrpc.GetTransactionResponse{
-				Sender:    &integr,
-				Recipient: txn.Recipient.Integrated(),
-				Amount:    txn.Amount,
-				Fee:       txn.Fee,
-				Nonce:     txn.Nonce,
-				Signature: txn.Signature[:],
-				Height:    height,
-				Coinbase:  false,
-			},
-			Id: c.Body.Id,
+			Result:  transactionResponse(txn, height),
+			Id:      c.Body.Id,
 		})
 
 	})
 
-	rs.Handle("get_info", func(c *rpcserver.Context) {
-		var stats *blockchain.Stats
-		var topBl *block.Block
-		err := bc.DB.View(func(tx *bolt.Tx) (err error) {
-			stats = bc.GetStats(tx)
-			topBl, err = bc.GetBlock(tx, stats.TopHash)
+	rs.Handle("get_raw_transaction", func(c *rpcserver.Context) {
+		params := daemonrpc.GetRawTransactionRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
 			return
+		}
+
+		txn, height, err := bc.GetTx(params.Txid)
+		if err != nil {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: fmt.Sprintf("transaction %x not found", params.Txid),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  rawTransactionResponse(txn, height, params.Verbose),
+			Id:      c.Body.Id,
 		})
+	})
+
+	rs.Handle("decode_raw_transaction", func(c *rpcserver.Context) {
+		params := daemonrpc.DecodeRawTransactionRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		res, err := decodeRawTransaction(params.Hex)
+		if err != nil {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    invalidParams,
+					Message: err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_info", func(c *rpcserver.Context) {
+		info, err := bc.GetInfo()
 		if err != nil {
 			Log.Fatal(err)
 		}
 
-		supply := block.GetSupplyAtHeight(stats.TopHeight)
+		supply := block.GetSupplyAtHeight(info.Height)
+		delay, staleRate := bc.PropagationStats()
 
 		c.Response(rpc.ResponseOut{
 			JsonRpc: "2.0",
 			Result: daemonrpc.GetInfoResponse{
-				Height:            stats.TopHeight,
-				TopHash:           stats.TopHash,
+				Height:            info.Height,
+				TopHash:           info.TopHash,
 				CirculatingSupply: supply,
 				MaxSupply:         config.MAX_SUPPLY,
 				Coin:              config.COIN,
-				Difficulty:        topBl.Difficulty.String(),
-				CumulativeDiff:    stats.CumulativeDiff.String(),
+				Difficulty:        info.TopDifficulty.String(),
+				NextDifficulty:    info.Difficulty.String(),
+				Hashrate:          info.Hashrate.String(),
+				AverageBlockTime:  info.AverageBlockTime,
+				MedianBlockTime:   info.MedianBlockTime,
+				CumulativeDiff:    info.CumulativeDiff.String(),
 				Target:            config.TARGET_BLOCK_TIME,
-				BlockReward:       block.Reward(stats.TopHeight),
+				BlockReward:       block.Reward(info.Height),
+				PropagationDelay:  delay.Seconds(),
+				StaleRate:         staleRate,
+				Synced:            info.Synced,
+				NetworkId:         fmt.Sprintf("%016x", info.NetworkID),
+				Version:           info.Version,
+				Peers:             info.Peers,
+				MempoolSize:       info.MempoolSize,
+				RelayFee:          info.RelayFee,
+				MinerPercent:      info.MinerPercent,
+				GovernancePercent: info.GovernancePercent,
 			},
 			Id: c.Body.Id,
 		})
 	})
 
-	rs.Handle("submit_transaction", func(c *rpcserver.Context) {
+	// send_raw_transaction is an alias of submit_transaction
+	submitTransaction := func(c *rpcserver.Context) {
 		params := daemonrpc.SubmitTransactionRequest{}
 		err := c.GetParams(&params)
 		if err != nil {
@@ -207,10 +278,9 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 		Log.Debugf("submit_transaction hex: %s", params.Hex)
 
 		tx := &transaction.Transaction{}
-
 		err = tx.Deserialize(params.Hex)
 		if err != nil {
-			Log.Warn(err)
+			Log.Debug(err)
 			c.Response(rpc.ResponseOut{
 				JsonRpc: "2.0",
 				Error: &rpc.Error{
@@ -222,45 +292,45 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 			return
 		}
 
-		err = tx.Prevalidate()
+		txid, err := bc.SubmitTx(tx)
 		if err != nil {
-			Log.Warn(err)
-			c.Response(rpc.ResponseOut{
-				JsonRpc: "2.0",
-				Error: &rpc.Error{
-					Code:    internalValidationErr,
-					Message: "transaction verification failed",
-				},
-				Id: c.Body.Id,
-			})
-			return
-		}
-
-		err = bc.DB.Update(func(txn *bolt.Tx) error {
-			return bc.AddTransaction(txn, tx, tx.Hash(), true)
-		})
-		if err != nil {
-			Log.Warn(err)
+			Log.Debug("submit_transaction rejected:", err)
+			code := internalValidationErr
+			switch {
+			case errors.Is(err, transaction.ErrInvalidSignature):
+				code = txInvalidSignature
+			case errors.Is(err, blockchain.ErrInsufficientBalance):
+				code = txInsufficientBalance
+			case errors.Is(err, blockchain.ErrInvalidNonce):
+				code = txInvalidNonce
+			case errors.Is(err, blockchain.ErrDuplicateTx):
+				code = txDuplicate
+			case errors.Is(err, blockchain.ErrTxConfirmed):
+				code = txConfirmed
+			case errors.Is(err, blockchain.ErrDustAmount):
+				code = txDust
+			}
 			c.Response(rpc.ResponseOut{
 				JsonRpc: "2.0",
 				Error: &rpc.Error{
-					Code:    internalInsertFailed,
-					Message: "failed to add transaction to chain",
+					Code:    code,
+					Message: err.Error(),
 				},
 				Id: c.Body.Id,
 			})
 			return
 		}
 
-		txhash := tx.Hash()
-
 		c.Response(rpc.ResponseOut{
 			JsonRpc: "2.0",
 			Result: daemonrpc.SubmitTransactionResponse{
-				TXID: util.Hash(txhash),
+				TXID: util.Hash(txid),
 			},
+			Id: c.Body.Id,
 		})
-	})
+	}
+	rs.Handle("submit_transaction", submitTransaction)
+	rs.Handle("send_raw_transaction", submitTransaction)
 
 	rs.Handle("get_address", func(c *rpcserver.Context) {
 		params := daemonrpc.GetAddressRequest{}
@@ -304,7 +374,6 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 		}
 
 		result.MempoolBalance = result.Balance
-		result.MempoolNonce = result.LastNonce
 
 		var mem *blockchain.Mempool
 		bc.DB.View(func(tx *bolt.Tx) error {
@@ -321,13 +390,47 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 				}
 				if v.Sender == params.Address.Addr {
 					result.MempoolBalance -= (txn.Amount + txn.Fee)
-					result.MempoolNonce++
 				} else {
 					result.MempoolBalance += txn.Amount
 					result.MempoolIncoming++
 				}
 			}
 		}
+		// the mempool nonce is the last one before a nonce gap, so that the next transaction fills the gap
+		next, _ := mem.NextNonce(params.Address.Addr, result.LastNonce)
+		result.MempoolNonce = next - 1
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  result,
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_nonce", func(c *rpcserver.Context) {
+		params := daemonrpc.GetNonceRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		if params.Address.Addr == address.INVALID_ADDRESS {
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    invalidParams,
+					Message: "invalid wallet address",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		result := daemonrpc.GetNonceResponse{}
+		bc.DB.View(func(tx *bolt.Tx) error {
+			result.LastNonce, result.NextNonce, result.Pending = bc.GetNextNonce(tx, params.Address.Addr)
+			return nil
+		})
 
 		c.Response(rpc.ResponseOut{
 			JsonRpc: "2.0",
@@ -336,6 +439,78 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 		})
 	})
 
+	rs.Handle("simulate_transaction", func(c *rpcserver.Context) {
+		params := daemonrpc.SimulateTransactionRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		if params.Sender.Addr == address.INVALID_ADDRESS || params.Recipient.Addr == address.INVALID_ADDRESS {
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    invalidParams,
+					Message: "invalid wallet address",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		var sim *blockchain.TxSimulation
+		bc.DB.View(func(tx *bolt.Tx) error {
+			sim = bc.SimulateTx(tx, params.Sender.Addr, params.Recipient.Addr, params.Amount, params.Fee,
+				params.Nonce)
+			return nil
+		})
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result: daemonrpc.SimulateTransactionResponse{
+				SenderBalance:    sim.SenderBalance,
+				RecipientBalance: sim.RecipientBalance,
+				BalanceValid:     sim.BalanceValid,
+				ExpectedNonce:    sim.ExpectedNonce,
+				NonceValid:       sim.NonceValid,
+				MinFee:           sim.MinFee,
+				FeeValid:         sim.FeeValid,
+			},
+			Id: c.Body.Id,
+		})
+	})
+
+	rs.Handle("estimate_fee", func(c *rpcserver.Context) {
+		params := daemonrpc.EstimateFeeRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		if params.Blocks < 1 {
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    invalidParams,
+					Message: "blocks must be at least 1",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		feePerByte := bc.EstimateFeeWithin(1, params.Blocks)
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result: daemonrpc.EstimateFeeResponse{
+				FeePerByte: feePerByte,
+				Fee:        feePerByte * transaction.Transaction{}.GetVirtualSize(),
+			},
+			Id: c.Body.Id,
+		})
+	})
+
 	rs.Handle("get_tx_list", func(c *rpcserver.Context) {
 		params := daemonrpc.GetTxListRequest{}
 		err := c.GetParams(&params)
@@ -479,7 +654,343 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 		})
 	})
 
+	rs.Handle("get_header_proof", func(c *rpcserver.Context) {
+		params := daemonrpc.GetHeaderProofRequest{}
+
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		// the public RPC serves shorter proofs, the light clients fetch longer ranges with more requests
+		if restricted && params.Height > params.Anchor &&
+			params.Height-params.Anchor >= config.HEADER_PROOF_MAX_BLOCKS_PUBLIC {
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code: invalidParams,
+					Message: fmt.Sprintf("height is more than %d blocks above anchor",
+						config.HEADER_PROOF_MAX_BLOCKS_PUBLIC-1),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		var proof *block.HeaderProof
+		err = bc.DB.View(func(tx *bolt.Tx) (err error) {
+			proof, err = bc.GetHeaderProof(tx, params.Anchor, params.Height)
+			return
+		})
+		if err != nil {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result: daemonrpc.GetHeaderProofResponse{
+				HeaderProof: *proof,
+			},
+			Id: c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_block_reward_info", func(c *rpcserver.Context) {
+		params := daemonrpc.GetBlockRewardInfoRequest{}
+
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		res := daemonrpc.GetBlockRewardInfoResponse{}
+		err = bc.DB.View(func(tx *bolt.Tx) (err error) {
+			res.BaseReward, res.Fees, res.GovernanceReward, res.MinerReward, err = bc.GetBlockRewardInfo(tx,
+				params.Hash)
+			return
+		})
+		if err != nil {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: "block not found",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_block_by_cumulative_diff", func(c *rpcserver.Context) {
+		params := daemonrpc.GetBlockByCumulativeDiffRequest{}
+
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		target, err := uint128.FromString(params.CumulativeDiff)
+		if err != nil {
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    invalidParams,
+					Message: "invalid cumulative diff",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		res := daemonrpc.GetBlockByCumulativeDiffResponse{}
+		err = bc.DB.View(func(tx *bolt.Tx) error {
+			res.TopCumulativeDiff = bc.GetStats(tx).CumulativeDiff.String()
+			bl, height, err := bc.FindBlockByCumulativeDiff(tx, target)
+			if err != nil {
+				return err
+			}
+			res.Reached = true
+			res.Height = height
+			res.Hash = bl.Hash().String()
+			res.Block = bl
+			return nil
+		})
+		if err != nil && !errors.Is(err, blockchain.ErrCumulativeDiffNotReached) {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_fork_info", func(c *rpcserver.Context) {
+		res := daemonrpc.GetForkInfoResponse{
+			Tips:    []daemonrpc.ForkTip{},
+			Orphans: []daemonrpc.ForkOrphan{},
+		}
+
+		bc.DB.View(func(tx *bolt.Tx) error {
+			for _, v := range bc.GetTips(tx) {
+				res.Tips = append(res.Tips, daemonrpc.ForkTip{
+					Hash:           v.Hash,
+					Height:         v.Height,
+					CumulativeDiff: v.CumulativeDiff.String(),
+				})
+			}
+			for _, v := range bc.GetOrphans(tx) {
+				res.Orphans = append(res.Orphans, daemonrpc.ForkOrphan{
+					Hash:     v.Hash,
+					PrevHash: v.PrevHash,
+					Height:   v.Height,
+					Expires:  v.Expires,
+				})
+			}
+			return nil
+		})
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_block_status", func(c *rpcserver.Context) {
+		params := daemonrpc.GetBlockStatusRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		res := daemonrpc.GetBlockStatusResponse{}
+		err = bc.DB.View(func(tx *bolt.Tx) (err error) {
+			res.Status, res.Height, res.Confirmations, err = bc.GetBlockStatus(tx, params.Hash)
+			return
+		})
+		if err != nil {
+			Log.Err(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: "failed to read block status",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("wait_for_event", func(c *rpcserver.Context) {
+		params := daemonrpc.WaitForEventRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		timeout := time.Duration(min(params.Timeout, EVENTS_MAX_WAIT)) * time.Second
+		evs, next, missed := bc.WaitForEvents(params.Cursor, EVENTS_PAGE_SIZE, timeout)
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  waitForEventResponse(evs, next, missed),
+			Id:      c.Body.Id,
+		})
+	})
+
+	// the filter is matched against the addresses of each transaction of the block, see GetFilteredBlockRequest
+	// for the privacy trade-off
+	rs.Handle("get_filtered_block", func(c *rpcserver.Context) {
+		params := daemonrpc.GetFilteredBlockRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		filter := &bloom.Filter{}
+		err = filter.Deserialize(params.Filter)
+		if err != nil {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    invalidParams,
+					Message: "invalid bloom filter",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		var bl *block.Block
+		var txs []blockchain.FilteredTx
+		err = bc.DB.View(func(tx *bolt.Tx) (err error) {
+			bl, err = bc.GetBlockByHeight(tx, params.Height)
+			if err != nil {
+				return
+			}
+			txs, err = bc.GetFilteredTxs(tx, bl, filter)
+			return
+		})
+		if err != nil {
+			Log.Debug(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: "block not found",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		res := daemonrpc.GetFilteredBlockResponse{
+			Hash:         bl.Hash(),
+			Height:       bl.Height,
+			Coinbase:     filter.Contains(bl.Recipient[:]),
+			Reward:       bl.Reward(),
+			Transactions: make([]daemonrpc.FilteredTransaction, 0, len(txs)),
+		}
+		for _, v := range txs {
+			res.Transactions = append(res.Transactions, daemonrpc.FilteredTransaction{
+				Txid:                   util.Hash(v.Txid),
+				GetTransactionResponse: transactionResponse(v.Tx, bl.Height),
+			})
+		}
+
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
+	if serveBootstrap {
+		rs.HandleHTTP("/get_bootstrap", bc.ServeBootstrap)
+	}
+
 	if !restricted {
+		rs.Handle("get_peers", func(c *rpcserver.Context) {
+			res := daemonrpc.GetPeersResponse{
+				Peers: []daemonrpc.PeerInfo{},
+			}
+
+			// connections must not be locked while P2P is locked
+			bc.P2P.RLock()
+			res.MaxInbound, res.MaxOutbound = bc.P2P.MaxInbound, bc.P2P.MaxOutbound
+			conns := make(map[string]*p2p.Connection, len(bc.P2P.Connections))
+			for addr, conn := range bc.P2P.Connections {
+				conns[addr] = conn
+			}
+			bc.P2P.RUnlock()
+
+			for addr, conn := range conns {
+				conn.View(func(c *p2p.ConnData) error {
+					if c.Outgoing {
+						res.Outbound++
+					} else {
+						res.Inbound++
+					}
+					res.Peers = append(res.Peers, daemonrpc.PeerInfo{
+						Address:  addr,
+						PeerId:   hex.EncodeToString(c.PeerId[:]),
+						Outgoing: c.Outgoing,
+					})
+					return nil
+				})
+			}
+
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Result:  res,
+				Id:      c.Body.Id,
+			})
+		})
+		rs.Handle("rebroadcast_mempool", func(c *rpcserver.Context) {
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Result: daemonrpc.RebroadcastMempoolResponse{
+					Count: bc.RebroadcastMempool(),
+				},
+				Id: c.Body.Id,
+			})
+		})
 		rs.Handle("calc_pow", func(c *rpcserver.Context) {
 			params := daemonrpc.CalcPowRequest{}
 
@@ -498,3 +1009,91 @@ func startRpc(bc *blockchain.Blockchain, ip string, port uint16, restricted bool
 		})
 	}
 }
+
+func transactionResponse(txn *transaction.Transaction, height uint64) daemonrpc.GetTransactionResponse {
+	integr := address.FromPubKey(txn.Sender).Integrated()
+
+	return daemonrpc.GetTransactionResponse{
+		Sender:    &integr,
+		Recipient: txn.Recipient.Integrated(),
+		Amount:    txn.Amount,
+		Fee:       txn.Fee,
+		Nonce:     txn.Nonce,
+		Signature: txn.Signature[:],
+		Height:    height,
+		Coinbase:  false,
+	}
+}
+
+// rawTransactionResponse returns the serialized transaction, and if verbose is true, also its decoded fields
+func rawTransactionResponse(txn *transaction.Transaction, height uint64,
+	verbose bool) daemonrpc.GetRawTransactionResponse {
+	res := daemonrpc.GetRawTransactionResponse{
+		Hex:    txn.Serialize(),
+		Height: height,
+	}
+	if verbose {
+		decoded := transactionResponse(txn, height)
+		res.Transaction = &decoded
+	}
+	return res
+}
+
+// decodeRawTransaction decodes a serialized transaction and verifies it like submit_transaction does, without
+// adding it to the mempool
+func decodeRawTransaction(data []byte) (daemonrpc.DecodeRawTransactionResponse, error) {
+	txn := &transaction.Transaction{}
+	if err := txn.Deserialize(data); err != nil {
+		return daemonrpc.DecodeRawTransactionResponse{}, fmt.Errorf("invalid transaction hex data: %w", err)
+	}
+	// the transaction ID is the hash of the serialized transaction, so it would not match data which isn't the
+	// exact serialization, for example because it's truncated or has trailing bytes
+	if !bytes.Equal(txn.Serialize(), data) {
+		return daemonrpc.DecodeRawTransactionResponse{}, errors.New("invalid transaction hex data: " +
+			"not a serialized transaction")
+	}
+
+	res := daemonrpc.DecodeRawTransactionResponse{
+		Txid:           util.Hash(txn.Hash()),
+		Sender:         address.FromPubKey(txn.Sender).Integrated(),
+		Recipient:      address.Integrated{Addr: txn.Recipient, Subaddr: txn.Subaddr},
+		Subaddr:        txn.Subaddr,
+		Nonce:          txn.Nonce,
+		Amount:         txn.Amount,
+		Fee:            txn.Fee,
+		Signature:      txn.Signature[:],
+		VSize:          txn.GetVirtualSize(),
+		SignatureValid: bitcrypto.VerifySignature(txn.Sender, txn.SignatureData(), txn.Signature),
+	}
+	if err := txn.Prevalidate(); err != nil {
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
+func waitForEventResponse(evs []blockchain.Event, next uint64, missed bool) daemonrpc.WaitForEventResponse {
+	res := daemonrpc.WaitForEventResponse{
+		Events:     make([]daemonrpc.EventInfo, 0, len(evs)),
+		NextCursor: next,
+		Missed:     missed,
+	}
+	for _, ev := range evs {
+		info := daemonrpc.EventInfo{
+			Seq:    ev.Seq,
+			Type:   ev.Type.String(),
+			Height: ev.Height,
+			Hash:   ev.Hash,
+		}
+		switch ev.Type {
+		case blockchain.EventTxConfirmed:
+			txid := util.Hash(ev.Txid)
+			from, to := ev.From.Integrated(), ev.To.Integrated()
+			info.Txid, info.From, info.To = &txid, &from, &to
+			info.Amount, info.Fee = ev.Amount, ev.Fee
+		case blockchain.EventReorg:
+			info.RolledBack = ev.RolledBack
+		}
+		res.Events = append(res.Events, info)
+	}
+	return res
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"still-blockchain/address"
+	"still-blockchain/config"
+	"still-blockchain/rpc/daemonrpc"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+func TestRawTransactionResponse(t *testing.T) {
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	txn, err := transaction.New(pk, recipient, config.COIN, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the raw form is the hex-encoded transaction, which can be decoded and verified again
+	data, err := json.Marshal(rawTransactionResponse(txn, 10, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["transaction"]; ok {
+		t.Fatalf("non-verbose response includes the decoded transaction: %s", data)
+	}
+	if raw["height"] != float64(10) {
+		t.Fatalf("response has height %v, expected 10", raw["height"])
+	}
+	hexStr, _ := raw["hex"].(string)
+	bin, err := hex.DecodeString(hexStr)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", hexStr, err)
+	}
+	decoded := &transaction.Transaction{}
+	if err := decoded.Deserialize(bin); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash() != txn.Hash() {
+		t.Fatalf("decoded transaction %x, expected %x", decoded.Hash(), txn.Hash())
+	}
+	if err := decoded.Prevalidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the verbose form also includes the decoded fields
+	data, err = json.Marshal(rawTransactionResponse(txn, 10, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := daemonrpc.GetRawTransactionResponse{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(res.Hex) != hexStr {
+		t.Fatalf("verbose response has hex %x, expected %s", res.Hex, hexStr)
+	}
+	if res.Transaction == nil {
+		t.Fatalf("verbose response doesn't include the decoded transaction: %s", data)
+	}
+	tx := res.Transaction
+	if tx.Sender == nil || tx.Sender.Addr != address.FromPubKey(pk.Public()) {
+		t.Fatalf("decoded sender is %v, expected %s", tx.Sender, address.FromPubKey(pk.Public()))
+	}
+	if tx.Recipient.Addr != recipient || tx.Amount != config.COIN || tx.Fee != txn.Fee || tx.Nonce != 3 ||
+		tx.Height != 10 || tx.Coinbase {
+		t.Fatalf("unexpected decoded transaction %+v", tx)
+	}
+}
+
+func TestDecodeRawTransaction(t *testing.T) {
+	pk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+	txn, err := transaction.New(pk, recipient, config.COIN, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := decodeRawTransaction(txn.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Txid != util.Hash(txn.Hash()) || res.Sender.Addr != address.FromPubKey(pk.Public()) ||
+		res.Recipient.Addr != recipient || res.Nonce != 3 || res.Amount != config.COIN || res.Fee != txn.Fee ||
+		res.VSize != txn.GetVirtualSize() {
+		t.Fatalf("unexpected decoded transaction %+v", res)
+	}
+	if !res.SignatureValid || res.Error != "" {
+		t.Fatalf("valid transaction decoded with signature valid %v, error %q", res.SignatureValid, res.Error)
+	}
+
+	// a transaction modified after signing is still decoded, reporting the invalid signature
+	txn.Amount++
+	res, err = decodeRawTransaction(txn.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SignatureValid || res.Error == "" {
+		t.Fatalf("modified transaction decoded with signature valid %v, error %q", res.SignatureValid, res.Error)
+	}
+
+	// malformed data is rejected
+	ser := txn.Serialize()
+	for _, data := range [][]byte{nil, ser[:len(ser)-1], append(ser, 0)} {
+		if _, err := decodeRawTransaction(data); err == nil {
+			t.Errorf("malformed transaction %x is decoded", data)
+		}
+	}
+}
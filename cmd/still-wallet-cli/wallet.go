@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
 	"still-blockchain/config"
 	"still-blockchain/logger"
 	"still-blockchain/util"
@@ -18,6 +22,36 @@ var Log = logger.New()
 
 var default_rpc = fmt.Sprintf("http://127.0.0.1:%d", config.RPC_BIND_PORT)
 
+// lineReader is the subset of readline.Instance used by the initial prompt
+type lineReader interface {
+	SetPrompt(s string)
+	ReadLine() (string, error)
+	ReadLineWithConfig(cfg *readline.Config) (string, error)
+}
+
+// number of times a failed read is retried before giving up
+const max_read_retries = 3
+
+// errPromptClosed is returned when the user closes a prompt with Ctrl-D (EOF) or Ctrl-C
+var errPromptClosed = errors.New("prompt closed")
+
+// readLine calls read until it succeeds, retrying transient errors
+func readLine(read func() (string, error)) (string, error) {
+	for i := 0; ; i++ {
+		line, err := read()
+		if err == nil {
+			return line, nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, readline.ErrInterrupt) {
+			return "", errPromptClosed
+		}
+		if i >= max_read_retries {
+			return "", err
+		}
+		Log.Warn("failed to read input, retrying:", err)
+	}
+}
+
 func initialPrompt() *wallet.Wallet {
 	l, err := readline.NewEx(&readline.Config{
 		InterruptPrompt: "^C",
@@ -33,6 +67,18 @@ func initialPrompt() *wallet.Wallet {
 	lcfg := l.GeneratePasswordConfig()
 	lcfg.MaskRune = '*'
 
+	w := runInitialPrompt(l, lcfg)
+	if w == nil {
+		Log.Info("Exiting")
+		l.Close()
+		os.Exit(0)
+	}
+	return w
+}
+
+// runInitialPrompt asks the user to open, create or restore a wallet. Closing any of the prompts after the
+// first one returns to the main menu; closing the main menu returns nil.
+func runInitialPrompt(l lineReader, lcfg *readline.Config) *wallet.Wallet {
 	for {
 		Log.Info("Available commands:")
 		Log.Info("open    Open wallet file")
@@ -41,10 +87,12 @@ func initialPrompt() *wallet.Wallet {
 
 		l.SetPrompt("\033[32m>\033[0m ")
 
-		line, err := l.ReadLine()
+		line, err := readLine(l.ReadLine)
 		if err != nil {
-			Log.Err(err)
-			os.Exit(0)
+			if err != errPromptClosed {
+				Log.Err(err)
+			}
+			return nil
 		}
 
 		cmds := strings.Split(strings.ToLower(strings.ReplaceAll(line, "  ", " ")), " ")
@@ -59,77 +107,81 @@ func initialPrompt() *wallet.Wallet {
 			Log.Err("unknown command")
 			continue
 		}
-		if len(cmds) == 1 {
-			l.SetPrompt("Wallet name: ")
-			filename, err := l.ReadLine()
-			if err != nil {
-				Log.Err(err)
-				os.Exit(0)
-			}
-			l.SetPrompt("\033[32m>\033[0m ")
 
-			if len(filename) == 0 {
-				Log.Err("wallet name is too short")
-				continue
+		w, err := walletPrompt(l, lcfg, cmds)
+		if err != nil {
+			if err == errPromptClosed {
+				fmt.Println()
+			} else {
+				Log.Err(err)
 			}
-
-			cmds = append(cmds, filename)
+			continue
 		}
+		return w
+	}
+}
 
-		fmt.Print("Wallet password: ")
-		password, err := l.ReadLineWithConfig(lcfg)
+// walletPrompt asks the remaining information needed to open, create or restore a wallet
+func walletPrompt(l lineReader, lcfg *readline.Config, cmds []string) (*wallet.Wallet, error) {
+	cmd := cmds[0]
+	if len(cmds) == 1 {
+		l.SetPrompt("Wallet name: ")
+		filename, err := readLine(l.ReadLine)
 		if err != nil {
-			Log.Err(err)
+			return nil, err
 		}
+		l.SetPrompt("\033[32m>\033[0m ")
 
-		if cmds[0] == "open" {
-			Log.Info("opening wallet")
+		if len(filename) == 0 {
+			return nil, errors.New("wallet name is too short")
+		}
 
-			w, err := wallet.OpenWalletFile(default_rpc, cmds[1]+".keys", []byte(password))
-			if err != nil {
-				Log.Err(err)
-				continue
-			}
-			return w
-		} else {
-			fmt.Print("Repeat password: ")
-			confirmPass, err := l.ReadLineWithConfig(lcfg)
-			if err != nil {
-				Log.Err(err)
-				continue
-			}
-			if string(confirmPass) != string(password) {
-				Log.Err("password doesn't match")
-			}
+		cmds = append(cmds, filename)
+	}
 
-			if cmd == "create" {
-				w, err := wallet.CreateWalletFile(default_rpc, cmds[1]+".keys", []byte(password))
-				if err != nil {
-					Log.Err("Could not create wallet:", err)
-					continue
-				}
-
-				return w
-			} else if cmd == "restore" {
-				Log.Info("restoring wallet")
-
-				l.SetPrompt("Mnemonic seed: ")
-				mnemonic, err := l.ReadLine()
-				if err != nil {
-					Log.Err(err)
-					os.Exit(0)
-				}
-
-				w, err := wallet.CreateWalletFileFromMnemonic("http://127.0.0.1:6311", cmds[1]+".keys",
-					mnemonic, []byte(password))
-				if err != nil {
-					Log.Err(err)
-					continue
-				}
-				return w
-			}
+	readPassword := func() (string, error) {
+		return l.ReadLineWithConfig(lcfg)
+	}
+
+	fmt.Print("Wallet password: ")
+	password, err := readLine(readPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd == "open" {
+		Log.Info("opening wallet")
+
+		return wallet.OpenWalletFile(default_rpc, cmds[1]+".keys", []byte(password))
+	}
+
+	fmt.Print("Repeat password: ")
+	confirmPass, err := readLine(readPassword)
+	if err != nil {
+		return nil, err
+	}
+	if confirmPass != password {
+		return nil, errors.New("password doesn't match")
+	}
+
+	if cmd == "create" {
+		w, err := wallet.CreateWalletFile(default_rpc, cmds[1]+".keys", []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("could not create wallet: %w", err)
 		}
+		return w, nil
 	}
+
+	Log.Info("restoring wallet")
+
+	l.SetPrompt("Mnemonic seed: ")
+	mnemonic, err := readLine(l.ReadLine)
+	if err != nil {
+		return nil, err
+	}
+
+	return wallet.CreateWalletFileFromMnemonic("http://127.0.0.1:6311", cmds[1]+".keys",
+		mnemonic, []byte(password))
 }
 
 func main() {
@@ -139,22 +191,40 @@ func main() {
 	rpc_auth := flag.String("rpc-auth", "", "colon-separated username and password, like user:pass")
 	open_wallet := flag.String("open-wallet", "", "open a wallet file")
 	wallet_password := flag.String("wallet-password", "", "wallet password when using --open-wallet")
+	watch_only := flag.String("watch-only", "",
+		"open a watch-only wallet for this public key (hex), to create unsigned transactions and submit the ones signed offline")
+	safe_confirmations := flag.Int("safe-confirmations", config.SAFE_CONFIRMATIONS,
+		"warn about transactions with fewer confirmations than this")
+	auto_lock := flag.Duration("auto-lock", 0,
+		"erases the private key from memory after the wallet is idle for this long, for example 10m; 0 disables it")
+	fee_priority := flag.String("fee-priority", "normal",
+		"fee priority of the transactions, the higher the sooner they are mined: low, normal or high")
 
 	flag.Parse()
 
 	Log.SetLogLevel(uint8(*log_level))
 
+	feeBlocks, err := wallet.ParseFeePriority(*fee_priority)
+	if err != nil {
+		Log.Fatal(err)
+	}
+
 	Log.Info("Starting STILL Wallet CLI")
 
 	var w *wallet.Wallet
 
-	if len(*open_wallet) > 0 {
+	if len(*watch_only) > 0 {
+		pub, err := hex.DecodeString(*watch_only)
+		if err != nil || len(pub) != bitcrypto.PUBKEY_SIZE {
+			Log.Fatal("invalid public key")
+		}
+		w = wallet.OpenWatchOnly(default_rpc, bitcrypto.Pubkey(pub))
+	} else if len(*open_wallet) > 0 {
 		wallname := *open_wallet
 
 		if strings.ContainsAny(wallname, "/. \\$") {
 			Log.Fatal("invalid wallet name")
 		}
-		var err error
 		w, err = wallet.OpenWalletFile(default_rpc, wallname+".keys", []byte(*wallet_password))
 		if err != nil {
 			Log.Fatal(err)
@@ -163,6 +233,8 @@ func main() {
 		w = initialPrompt()
 	}
 
+	w.SetFeePriority(feeBlocks)
+
 	if *rpc_bind_port != 0 {
 		if len(*rpc_auth) < 7 {
 			Log.Err("rpc-auth is invalid or too short")
@@ -171,6 +243,10 @@ func main() {
 		startRpcServer(w, *rpc_bind_ip, uint16(*rpc_bind_port), *rpc_auth)
 	}
 
+	if *auto_lock > 0 {
+		w.SetAutoLock(*auto_lock)
+	}
+
 	addr := w.GetAddress()
 	if addr.Addr == address.INVALID_ADDRESS {
 		Log.Fatal("wallet has invalid address")
@@ -180,7 +256,7 @@ func main() {
 
 	Log.Debugf("Address hex: %x", addr.Addr[:])
 
-	err := w.Refresh()
+	err = w.Refresh()
 	if err != nil {
 		Log.Warn("refresh failed:", err)
 	} else {
@@ -188,5 +264,5 @@ func main() {
 		Log.Info("Last nonce:", w.GetLastNonce())
 	}
 
-	prompts(w)
+	prompts(w, *safe_confirmations)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ergochat/readline"
+)
+
+// scriptedReader returns the scripted lines or errors in order, and io.EOF when the script is over
+type scriptedReader struct {
+	script []any // string or error
+	menus  int   // number of times the main menu prompt was read
+	prompt string
+}
+
+func (r *scriptedReader) SetPrompt(s string) {
+	r.prompt = s
+}
+func (r *scriptedReader) ReadLine() (string, error) {
+	if r.prompt == "\033[32m>\033[0m " {
+		r.menus++
+	}
+	return r.next()
+}
+func (r *scriptedReader) ReadLineWithConfig(*readline.Config) (string, error) {
+	return r.next()
+}
+func (r *scriptedReader) next() (string, error) {
+	if len(r.script) == 0 {
+		return "", io.EOF
+	}
+	v := r.script[0]
+	r.script = r.script[1:]
+	if err, ok := v.(error); ok {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func TestInitialPromptEOF(t *testing.T) {
+	r := &scriptedReader{
+		script: []any{
+			errors.New("transient error"),
+			"open",
+			"mywallet",
+			io.EOF, // password prompt closed
+			"create mywallet",
+			readline.ErrInterrupt, // password prompt interrupted
+		},
+	}
+
+	w := runInitialPrompt(r, &readline.Config{})
+	if w != nil {
+		t.Fatal("no wallet should be opened")
+	}
+	if len(r.script) != 0 {
+		t.Fatalf("script was not consumed: %v", r.script)
+	}
+	// the menu is read twice because of the transient error, then once after each closed password prompt
+	if r.menus != 4 {
+		t.Fatalf("main menu was read %d times, expected 4", r.menus)
+	}
+}
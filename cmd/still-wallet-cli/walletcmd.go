@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
+	"slices"
 	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
 	"still-blockchain/config"
+	"still-blockchain/transaction"
 	"still-blockchain/util"
 	"still-blockchain/wallet"
 	"strconv"
@@ -56,7 +60,65 @@ func (c Commands) Do(line []rune, pos int) (newLine [][]rune, length int) {
 	return sols, pos
 }
 
-func prompts(w *wallet.Wallet) {
+// warnNotSynced warns the user when the node doesn't have enough peers agreeing on its view of the chain
+func warnNotSynced(w *wallet.Wallet) {
+	synced, err := w.IsNodeSynced()
+	if err != nil {
+		Log.Debug("could not check if node is synced:", err)
+		return
+	}
+	if !synced {
+		Log.Warn("node is not synced, balance and confirmations may be outdated")
+	}
+}
+
+// warnNonceReconciled warns the user when a refresh found that transactions of the wallet have been rolled back
+// or dropped by the node, so that they can be sent again
+func warnNonceReconciled(w *wallet.Wallet) {
+	r := w.TakeNonceReconciliation()
+	if r == nil {
+		return
+	}
+	if r.LastNonce < r.PrevNonce {
+		Log.Warnf("last nonce went back from %d to %d, probably because of a reorg: the rolled back transactions "+
+			"may need to be sent again", r.PrevNonce, r.LastNonce)
+	}
+	if len(r.Dropped) > 0 {
+		Log.Warnf("submitted transactions with nonces %v are not known by the node anymore, and have been "+
+			"forgotten", r.Dropped)
+	}
+}
+
+func prompts(w *wallet.Wallet, safeConfirmations int) {
+	var l *readline.Instance
+
+	// unlock asks the password if the wallet has been locked, and returns false if it's still locked
+	unlock := func() bool {
+		if w.IsWatchOnly() {
+			Log.Err(wallet.ErrWatchOnly)
+			return false
+		}
+		if !w.IsLocked() {
+			return true
+		}
+		Log.Info("Wallet is locked")
+		cfg := l.GeneratePasswordConfig()
+		cfg.MaskRune = '*'
+		fmt.Print("Wallet password: ")
+		pass, err := l.ReadLineWithConfig(cfg)
+		if err != nil {
+			Log.Err(err)
+			return false
+		}
+		err = w.Unlock([]byte(pass))
+		if err != nil {
+			Log.Err(err)
+			return false
+		}
+		Log.Info("Wallet unlocked")
+		return true
+	}
+
 	commands = append(commands, []Cmd{{
 		Names: []string{"status", "info", "balance", "addr", "address"},
 		Args:  "",
@@ -65,7 +127,10 @@ func prompts(w *wallet.Wallet) {
 			if err != nil {
 				Log.Warn("refresh failed:", err)
 			}
+			warnNotSynced(w)
+			warnNonceReconciled(w)
 			Log.Infof("Wallet %s", w.GetAddress())
+			Log.Infof("Public key: %x", w.GetPublicKey())
 			Log.Infof("Balance: %s", util.FormatCoin(w.GetBalance()))
 			Log.Infof("Last nonce: %d", w.GetLastNonce())
 		},
@@ -86,7 +151,7 @@ func prompts(w *wallet.Wallet) {
 		},
 	}, {
 		Names: []string{"transfer"},
-		Args:  "<destination> <amount>",
+		Args:  "<destination or label> <amount>",
 		Action: func(args []string) {
 			fmt.Println("args:", args)
 			const USAGE = "Usage: transfer <destination> <amount>"
@@ -95,34 +160,116 @@ func prompts(w *wallet.Wallet) {
 				return
 			}
 
-			dst, err := address.FromString(args[0])
+			dst, amt, ok := parseTransfer(w, args)
+			if !ok {
+				return
+			}
+
+			if !unlock() {
+				return
+			}
+			warnNotSynced(w)
+			warnNonceReconciled(w)
+
+			Log.Info("transferring", util.FormatCoin(amt), "to", dst)
+
+			txn, err := w.Transfer(amt, dst)
 			if err != nil {
-				Log.Err("invalid destination:", err)
+				Log.Err(err)
 				return
 			}
 
-			xbal, err := strconv.ParseFloat(args[1], 64)
+			Log.Infof("transaction has been generated, fee: %s", util.FormatCoin(txn.Fee))
+
+			submitRes, err := w.SubmitTx(txn)
 			if err != nil {
-				Log.Err("invalid amount:", err)
+				Log.Err(err)
 				return
 			}
 
-			var amt = uint64(xbal * config.COIN)
+			Log.Infof("transaction has been submit, txid: %s", submitRes.TXID.String())
+		},
+	}, {
+		Names: []string{"create_unsigned"},
+		Args:  "<destination or label> <amount>",
+		Action: func(args []string) {
+			const USAGE = "Usage: create_unsigned <destination> <amount>"
+			if len(args) < 2 {
+				Log.Err(USAGE)
+				return
+			}
 
-			if amt < 1 || amt > w.GetBalance() {
-				Log.Errf("transaction spends too much money, wallet balance is: %s", util.FormatCoin(w.GetBalance()))
+			dst, amt, ok := parseTransfer(w, args)
+			if !ok {
 				return
 			}
+			warnNotSynced(w)
+			warnNonceReconciled(w)
 
-			Log.Info("transferring", util.FormatCoin(amt), "to", dst)
+			txn, err := w.CreateUnsigned(amt, dst)
+			if err != nil {
+				Log.Err(err)
+				return
+			}
 
-			txn, err := w.Transfer(amt, dst)
+			Log.Infof("unsigned transaction of %s to %s, fee: %s, nonce: %d", util.FormatCoin(txn.Amount), dst,
+				util.FormatCoin(txn.Fee), txn.Nonce)
+			Log.Info("sign it with sign_offline on the machine holding the wallet keys:")
+			Log.Info(hex.EncodeToString(txn.SerializeUnsigned()))
+		},
+	}, {
+		Names: []string{"sign_offline"},
+		Args:  "<unsigned transaction hex>",
+		Action: func(args []string) {
+			const USAGE = "Usage: sign_offline <unsigned transaction hex>"
+			if len(args) < 1 {
+				Log.Err(USAGE)
+				return
+			}
+
+			unsigned, err := hex.DecodeString(args[0])
+			if err != nil {
+				Log.Err("invalid unsigned transaction:", err)
+				return
+			}
+
+			if !unlock() {
+				return
+			}
+
+			txn, err := w.SignOffline(unsigned)
 			if err != nil {
 				Log.Err(err)
 				return
 			}
 
-			Log.Infof("transaction has been generated, fee: %s", util.FormatCoin(txn.Fee))
+			Log.Infof("signed transaction of %s to %s, fee: %s, nonce: %d, txid: %s", util.FormatCoin(txn.Amount),
+				address.Integrated{Addr: txn.Recipient, Subaddr: txn.Subaddr}, util.FormatCoin(txn.Fee), txn.Nonce,
+				util.Hash(txn.Hash()))
+			Log.Info("submit it with submit_signed on a wallet connected to the node:")
+			Log.Info(hex.EncodeToString(txn.Serialize()))
+		},
+	}, {
+		Names: []string{"submit_signed"},
+		Args:  "<signed transaction hex>",
+		Action: func(args []string) {
+			const USAGE = "Usage: submit_signed <signed transaction hex>"
+			if len(args) < 1 {
+				Log.Err(USAGE)
+				return
+			}
+
+			data, err := hex.DecodeString(args[0])
+			if err != nil {
+				Log.Err("invalid signed transaction:", err)
+				return
+			}
+			txn := &transaction.Transaction{}
+			err = txn.Deserialize(data)
+			if err != nil {
+				Log.Err("invalid signed transaction:", err)
+				return
+			}
 
 			submitRes, err := w.SubmitTx(txn)
 			if err != nil {
@@ -132,6 +279,196 @@ func prompts(w *wallet.Wallet) {
 
 			Log.Infof("transaction has been submit, txid: %s", submitRes.TXID.String())
 		},
+	}, {
+		Names: []string{"sign", "sign_message"},
+		Args:  "<message>",
+		Action: func(args []string) {
+			if len(args) < 1 {
+				Log.Err("Usage: sign <message>")
+				return
+			}
+			msg := strings.Join(args, " ")
+			if !unlock() {
+				return
+			}
+
+			sig, err := w.SignMessage([]byte(msg))
+			if err != nil {
+				Log.Err(err)
+				return
+			}
+			pub := w.GetPublicKey()
+
+			// the signature includes the public key, which is needed to verify it
+			Log.Infof("Signature: %x%x", pub, sig)
+		},
+	}, {
+		Names: []string{"verify", "verify_message"},
+		Args:  "<address> <signature> <message>",
+		Action: func(args []string) {
+			const USAGE = "Usage: verify <address> <signature> <message>"
+			if len(args) < 3 {
+				Log.Err(USAGE)
+				return
+			}
+
+			addr, err := address.FromString(args[0])
+			if err != nil {
+				Log.Err("invalid address:", err)
+				return
+			}
+			sigBin, err := hex.DecodeString(args[1])
+			if err != nil || len(sigBin) != bitcrypto.PUBKEY_SIZE+bitcrypto.SIGNATURE_SIZE {
+				Log.Err("invalid signature")
+				return
+			}
+			pub := bitcrypto.Pubkey(sigBin[:bitcrypto.PUBKEY_SIZE])
+			sig := bitcrypto.Signature(sigBin[bitcrypto.PUBKEY_SIZE:])
+			msg := strings.Join(args[2:], " ")
+
+			if address.VerifyMessage(addr.Addr, []byte(msg), pub, sig) {
+				Log.Info("Signature is VALID")
+			} else {
+				Log.Err("Signature is NOT valid")
+			}
+		},
+	}, {
+		Names: []string{"lock"},
+		Args:  "",
+		Action: func(args []string) {
+			w.Lock()
+			Log.Info("Wallet locked, the password is required for the next transfer")
+		},
+	}, {
+		Names: []string{"unlock"},
+		Args:  "",
+		Action: func(args []string) {
+			if !w.IsLocked() {
+				Log.Info("Wallet is not locked")
+				return
+			}
+			unlock()
+		},
+	}, {
+		Names: []string{"confirmations", "confs"},
+		Args:  "<txid>",
+		Action: func(args []string) {
+			if len(args) < 1 {
+				Log.Err("Usage: confirmations <txid>")
+				return
+			}
+			var txid util.Hash
+			err := txid.UnmarshalText([]byte(args[0]))
+			if err != nil {
+				Log.Err("invalid txid:", err)
+				return
+			}
+
+			confs, err := w.GetConfirmations(txid)
+			if err != nil {
+				Log.Err(err)
+				return
+			}
+			if confs == 0 {
+				Log.Warn("Transaction is in mempool, it has not been confirmed yet")
+				return
+			}
+			Log.Infof("Transaction has %d confirmations", confs)
+			if confs < safeConfirmations {
+				Log.Warnf("Transaction has less than %d confirmations, it could still be reverted by a reorg",
+					safeConfirmations)
+			}
+		},
+	}, {
+		Names: []string{"label", "subaddress"},
+		Args:  "[index] [label]",
+		Action: func(args []string) {
+			if len(args) == 0 || args[0] == "" {
+				labels := w.GetSubaddressLabels()
+				indexes := make([]uint64, 0, len(labels))
+				for index := range labels {
+					indexes = append(indexes, index)
+				}
+				slices.Sort(indexes)
+				Log.Infof("Labeled subaddresses (%d)", len(labels))
+				for _, index := range indexes {
+					Log.Infof(" - %d %s %s", index, w.GetSubaddress(index), labels[index])
+				}
+				return
+			}
+
+			index, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				Log.Err("invalid subaddress index:", err)
+				return
+			}
+			if len(args) == 1 {
+				Log.Infof("Subaddress %d: %s", index, w.GetSubaddress(index))
+				if label := w.GetSubaddressLabel(index); label != "" {
+					Log.Infof("Label: %s", label)
+				}
+				return
+			}
+
+			if !unlock() {
+				return
+			}
+			err = w.SetSubaddressLabel(index, strings.Join(args[1:], " "))
+			if err != nil {
+				Log.Err(err)
+				return
+			}
+			Log.Infof("Label of subaddress %d saved", index)
+		},
+	}, {
+		Names: []string{"address_book", "contacts"},
+		Args:  "[add <label> <address> | delete <label>]",
+		Action: func(args []string) {
+			const USAGE = "Usage: address_book [add <label> <address> | delete <label>]"
+			if len(args) == 0 || args[0] == "" {
+				book := w.GetAddressBook()
+				labels := make([]string, 0, len(book))
+				for label := range book {
+					labels = append(labels, label)
+				}
+				slices.Sort(labels)
+				Log.Infof("Address book (%d)", len(book))
+				for _, label := range labels {
+					Log.Infof(" - %s %s", label, book[label])
+				}
+				return
+			}
+
+			switch {
+			case args[0] == "add" && len(args) == 3:
+				addr, err := address.FromString(args[2])
+				if err != nil {
+					Log.Err("invalid address:", err)
+					return
+				}
+				if !unlock() {
+					return
+				}
+				err = w.SetAddressBookEntry(args[1], addr)
+				if err != nil {
+					Log.Err(err)
+					return
+				}
+				Log.Infof("Address %s saved as %s", addr, args[1])
+			case args[0] == "delete" && len(args) == 2:
+				if !unlock() {
+					return
+				}
+				err := w.DeleteAddressBookEntry(args[1])
+				if err != nil {
+					Log.Err(err)
+					return
+				}
+				Log.Infof("Address %s deleted", args[1])
+			default:
+				Log.Err(USAGE)
+			}
+		},
 	}, {
 		Names: []string{"list", "list_transactions", "list_tx", "list_txs"},
 		Args:  "",
@@ -169,9 +506,49 @@ func prompts(w *wallet.Wallet) {
 
 			Log.Infof("page %d/%d", page+1, maxPage+1)
 		},
+	}, {
+		Names: []string{"export_statement", "statement"},
+		Args:  "<file> [min height] [max height]",
+		Action: func(args []string) {
+			if len(args) < 1 || len(args) > 3 {
+				Log.Err("Usage: export_statement <file> [min height] [max height]")
+				return
+			}
+			var heights [2]uint64
+			for i, v := range args[1:] {
+				var err error
+				heights[i], err = strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					Log.Err("invalid height:", v)
+					return
+				}
+			}
+			warnNotSynced(w)
+
+			entries, err := w.Statement(heights[0], heights[1])
+			if err != nil {
+				Log.Err("failed to get transactions:", err)
+				return
+			}
+			f, err := os.Create(args[0])
+			if err != nil {
+				Log.Err(err)
+				return
+			}
+			err = wallet.WriteStatementCSV(f, entries)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				Log.Err("failed to write statement:", err)
+				return
+			}
+			Log.Infof("Exported %d transactions to %s", len(entries), args[0])
+		},
 	}}...)
 
-	l, err := readline.NewEx(&readline.Config{
+	var err error
+	l, err = readline.NewEx(&readline.Config{
 		Prompt:          "\033[32m>\033[0m ",
 		AutoComplete:    commands,
 		InterruptPrompt: "^C",
@@ -219,3 +596,31 @@ func prompts(w *wallet.Wallet) {
 		}
 	}
 }
+
+// parseTransfer parses the destination and amount arguments of a transfer. The destination can be an address or
+// an address book label. It logs the error and returns false if they are invalid.
+func parseTransfer(w *wallet.Wallet, args []string) (address.Integrated, uint64, bool) {
+	dst, err := address.FromString(args[0])
+	if err != nil {
+		var ok bool
+		dst, ok = w.GetAddressBookEntry(args[0])
+		if !ok {
+			Log.Err("invalid destination:", err)
+			return dst, 0, false
+		}
+	}
+
+	xbal, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		Log.Err("invalid amount:", err)
+		return dst, 0, false
+	}
+
+	var amt = uint64(xbal * config.COIN)
+
+	if amt < 1 || amt > w.GetBalance() {
+		Log.Errf("transaction spends too much money, wallet balance is: %s", util.FormatCoin(w.GetBalance()))
+		return dst, 0, false
+	}
+	return dst, amt, true
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"slices"
 	"still-blockchain/rpc"
 	"still-blockchain/rpc/rpcserver"
 	"still-blockchain/rpc/walletrpc"
@@ -10,6 +11,8 @@ import (
 	"still-blockchain/util"
 	"still-blockchain/util/ratelimit"
 	"still-blockchain/wallet"
+	"strings"
+	"time"
 )
 
 type RpcServer struct {
@@ -31,6 +34,8 @@ const sInvalidJson = "Parse error"
 
 const internalReadFailed = -32001
 
+const TRANSFER_MAX_WAIT = 60 // maximum timeout of wait_for_new_transfer, in seconds
+
 func startRpcServer(w *wallet.Wallet, ip string, port uint16, auth string) {
 	rs := rpcserver.New(fmt.Sprintf("%s:%d", ip, port), rpcserver.Config{
 		Restricted:     true,
@@ -54,6 +59,51 @@ func startRpcServer(w *wallet.Wallet, ip string, port uint16, auth string) {
 		})
 	})
 
+	rs.Handle("wait_for_new_transfer", func(c *rpcserver.Context) {
+		params := walletrpc.WaitForNewTransferRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		timeout := time.Duration(min(params.Timeout, TRANSFER_MAX_WAIT)) * time.Second
+		n, err := w.WaitForTransfer(params.Seq, timeout)
+		if err != nil {
+			Log.Warn(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: "failed to refresh wallet",
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+
+		res := walletrpc.WaitForNewTransferResponse{
+			Seq: params.Seq,
+		}
+		if n != nil {
+			res = walletrpc.WaitForNewTransferResponse{
+				Found:           true,
+				Seq:             n.Seq,
+				LastIncoming:    n.LastIncoming,
+				LastNonce:       n.LastNonce,
+				MempoolIncoming: n.MempoolIncoming,
+				MempoolOutgoing: n.MempoolOutgoing,
+				Height:          n.Height,
+				Balance:         n.Balance,
+				MempoolBalance:  n.MempoolBalance,
+			}
+		}
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  res,
+			Id:      c.Body.Id,
+		})
+	})
+
 	rs.Handle("get_history", func(c *rpcserver.Context) {
 		params := walletrpc.GetHistoryRequest{}
 		err := c.GetParams(&params)
@@ -143,6 +193,22 @@ func startRpcServer(w *wallet.Wallet, ip string, port uint16, auth string) {
 			return
 		}
 
+		if params.DestinationLabel != "" {
+			var ok bool
+			params.Destination, ok = w.GetAddressBookEntry(params.DestinationLabel)
+			if !ok {
+				c.Response(rpc.ResponseOut{
+					JsonRpc: "2.0",
+					Error: &rpc.Error{
+						Code:    -1,
+						Message: "destination label not found in address book",
+					},
+					Id: c.Body.Id,
+				})
+				return
+			}
+		}
+
 		tx, err := w.Transfer(params.Amount, params.Destination)
 		if err != nil {
 			Log.Warn(err)
@@ -223,4 +289,156 @@ func startRpcServer(w *wallet.Wallet, ip string, port uint16, auth string) {
 
 	})
 
+	rs.Handle("get_subaddress", func(c *rpcserver.Context) {
+		params := walletrpc.GetSubaddressRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result: walletrpc.GetSubaddressResponse{
+				Address: w.GetSubaddress(params.Index),
+				Label:   w.GetSubaddressLabel(params.Index),
+			},
+			Id: c.Body.Id,
+		})
+	})
+
+	rs.Handle("set_subaddress_label", func(c *rpcserver.Context) {
+		params := walletrpc.SetSubaddressLabelRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		err = w.SetSubaddressLabel(params.Index, params.Label)
+		if err != nil {
+			Log.Warn(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    -1,
+					Message: "could not save label: " + err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  walletrpc.SetSubaddressLabelResponse{},
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("get_address_book", func(c *rpcserver.Context) {
+		params := walletrpc.GetAddressBookRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		entries := []walletrpc.AddressBookEntry{}
+		for label, addr := range w.GetAddressBook() {
+			entries = append(entries, walletrpc.AddressBookEntry{
+				Label:   label,
+				Address: addr,
+			})
+		}
+		slices.SortFunc(entries, func(a, b walletrpc.AddressBookEntry) int {
+			return strings.Compare(a.Label, b.Label)
+		})
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result: walletrpc.GetAddressBookResponse{
+				Entries: entries,
+			},
+			Id: c.Body.Id,
+		})
+	})
+
+	rs.Handle("set_address_book_entry", func(c *rpcserver.Context) {
+		params := walletrpc.SetAddressBookEntryRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		err = w.SetAddressBookEntry(params.Label, params.Address)
+		if err != nil {
+			Log.Warn(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    -1,
+					Message: "could not save address book entry: " + err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  walletrpc.SetAddressBookEntryResponse{},
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("delete_address_book_entry", func(c *rpcserver.Context) {
+		params := walletrpc.DeleteAddressBookEntryRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		err = w.DeleteAddressBookEntry(params.Label)
+		if err != nil {
+			Log.Warn(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    -1,
+					Message: "could not delete address book entry: " + err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result:  walletrpc.DeleteAddressBookEntryResponse{},
+			Id:      c.Body.Id,
+		})
+	})
+
+	rs.Handle("export_statement", func(c *rpcserver.Context) {
+		params := walletrpc.ExportStatementRequest{}
+		err := c.GetParams(&params)
+		if err != nil {
+			return
+		}
+
+		var buf strings.Builder
+		err = w.ExportStatement(&buf, params.MinHeight, params.MaxHeight)
+		if err != nil {
+			Log.Warn(err)
+			c.Response(rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    internalReadFailed,
+					Message: "could not export statement: " + err.Error(),
+				},
+				Id: c.Body.Id,
+			})
+			return
+		}
+		c.Response(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Result: walletrpc.ExportStatementResponse{
+				Csv: buf.String(),
+			},
+			Id: c.Body.Id,
+		})
+	})
 }
@@ -13,11 +13,18 @@ import (
 const MAX_MERGE_MINED_CHAINS = 16
 const DEFAULT_CHECKPOINT_INTERVAL = 32
 const SEEDHASH_DURATION = 4 * (60 * 60 * 24) // seed hash changes once every 4 days
+const SEED_CACHE_SIZE = 4                    // number of seedhash epochs whose seed is kept in memory
+const HEADER_PROOF_MAX_BLOCKS = 2000         // maximum number of blocks in a header proof
+const HEADER_PROOF_MAX_BLOCKS_PUBLIC = 100   // maximum number of blocks in a header proof of the restricted RPC
+
+const GENESIS_WAIT_LOG_INTERVAL = time.Minute // how often the remaining time is logged while waiting for genesis
 
 const BLOCKS_PER_DAY = 60 * 60 * 24 / TARGET_BLOCK_TIME
 
 const STRATUM_READ_TIMEOUT = 90 * time.Second
 const STRATUM_JOBS_HISTORY = MINIDAG_ANCESTORS
+const STRATUM_SHARES_PER_MINUTE = 6               // default vardiff target, can be changed with a daemon flag
+const STRATUM_VARDIFF_RETARGET = 30 * time.Second // minimum time between two vardiff adjustments
 
 var ATOMIC = math.Round(math.Log10(COIN))
 
@@ -27,7 +34,89 @@ const WALLET_PREFIX = "s" // Wallet prefix should be the same for all merge mine
 // node to send Merge Mining jobs
 const IS_MASTERCHAIN = NETWORK_ID == 0x4af15cf1542ba49a // do not change this
 
-const PARALLEL_BLOCKS_DOWNLOAD = 50
+// Network identifier of the regtest chain, built with the regtest tag. Regtest blocks don't need a valid PoW and
+// always have the minimum difficulty, so they can be generated instantly by integration tests.
+const REGTEST_NETWORK_ID uint64 = 0x6af15cf1542ba49a
+
+const IS_REGTEST = NETWORK_ID == REGTEST_NETWORK_ID // do not change this
+
+const PARALLEL_BLOCKS_DOWNLOAD = 50 // default, can be changed at runtime
+const PARALLEL_BLOCKS_DOWNLOAD_MIN = 1
+const PARALLEL_BLOCKS_DOWNLOAD_MAX = 1000
+
+// Maximum number of blocks in the download queue, including the parents of orphan blocks. It's a default, and can
+// be changed at runtime.
+const BLOCK_QUEUE_MAX = 10_000
+const BLOCK_QUEUE_MAX_MIN = PARALLEL_BLOCKS_DOWNLOAD_MAX + 1 + BLOCK_QUEUE_MIN_HASHES
+const BLOCK_QUEUE_MAX_MAX = 1_000_000
+
+// The queue always has room for this many blocks queued by hash, like the parents of orphan blocks, since the
+// blocks queued by height during sync are at most one more than the parallel downloads
+const BLOCK_QUEUE_MIN_HASHES = 100
+
+// Number of peers a new block received from the network is relayed to. It's a default, and can be changed at
+// runtime.
+const BLOCK_RELAY_FANOUT = 8
+const BLOCK_RELAY_FANOUT_MIN = 1
+const BLOCK_RELAY_FANOUT_MAX = P2P_MAX_OUTBOUND + P2P_MAX_INBOUND
+
+// Number of recently relayed block hashes that are remembered, so that each block is only relayed once
+const RELAYED_BLOCKS_CACHE = 1000
+
+// Number of recent events kept in memory by the event log, so that external indexers can catch up after a
+// disconnection
+const EVENT_LOG_SIZE = 10000
+
+// Blocks received later than this after their timestamp are considered synchronized rather than propagated,
+// and are not counted in the propagation statistics
+const PROPAGATION_MAX_DELAY = 2 * time.Minute
+const PROPAGATION_SAMPLES = 100 // number of blocks weighted by the propagation moving averages
+
+// Number of recent mainchain blocks the average and median block times reported by get_info are computed over
+const BLOCK_TIME_WINDOW = 100
+
+// Number of peers that must advertise at least a given cumulative difficulty before it's used as sync target.
+// This prevents a single peer from making the node download nonexistent blocks.
+const SYNC_QUORUM_PEERS = 2
+
+// The node is considered synced only when at least this many peers agree that the local top block is the best
+// one, so that a single peer can't make it act on a partial view of the chain
+const SYNCED_MIN_PEERS = 2
+
+// Block requests are spread across at least this many distinct peers when available, so that a single fast peer
+// can't feed the node the whole chain during sync. The sync target is cross-validated by SYNC_QUORUM_PEERS
+// before any block is queued.
+const SYNC_MIN_SOURCES = 3
+
+// A peer still agrees that the node is synced when its cumulative difficulty exceeds the local one by at most
+// this many blocks (at the top block difficulty), since a new block may still be propagating
+const SYNCED_TOLERANCE_BLOCKS = 1
+
+// The chain is reported as stalled when no block is added for this many target block times. It's a default,
+// and can be changed with a daemon flag.
+const STALL_TIMEOUT_BLOCKS = 20
+
+// Maximum number of blocks a fee estimate can target. Estimates for more blocks are capped to this value.
+const FEE_ESTIMATE_MAX_BLOCKS = 100
+
+// Number of recently read blocks kept deserialized in memory, so that sync and reorgs don't deserialize the same
+// blocks again. It's a default, and can be changed with the blockchain options.
+const BLOCK_CACHE_SIZE = 1000
+
+// Default maximum difference between the local clock and the median clock of the peers. The operator is warned
+// about a larger difference, as blocks more than FUTURE_TIME_LIMIT seconds in the future are rejected. It can be
+// changed with a daemon flag.
+const MAX_CLOCK_SKEW = 5 * time.Second
+
+const PEER_TIME_SAMPLES = 64    // number of peers whose clock offset is remembered
+const PEER_TIME_MIN_SAMPLES = 5 // minimum number of peers needed to compute the median peer time
+
+// When the median peer time is used to check block timestamps, it never corrects the local clock by more than
+// this, so that the peers can't move the node's time arbitrarily
+const MAX_PEER_TIME_ADJUSTMENT = 10 * time.Minute
+
+const BLOOM_MAX_SIZE = 36_000 // maximum size in bytes of a bloom filter sent by a light client
+const BLOOM_MAX_HASHES = 50   // maximum number of hash functions of a bloom filter
 
 var BinaryNetworkID = make([]byte, 8)
 
@@ -2,32 +2,88 @@ package config
 
 import "time"
 
+const VERSION = "0.1.0" // node software version
+
+// The networks haven't launched yet, so consensus rules are changed without an activation height: a node must be
+// resynced from genesis after upgrading across a consensus change. After the launch, every new rule must only
+// apply from its fork height. The rules added before the launch, which apply from genesis, are:
+//   - block transactions are sorted by sender, then by nonce (blockchain.checkTxOrder)
+//   - MINIDAG_ANCESTORS consecutive blocks reference at most MAX_WINDOW_SIDE_BLOCKS side blocks
+//   - block difficulties are canonically encoded, without trailing zero bytes
+//   - the OtherChains of blocks and side blocks are sorted by network ID (checked by Block.Prevalidate)
+//   - side blocks are in the MINIDAG_ANCESTORS-1 heights preceding the block referencing them
+
 const COIN = 1_000_000_000                     // 1e9
 const FEE_PER_BYTE = 500_000                   // ~0.06 coins per tx
+const DUST_THRESHOLD = COIN / 1000             // transactions sending less than this are not relayed or mined
 const BLOCK_REWARD = 184 * COIN                // initial block reward
-const REDUCTION_INTERVAL = BLOCKS_PER_DAY * 90 // block reward reduces by 10% every 90 days
+const REDUCTION_INTERVAL = BLOCKS_PER_DAY * 90 // block reward reduces by REDUCTION_PERCENT every 90 days
+const REDUCTION_PERCENT = 10
+const TAIL_EMISSION = 0 // minimum block reward, paid forever once the reductions reach it
 
 // The exact number is slightly smaller than this because of rounding errors. You can see the accurate result
-// using the reward_test.go file. Error is less than 0.00000005% so it doesn't matter much, anyway.
+// using the reward_test.go file. Error is less than 0.00000005% so it doesn't matter much, anyway. It assumes
+// REDUCTION_PERCENT is 10 and there's no tail emission: block.Schedule.Validate stops the node at startup if it
+// doesn't match the reward schedule. It must be math.MaxUint64 if there's a tail emission.
 const MAX_SUPPLY = REDUCTION_INTERVAL*BLOCK_REWARD*10 +
 	(BLOCK_REWARD * REDUCTION_INTERVAL / 2) // also include initial half-reward phase
 
-const P2P_CONNECTIONS = 1
+// A transaction can't spend more than the maximum supply, since no address can hold more. Larger amounts are
+// rejected by prevalidation, before verifying the signature.
+const MAX_TX_SPEND = MAX_SUPPLY
+
+const P2P_MAX_OUTBOUND = 8 // default number of outgoing connections the node tries to keep
+const P2P_MAX_INBOUND = 32 // default maximum number of incoming connections
 const P2P_PING_INTERVAL = 5
-const P2P_TIMEOUT = 40
+const P2P_STATS_INTERVAL = 60      // seconds between the stats sent to all the peers
+const P2P_STATS_PROOF_INTERVAL = 2 // minimum seconds between the stats of a peer whose PoW is verified
+const P2P_TIMEOUT = 40             // seconds without packets after which a peer is disconnected
+const P2P_DIAL_TIMEOUT = 10        // seconds to establish an outgoing connection
+const P2P_KEEPALIVE = 30           // seconds between the TCP keepalive probes
+const P2P_MAX_INV = 1_000          // max number of transaction hashes in an INV or TX_REQUEST packet
+const P2P_MAGIC_BAN = 60 * 60      // seconds a dialed address sending the magic of another network isn't dialed
+
+// Packets are queued and written to each peer by its own goroutine, so that a slow peer doesn't block the
+// sender. A peer whose queue exceeds either limit is disconnected.
+const P2P_SEND_QUEUE_SIZE = 256               // max packets queued for a peer
+const P2P_SEND_QUEUE_BYTES = 32 * 1024 * 1024 // max bytes queued for a peer
+
+// Packets are decrypted and authenticated as a whole, so each received packet is read in memory at once
+const P2P_MAX_PACKET_SIZE = 4 * 1024 * 1024
 
 const MAX_TX_PER_BLOCK = 1_000
 const MAX_HEIGHT = 5_000_000_000
 
 const MIN_DIFFICULTY = 1000
+
+// Target block time in seconds. The difficulty adjustment, the network hashrate, the stall detection and the
+// emission schedule (through BLOCKS_PER_DAY) are all derived from it. It's the same on every network: a network
+// with a different block time must define it in its own config file instead.
 const TARGET_BLOCK_TIME = 15
+
 const FUTURE_TIME_LIMIT = 10
 const DIFFICULTY_N = 60 * 60 / TARGET_BLOCK_TIME // DAA half-life (1 hour).
 
+const SAFE_CONFIRMATIONS = 10 // default number of confirmations after which a payment is unlikely to be reverted
+
 const MEMPOOL_EXPIRATION = 2 * time.Hour
+const MEMPOOL_MAX_NONCE_GAP = 16                 // transactions can use nonces up to this far ahead of the state
+const MEMPOOL_REBROADCAST_AGE = 10 * time.Minute // mempool transactions older than this are periodically relayed again
+const MEMPOOL_REBROADCAST_RATE = 50              // max transactions relayed per second while rebroadcasting
+
+// The minimum relay fee starts rising when the mempool is half of MEMPOOL_CONGESTION_SIZE (in vsize), and reaches
+// MEMPOOL_MAX_FEE_MULTIPLIER times FEE_PER_BYTE when the mempool is full. It only applies to mempool admission,
+// blocks are valid as long as their transactions pay FEE_PER_BYTE.
+const MEMPOOL_CONGESTION_SIZE = 20 * MAX_BLOCK_SIZE
+const MEMPOOL_MAX_FEE_MULTIPLIER = 10
 
 const MAX_TX_SIZE = 300                      // Hard cap for the maximum VSize of a transaction
 const MAX_BLOCK_SIZE = 1000 + 25*MAX_TX_SIZE // Hard cap for the maximum VSize of a block
 
 const MINIDAG_ANCESTORS = 3 // number of ancestors saved for each block
 const MAX_SIDE_BLOCKS = 2   // max number of side blocks that can be referenced by a block
+
+// max number of side blocks that can be referenced by MINIDAG_ANCESTORS consecutive blocks, so that miners can't
+// inflate the cumulative difficulty by referencing as many side blocks as possible in every block. Like the other
+// rules added before the launch, it applies from genesis.
+const MAX_WINDOW_SIDE_BLOCKS = MINIDAG_ANCESTORS
@@ -1,4 +1,4 @@
-//go:build !testnet
+//go:build !testnet && !regtest
 
 package config
 
@@ -12,6 +12,6 @@ const NETWORK_NAME = "stagenet"
 // GENESIS BLOCK INFO
 const GENESIS_ADDRESS = "so3yexhnu89af4aai83uou17dupb79c3gxng1q"
 const GENESIS_TIMESTAMP = 0
-const BLOCK_REWARD_FEE_PERCENT = 10
+const BLOCK_REWARD_FEE_PERCENT = 10 // share of the block rewards paid to the genesis address, from 0 to 100
 
 var SEED_NODES = []string{"127.0.0.1:6310"}
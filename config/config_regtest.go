@@ -0,0 +1,18 @@
+//go:build regtest
+
+package config
+
+const P2P_BIND_PORT = 26310
+const RPC_BIND_PORT = 26311
+const STRATUM_BIND_PORT = 26312
+const NETWORK_ID uint64 = REGTEST_NETWORK_ID // Network identifier. It MUST be unique for each chain
+
+const NETWORK_NAME = "regtest"
+
+// GENESIS BLOCK INFO
+const GENESIS_ADDRESS = "so3yexhnu89af4aai83uou17dupb79c3gxng1q"
+const GENESIS_TIMESTAMP = 0
+const BLOCK_REWARD_FEE_PERCENT = 10 // share of the block rewards paid to the genesis address, from 0 to 100
+
+// regtest nodes don't connect to any node by default
+var SEED_NODES = []string{}
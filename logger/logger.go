@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,28 @@ import (
 	"time"
 )
 
+// Logger is implemented by Log. It allows components to receive their own logger, for example to capture
+// logs in tests or to route the logs of multiple nodes running in the same process to different sinks.
+type Logger interface {
+	Info(a ...any)
+	Infof(format string, a ...any)
+	Warn(a ...any)
+	Warnf(format string, a ...any)
+	Err(a ...any)
+	Errf(format string, a ...any)
+	Debug(a ...any)
+	Debugf(format string, a ...any)
+	Dev(a ...any)
+	Devf(format string, a ...any)
+	Net(a ...any)
+	Netf(format string, a ...any)
+	NetDev(a ...any)
+	NetDevf(format string, a ...any)
+	Fatal(a ...any)
+}
+
+var _ Logger = (*Log)(nil)
+
 var DiscardLog = &Log{
 	logLevel: 0,
 	stdout:   io.Discard,
@@ -28,9 +51,29 @@ type Log struct {
 	logLevel uint8
 	stdout   io.Writer
 	stderr   io.Writer
+	format   Format
 	sync.RWMutex
 }
 
+// Format is the output format of a Log
+type Format uint8
+
+const (
+	FormatText Format = iota // human readable lines, with colors
+	FormatJSON               // a JSON object for each line, for log aggregation
+)
+
+// ParseFormat returns the format with the given name: text or json
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q, expected text or json", s)
+}
+
 func (l *Log) SetLogLevel(lvl uint8) {
 	l.Lock()
 	defer l.Unlock()
@@ -49,6 +92,12 @@ func (l *Log) SetStderr(stderr io.Writer) {
 
 	l.stderr = stderr
 }
+func (l *Log) SetFormat(format Format) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.format = format
+}
 
 var Reset = "\033[0m"
 var Red = "\033[31m"
@@ -61,15 +110,11 @@ var Gray = "\033[37m"
 var White = "\033[97m"
 var Bold = "\033[1m"
 
-func getLogPrefix() string {
-	_, file, line, _ := runtime.Caller(2)
+// getCaller returns the file name without extension and the line of the code which called the logger method
+func getCaller() string {
+	_, file, line, _ := runtime.Caller(3)
 	fileSpl := strings.Split(file, "/")
-	debugInfos := strings.Split(fileSpl[len(fileSpl)-1], ".")[0] + ":" + strconv.FormatInt(int64(line), 10)
-	for len(debugInfos) < 18 {
-		debugInfos = debugInfos + " "
-	}
-
-	return getTime() + debugInfos
+	return strings.Split(fileSpl[len(fileSpl)-1], ".")[0] + ":" + strconv.FormatInt(int64(line), 10)
 }
 func getTime() string {
 	t := time.Now()
@@ -77,134 +122,224 @@ func getTime() string {
 	return s + " "
 }
 
-func (l *Log) Info(a ...any) {
+// level describes how the lines of a logger method are written
+type level struct {
+	name   string // level name in JSON format
+	letter string // level letter in text format
+	color  string
+	min    uint8 // minimum log level at which the line is written
+	stderr bool
+}
+
+var (
+	levelInfo   = level{name: "info", letter: "I", min: 1}
+	levelWarn   = level{name: "warn", letter: "W", color: Yellow, min: 1}
+	levelErr    = level{name: "error", letter: "E", color: Red, min: 1}
+	levelErrf   = level{name: "error", letter: "E", color: Red, min: 1, stderr: true}
+	levelDebug  = level{name: "debug", letter: "D", color: Cyan, min: 2}
+	levelDev    = level{name: "dev", letter: "d", color: Cyan, min: 3}
+	levelNet    = level{name: "net", letter: "N", color: Green, min: 3}
+	levelNetDev = level{name: "netdev", letter: "n", color: Green, min: 4}
+	levelFatal  = level{name: "fatal", letter: "F", color: Red, min: 1, stderr: true}
+)
+
+// output writes a line with the given message, which ends with a newline, and key-value pairs. It returns false
+// if the line is below the log level. It MUST be called directly by the logger methods, so that the caller of
+// the method is reported.
+func (l *Log) output(lvl level, msg string, fields []any) bool {
 	l.Lock()
 	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
+	if l.logLevel < lvl.min {
+		return false
+	}
+	w := l.stdout
+	if lvl.stderr {
+		w = l.stderr
+	}
+
+	if l.format == FormatJSON {
+		w.Write(formatJSON(lvl, getCaller(), strings.TrimSuffix(msg, "\n"), fields))
+		return true
 	}
-	l.stdout.Write([]byte(getLogPrefix() + "I " + fmt.Sprintln(a...) + Reset))
+
+	debugInfos := getCaller()
+	for len(debugInfos) < 18 {
+		debugInfos = debugInfos + " "
+	}
+	if len(fields) > 0 {
+		msg = strings.TrimSuffix(msg, "\n")
+		for i := 0; i < len(fields); i += 2 {
+			msg += fmt.Sprintf(" %v=%v", fields[i], fieldValue(fields, i+1))
+		}
+		msg += "\n"
+	}
+	w.Write([]byte(getTime() + debugInfos + lvl.color + lvl.letter + " " + msg + Reset))
+	return true
 }
-func (l *Log) Infof(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
+
+func fieldValue(fields []any, i int) any {
+	if i >= len(fields) {
+		return "MISSING"
 	}
-	l.stdout.Write([]byte(getLogPrefix() + fmt.Sprintf("I "+format+"\n", a...) + Reset))
+	return fields[i]
 }
 
-func (l *Log) Warn(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
+// formatJSON returns a JSON object with the level, the time, the caller, the message and the fields of a line,
+// followed by a newline
+func formatJSON(lvl level, caller, msg string, fields []any) []byte {
+	b := []byte(`{"level":`)
+	b = appendJSON(b, lvl.name)
+	b = append(b, `,"time":`...)
+	b = appendJSON(b, time.Now().Format("2006-01-02T15:04:05.000Z07:00"))
+	b = append(b, `,"caller":`...)
+	b = appendJSON(b, caller)
+	b = append(b, `,"msg":`...)
+	b = appendJSON(b, msg)
+	if len(fields) > 0 {
+		b = append(b, `,"fields":{`...)
+		for i := 0; i < len(fields); i += 2 {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSON(b, fmt.Sprint(fields[i]))
+			b = append(b, ':')
+			b = appendJSON(b, fieldValue(fields, i+1))
+		}
+		b = append(b, '}')
 	}
-	l.stdout.Write([]byte(getLogPrefix() + Yellow + "W " + fmt.Sprintln(a...) + Reset))
+	return append(b, "}\n"...)
 }
-func (l *Log) Warnf(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
+
+// appendJSON appends the JSON encoding of v. Errors and values that implement fmt.Stringer are encoded as
+// strings, and values that can't be encoded are formatted with fmt.
+func appendJSON(b []byte, v any) []byte {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
 	}
-	l.stdout.Write([]byte(getLogPrefix() + Yellow + fmt.Sprintf("W "+format+"\n", a...) + Reset))
+	return append(b, data...)
+}
+
+func (l *Log) Info(a ...any) {
+	l.output(levelInfo, fmt.Sprintln(a...), nil)
+}
+func (l *Log) Infof(format string, a ...any) {
+	l.output(levelInfo, fmt.Sprintf(format+"\n", a...), nil)
+}
+
+func (l *Log) Warn(a ...any) {
+	l.output(levelWarn, fmt.Sprintln(a...), nil)
+}
+func (l *Log) Warnf(format string, a ...any) {
+	l.output(levelWarn, fmt.Sprintf(format+"\n", a...), nil)
 }
 
 func (l *Log) Err(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Red + "E " + fmt.Sprintln(a...) + Reset))
+	l.output(levelErr, fmt.Sprintln(a...), nil)
 }
 
 func (l *Log) Errf(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
-	}
-	l.stderr.Write([]byte(getLogPrefix() + Red + fmt.Sprintf("E "+format+"\n", a...) + Reset))
+	l.output(levelErrf, fmt.Sprintf(format+"\n", a...), nil)
 }
 
 func (l *Log) Debug(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 2 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Cyan + "D " + fmt.Sprintln(a...) + Reset))
+	l.output(levelDebug, fmt.Sprintln(a...), nil)
 }
 func (l *Log) Debugf(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 2 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Cyan + fmt.Sprintf("D "+format+"\n", a...) + Reset))
+	l.output(levelDebug, fmt.Sprintf(format+"\n", a...), nil)
 }
 
 func (l *Log) Dev(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 3 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Cyan + "d " + fmt.Sprintln(a...) + Reset))
+	l.output(levelDev, fmt.Sprintln(a...), nil)
 }
 
 func (l *Log) Devf(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 3 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Cyan + fmt.Sprintf("d "+format+"\n", a...) + Reset))
+	l.output(levelDev, fmt.Sprintf(format+"\n", a...), nil)
 }
 
 func (l *Log) Net(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 3 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Green + "N " + fmt.Sprintln(a...) + Reset))
+	l.output(levelNet, fmt.Sprintln(a...), nil)
 }
 func (l *Log) Netf(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 3 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Green + fmt.Sprintf("N "+format+"\n", a...) + Reset))
+	l.output(levelNet, fmt.Sprintf(format+"\n", a...), nil)
 }
 
 func (l *Log) NetDev(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 4 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Green + "n " + fmt.Sprintln(a...) + Reset))
+	l.output(levelNetDev, fmt.Sprintln(a...), nil)
 }
 
 func (l *Log) NetDevf(format string, a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 4 {
-		return
-	}
-	l.stdout.Write([]byte(getLogPrefix() + Green + fmt.Sprintf("n "+format+"\n", a...) + Reset))
+	l.output(levelNetDev, fmt.Sprintf(format+"\n", a...), nil)
 }
 
 func (l *Log) Fatal(a ...any) {
-	l.Lock()
-	defer l.Unlock()
-	if l.logLevel < 1 {
-		return
+	if l.output(levelFatal, fmt.Sprintln(a...), nil) {
+		panic(fmt.Sprintln(a...))
+	}
+}
+
+// With returns a logger which adds the given key-value pairs to each line: as structured fields in JSON format,
+// and as key=value pairs at the end of the line in text format. The returned logger writes to l.
+func (l *Log) With(kv ...any) Logger {
+	return &fieldLog{l: l, fields: kv}
+}
+
+// fieldLog is a Log that adds key-value pairs to each line, see Log.With
+type fieldLog struct {
+	l      *Log
+	fields []any
+}
+
+func (f *fieldLog) Info(a ...any) {
+	f.l.output(levelInfo, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) Infof(format string, a ...any) {
+	f.l.output(levelInfo, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) Warn(a ...any) {
+	f.l.output(levelWarn, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) Warnf(format string, a ...any) {
+	f.l.output(levelWarn, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) Err(a ...any) {
+	f.l.output(levelErr, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) Errf(format string, a ...any) {
+	f.l.output(levelErrf, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) Debug(a ...any) {
+	f.l.output(levelDebug, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) Debugf(format string, a ...any) {
+	f.l.output(levelDebug, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) Dev(a ...any) {
+	f.l.output(levelDev, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) Devf(format string, a ...any) {
+	f.l.output(levelDev, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) Net(a ...any) {
+	f.l.output(levelNet, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) Netf(format string, a ...any) {
+	f.l.output(levelNet, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) NetDev(a ...any) {
+	f.l.output(levelNetDev, fmt.Sprintln(a...), f.fields)
+}
+func (f *fieldLog) NetDevf(format string, a ...any) {
+	f.l.output(levelNetDev, fmt.Sprintf(format+"\n", a...), f.fields)
+}
+func (f *fieldLog) Fatal(a ...any) {
+	if f.l.output(levelFatal, fmt.Sprintln(a...), f.fields) {
+		panic(fmt.Sprintln(a...))
 	}
-	l.stderr.Write([]byte(getLogPrefix() + Red + "F " + fmt.Sprintln(a...) + Reset))
-	panic(fmt.Sprintln(a...))
 }
@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONFormat(t *testing.T) {
+	var out bytes.Buffer
+	l := New()
+	l.SetStdout(&out)
+	l.SetLogLevel(1)
+	l.SetFormat(FormatJSON)
+
+	l.Infof("Added block %d", 42)
+	l.With("peer", "10.0.0.1", "height", 43, "err", errors.New("invalid block")).Warn("dropping peer:", "bad")
+	l.Debug("not written at log level 1")
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines written, expected 2: %q", len(lines), out.String())
+	}
+
+	type line struct {
+		Level  string         `json:"level"`
+		Time   string         `json:"time"`
+		Caller string         `json:"caller"`
+		Msg    string         `json:"msg"`
+		Fields map[string]any `json:"fields"`
+	}
+	var info, warn line
+	if err := json.Unmarshal([]byte(lines[0]), &info); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &warn); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Level != "info" || info.Msg != "Added block 42" || info.Fields != nil {
+		t.Errorf("unexpected info line %+v", info)
+	}
+	if !strings.HasPrefix(info.Caller, "logger_test:") {
+		t.Errorf("caller is %q, expected the test file", info.Caller)
+	}
+	if ts, err := time.Parse(time.RFC3339, info.Time); err != nil || time.Since(ts) > time.Minute {
+		t.Errorf("invalid timestamp %q: %v", info.Time, err)
+	}
+
+	expected := map[string]any{"peer": "10.0.0.1", "height": float64(43), "err": "invalid block"}
+	if warn.Level != "warn" || warn.Msg != "dropping peer: bad" || len(warn.Fields) != len(expected) {
+		t.Fatalf("unexpected warn line %+v", warn)
+	}
+	for k, v := range expected {
+		if warn.Fields[k] != v {
+			t.Errorf("field %s is %v, expected %v", k, warn.Fields[k], v)
+		}
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var out bytes.Buffer
+	l := New()
+	l.SetStdout(&out)
+	l.SetLogLevel(1)
+
+	l.Warnf("peer %s", "10.0.0.1")
+	l.With("height", 43).Info("block added")
+
+	lines := strings.Split(out.String(), Reset)
+	if !strings.HasSuffix(lines[0], Yellow+"W peer 10.0.0.1\n") || !strings.Contains(lines[0], "logger_test:") {
+		t.Errorf("unexpected text line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "I block added height=43\n") {
+		t.Errorf("unexpected text line with fields %q", lines[1])
+	}
+}
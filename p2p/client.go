@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"net"
+	"time"
 )
 
 // P2P must NOT be locked before calling this
@@ -16,10 +17,31 @@ func (p2 *P2P) startClient(addr string) {
 }
 
 func (p2 *P2P) connectClient(addr string) (*Connection, error) {
-	conn, err := net.Dial("tcp", addr)
+	d := net.Dialer{
+		Timeout:   p2.Timeouts.Dial,
+		KeepAlive: p2.Timeouts.KeepAlive,
+	}
+	conn, err := d.Dial("tcp", addr)
 	if err != nil {
 		Log.Net(err)
 		return &Connection{}, err
 	}
 	return NewConnection(conn, true), nil
 }
+
+// setKeepAlive enables the TCP keepalive probes of an incoming connection with the given interval, or disables
+// them if it's negative
+func setKeepAlive(c net.Conn, interval time.Duration) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if interval < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	if interval > 0 {
+		tc.SetKeepAlivePeriod(interval)
+	}
+}
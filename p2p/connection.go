@@ -1,22 +1,35 @@
 package p2p
 
 import (
+	"errors"
 	"net"
 	"still-blockchain/binary"
 	"still-blockchain/bitcrypto"
+	"still-blockchain/config"
 	"still-blockchain/util"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrSendQueueFull is returned when a packet is sent to a peer which doesn't read the packets queued for it.
+// The peer is disconnected.
+var ErrSendQueueFull = errors.New("send queue is full")
+
 func NewConnection(c net.Conn, outgoing bool) *Connection {
-	return &Connection{
+	conn := &Connection{
 		data: &ConnData{
-			Conn:     c,
-			Outgoing: outgoing,
-			LastPing: time.Now().Unix(),
+			Conn:      c,
+			Outgoing:  outgoing,
+			LastPing:  time.Now().Unix(),
+			sendQueue: make(chan []byte, config.P2P_SEND_QUEUE_SIZE),
+			closed:    make(chan struct{}),
 		},
 		peerData: &PeerData{},
 	}
+	go conn.data.writer()
+	return conn
 }
 
 // a concurrency-safe wrapper for ConnData
@@ -54,21 +67,63 @@ type ConnData struct {
 	LastOutPacket int64            // when the last packet has been sent to the peer
 	Cipher        bitcrypto.Cipher
 
-	Conn     net.Conn
-	writeMut util.Mutex
+	Conn net.Conn
+
+	// encrypted packets waiting to be written by the writer goroutine, and their total size
+	sendQueue   chan []byte
+	queuedBytes atomic.Int64
+
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // returns the connection IP address (without port)
 func (c *ConnData) IP() string {
 	return c.Conn.RemoteAddr().(*net.TCPAddr).IP.String()
 }
+
+// IPPort returns the remote address of the connection, built with net.JoinHostPort like the addresses dialed
+// by connectToRandomPeer, so that IPv6 addresses have the same form. It's the key of the connection in
+// P2P.Connections.
+func (c *ConnData) IPPort() string {
+	addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return c.Conn.RemoteAddr().String()
+	}
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
 func (c *ConnData) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
 	c.Conn.Close()
 }
 
-func (c *ConnData) sendPacket(p pack) error {
-	c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+// writer writes the queued packets to the connection until it's closed. A peer which doesn't read them within
+// the write deadline is disconnected.
+func (c *ConnData) writer() {
+	for {
+		select {
+		case data := <-c.sendQueue:
+			c.queuedBytes.Add(-int64(len(data)))
+
+			c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, err := c.Conn.Write(data)
+			if err != nil {
+				Log.Warn(err)
+				c.Close()
+				return
+			}
+			Log.Debugf("packet sent (%0.3f KB)", float64(len(data))/1000)
+		case <-c.closed:
+			return
+		}
+	}
+}
 
+// sendPacket encrypts the packet and queues it for the writer goroutine, without waiting for it to be written.
+// If the queue is full, the peer is disconnected.
+func (c *ConnData) sendPacket(p pack) error {
 	Log.Debug("sendPacket:", p.String())
 
 	c.LastOutPacket = time.Now().Unix()
@@ -87,21 +142,30 @@ func (c *ConnData) sendPacket(p pack) error {
 	ser = binary.Ser{}
 	ser.AddUint32(uint32(len(data)))
 	ser.AddFixedByteArray(data)
+	data = ser.Output()
 
-	func() {
-		c.writeMut.Lock()
-		defer c.writeMut.Unlock()
-		_, err = c.Conn.Write(ser.Output())
-		if err != nil {
-			Log.Warn(err)
-		}
-	}()
-	if err != nil {
-		return err
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	if c.queuedBytes.Add(int64(len(data))) > config.P2P_SEND_QUEUE_BYTES {
+		c.queuedBytes.Add(-int64(len(data)))
+		return c.sendQueueFull()
 	}
-	Log.Debugf("packet sent (%0.3f KB)", float64(len(ser.Output()))/1000)
+	select {
+	case c.sendQueue <- data:
+		return nil
+	default:
+		c.queuedBytes.Add(-int64(len(data)))
+		return c.sendQueueFull()
+	}
+}
 
-	return nil
+func (c *ConnData) sendQueueFull() error {
+	Log.Warnf("peer %s is not reading the packets sent to it, disconnecting it", c.Conn.RemoteAddr())
+	c.Close()
+	return ErrSendQueueFull
 }
 func (c *ConnData) SendPacket(p *Packet) error {
 	Log.Devf("Sending packet of type %s to peer %x", p.Type.String(), c.PeerId)
@@ -21,7 +21,7 @@ import (
 	"github.com/zeebo/blake3"
 )
 
-var Log = logger.DiscardLog
+var Log logger.Logger = logger.DiscardLog
 
 const P2P_PING_INTERVAL = 15 // seconds
 const P2P_TIMEOUT = 40       // seconds
@@ -34,19 +34,68 @@ type P2P struct {
 	PacketsIn      chan Packet
 	NewConnections chan *Connection
 	KnownPeers     []KnownPeer
+	DataDir        string // directory where the peer list is saved
+	MaxInbound     int    // incoming connections beyond this are refused
+	MaxOutbound    int    // number of outgoing connections the node tries to keep
+	Timeouts       Timeouts
+	Magic          [8]byte // starts the handshake, connections with a different magic are dropped
 
 	listener net.Listener
 
+	// addresses which turned out to be this node when dialed, they are never dialed again
+	selfAddrs map[string]bool
+	// addresses which sent the magic of another network when dialed, with the UNIX time until which they aren't
+	// dialed again
+	otherNetwork map[string]int64
+
 	util.RWMutex
 }
 
+// PeerId returns the ID of this node, sent in the handshake of every connection. It's the public key of a key
+// pair generated when P2P is started, so it's random and different for each node: a connection from a peer with
+// the same ID is a connection to self.
 func (p *P2P) PeerId() [32]byte {
 	return [32]byte(p.Privkey.Public().(*ecdh.PublicKey).Bytes())
 }
 
+// NetworkMagic returns the magic sent at the start of the handshake, derived from the network name and ID. Nodes
+// of different networks have different magics, so they disconnect before exchanging anything else.
+//
+// Protocol note: the magic is sent before the peer ID since version 0.1.0, and nodes released before it are
+// incompatible. They read the magic as the start of the peer ID and fail the handshake, and they are disconnected
+// for sending a wrong magic, so all the nodes of a network must be upgraded together.
+func NetworkMagic() [8]byte {
+	sum := blake3.Sum256(append([]byte(config.NETWORK_NAME), config.BinaryNetworkID...))
+	return [8]byte(sum[:8])
+}
+
+// Timeouts of the P2P connections. They must not be changed after the connections are started.
+type Timeouts struct {
+	Dial      time.Duration // outgoing connections not established within this are abandoned
+	Read      time.Duration // peers which don't send any packet within this are disconnected
+	KeepAlive time.Duration // interval between the TCP keepalive probes, negative to disable them
+}
+
+// DefaultTimeouts returns the timeouts used by Start
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Dial:      config.P2P_DIAL_TIMEOUT * time.Second,
+		Read:      config.P2P_TIMEOUT * time.Second,
+		KeepAlive: config.P2P_KEEPALIVE * time.Second,
+	}
+}
+
 type PeerData struct {
 	Stats      packet.PacketStats
 	LastHeight uint64 // last block height requested to this peer
+
+	// false if the parent of the top block of the stats was unknown, so only their height is trusted
+	StatsVerified bool
+
+	// blocks requested to this peer, with the UNIX time of the request
+	Requests map[packet.PacketBlockRequest]int64
+
+	LastStatsProof int64 // UNIX milliseconds of the last stats whose top block PoW was verified
 }
 
 type KnownPeer struct {
@@ -67,6 +116,8 @@ type Packet struct { // exported
 	Type packet.Type // Packet type, starting from 0
 	Data []byte      // Packet data
 	Conn *Connection
+
+	Received time.Time // when the packet was read, before it waited in PacketsIn
 }
 
 type pack struct { // only used inside p2p
@@ -102,6 +153,12 @@ func Start(peers []string) *P2P {
 		PacketsIn:      make(chan Packet),
 		NewConnections: make(chan *Connection),
 		Connections:    make(map[string]*Connection),
+		selfAddrs:      make(map[string]bool),
+		otherNetwork:   make(map[string]int64),
+		MaxInbound:     config.P2P_MAX_INBOUND,
+		MaxOutbound:    config.P2P_MAX_OUTBOUND,
+		Timeouts:       DefaultTimeouts(),
+		Magic:          NetworkMagic(),
 	}
 	for _, v := range peers {
 		splv := strings.Split(v, ":")
@@ -130,7 +187,10 @@ func Start(peers []string) *P2P {
 }
 
 func (p *P2P) Close() {
-	p.listener.Close()
+	// the listener is nil if ListenServer hasn't been called
+	if p.listener != nil {
+		p.listener.Close()
+	}
 	for _, v := range p.Connections {
 		v.View(func(c *ConnData) error {
 			c.Close()
@@ -148,11 +208,19 @@ func (p *P2P) ListenServer(port uint16) {
 		Log.Fatal(err)
 		os.Exit(1)
 	}
+
+	Log.Infof("P2P server listening: %s:%d", "0.0.0.0", port)
+
+	p.serve(listen)
+}
+
+// serve accepts incoming connections until the listener is closed
+func (p *P2P) serve(listen net.Listener) {
 	defer listen.Close()
 
+	p.Lock()
 	p.listener = listen
-
-	Log.Infof("P2P server listening: %s:%d", "0.0.0.0", port)
+	p.Unlock()
 
 	for {
 		c, err := listen.Accept()
@@ -160,26 +228,59 @@ func (p *P2P) ListenServer(port uint16) {
 			Log.Debug("listener closed:", err)
 			return
 		}
+		setKeepAlive(c, p.Timeouts.KeepAlive)
 		conn := NewConnection(c, false)
 
 		// prevent banned peers from connecting
+		banned := false
+		p.RLock()
 		for _, v := range p.KnownPeers {
 			if v.IP == conn.data.IP() && v.IsBanned() {
-				Log.Debugf("peer %s is banned", c.RemoteAddr().String())
-				return
+				banned = true
+				break
 			}
 		}
+		p.RUnlock()
+		if banned {
+			Log.Debugf("peer %s is banned", c.RemoteAddr().String())
+			conn.data.Close()
+			continue
+		}
 
 		Log.Infof("New connection with IP %s", c.RemoteAddr().String())
-		p.handleConnection(conn)
+		go p.handleConnection(conn)
 	}
 }
+
+// ConnectionCounts returns the number of incoming and outgoing connections.
+// P2P must NOT be locked before calling this
+func (p *P2P) ConnectionCounts() (inbound, outbound int) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.connectionCounts()
+}
+
+// P2P MUST be locked before calling this
+func (p *P2P) connectionCounts() (inbound, outbound int) {
+	for _, conn := range p.Connections {
+		// Outgoing never changes, so the connection doesn't have to be locked
+		if conn.data.Outgoing {
+			outbound++
+		} else {
+			inbound++
+		}
+	}
+	return
+}
+
 func (p *P2P) StartClients() {
 	go func() {
 		for {
 			p.Lock()
-			if len(p.Connections) < config.P2P_CONNECTIONS {
-				p.connectToRandomPeer()
+			_, outbound := p.connectionCounts()
+			if outbound < p.MaxOutbound {
+				p.connectToRandomPeer(p.MaxOutbound - outbound)
 			}
 			p.Unlock()
 			time.Sleep(15 * time.Second)
@@ -187,32 +288,83 @@ func (p *P2P) StartClients() {
 	}()
 }
 
+// connectToRandomPeer dials up to n random known peers that aren't already connected.
 // P2P MUST be locked before calling this
-func (p *P2P) connectToRandomPeer() {
+func (p *P2P) connectToRandomPeer(n int) {
+	dialed := make(map[string]bool)
 scanning:
-	for i := 0; i < 5; i++ {
+	for i := 0; i < 5 && n > 0; i++ {
 		if len(p.KnownPeers) == 0 {
 			return
 		}
 		randPeer := p.KnownPeers[mrand.IntN(len(p.KnownPeers))]
-		if randPeer.IsBanned() {
+		addr := net.JoinHostPort(randPeer.IP, strconv.FormatUint(uint64(randPeer.Port), 10))
+		if randPeer.IsBanned() || dialed[randPeer.IP] || p.selfAddrs[addr] ||
+			p.otherNetwork[addr] > time.Now().Unix() {
 			continue
 		}
 
 		for _, conn := range p.Connections {
-			continueScan := false
-			conn.View(func(c *ConnData) error {
-				if c.IP() == randPeer.IP {
-					continueScan = true
-				}
-				return nil
-			})
-			if continueScan {
+			// the remote address never changes, so the connection doesn't have to be locked
+			if conn.data.IP() == randPeer.IP {
 				continue scanning
 			}
 		}
 
-		go p.startClient(randPeer.IP + ":" + strconv.FormatUint(uint64(randPeer.Port), 10))
+		dialed[randPeer.IP] = true
+		go p.startClient(addr)
+		n--
+	}
+}
+
+// countPeerId returns the number of connections, other than the one with the given IP:PORT, with the given
+// peer ID. The connections are not locked while P2P is locked, since Kick locks them in the opposite order.
+// P2P and the connections must NOT be locked before calling this
+func (p *P2P) countPeerId(id bitcrypto.Pubkey, ipPort string) int {
+	p.RLock()
+	conns := make([]*Connection, 0, len(p.Connections))
+	for addr, conn := range p.Connections {
+		if addr != ipPort {
+			conns = append(conns, conn)
+		}
+	}
+	p.RUnlock()
+
+	n := 0
+	for _, conn := range conns {
+		conn.View(func(c *ConnData) error {
+			if c.PeerId == id {
+				n++
+			}
+			return nil
+		})
+	}
+	return n
+}
+
+// KickUnresponsive disconnects the peers which haven't sent any packet within the read timeout. Every peer pings
+// the others every P2P_PING_INTERVAL seconds, so a peer which is still working can't stay silent that long.
+// P2P must NOT be locked before calling this
+func (p *P2P) KickUnresponsive() {
+	p.RLock()
+	conns := make([]*Connection, 0, len(p.Connections))
+	for _, conn := range p.Connections {
+		conns = append(conns, conn)
+	}
+	p.RUnlock()
+
+	limit := time.Now().Add(-p.Timeouts.Read).Unix()
+	for _, conn := range conns {
+		var lastPing int64
+		conn.View(func(c *ConnData) error {
+			lastPing = c.LastPing
+			return nil
+		})
+		if lastPing < limit {
+			Log.Netf("peer %s didn't send any packet for %d seconds, disconnecting it",
+				conn.data.Conn.RemoteAddr(), time.Now().Unix()-lastPing)
+			p.Kick(conn)
+		}
 	}
 }
 
@@ -220,7 +372,7 @@ scanning:
 func (p *P2P) Kick(c *Connection) {
 	c.Update(func(c *ConnData) error {
 		c.Close()
-		ip := c.Conn.RemoteAddr().String()
+		ip := c.IPPort()
 		Log.Debug("p2p kick", ip)
 		c.Close()
 		p.Lock()
@@ -234,7 +386,7 @@ func (p *P2P) handleConnection(conn *Connection) {
 	var ipPort string
 	shouldReturn := false
 	err := conn.Update(func(c *ConnData) error {
-		ipPort = c.Conn.RemoteAddr().String()
+		ipPort = c.IPPort()
 		var peerid [32]byte
 		err := func() error {
 			p.Lock()
@@ -245,18 +397,26 @@ func (p *P2P) handleConnection(conn *Connection) {
 			if p.Connections[ipPort] != nil {
 				return fmt.Errorf("peer %s is already connected", ipPort)
 			}
+			inbound, outbound := p.connectionCounts()
+			if c.Outgoing && outbound >= p.MaxOutbound {
+				return fmt.Errorf("not connecting to %s: outgoing connection limit reached", ipPort)
+			}
+			if !c.Outgoing && inbound >= p.MaxInbound {
+				return fmt.Errorf("refusing connection from %s: incoming connection limit reached", ipPort)
+			}
 			p.Connections[ipPort] = conn
 			return nil
 		}()
 		if err != nil {
+			Log.Debug(err)
 			c.Close()
 			shouldReturn = true
 			return nil
 		}
 
-		// send peer ID
+		// send network magic and peer ID
 		c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		_, err = c.Conn.Write(peerid[:])
+		_, err = c.Conn.Write(append(p.Magic[:], peerid[:]...))
 		return err
 	})
 	if shouldReturn {
@@ -267,8 +427,31 @@ func (p *P2P) handleConnection(conn *Connection) {
 		return
 	}
 
-	// read peer ID
+	// read network magic, a peer of another network is dropped before anything else
 	conn.data.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var magic [8]byte
+	_, err = io.ReadFull(conn.data.Conn, magic[:])
+	if err != nil {
+		Log.Warnf("error occurred while reading network magic: %s", err)
+		p.Kick(conn)
+		return
+	}
+	if magic != p.Magic {
+		Log.Netf("disconnecting from %s: network magic %x is not %x, the peer is on another network", ipPort,
+			magic, p.Magic)
+		// a single mismatch may be a misconfigured peer, so the address dialed isn't dialed again for a while
+		// rather than forgotten. Other nodes may share its IP, so they aren't affected. Incoming connections are
+		// just dropped: their port isn't the one the peer listens on.
+		if conn.data.Outgoing {
+			p.Lock()
+			p.otherNetwork[ipPort] = time.Now().Unix() + config.P2P_MAGIC_BAN
+			p.Unlock()
+		}
+		p.Kick(conn)
+		return
+	}
+
+	// read peer ID
 	peerIdBin := make([]byte, 32)
 	_, err = conn.data.Conn.Read(peerIdBin)
 	if err != nil {
@@ -283,32 +466,32 @@ func (p *P2P) handleConnection(conn *Connection) {
 		Log.Debugf("New connection with ID %x", c.PeerId)
 
 		if c.PeerId == p.PeerId() {
-			err := fmt.Errorf("disconnecting from peer: connection to self detected")
-			return err
+			// the address dialed is one of this node's
+			if c.Outgoing {
+				p.Lock()
+				p.selfAddrs[ipPort] = true
+				p.Unlock()
+			}
+			return fmt.Errorf("disconnecting from %s: connection to self detected", ipPort)
 		}
+		return nil
+	})
+	if err != nil {
+		Log.Warn(err)
+		p.Kick(conn)
+		return
+	}
 
-		func() {
-			p.RLock()
-			conns := p.Connections
-			p.RUnlock()
-
-			for addr, vconn := range conns {
-				if addr == ipPort {
-					continue
-				}
-				err := vconn.View(func(v *ConnData) error {
-					if v.PeerId == c.PeerId && v.Conn.RemoteAddr().String() != c.Conn.RemoteAddr().String() {
-						err := fmt.Errorf("disconnecting from peer: duplicate ID %x", c.PeerId)
-						return err
-					}
-					return nil
-				})
-				if err != nil {
-					Log.Warn(err)
-				}
-			}
-		}()
+	// check if this peer is already connected
+	if n := p.countPeerId(bitcrypto.Pubkey(peerIdBin), ipPort); n >= 2 {
+		Log.Warnf("peer with id: %x is already connected - disconnecting it", peerIdBin)
+		p.Kick(conn)
+		return
+	} else if n == 1 {
+		Log.Warnf("duplicate peer ID %x", peerIdBin)
+	}
 
+	err = conn.Update(func(c *ConnData) error {
 		peerpub, err := curve.NewPublicKey(c.PeerId[:])
 		if err != nil {
 			Log.Err(err)
@@ -330,36 +513,6 @@ func (p *P2P) handleConnection(conn *Connection) {
 
 		p.NewConnections <- conn
 
-		// check if this peer is already connected
-		err = func() error {
-			p.RLock()
-			defer p.RUnlock()
-
-			n := 0
-			for i, vconn := range p.Connections {
-				if i == ipPort {
-					continue
-				}
-				err := vconn.Update(func(v *ConnData) error {
-					if v.PeerId == c.PeerId {
-						n++
-						if n >= 2 {
-							err := fmt.Errorf("peer with id: %x is already connected - disconnecting it", c.PeerId)
-							return err
-						}
-					}
-					return nil
-				})
-				if err != nil {
-					return err
-				}
-			}
-			return err
-		}()
-		if err != nil {
-			return err
-		}
-
 		// update and broadcast peerlist
 		s := binary.Ser{}
 		p.Lock()
@@ -393,7 +546,7 @@ func (p *P2P) handleConnection(conn *Connection) {
 
 		func() error {
 			// packet length is unencrypted
-			conn.data.Conn.SetReadDeadline(time.Now().Add(config.P2P_TIMEOUT * time.Second))
+			conn.data.Conn.SetReadDeadline(time.Now().Add(p.Timeouts.Read))
 			packLenBuf := make([]byte, 4)
 			_, err := io.ReadFull(conn.data.Conn, packLenBuf)
 			if err != nil {
@@ -402,12 +555,12 @@ func (p *P2P) handleConnection(conn *Connection) {
 			}
 
 			packetLen := binary.LittleEndian.Uint32(packLenBuf)
-			if packetLen > 1024*1024*4 /* 4 MiB */ {
+			if packetLen > config.P2P_MAX_PACKET_SIZE {
 				return fmt.Errorf("connection error: invalid packet length %d received", packetLen)
 			}
 
 			// now read encrypted data
-			conn.data.Conn.SetReadDeadline(time.Now().Add(config.P2P_TIMEOUT * time.Second))
+			conn.data.Conn.SetReadDeadline(time.Now().Add(p.Timeouts.Read))
 			encData = make([]byte, packetLen)
 			_, err = io.ReadFull(conn.data.Conn, encData)
 			if err != nil {
@@ -464,7 +617,7 @@ func (p *P2P) onPacketReceived(pk pack, c *Connection) {
 	} else if pk.Type == 1 { // addPeer
 		p.OnAddPeerPacket(pk.Data)
 	} else {
-		p.PacketsIn <- Packet{Data: pk.Data, Type: packet.Type(pk.Type - 2), Conn: c}
+		p.PacketsIn <- Packet{Data: pk.Data, Type: packet.Type(pk.Type - 2), Conn: c, Received: time.Now()}
 	}
 }
 
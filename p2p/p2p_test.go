@@ -0,0 +1,372 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"still-blockchain/bitcrypto"
+	"still-blockchain/config"
+	"still-blockchain/p2p/packet"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a P2P node with the given connection limits. If ip is not empty, the node accepts
+// incoming connections on a random port of that IP, and the address is returned.
+func newTestNode(t *testing.T, ip string, maxInbound, maxOutbound int) (*P2P, string) {
+	t.Helper()
+
+	p := Start(nil)
+	p.MaxInbound, p.MaxOutbound = maxInbound, maxOutbound
+
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+	})
+	go func() {
+		for {
+			select {
+			case <-p.NewConnections:
+			case <-p.PacketsIn:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if ip == "" {
+		return p, ""
+	}
+	listen, err := net.Listen("tcp", ip+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listen.Close()
+	})
+	go p.serve(listen)
+
+	return p, listen.Addr().String()
+}
+
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	srv, srvAddr := newTestNode(t, "127.0.0.1", 1, 1)
+	peer, peerAddr := newTestNode(t, "127.0.0.2", 1, 1)
+
+	// the first incoming connection is accepted
+	client1, _ := newTestNode(t, "", 1, 1)
+	go client1.startClient(srvAddr)
+	waitFor(t, "the first incoming connection", func() bool {
+		inbound, _ := srv.ConnectionCounts()
+		return inbound == 1
+	})
+
+	// the second one is refused, since the inbound limit is reached
+	client2, _ := newTestNode(t, "", 1, 1)
+	refused := make(chan struct{})
+	go func() {
+		client2.startClient(srvAddr)
+		close(refused)
+	}()
+	select {
+	case <-refused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection beyond the inbound limit was not refused")
+	}
+	if inbound, _ := srv.ConnectionCounts(); inbound != 1 {
+		t.Fatalf("node has %d incoming connections, expected 1", inbound)
+	}
+
+	// outgoing connections are still made while the inbound limit is reached
+	host, port, err := net.SplitHostPort(peerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Lock()
+	srv.KnownPeers = append(srv.KnownPeers, KnownPeer{IP: host, Port: uint16(portNum), Type: PEER_WHITE})
+	srv.Unlock()
+	srv.StartClients()
+
+	waitFor(t, "the outgoing connection", func() bool {
+		_, outbound := srv.ConnectionCounts()
+		return outbound == 1
+	})
+	if inbound, _ := peer.ConnectionCounts(); inbound != 1 {
+		t.Fatalf("peer has %d incoming connections, expected 1", inbound)
+	}
+	if inbound, _ := srv.ConnectionCounts(); inbound != 1 {
+		t.Fatalf("node has %d incoming connections, expected 1", inbound)
+	}
+}
+
+func TestSelfConnection(t *testing.T) {
+	srv, srvAddr := newTestNode(t, "127.0.0.1", 2, 2)
+
+	// a node with the same ID sends the same ID in the handshake, like srv dialing its own address
+	self, _ := newTestNode(t, "", 2, 2)
+	self.Privkey = srv.Privkey
+
+	self.startClient(srvAddr)
+	if inbound, outbound := self.ConnectionCounts(); inbound != 0 || outbound != 0 {
+		t.Fatalf("self connection was not dropped: %d incoming and %d outgoing connections", inbound, outbound)
+	}
+	waitFor(t, "the incoming self connection to be dropped", func() bool {
+		inbound, _ := srv.ConnectionCounts()
+		return inbound == 0
+	})
+	self.RLock()
+	isSelf := self.selfAddrs[srvAddr]
+	self.RUnlock()
+	if !isSelf {
+		t.Fatalf("dialed address %s is not recorded as self", srvAddr)
+	}
+
+	// the self addresses are not dialed again, whatever the IP version
+	for _, bind := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listen, err := net.Listen("tcp", bind)
+		if err != nil {
+			t.Logf("cannot listen on %s: %v", bind, err)
+			continue
+		}
+		defer listen.Close()
+		accepted := make(chan struct{}, 2)
+		go func() {
+			for {
+				c, err := listen.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+				accepted <- struct{}{}
+			}
+		}()
+		host, port, err := net.SplitHostPort(listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the address is dialed until it's known to be a self address
+		self.Lock()
+		self.KnownPeers = []KnownPeer{{IP: host, Port: uint16(portNum), Type: PEER_WHITE}}
+		self.connectToRandomPeer(1)
+		self.Unlock()
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("address %s was not dialed", listen.Addr())
+		}
+
+		self.Lock()
+		self.selfAddrs[listen.Addr().String()] = true
+		self.connectToRandomPeer(1)
+		self.Unlock()
+		select {
+		case <-accepted:
+			t.Fatalf("self address %s was dialed again", listen.Addr())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func TestNetworkMagicMismatch(t *testing.T) {
+	srv, srvAddr := newTestNode(t, "127.0.0.1", 2, 2)
+
+	// a node of another network, which knows the address of srv
+	other, _ := newTestNode(t, "", 2, 2)
+	other.Magic[0] ^= 1
+	host, port, err := net.SplitHostPort(srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.KnownPeers = []KnownPeer{{IP: host, Port: uint16(portNum), Type: PEER_WHITE}}
+
+	other.startClient(srvAddr)
+	if inbound, outbound := other.ConnectionCounts(); inbound != 0 || outbound != 0 {
+		t.Fatalf("connection to another network was not dropped: %d incoming and %d outgoing connections",
+			inbound, outbound)
+	}
+	waitFor(t, "the incoming connection from another network to be dropped", func() bool {
+		inbound, _ := srv.ConnectionCounts()
+		return inbound == 0
+	})
+
+	// the dialing node doesn't dial the address again for a while, rather than forgetting the peer, while the
+	// other node just dropped the incoming connection
+	other.RLock()
+	until, known := other.otherNetwork[srvAddr], slices.Clone(other.KnownPeers)
+	other.RUnlock()
+	if until <= time.Now().Unix() || until > time.Now().Unix()+config.P2P_MAGIC_BAN {
+		t.Fatalf("address of another network is skipped until %d", until)
+	}
+	if len(known) != 1 || known[0].IsBanned() {
+		t.Fatalf("peer of another network is not kept as it was: %v", known)
+	}
+	srv.RLock()
+	srvKnown, srvSkipped := slices.Clone(srv.KnownPeers), len(srv.otherNetwork)
+	srv.RUnlock()
+	if len(srvKnown) != 0 || srvSkipped != 0 {
+		t.Fatalf("incoming connection from another network changed the peers: %v, %d skipped", srvKnown,
+			srvSkipped)
+	}
+
+	// nodes of the same network still connect
+	same, _ := newTestNode(t, "", 2, 2)
+	go same.startClient(srvAddr)
+	waitFor(t, "the connection from the same network", func() bool {
+		inbound, _ := srv.ConnectionCounts()
+		return inbound == 1
+	})
+}
+
+// newTestConn returns a connection over an in-memory pipe, and the remote end of the pipe. Writes to the pipe
+// block until the remote end reads them.
+func newTestConn(t *testing.T) (*Connection, net.Conn) {
+	t.Helper()
+
+	cip, err := bitcrypto.NewCipher([32]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	conn := NewConnection(local, true)
+	conn.Update(func(c *ConnData) error {
+		c.Cipher = cip
+		return nil
+	})
+	t.Cleanup(func() {
+		conn.data.Close()
+		remote.Close()
+	})
+	return conn, remote
+}
+
+func TestSendQueue(t *testing.T) {
+	slow, slowRemote := newTestConn(t)
+	fast, fastRemote := newTestConn(t)
+	ping := &Packet{Type: packet.PING, Data: []byte{}}
+
+	// the packets for a peer which doesn't read them are queued without blocking the sender
+	start := time.Now()
+	for i := 0; i < config.P2P_SEND_QUEUE_SIZE; i++ {
+		if err := slow.SendPacket(ping); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("queueing the packets of the slow peer took %v", elapsed)
+	}
+
+	// other peers still receive their packets
+	if err := fast.SendPacket(ping); err != nil {
+		t.Fatal(err)
+	}
+	fastRemote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(fastRemote, make([]byte, 4)); err != nil {
+		t.Fatal("packet was not written to the fast peer:", err)
+	}
+
+	// the slow peer is disconnected when its queue overflows. The writer may have taken a packet from the queue
+	// while waiting for the peer to read it, leaving room for one more.
+	var err error
+	for i := 0; i < 2 && err == nil; i++ {
+		err = slow.SendPacket(ping)
+	}
+	if !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("got error %v, expected %v", err, ErrSendQueueFull)
+	}
+
+	// the packet being written may still be read before the connection is closed
+	slowRemote.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	for err = nil; err == nil; {
+		_, err = slowRemote.Read(buf)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("slow peer connection is not closed, read error %v", err)
+	}
+	if err := slow.SendPacket(ping); err == nil {
+		t.Error("packet is queued for a disconnected peer")
+	}
+}
+
+func TestUnresponsivePeer(t *testing.T) {
+	srv, srvAddr := newTestNode(t, "127.0.0.1", 2, 2)
+	srv.Timeouts.Read = 500 * time.Millisecond
+
+	// a peer completes the handshake, then stops sending anything, not even the replies to the pings
+	peerKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(append(srv.Magic[:], peerKey.PublicKey().Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the incoming connection", func() bool {
+		inbound, _ := srv.ConnectionCounts()
+		return inbound == 1
+	})
+	start := time.Now()
+
+	// it's disconnected once the read timeout expires
+	waitFor(t, "the unresponsive peer to be disconnected", func() bool {
+		inbound, _ := srv.ConnectionCounts()
+		return inbound == 0
+	})
+	if elapsed := time.Since(start); elapsed < srv.Timeouts.Read/2 {
+		t.Errorf("peer disconnected after %v, before the timeout of %v", elapsed, srv.Timeouts.Read)
+	}
+
+	// the pinger disconnects the peers which keep the connection open without sending any packet, while the
+	// other peers stay connected
+	stale, _ := newTestConn(t)
+	fresh, _ := newTestConn(t)
+	stale.Update(func(c *ConnData) error {
+		c.LastPing = time.Now().Add(-2 * time.Minute).Unix()
+		return nil
+	})
+	node, _ := newTestNode(t, "", 2, 2)
+	node.Timeouts.Read = time.Minute
+	node.Lock()
+	node.Connections[stale.data.Conn.RemoteAddr().String()] = stale
+	node.Connections["fresh"] = fresh
+	node.Unlock()
+
+	node.KickUnresponsive()
+	node.RLock()
+	defer node.RUnlock()
+	if len(node.Connections) != 1 || node.Connections["fresh"] != fresh {
+		t.Errorf("connections after kicking the unresponsive peers: %v", node.Connections)
+	}
+}
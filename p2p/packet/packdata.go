@@ -3,6 +3,7 @@ package packet
 import (
 	"fmt"
 	"still-blockchain/binary"
+	"still-blockchain/config"
 	"still-blockchain/util/uint128"
 )
 
@@ -22,7 +23,7 @@ func (p PacketStats) Serialize() []byte {
 
 	diff := make([]byte, 16)
 	p.CumulativeDiff.PutBytes(diff)
-	for diff[len(diff)-1] == 0 {
+	for len(diff) > 0 && diff[len(diff)-1] == 0 {
 		diff = diff[:len(diff)-1]
 	}
 	s.AddByteSlice(diff)
@@ -36,7 +37,11 @@ func (p *PacketStats) Deserialize(data []byte) error {
 	d := binary.Des{
 		Data: data,
 	}
+	p.deserialize(&d)
+	return d.Error()
+}
 
+func (p *PacketStats) deserialize(d *binary.Des) {
 	p.Height = d.ReadUvarint()
 
 	// read difficulty
@@ -48,14 +53,48 @@ func (p *PacketStats) Deserialize(data []byte) error {
 	}
 
 	p.Hash = [32]byte(d.ReadFixedByteArray(32))
-
-	return d.Error()
 }
 
 func (p PacketStats) String() string {
 	return fmt.Sprintf("Height: %d; Cumulative diff: %s; Hash: %x", p.Height, p.CumulativeDiff, p.Hash)
 }
 
+// PacketStatsProof is the content of the STATS packet: the stats, followed by the top block they refer to
+// (without transaction data). The top block proves that the advertised cumulative difficulty is backed by
+// real work. Peers that don't send it are not trusted as sync targets.
+type PacketStatsProof struct {
+	PacketStats
+	Tip []byte // serialized top block
+}
+
+func (p PacketStatsProof) Serialize() []byte {
+	stats := p.PacketStats.Serialize()
+
+	s := binary.NewSer(make([]byte, len(stats)+len(p.Tip)+3))
+	s.AddFixedByteArray(stats)
+	s.AddByteSlice(p.Tip)
+	return s.Output()
+}
+
+func (p *PacketStatsProof) Deserialize(data []byte) error {
+	d := binary.Des{
+		Data: data,
+	}
+	p.PacketStats.deserialize(&d)
+	if d.Error() != nil {
+		return d.Error()
+	}
+
+	// the tip is optional
+	if len(d.RemainingData()) == 0 {
+		p.Tip = nil
+		return nil
+	}
+	p.Tip = d.ReadByteSlice()
+
+	return d.Error()
+}
+
 type PacketBlockRequest struct {
 	Height uint64 // if height is zero, then request is by hash
 	Hash   [32]byte
@@ -79,3 +118,58 @@ func (p *PacketBlockRequest) Deserialize(d []byte) error {
 	}
 	return s.Error()
 }
+
+// PacketInv is a list of transaction hashes. It's used by the INV packet, to announce transactions, and by
+// the TX_REQUEST packet, to request the announced transactions that are missing.
+type PacketInv struct {
+	Hashes [][32]byte
+}
+
+func (p PacketInv) Serialize() []byte {
+	s := binary.NewSer(make([]byte, 1+len(p.Hashes)*32))
+	s.AddUvarint(uint64(len(p.Hashes)))
+	for _, v := range p.Hashes {
+		s.AddFixedByteArray(v[:])
+	}
+	return s.Output()
+}
+func (p *PacketInv) Deserialize(d []byte) error {
+	s := binary.Des{
+		Data: d,
+	}
+	n := s.ReadUvarint()
+	if s.Error() != nil {
+		return s.Error()
+	}
+	if n > config.P2P_MAX_INV {
+		return fmt.Errorf("inventory has too many hashes: %d, max: %d", n, config.P2P_MAX_INV)
+	}
+	p.Hashes = make([][32]byte, n)
+	for i := range p.Hashes {
+		p.Hashes[i] = [32]byte(s.ReadFixedByteArray(32))
+		if s.Error() != nil {
+			return s.Error()
+		}
+	}
+	return s.Error()
+}
+
+// PacketTime is the content of the TIME packet: the local time of the peer when it sent the packet, in
+// milliseconds since the Unix epoch. It's sent when a connection is established, so that nodes can check their
+// clock against the ones of their peers.
+type PacketTime struct {
+	Time uint64
+}
+
+func (p PacketTime) Serialize() []byte {
+	s := binary.Ser{}
+	s.AddUvarint(p.Time)
+	return s.Output()
+}
+func (p *PacketTime) Deserialize(d []byte) error {
+	s := binary.Des{
+		Data: d,
+	}
+	p.Time = s.ReadUvarint()
+	return s.Error()
+}
@@ -8,6 +8,9 @@ const (
 	TX
 	STATS
 	BLOCK_REQUEST
+	INV
+	TX_REQUEST
+	TIME
 )
 
 func (p Type) String() string {
@@ -22,6 +25,12 @@ func (p Type) String() string {
 		return "STATS"
 	case BLOCK_REQUEST:
 		return "BLOCK_REQUEST"
+	case INV:
+		return "INV"
+	case TX_REQUEST:
+		return "TX_REQUEST"
+	case TIME:
+		return "TIME"
 	}
 	return "UNKNOWN"
 }
@@ -3,6 +3,7 @@ package p2p
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"still-blockchain/config"
 )
 
@@ -13,5 +14,5 @@ func (p *P2P) savePeerlist() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("./peerlist-"+config.NETWORK_NAME+".json", d, 0o660)
+	return os.WriteFile(filepath.Join(p.DataDir, "peerlist-"+config.NETWORK_NAME+".json"), d, 0o660)
 }
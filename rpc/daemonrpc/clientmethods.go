@@ -6,6 +6,16 @@ func (r *RpcClient) GetTransaction(p GetTransactionRequest) (*GetTransactionResp
 	return o, r.Request("get_transaction", p, o)
 }
 
+func (r *RpcClient) GetRawTransaction(p GetRawTransactionRequest) (*GetRawTransactionResponse, error) {
+	o := &GetRawTransactionResponse{}
+	return o, r.Request("get_raw_transaction", p, o)
+}
+
+func (r *RpcClient) DecodeRawTransaction(p DecodeRawTransactionRequest) (*DecodeRawTransactionResponse, error) {
+	o := &DecodeRawTransactionResponse{}
+	return o, r.Request("decode_raw_transaction", p, &o)
+}
+
 func (r *RpcClient) GetInfo(p GetInfoRequest) (*GetInfoResponse, error) {
 	o := &GetInfoResponse{}
 	return o, r.Request("get_info", p, &o)
@@ -16,6 +26,21 @@ func (r *RpcClient) GetAddress(p GetAddressRequest) (*GetAddressResponse, error)
 	return o, r.Request("get_address", p, &o)
 }
 
+func (r *RpcClient) GetNonce(p GetNonceRequest) (*GetNonceResponse, error) {
+	o := &GetNonceResponse{}
+	return o, r.Request("get_nonce", p, &o)
+}
+
+func (r *RpcClient) SimulateTransaction(p SimulateTransactionRequest) (*SimulateTransactionResponse, error) {
+	o := &SimulateTransactionResponse{}
+	return o, r.Request("simulate_transaction", p, &o)
+}
+
+func (r *RpcClient) EstimateFee(p EstimateFeeRequest) (*EstimateFeeResponse, error) {
+	o := &EstimateFeeResponse{}
+	return o, r.Request("estimate_fee", p, &o)
+}
+
 func (r *RpcClient) GetTxList(p GetTxListRequest) (*GetTxListResponse, error) {
 	o := &GetTxListResponse{}
 	return o, r.Request("get_tx_list", p, &o)
@@ -26,6 +51,11 @@ func (r *RpcClient) SubmitTransaction(p SubmitTransactionRequest) (*SubmitTransa
 	return o, r.Request("submit_transaction", p, &o)
 }
 
+func (r *RpcClient) SendRawTransaction(p SendRawTransactionRequest) (*SendRawTransactionResponse, error) {
+	o := &SendRawTransactionResponse{}
+	return o, r.Request("send_raw_transaction", p, &o)
+}
+
 func (r *RpcClient) GetBlockByHash(p GetBlockByHashRequest) (*GetBlockResponse, error) {
 	o := &GetBlockResponse{}
 	return o, r.Request("get_block_by_hash", p, &o)
@@ -36,7 +66,53 @@ func (r *RpcClient) GetBlockByHeight(p GetBlockByHeightRequest) (*GetBlockRespon
 	return o, r.Request("get_block_by_height", p, &o)
 }
 
+func (r *RpcClient) GetHeaderProof(p GetHeaderProofRequest) (*GetHeaderProofResponse, error) {
+	o := &GetHeaderProofResponse{}
+	return o, r.Request("get_header_proof", p, &o)
+}
+
+func (r *RpcClient) GetBlockRewardInfo(p GetBlockRewardInfoRequest) (*GetBlockRewardInfoResponse, error) {
+	o := &GetBlockRewardInfoResponse{}
+	return o, r.Request("get_block_reward_info", p, &o)
+}
+
+func (r *RpcClient) GetBlockByCumulativeDiff(p GetBlockByCumulativeDiffRequest) (*GetBlockByCumulativeDiffResponse,
+	error) {
+	o := &GetBlockByCumulativeDiffResponse{}
+	return o, r.Request("get_block_by_cumulative_diff", p, &o)
+}
+
+func (r *RpcClient) GetForkInfo(p GetForkInfoRequest) (*GetForkInfoResponse, error) {
+	o := &GetForkInfoResponse{}
+	return o, r.Request("get_fork_info", p, &o)
+}
+
+func (r *RpcClient) GetBlockStatus(p GetBlockStatusRequest) (*GetBlockStatusResponse, error) {
+	o := &GetBlockStatusResponse{}
+	return o, r.Request("get_block_status", p, &o)
+}
+
+func (r *RpcClient) GetPeers(p GetPeersRequest) (*GetPeersResponse, error) {
+	o := &GetPeersResponse{}
+	return o, r.Request("get_peers", p, &o)
+}
+
+func (r *RpcClient) RebroadcastMempool(p RebroadcastMempoolRequest) (*RebroadcastMempoolResponse, error) {
+	o := &RebroadcastMempoolResponse{}
+	return o, r.Request("rebroadcast_mempool", p, &o)
+}
+
 func (r *RpcClient) CalcPow(p CalcPowRequest) (*CalcPowResponse, error) {
 	o := &CalcPowResponse{}
 	return o, r.Request("calc_pow", p, &o)
 }
+
+func (r *RpcClient) WaitForEvent(p WaitForEventRequest) (*WaitForEventResponse, error) {
+	o := &WaitForEventResponse{}
+	return o, r.Request("wait_for_event", p, &o)
+}
+
+func (r *RpcClient) GetFilteredBlock(p GetFilteredBlockRequest) (*GetFilteredBlockResponse, error) {
+	o := &GetFilteredBlockResponse{}
+	return o, r.Request("get_filtered_block", p, &o)
+}
@@ -22,6 +22,38 @@ type GetTransactionResponse struct {
 	Coinbase  bool                `json:"coinbase"`
 }
 
+type GetRawTransactionRequest struct {
+	Txid    util.Hash `json:"txid"`
+	Verbose bool      `json:"verbose"` // also decode the transaction
+}
+
+type GetRawTransactionResponse struct {
+	Hex         enc.Hex                 `json:"hex"`    // serialized transaction as hex string
+	Height      uint64                  `json:"height"` // zero if the transaction is not mined
+	Transaction *GetTransactionResponse `json:"transaction,omitempty"`
+}
+
+// DecodeRawTransactionRequest decodes a serialized transaction without submitting it
+type DecodeRawTransactionRequest struct {
+	Hex enc.Hex `json:"hex"` // serialized transaction as hex string
+}
+type DecodeRawTransactionResponse struct {
+	Txid           util.Hash          `json:"txid"`
+	Sender         address.Integrated `json:"sender"`
+	Recipient      address.Integrated `json:"recipient"`
+	Subaddr        uint64             `json:"subaddr"`
+	Nonce          uint64             `json:"nonce"`
+	Amount         uint64             `json:"amount"`
+	Fee            uint64             `json:"fee"`
+	Signature      enc.Hex            `json:"signature"`
+	VSize          uint64             `json:"vsize"`
+	SignatureValid bool               `json:"signature_valid"`
+
+	// why the transaction fails the checks done before submitting it, empty if it passes them. The balance and
+	// the nonce of the sender are not checked.
+	Error string `json:"error,omitempty"`
+}
+
 type GetInfoRequest struct {
 }
 type GetInfoResponse struct {
@@ -30,10 +62,24 @@ type GetInfoResponse struct {
 	CirculatingSupply uint64    `json:"circulating_supply"`
 	MaxSupply         uint64    `json:"max_supply"`
 	Coin              uint64    `json:"coin"`
-	Difficulty        string    `json:"difficulty"`
+	Difficulty        string    `json:"difficulty"`         // difficulty of the top block
+	NextDifficulty    string    `json:"next_difficulty"`    // difficulty of the next block
+	Hashrate          string    `json:"hashrate"`           // estimated network hashrate, in hashes per second
+	AverageBlockTime  float64   `json:"average_block_time"` // mean time between the recent blocks, in seconds
+	MedianBlockTime   float64   `json:"median_block_time"`  // median time between the recent blocks, in seconds
 	CumulativeDiff    string    `json:"cumulative_diff"`
 	Target            int       `json:"target_block_time"`
 	BlockReward       uint64    `json:"block_reward"`
+	PropagationDelay  float64   `json:"propagation_delay"` // average block propagation delay, in seconds
+	StaleRate         float64   `json:"stale_rate"`        // average fraction of altchain and orphan blocks
+	Synced            bool      `json:"synced"`            // true if enough peers agree that the top block is the best
+	NetworkId         string    `json:"network_id"`        // hex encoded
+	Version           string    `json:"version"`
+	Peers             int       `json:"peers"`
+	MempoolSize       int       `json:"mempool_size"`
+	RelayFee          uint64    `json:"relay_fee_per_byte"`        // minimum fee per byte to relay a transaction
+	MinerPercent      uint64    `json:"miner_reward_percent"`      // share of the block rewards paid to the miner
+	GovernancePercent uint64    `json:"governance_reward_percent"` // share paid to the governance address
 }
 
 type GetAddressRequest struct {
@@ -49,6 +95,40 @@ type GetAddressResponse struct {
 	Height          uint64 `json:"height"`
 }
 
+type GetNonceRequest struct {
+	Address address.Integrated `json:"address"`
+}
+type GetNonceResponse struct {
+	LastNonce uint64 `json:"last_nonce"` // last nonce used in a confirmed transaction
+	NextNonce uint64 `json:"next_nonce"` // nonce to use for the next transaction, including the mempool ones
+	Pending   int    `json:"pending"`    // number of mempool transactions sent by the address
+}
+
+type SimulateTransactionRequest struct {
+	Sender    address.Integrated `json:"sender"`
+	Recipient address.Integrated `json:"recipient"`
+	Amount    uint64             `json:"amount"`
+	Fee       uint64             `json:"fee"`
+	Nonce     uint64             `json:"nonce"`
+}
+type SimulateTransactionResponse struct {
+	SenderBalance    uint64 `json:"sender_balance"`    // sender balance after the transaction
+	RecipientBalance uint64 `json:"recipient_balance"` // recipient balance after the transaction
+	BalanceValid     bool   `json:"balance_valid"`     // the sender can afford the amount plus the fee
+	ExpectedNonce    uint64 `json:"expected_nonce"`
+	NonceValid       bool   `json:"nonce_valid"`
+	MinFee           uint64 `json:"min_fee"` // minimum fee to relay the transaction
+	FeeValid         bool   `json:"fee_valid"`
+}
+
+type EstimateFeeRequest struct {
+	Blocks int `json:"blocks"` // number of blocks the transaction should be mined within
+}
+type EstimateFeeResponse struct {
+	FeePerByte uint64 `json:"fee_per_byte"`
+	Fee        uint64 `json:"fee"` // fee of a transfer transaction
+}
+
 type GetTxListRequest struct {
 	Address      address.Integrated `json:"address"`
 	TransferType string             `json:"transfer_type"` // incoming or outgoing
@@ -66,6 +146,10 @@ type SubmitTransactionResponse struct {
 	TXID util.Hash `json:"txid"`
 }
 
+// send_raw_transaction is an alias of submit_transaction
+type SendRawTransactionRequest = SubmitTransactionRequest
+type SendRawTransactionResponse = SubmitTransactionResponse
+
 type GetBlockByHashRequest struct {
 	Hash util.Hash `json:"hash"`
 }
@@ -79,6 +163,88 @@ type GetBlockResponse struct {
 	Miner  string      `json:"miner"`
 }
 
+type GetHeaderProofRequest struct {
+	Anchor uint64 `json:"anchor"` // height of the last block trusted by the client, the proof starts from it
+	Height uint64 `json:"height"`
+}
+type GetHeaderProofResponse struct {
+	block.HeaderProof
+}
+
+type GetBlockRewardInfoRequest struct {
+	Hash util.Hash `json:"hash"`
+}
+
+// the base reward plus the fees equal the governance reward plus the miner reward
+type GetBlockRewardInfoResponse struct {
+	BaseReward       uint64 `json:"base_reward"` // coins emitted by the block
+	Fees             uint64 `json:"fees"`        // sum of the fees of the block transactions
+	GovernanceReward uint64 `json:"governance_reward"`
+	MinerReward      uint64 `json:"miner_reward"`
+}
+
+type GetBlockByCumulativeDiffRequest struct {
+	CumulativeDiff string `json:"cumulative_diff"` // decimal target
+}
+type GetBlockByCumulativeDiffResponse struct {
+	Reached bool `json:"reached"` // false if the mainchain cumulative diff is below the target
+
+	// first mainchain block whose cumulative diff is greater than or equal to the target, if reached
+	Height uint64       `json:"height"`
+	Hash   string       `json:"hash"`
+	Block  *block.Block `json:"block,omitempty"`
+
+	TopCumulativeDiff string `json:"top_cumulative_diff"`
+}
+
+type GetForkInfoRequest struct {
+}
+type GetForkInfoResponse struct {
+	Tips    []ForkTip    `json:"tips"`
+	Orphans []ForkOrphan `json:"orphans"`
+}
+type ForkTip struct {
+	Hash           util.Hash `json:"hash"`
+	Height         uint64    `json:"height"`
+	CumulativeDiff string    `json:"cumulative_diff"`
+}
+type ForkOrphan struct {
+	Hash     util.Hash `json:"hash"`
+	PrevHash util.Hash `json:"prev_hash"`
+	Height   uint64    `json:"height"`
+	Expires  int64     `json:"expires"` // expiration time (UNIX seconds)
+}
+
+type GetBlockStatusRequest struct {
+	Hash util.Hash `json:"hash"`
+}
+type GetBlockStatusResponse struct {
+	Status        string `json:"status"` // mainchain, altchain, orphan or unknown
+	Height        uint64 `json:"height"`
+	Confirmations int    `json:"confirmations"` // zero unless the block is in the mainchain
+}
+
+type GetPeersRequest struct {
+}
+type GetPeersResponse struct {
+	Inbound     int        `json:"inbound"`
+	Outbound    int        `json:"outbound"`
+	MaxInbound  int        `json:"max_inbound"`
+	MaxOutbound int        `json:"max_outbound"`
+	Peers       []PeerInfo `json:"peers"`
+}
+type PeerInfo struct {
+	Address  string `json:"address"`
+	PeerId   string `json:"peer_id"`
+	Outgoing bool   `json:"outgoing"`
+}
+
+type RebroadcastMempoolRequest struct {
+}
+type RebroadcastMempoolResponse struct {
+	Count int `json:"count"` // number of transactions being relayed in the background
+}
+
 type CalcPowRequest struct {
 	Blob     enc.Hex   `json:"blob"`
 	SeedHash util.Hash `json:"seed_hash"`
@@ -87,6 +253,53 @@ type CalcPowResponse struct {
 	Hash util.Hash `json:"hash"`
 }
 
+type WaitForEventRequest struct {
+	Cursor  uint64 `json:"cursor"`  // sequence number of the first event returned; 0 returns all the recent events
+	Timeout uint64 `json:"timeout"` // maximum time to wait for new events, in seconds
+}
+type WaitForEventResponse struct {
+	Events     []EventInfo `json:"events"`
+	NextCursor uint64      `json:"next_cursor"` // cursor of the following request
+	Missed     bool        `json:"missed"`      // some events after the cursor are no longer available
+}
+type EventInfo struct {
+	Seq    uint64    `json:"seq"`
+	Type   string    `json:"type"` // block_added, tx_confirmed or reorg
+	Height uint64    `json:"height"`
+	Hash   util.Hash `json:"hash"`
+
+	Txid   *util.Hash          `json:"txid,omitempty"`
+	From   *address.Integrated `json:"from,omitempty"`
+	To     *address.Integrated `json:"to,omitempty"`
+	Amount uint64              `json:"amount,omitempty"`
+	Fee    uint64              `json:"fee,omitempty"`
+
+	RolledBack []uint64 `json:"rolled_back,omitempty"` // heights of the removed blocks, for reorgs
+}
+
+// GetFilteredBlockRequest asks for the transactions of a block matching a bloom filter of the client's
+// addresses. This reveals to the node that the client's addresses are among the ones the filter matches: a
+// filter with a higher false positive rate hides them among more addresses, at the cost of receiving more
+// transactions. The same filter should be reused for every block, since the intersection of different filters
+// narrows down the addresses.
+type GetFilteredBlockRequest struct {
+	Height uint64  `json:"height"`
+	Filter enc.Hex `json:"filter"` // serialized bloom filter
+}
+type GetFilteredBlockResponse struct {
+	Hash     util.Hash `json:"hash"`
+	Height   uint64    `json:"height"`
+	Coinbase bool      `json:"coinbase"` // the filter matches the recipient of the block reward
+	Reward   uint64    `json:"reward"`
+
+	// transactions of the block whose sender or recipient matches the filter, which may include false positives
+	Transactions []FilteredTransaction `json:"transactions"`
+}
+type FilteredTransaction struct {
+	Txid util.Hash `json:"txid"`
+	GetTransactionResponse
+}
+
 // TODO: implement these methods in the daemon
 type GetBlockTemplateRequest struct {
 	Address address.Integrated `json:"address"`
@@ -19,6 +19,15 @@ const sInvalidMethod = "Method not found"
 const invalidRequest = -32600
 
 func (s *Server) handler(res http.ResponseWriter, req *http.Request) error {
+	if h := s.httpHandlers[req.URL.Path]; h != nil {
+		err := s.checkAccess(res, req)
+		if err != nil {
+			return err
+		}
+		h(res, req)
+		return nil
+	}
+
 	if req.Method != "POST" {
 		res.WriteHeader(405)
 		WriteJSON(res, rpc.ResponseOut{
@@ -31,48 +40,9 @@ func (s *Server) handler(res http.ResponseWriter, req *http.Request) error {
 		return errors.New("method not allowed")
 	}
 
-	ip := strings.Split(req.RemoteAddr, ":")[0]
-	if !s.limit.CanAct(ip, 1) {
-		res.WriteHeader(429)
-		WriteJSON(res, rpc.ResponseOut{
-			JsonRpc: "2.0",
-			Error: &rpc.Error{
-				Code:    429,
-				Message: "Too Many Requests",
-			},
-		})
-		return errors.New("too many requests")
-	}
-
-	if s.config.Restricted {
-		origin := req.Header.Get("Origin")
-		if origin != "" && origin != "127.0.0.1" && origin != "localhost" {
-			res.WriteHeader(400)
-			WriteJSON(res, rpc.ResponseOut{
-				JsonRpc: "2.0",
-				Error: &rpc.Error{
-					Code:    400,
-					Message: "invalid origin",
-				},
-			})
-			return errors.New("invalid origin")
-		}
-	}
-
-	if len(s.config.Authentication) != 0 {
-		uname, pw, ok := req.BasicAuth()
-		if !ok || uname+":"+pw != s.config.Authentication {
-			res.WriteHeader(400)
-			s.limit.CanAct(ip, 9)
-			WriteJSON(res, rpc.ResponseOut{
-				JsonRpc: "2.0",
-				Error: &rpc.Error{
-					Code:    400,
-					Message: "unauthorized",
-				},
-			})
-			return errors.New("unauthorized")
-		}
+	err := s.checkAccess(res, req)
+	if err != nil {
+		return err
 	}
 
 	body, err := io.ReadAll(req.Body)
@@ -147,6 +117,55 @@ func (s *Server) handler(res http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// checkAccess applies the rate limit, and the origin and authentication checks of the configuration. If the
+// request is rejected, the error response is written.
+func (s *Server) checkAccess(res http.ResponseWriter, req *http.Request) error {
+	ip := strings.Split(req.RemoteAddr, ":")[0]
+	if !s.limit.CanAct(ip, 1) {
+		res.WriteHeader(429)
+		WriteJSON(res, rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Error: &rpc.Error{
+				Code:    429,
+				Message: "Too Many Requests",
+			},
+		})
+		return errors.New("too many requests")
+	}
+
+	if s.config.Restricted {
+		origin := req.Header.Get("Origin")
+		if origin != "" && origin != "127.0.0.1" && origin != "localhost" {
+			res.WriteHeader(400)
+			WriteJSON(res, rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    400,
+					Message: "invalid origin",
+				},
+			})
+			return errors.New("invalid origin")
+		}
+	}
+
+	if len(s.config.Authentication) != 0 {
+		uname, pw, ok := req.BasicAuth()
+		if !ok || uname+":"+pw != s.config.Authentication {
+			res.WriteHeader(400)
+			s.limit.CanAct(ip, 9)
+			WriteJSON(res, rpc.ResponseOut{
+				JsonRpc: "2.0",
+				Error: &rpc.Error{
+					Code:    400,
+					Message: "unauthorized",
+				},
+			})
+			return errors.New("unauthorized")
+		}
+	}
+	return nil
+}
+
 func WriteJSON(res http.ResponseWriter, v any) error {
 	bin, err := json.Marshal(v)
 	if err != nil {
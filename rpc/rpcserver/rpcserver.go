@@ -6,8 +6,9 @@ import (
 )
 
 type Server struct {
-	handlers map[string]Handler
-	config   Config
+	handlers     map[string]Handler
+	httpHandlers map[string]http.HandlerFunc
+	config       Config
 
 	limit *ratelimit.Limit
 }
@@ -30,9 +31,10 @@ func New(bind string, config Config) *Server {
 	}
 
 	rpcSrv := &Server{
-		handlers: make(map[string]func(c *Context)),
-		config:   config,
-		limit:    ratelimit.New(config.RateLimit),
+		handlers:     make(map[string]func(c *Context)),
+		httpHandlers: make(map[string]http.HandlerFunc),
+		config:       config,
+		limit:        ratelimit.New(config.RateLimit),
 	}
 
 	httpSrv := &http.Server{
@@ -50,3 +52,9 @@ func New(bind string, config Config) *Server {
 func (s *Server) Handle(method string, f Handler) {
 	s.handlers[method] = f
 }
+
+// HandleHTTP serves the requests to the given URL path with a plain HTTP handler instead of JSON-RPC, for the
+// responses which aren't JSON. The rate limit and the access checks still apply.
+func (s *Server) HandleHTTP(path string, f http.HandlerFunc) {
+	s.httpHandlers[path] = f
+}
@@ -5,3 +5,45 @@ func (r *RpcClient) GetBalance(p GetBalanceRequest) (*GetBalanceResponse, error)
 
 	return o, r.Request("get_balance", p, o)
 }
+
+func (r *RpcClient) GetSubaddress(p GetSubaddressRequest) (*GetSubaddressResponse, error) {
+	o := &GetSubaddressResponse{}
+
+	return o, r.Request("get_subaddress", p, o)
+}
+
+func (r *RpcClient) SetSubaddressLabel(p SetSubaddressLabelRequest) (*SetSubaddressLabelResponse, error) {
+	o := &SetSubaddressLabelResponse{}
+
+	return o, r.Request("set_subaddress_label", p, o)
+}
+
+func (r *RpcClient) GetAddressBook(p GetAddressBookRequest) (*GetAddressBookResponse, error) {
+	o := &GetAddressBookResponse{}
+
+	return o, r.Request("get_address_book", p, o)
+}
+
+func (r *RpcClient) SetAddressBookEntry(p SetAddressBookEntryRequest) (*SetAddressBookEntryResponse, error) {
+	o := &SetAddressBookEntryResponse{}
+
+	return o, r.Request("set_address_book_entry", p, o)
+}
+
+func (r *RpcClient) DeleteAddressBookEntry(p DeleteAddressBookEntryRequest) (*DeleteAddressBookEntryResponse, error) {
+	o := &DeleteAddressBookEntryResponse{}
+
+	return o, r.Request("delete_address_book_entry", p, o)
+}
+
+func (r *RpcClient) WaitForNewTransfer(p WaitForNewTransferRequest) (*WaitForNewTransferResponse, error) {
+	o := &WaitForNewTransferResponse{}
+
+	return o, r.Request("wait_for_new_transfer", p, o)
+}
+
+func (r *RpcClient) ExportStatement(p ExportStatementRequest) (*ExportStatementResponse, error) {
+	o := &ExportStatementResponse{}
+
+	return o, r.Request("export_statement", p, o)
+}
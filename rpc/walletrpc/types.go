@@ -41,8 +41,9 @@ type GetHistoryResponse struct {
 }
 
 type CreateTransactionRequest struct {
-	Destination address.Integrated `json:"destination"`
-	Amount      uint64             `json:"amount"`
+	Destination      address.Integrated `json:"destination"`
+	DestinationLabel string             `json:"destination_label,omitempty"` // address book label, replaces Destination
+	Amount           uint64             `json:"amount"`
 }
 type CreateTransactionResponse struct {
 	TxBlob enc.Hex   `json:"tx_blob"`
@@ -55,3 +56,68 @@ type SubmitTransactionRequest struct {
 type SubmitTransactionResponse struct {
 	TXID util.Hash `json:"txid"`
 }
+
+type GetSubaddressRequest struct {
+	Index uint64 `json:"index"`
+}
+type GetSubaddressResponse struct {
+	Address address.Integrated `json:"address"`
+	Label   string             `json:"label"`
+}
+
+type SetSubaddressLabelRequest struct {
+	Index uint64 `json:"index"`
+	Label string `json:"label"` // empty to remove the label
+}
+type SetSubaddressLabelResponse struct {
+}
+
+type AddressBookEntry struct {
+	Label   string             `json:"label"`
+	Address address.Integrated `json:"address"`
+}
+
+type GetAddressBookRequest struct {
+}
+type GetAddressBookResponse struct {
+	Entries []AddressBookEntry `json:"entries"`
+}
+
+type SetAddressBookEntryRequest struct {
+	AddressBookEntry
+}
+type SetAddressBookEntryResponse struct {
+}
+
+type DeleteAddressBookEntryRequest struct {
+	Label string `json:"label"`
+}
+type DeleteAddressBookEntryResponse struct {
+}
+
+type WaitForNewTransferRequest struct {
+	Seq     uint64 `json:"seq"`     // sequence number of the last notification received, 0 if none
+	Timeout uint64 `json:"timeout"` // maximum time to wait for a new transfer, in seconds
+}
+type WaitForNewTransferResponse struct {
+	Found bool   `json:"found"` // false if there was no new transfer before the timeout
+	Seq   uint64 `json:"seq"`   // sequence number of this notification, for the following request
+
+	// totals after the new transfer, the changed ones identify it
+	LastIncoming    uint64 `json:"last_incoming"` // confirmed incoming transactions, including block rewards
+	LastNonce       uint64 `json:"last_nonce"`    // confirmed outgoing transactions
+	MempoolIncoming uint64 `json:"mempool_incoming"`
+	MempoolOutgoing uint64 `json:"mempool_outgoing"`
+
+	Height         uint64 `json:"height"`
+	Balance        uint64 `json:"balance"`
+	MempoolBalance uint64 `json:"mempool_balance"`
+}
+
+type ExportStatementRequest struct {
+	MinHeight uint64 `json:"min_height"`
+	MaxHeight uint64 `json:"max_height"` // 0 for no upper limit
+}
+type ExportStatementResponse struct {
+	Csv string `json:"csv"` // date, direction, counterparty, amount, fee, txid, height, confirmations
+}
@@ -22,10 +22,11 @@ import (
 var Log *logger.Log = logger.DiscardLog
 
 type Server struct {
-	LastBlock      *block.Block
-	LastMinDiff    uint128.Uint128
-	conns          map[string]*Conn
-	NewConnections chan *Conn
+	LastBlock       *block.Block
+	LastMinDiff     uint128.Uint128
+	SharesPerMinute float64 // vardiff target
+	conns           map[string]*Conn
+	NewConnections  chan *Conn
 	util.RWMutex
 }
 
@@ -57,12 +58,15 @@ type ConnData struct {
 	Conn    net.Conn
 	Address address.Address
 	Jobs    []*MinerJob
+	Vardiff *Vardiff // nil for merge mining connections, which always receive the minimum difficulty
 }
 
 type MinerJob struct {
-	JobID string
-	Block *block.Block
-	Seed  randomstill.Seed
+	JobID     string
+	Block     *block.Block
+	Seed      randomstill.Seed
+	ShareDiff uint128.Uint128 // difficulty of the shares submitted to this job
+	MinDiff   uint128.Uint128 // minimum difficulty for a share to be a block
 }
 
 func (s *Server) StartStratum(ip string, port uint16) error {
@@ -127,7 +131,11 @@ func (s *Server) SendJob(bl *block.Block, diff uint128.Uint128) {
 				blob := bl.Commitment().MiningBlob()
 				seed := blob.GetSeed()
 				jobid := strconv.FormatUint(util.RandomUint64(), 36)
-				target := util.GetTargetBytes(diff)
+				if c.Vardiff != nil {
+					c.Vardiff.Retarget(time.Now())
+				}
+				shareDiff := c.ShareDiff(diff)
+				target := util.GetTargetBytes(shareDiff)
 
 				if !config.IS_MASTERCHAIN {
 					if len(blob.Chains) != 1 {
@@ -139,9 +147,11 @@ func (s *Server) SendJob(bl *block.Block, diff uint128.Uint128) {
 					c.Jobs = c.Jobs[1:]
 				}
 				c.Jobs = append(c.Jobs, &MinerJob{
-					JobID: jobid,
-					Block: bl,
-					Seed:  seed,
+					JobID:     jobid,
+					Block:     bl,
+					Seed:      seed,
+					ShareDiff: shareDiff,
+					MinDiff:   diff,
 				})
 
 				Log.Debug("sending job to stratum connection", c.Conn.RemoteAddr())
@@ -0,0 +1,71 @@
+package stratumsrv
+
+import (
+	"still-blockchain/config"
+	"still-blockchain/util/uint128"
+	"time"
+)
+
+// the share difficulty can change at most by this factor on every retarget
+const vardiff_max_change = 4
+
+// Vardiff adjusts the share difficulty of a single stratum connection, so that the miner submits roughly
+// SharesPerMinute shares, regardless of its hashrate and of the network difficulty.
+type Vardiff struct {
+	Diff            uint64
+	SharesPerMinute float64
+
+	shares       uint64
+	lastRetarget time.Time
+}
+
+func NewVardiff(sharesPerMinute float64, now time.Time) *Vardiff {
+	return &Vardiff{
+		Diff:            config.MIN_DIFFICULTY,
+		SharesPerMinute: sharesPerMinute,
+		lastRetarget:    now,
+	}
+}
+
+// OnShare records a valid share and retargets the difficulty if needed
+func (v *Vardiff) OnShare(now time.Time) {
+	v.shares++
+	v.Retarget(now)
+}
+
+// Retarget adjusts the share difficulty based on the share rate since the last retarget. It does nothing
+// if not enough time has passed since the last retarget.
+func (v *Vardiff) Retarget(now time.Time) {
+	elapsed := now.Sub(v.lastRetarget)
+	if elapsed < config.STRATUM_VARDIFF_RETARGET {
+		return
+	}
+
+	rate := float64(v.shares) / elapsed.Minutes()
+	factor := rate / v.SharesPerMinute
+	if factor > vardiff_max_change {
+		factor = vardiff_max_change
+	} else if factor < 1.0/vardiff_max_change {
+		factor = 1.0 / vardiff_max_change
+	}
+
+	newDiff := uint64(float64(v.Diff) * factor)
+	if newDiff < config.MIN_DIFFICULTY {
+		newDiff = config.MIN_DIFFICULTY
+	}
+
+	Log.Debugf("vardiff: %.2f shares per minute, diff %d -> %d", rate, v.Diff, newDiff)
+
+	v.Diff = newDiff
+	v.shares = 0
+	v.lastRetarget = now
+}
+
+// ShareDiff returns the share difficulty of a job with the given minimum difficulty. The share difficulty is
+// never higher than the minimum difficulty, since shares that meet it are blocks.
+func (c *ConnData) ShareDiff(minDiff uint128.Uint128) uint128.Uint128 {
+	if c.Vardiff == nil || minDiff.Cmp64(c.Vardiff.Diff) <= 0 {
+		return minDiff
+	}
+	return uint128.From64(c.Vardiff.Diff)
+}
@@ -0,0 +1,50 @@
+package stratumsrv
+
+import (
+	"still-blockchain/config"
+	"testing"
+	"time"
+)
+
+func TestVardiff(t *testing.T) {
+	start := time.Now()
+
+	// fast miner: one share per second, the target is 6 per minute
+	fast := NewVardiff(6, start)
+	fast.Diff = 100_000
+	for i := 1; i <= 60; i++ {
+		fast.OnShare(start.Add(time.Duration(i) * time.Second))
+	}
+	if fast.Diff <= 100_000 {
+		t.Fatalf("fast miner difficulty should rise, got %d", fast.Diff)
+	}
+
+	// slow miner: one share every two minutes
+	slow := NewVardiff(6, start)
+	slow.Diff = 100_000
+	for i := 1; i <= 3; i++ {
+		slow.OnShare(start.Add(time.Duration(i) * 2 * time.Minute))
+	}
+	if slow.Diff >= 100_000 {
+		t.Fatalf("slow miner difficulty should fall, got %d", slow.Diff)
+	}
+
+	// miner at target rate: difficulty should stay roughly the same
+	exact := NewVardiff(6, start)
+	exact.Diff = 100_000
+	for i := 1; i <= 60; i++ {
+		exact.OnShare(start.Add(time.Duration(i) * 10 * time.Second))
+	}
+	if exact.Diff < 90_000 || exact.Diff > 110_000 {
+		t.Fatalf("difficulty of miner at target rate should not change much, got %d", exact.Diff)
+	}
+
+	// difficulty never goes below the minimum
+	idle := NewVardiff(6, start)
+	for i := 1; i <= 10; i++ {
+		idle.Retarget(start.Add(time.Duration(i) * time.Hour))
+	}
+	if idle.Diff != config.MIN_DIFFICULTY {
+		t.Fatalf("idle miner difficulty should be %d, got %d", config.MIN_DIFFICULTY, idle.Diff)
+	}
+}
@@ -1,6 +1,7 @@
 package transaction
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -26,6 +27,57 @@ type Transaction struct {
 
 type TXID [32]byte
 
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// ErrAmountTooLarge is returned by Prevalidate when the amount plus fee of a transaction exceeds MAX_TX_SPEND
+var ErrAmountTooLarge = errors.New("transaction spends more than the maximum supply")
+
+// ErrUnsigned is returned when an unsigned transaction, serialized by SerializeUnsigned, is deserialized as a
+// signed one, and by Prevalidate when the signature is all zeros
+var ErrUnsigned = errors.New("transaction is not signed")
+
+// unsignedMagic prefixes the unsigned transactions, so they can't be mistaken for signed ones. A signed
+// transaction starts with the sender public key instead.
+var unsignedMagic = []byte("STILL unsigned tx")
+
+// New returns a transaction from sender to recipient paying the minimum fee, signed with the sender's private
+// key and ready to be broadcasted.
+func New(sender bitcrypto.Privkey, recipient address.Address, amount, nonce uint64) (*Transaction, error) {
+	t := &Transaction{
+		Sender:    sender.Public(),
+		Recipient: recipient,
+		Nonce:     nonce,
+		Amount:    amount,
+	}
+	return t, t.finalize(sender, t.MinFee())
+}
+
+// NewWithFee is like New, but the transaction pays the given fee, which must not be less than the minimum fee.
+func NewWithFee(sender bitcrypto.Privkey, recipient address.Address, amount, nonce, fee uint64) (*Transaction,
+	error) {
+	t := &Transaction{
+		Sender:    sender.Public(),
+		Recipient: recipient,
+		Nonce:     nonce,
+		Amount:    amount,
+	}
+	return t, t.finalize(sender, fee)
+}
+
+// finalize sets the fee, signs the transaction and prevalidates it
+func (t *Transaction) finalize(pk bitcrypto.Privkey, fee uint64) error {
+	if fee < t.MinFee() {
+		return fmt.Errorf("fee %d is less than the minimum fee %d", fee, t.MinFee())
+	}
+	t.Fee = fee
+
+	err := t.Sign(pk)
+	if err != nil {
+		return err
+	}
+	return t.Prevalidate()
+}
+
 func (t Transaction) Serialize() []byte {
 	s := binary.NewSer(make([]byte, 120))
 
@@ -41,6 +93,10 @@ func (t Transaction) Serialize() []byte {
 	return s.Output()
 }
 func (t *Transaction) Deserialize(data []byte) error {
+	if bytes.HasPrefix(data, unsignedMagic) {
+		return ErrUnsigned
+	}
+
 	d := binary.Des{
 		Data: data,
 	}
@@ -57,6 +113,30 @@ func (t *Transaction) Deserialize(data []byte) error {
 	return d.Error()
 }
 
+// SerializeUnsigned serializes the transaction without its signature, so that it can be signed offline by the
+// owner of the sender's private key. The data is the signature data of the transaction, prefixed by a magic
+// string which makes Deserialize reject it.
+func (t Transaction) SerializeUnsigned() []byte {
+	return append(bytes.Clone(unsignedMagic), t.SignatureData()...)
+}
+
+// DeserializeUnsigned deserializes a transaction serialized by SerializeUnsigned. The returned transaction has
+// to be signed with Sign.
+func DeserializeUnsigned(data []byte) (*Transaction, error) {
+	if !bytes.HasPrefix(data, unsignedMagic) {
+		return nil, errors.New("data is not an unsigned transaction")
+	}
+	t := &Transaction{}
+	err := t.Deserialize(data[len(unsignedMagic):])
+	if err != nil {
+		return nil, err
+	}
+	if t.Signature != (bitcrypto.Signature{}) {
+		return nil, errors.New("unsigned transaction has a signature")
+	}
+	return t, nil
+}
+
 func (t Transaction) Hash() TXID {
 	return blake3.Sum256(t.Serialize())
 }
@@ -70,6 +150,11 @@ func (t Transaction) GetVirtualSize() uint64 {
 	return base_overhead
 }
 
+// MinFee returns the minimum fee the transaction has to pay
+func (t Transaction) MinFee() uint64 {
+	return config.FEE_PER_BYTE * t.GetVirtualSize()
+}
+
 func (t Transaction) SignatureData() []byte {
 	t.Signature = bitcrypto.Signature{}
 
@@ -99,6 +184,15 @@ func (t *Transaction) Prevalidate() error {
 		return fmt.Errorf("transaction amount cannot be zero")
 	}
 
+	// verify that the amount spent fits in an uint64, and doesn't exceed the supply
+	spent, err := util.SafeAdd(t.Amount, t.Fee)
+	if err != nil {
+		return fmt.Errorf("amount plus fee: %w", err)
+	}
+	if spent > config.MAX_TX_SPEND {
+		return fmt.Errorf("%w: amount %d plus fee %d", ErrAmountTooLarge, t.Amount, t.Fee)
+	}
+
 	// verify sender address
 	senderAddr := address.FromPubKey(t.Sender)
 	if senderAddr == address.INVALID_ADDRESS {
@@ -111,15 +205,19 @@ func (t *Transaction) Prevalidate() error {
 	}
 
 	// verify that fee is higher than minimum fee level
-	if t.Fee < config.FEE_PER_BYTE*vsize {
-		return fmt.Errorf("invalid transaction fee: got %d, expected at least %d", t.Fee,
-			config.FEE_PER_BYTE*vsize)
+	if t.Fee < t.MinFee() {
+		return fmt.Errorf("invalid transaction fee: got %d, expected at least %d", t.Fee, t.MinFee())
+	}
+
+	// reject unsigned transactions without the cost of verifying the signature
+	if t.Signature == (bitcrypto.Signature{}) {
+		return ErrUnsigned
 	}
 
 	// verify signature
 	sigValid := bitcrypto.VerifySignature(t.Sender, t.SignatureData(), t.Signature)
 	if !sigValid {
-		return fmt.Errorf("invalid signature")
+		return ErrInvalidSignature
 	}
 
 	// TODO: check if there is something else to prevalidate here
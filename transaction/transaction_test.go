@@ -3,11 +3,14 @@ package transaction_test
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"math"
 	"slices"
 	"still-blockchain/address"
 	"still-blockchain/bitcrypto"
 	"still-blockchain/config"
 	"still-blockchain/transaction"
+	"still-blockchain/util"
 	"testing"
 
 	"github.com/zeebo/blake3"
@@ -64,3 +67,148 @@ func TestTransaction(t *testing.T) {
 
 	t.Log(tx.String())
 }
+
+func TestNew(t *testing.T) {
+	privk := address.GenerateKeypair(blake3.Sum256([]byte("test")))
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+
+	tx, err := transaction.New(privk, recipient, config.COIN, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Fee != tx.MinFee() {
+		t.Errorf("fee is %d, expected the minimum fee %d", tx.Fee, tx.MinFee())
+	}
+	if tx.Sender != privk.Public() || tx.Recipient != recipient || tx.Amount != config.COIN || tx.Nonce != 1 {
+		t.Errorf("transaction fields do not match: %s", tx)
+	}
+	if err := tx.Prevalidate(); err != nil {
+		t.Fatal("transaction verification failed:", err)
+	}
+
+	tx, err = transaction.NewWithFee(privk, recipient, config.COIN, 1, tx.MinFee()*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Fee != tx.MinFee()*2 {
+		t.Errorf("fee is %d, expected %d", tx.Fee, tx.MinFee()*2)
+	}
+	if err := tx.Prevalidate(); err != nil {
+		t.Fatal("transaction verification failed:", err)
+	}
+
+	if _, err := transaction.NewWithFee(privk, recipient, config.COIN, 1, tx.MinFee()-1); err == nil {
+		t.Error("transaction with fee less than minimum is accepted")
+	}
+	if _, err := transaction.New(privk, recipient, 0, 1); err == nil {
+		t.Error("transaction with zero amount is accepted")
+	}
+	if _, err := transaction.New(privk, address.FromPubKey(privk.Public()), config.COIN, 1); err == nil {
+		t.Error("transaction to self is accepted")
+	}
+	if _, err := transaction.New(privk, recipient, math.MaxUint64, 1); !errors.Is(err, util.ErrOverflow) {
+		t.Errorf("transaction with amount plus fee overflowing returned %v", err)
+	}
+	if _, err := transaction.New(privk, recipient, config.MAX_TX_SPEND, 1); !errors.Is(err,
+		transaction.ErrAmountTooLarge) {
+		t.Errorf("transaction spending more than the supply returned %v", err)
+	}
+	if _, err := transaction.New(privk, recipient, config.MAX_TX_SPEND-tx.MinFee(), 1); err != nil {
+		t.Errorf("transaction spending the whole supply is rejected: %v", err)
+	}
+
+	// an unsigned transaction over the supply is rejected without verifying the signature
+	overSupply := transaction.Transaction{
+		Sender:    privk.Public(),
+		Recipient: recipient,
+		Amount:    config.MAX_TX_SPEND,
+		Nonce:     1,
+	}
+	overSupply.Fee = overSupply.MinFee()
+	if err := overSupply.Prevalidate(); !errors.Is(err, transaction.ErrAmountTooLarge) {
+		t.Errorf("unsigned transaction spending more than the supply returned %v", err)
+	}
+}
+
+func TestUnsignedRoundTrip(t *testing.T) {
+	privk := address.GenerateKeypair(blake3.Sum256([]byte("cold storage")))
+	recipient := address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public())
+
+	// the online machine creates the transaction without the private key
+	tx := transaction.Transaction{
+		Sender:    privk.Public(),
+		Recipient: recipient,
+		Nonce:     3,
+		Amount:    config.COIN,
+		Subaddr:   7,
+	}
+	tx.Fee = tx.MinFee()
+	unsigned := tx.SerializeUnsigned()
+
+	// an unsigned transaction can't be mistaken for a signed one
+	if err := (&transaction.Transaction{}).Deserialize(unsigned); !errors.Is(err, transaction.ErrUnsigned) {
+		t.Fatalf("unsigned transaction deserialized as signed, error %v", err)
+	}
+
+	// the offline machine signs it
+	offline, err := transaction.DeserializeUnsigned(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *offline != tx {
+		t.Fatalf("unsigned transaction is %v, expected %v", offline, &tx)
+	}
+	if err := offline.Sign(privk); err != nil {
+		t.Fatal(err)
+	}
+	signed := offline.Serialize()
+
+	// the online machine broadcasts it
+	broadcast := &transaction.Transaction{}
+	if err := broadcast.Deserialize(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := broadcast.Prevalidate(); err != nil {
+		t.Fatal("signed transaction is not valid:", err)
+	}
+	if _, err := transaction.DeserializeUnsigned(signed); err == nil {
+		t.Error("signed transaction deserialized as unsigned")
+	}
+
+	// the signature doesn't cover a different transaction
+	tampered := *broadcast
+	tampered.Amount++
+	if err := tampered.Prevalidate(); !errors.Is(err, transaction.ErrInvalidSignature) {
+		t.Errorf("tampered transaction got error %v, expected %v", err, transaction.ErrInvalidSignature)
+	}
+}
+
+func TestZeroSignature(t *testing.T) {
+	privk := address.GenerateKeypair(blake3.Sum256([]byte("sender")))
+	tx := transaction.Transaction{
+		Sender:    privk.Public(),
+		Recipient: address.FromPubKey(address.GenerateKeypair(blake3.Sum256([]byte("recipient"))).Public()),
+		Nonce:     1,
+		Amount:    config.COIN,
+	}
+	tx.Fee = tx.MinFee()
+
+	// the all-zero signature is rejected before the signature verification
+	if err := tx.Prevalidate(); !errors.Is(err, transaction.ErrUnsigned) {
+		t.Errorf("transaction with zero signature got error %v, expected %v", err, transaction.ErrUnsigned)
+	}
+
+	// any other invalid signature still goes through the verification
+	tx.Signature[0] = 1
+	if err := tx.Prevalidate(); !errors.Is(err, transaction.ErrInvalidSignature) {
+		t.Errorf("transaction with invalid signature got error %v, expected %v", err,
+			transaction.ErrInvalidSignature)
+	}
+
+	if err := tx.Sign(privk); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Prevalidate(); err != nil {
+		t.Error("signed transaction is not valid:", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Package bloom implements the bloom filters used by light clients to request only the transactions involving
+// their addresses
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"still-blockchain/config"
+
+	sbin "still-blockchain/binary"
+
+	"github.com/zeebo/blake3"
+)
+
+var ErrInvalid = errors.New("invalid bloom filter")
+
+// Filter is a bloom filter: Contains never returns false for data that has been added, but it returns true for
+// other data with a probability that depends on the size of the filter and the number of elements added. A
+// light client adds its addresses to the filter, so the node can't tell which of the matching addresses are
+// actually the client's ones.
+type Filter struct {
+	bits   []byte
+	hashes uint8
+	tweak  uint32 // changes the bit positions, so that filters of different clients have different false positives
+}
+
+// New returns an empty filter sized for the given number of elements with the given false positive rate, within
+// the limits BLOOM_MAX_SIZE and BLOOM_MAX_HASHES
+func New(elements int, fpRate float64, tweak uint32) *Filter {
+	elements = max(elements, 1)
+	fpRate = min(max(fpRate, 1e-9), 1)
+
+	size := int(-float64(elements) * math.Log(fpRate) / (math.Ln2 * math.Ln2) / 8)
+	size = min(max(size, 1), config.BLOOM_MAX_SIZE)
+
+	hashes := int(float64(size*8) / float64(elements) * math.Ln2)
+	hashes = min(max(hashes, 1), config.BLOOM_MAX_HASHES)
+
+	return &Filter{
+		bits:   make([]byte, size),
+		hashes: uint8(hashes),
+		tweak:  tweak,
+	}
+}
+
+// positions returns the bit positions of the data, using double hashing to derive them from a single hash
+func (f *Filter) positions(data []byte) []uint64 {
+	sum := blake3.Sum256(append(binary.LittleEndian.AppendUint32(nil, f.tweak), data...))
+
+	h1 := binary.LittleEndian.Uint64(sum[0:8])
+	h2 := binary.LittleEndian.Uint64(sum[8:16])
+	n := uint64(len(f.bits)) * 8
+
+	pos := make([]uint64, f.hashes)
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % n
+	}
+	return pos
+}
+
+// Add adds the data to the filter
+func (f *Filter) Add(data []byte) {
+	for _, p := range f.positions(data) {
+		f.bits[p/8] |= 1 << (p % 8)
+	}
+}
+
+// Contains returns true if the data may have been added to the filter
+func (f *Filter) Contains(data []byte) bool {
+	for _, p := range f.positions(data) {
+		if f.bits[p/8]&(1<<(p%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) Serialize() []byte {
+	s := sbin.NewSer(make([]byte, 0, len(f.bits)+8))
+	s.AddUint8(f.hashes)
+	s.AddUint32(f.tweak)
+	s.AddByteSlice(f.bits)
+	return s.Output()
+}
+
+func (f *Filter) Deserialize(data []byte) error {
+	d := sbin.NewDes(data)
+	f.hashes = d.ReadUint8()
+	f.tweak = d.ReadUint32()
+	f.bits = d.ReadByteSlice()
+	if d.Error() != nil {
+		return fmt.Errorf("%w: %w", ErrInvalid, d.Error())
+	}
+	if len(d.RemainingData()) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalid, len(d.RemainingData()))
+	}
+	if len(f.bits) == 0 || len(f.bits) > config.BLOOM_MAX_SIZE {
+		return fmt.Errorf("%w: size %d", ErrInvalid, len(f.bits))
+	}
+	if f.hashes == 0 || f.hashes > config.BLOOM_MAX_HASHES {
+		return fmt.Errorf("%w: %d hash functions", ErrInvalid, f.hashes)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"still-blockchain/config"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(100, 0.001, 1)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(fmt.Sprint("added", i)))
+	}
+
+	d := &Filter{}
+	if err := d.Deserialize(f.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		for _, v := range []*Filter{f, d} {
+			if !v.Contains([]byte(fmt.Sprint("added", i%100))) {
+				t.Fatalf("filter doesn't contain element %d", i%100)
+			}
+		}
+		if d.Contains([]byte(fmt.Sprint("other", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 10 {
+		t.Fatalf("%d false positives out of 1000", falsePositives)
+	}
+}
+
+func TestFilterLimits(t *testing.T) {
+	f := New(1_000_000, 1e-9, 0)
+	if len(f.bits) != config.BLOOM_MAX_SIZE || f.hashes < 1 || f.hashes > config.BLOOM_MAX_HASHES {
+		t.Fatalf("filter size %d with %d hash functions exceeds the limits", len(f.bits), f.hashes)
+	}
+
+	big := &Filter{bits: make([]byte, config.BLOOM_MAX_SIZE+1), hashes: 1}
+	if err := (&Filter{}).Deserialize(big.Serialize()); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("oversized filter: unexpected error %v", err)
+	}
+	noHashes := &Filter{bits: make([]byte, 8)}
+	if err := (&Filter{}).Deserialize(noHashes.Serialize()); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("filter without hash functions: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Package metrics is a minimal registry of counters and gauges, exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type metric struct {
+	name  string
+	help  string
+	typ   string // "counter" or "gauge"
+	value func() float64
+}
+
+type Registry struct {
+	metrics []metric
+
+	sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(name, help, typ string, value func() float64) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.metrics = append(r.metrics, metric{
+		name:  name,
+		help:  help,
+		typ:   typ,
+		value: value,
+	})
+}
+
+// Counter registers a new counter, which can only be increased
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.add(name, help, "counter", func() float64 {
+		return float64(c.Get())
+	})
+	return c
+}
+
+// Gauge registers a gauge. The value function is called every time the metrics are read.
+func (r *Registry) Gauge(name, help string, value func() float64) {
+	r.add(name, help, "gauge", value)
+}
+
+// Meter registers a gauge that reports how many events were marked in the given time window
+func (r *Registry) Meter(name, help string, window time.Duration) *Meter {
+	m := &Meter{
+		window: window,
+	}
+	r.add(name, help, "gauge", func() float64 {
+		return float64(m.Count(time.Now()))
+	})
+	return m
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	var total int64
+	for _, m := range r.metrics {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.typ,
+			m.name, strconv.FormatFloat(m.value(), 'g', -1, 64))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+func (c *Counter) Get() uint64 {
+	return c.v.Load()
+}
+
+type Meter struct {
+	window time.Duration
+	events []time.Time
+
+	sync.Mutex
+}
+
+func (m *Meter) Mark(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.prune(now)
+	m.events = append(m.events, now)
+}
+
+// Count returns the number of events in the last window
+func (m *Meter) Count(now time.Time) int {
+	m.Lock()
+	defer m.Unlock()
+
+	m.prune(now)
+	return len(m.events)
+}
+
+func (m *Meter) prune(now time.Time) {
+	i := 0
+	for i < len(m.events) && now.Sub(m.events[i]) > m.window {
+		i++
+	}
+	m.events = m.events[i:]
+}
@@ -4,10 +4,13 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"math/bits"
 	"still-blockchain/config"
 	"still-blockchain/util/uint128"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sasha-s/go-deadlock"
@@ -17,6 +20,18 @@ import (
 func Time() uint64 {
 	return uint64(time.Now().UnixMilli())
 }
+
+var timeOffset atomic.Int64
+
+// AdjustedTime returns the timestamp (UNIX milliseconds) corrected by the offset set with SetTimeOffset
+func AdjustedTime() uint64 {
+	return uint64(int64(Time()) + timeOffset.Load())
+}
+
+// SetTimeOffset sets the offset in milliseconds that AdjustedTime adds to the local time
+func SetTimeOffset(ms int64) {
+	timeOffset.Store(ms)
+}
 func FormatInt[V int | int64 | int32 | int16 | int8 | uint8 | uint16 | uint32](n V) string {
 	return strconv.FormatInt(int64(n), 10)
 }
@@ -57,6 +72,26 @@ func PadC(s string, l int) string {
 
 }
 
+var ErrOverflow = errors.New("integer overflow")
+
+// SafeAdd returns a + b, or ErrOverflow if the result doesn't fit in an uint64
+func SafeAdd(a, b uint64) (uint64, error) {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return 0, ErrOverflow
+	}
+	return sum, nil
+}
+
+// SafeMul returns a * b, or ErrOverflow if the result doesn't fit in an uint64
+func SafeMul(a, b uint64) (uint64, error) {
+	hi, lo := bits.Mul64(a, b)
+	if hi != 0 {
+		return 0, ErrOverflow
+	}
+	return lo, nil
+}
+
 func U64Bytes(v uint64) []byte {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, v)
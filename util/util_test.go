@@ -3,6 +3,8 @@ package util
 import (
 	crand "crypto/rand"
 	"encoding/hex"
+	"errors"
+	"math"
 	"math/rand/v2"
 	"still-blockchain/util/uint128"
 	"testing"
@@ -46,3 +48,21 @@ func TestIsHex(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSafeMath(t *testing.T) {
+	if v, err := SafeAdd(math.MaxUint64-1, 1); err != nil || v != math.MaxUint64 {
+		t.Errorf("SafeAdd(max-1, 1) = %d, %v", v, err)
+	}
+	if _, err := SafeAdd(math.MaxUint64, 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("SafeAdd(max, 1) returned %v, expected overflow", err)
+	}
+	if v, err := SafeMul(math.MaxUint64/10, 10); err != nil || v != math.MaxUint64/10*10 {
+		t.Errorf("SafeMul(max/10, 10) = %d, %v", v, err)
+	}
+	if _, err := SafeMul(math.MaxUint64/10+1, 10); !errors.Is(err, ErrOverflow) {
+		t.Errorf("SafeMul(max/10+1, 10) returned %v, expected overflow", err)
+	}
+	if v, err := SafeMul(math.MaxUint64, 0); err != nil || v != 0 {
+		t.Errorf("SafeMul(max, 0) = %d, %v", v, err)
+	}
+}
@@ -0,0 +1,141 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"still-blockchain/bitcrypto"
+	"sync"
+	"time"
+)
+
+var ErrLocked = errors.New("wallet is locked")
+
+// autoLock erases the private key material from memory after the wallet has been idle for a while
+type autoLock struct {
+	// a plain sync.Mutex is used, since it's held while the wallet database is decrypted or encrypted again,
+	// which would be reported as a deadlock by util.Mutex
+	sync.Mutex
+
+	locked       bool
+	timeout      time.Duration // zero disables the auto-lock
+	lastActivity time.Time
+	timer        *time.Timer
+}
+
+// SetAutoLock locks the wallet after it has been idle for the given duration. Zero disables the auto-lock.
+func (w *Wallet) SetAutoLock(timeout time.Duration) {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	w.autoLock.timeout = timeout
+	w.autoLock.lastActivity = time.Now()
+	if w.autoLock.timer != nil {
+		w.autoLock.timer.Stop()
+		w.autoLock.timer = nil
+	}
+	if timeout > 0 && !w.autoLock.locked {
+		w.autoLock.timer = time.AfterFunc(timeout, w.checkIdle)
+	}
+}
+
+// touch records wallet activity, postponing the auto-lock
+func (w *Wallet) touch() {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	w.autoLock.lastActivity = time.Now()
+}
+
+// checkIdle locks the wallet if it has been idle for longer than the timeout, otherwise it checks again when
+// the timeout will be reached
+func (w *Wallet) checkIdle() {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	w.autoLock.timer = nil
+	if w.autoLock.locked || w.autoLock.timeout == 0 {
+		return
+	}
+	idle := time.Since(w.autoLock.lastActivity)
+	if idle < w.autoLock.timeout {
+		w.autoLock.timer = time.AfterFunc(w.autoLock.timeout-idle, w.checkIdle)
+		return
+	}
+	w.lock()
+}
+
+// Lock erases the private key, the mnemonic and the password from memory. The address, the public key and
+// the cached balance are still available, but signing requires calling Unlock.
+func (w *Wallet) Lock() {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	w.lock()
+}
+
+// the auto-lock mutex MUST be locked before calling this
+func (w *Wallet) lock() {
+	clear(w.dbInfo.PrivateKey[:])
+	clear(w.password)
+	w.password = nil
+	w.dbInfo.Mnemonic = ""
+	w.autoLock.locked = true
+	if w.autoLock.timer != nil {
+		w.autoLock.timer.Stop()
+		w.autoLock.timer = nil
+	}
+}
+
+// Unlock decrypts the private key material again using the wallet password
+func (w *Wallet) Unlock(pass []byte) error {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	if w.watchOnly {
+		return ErrWatchOnly
+	}
+	if !w.autoLock.locked {
+		return nil
+	}
+	info, err := decodeDatabase(w.encrypted, pass)
+	if err != nil {
+		return errors.New("invalid password")
+	}
+	if info.Address != w.dbInfo.Address {
+		return errors.New("wallet database does not match the wallet address")
+	}
+
+	// only the erased fields are restored: the address is read without locking
+	w.dbInfo.PrivateKey = info.PrivateKey
+	w.dbInfo.Mnemonic = info.Mnemonic
+	w.password = bytes.Clone(pass)
+	w.autoLock.locked = false
+	w.autoLock.lastActivity = time.Now()
+	if w.autoLock.timeout > 0 {
+		w.autoLock.timer = time.AfterFunc(w.autoLock.timeout, w.checkIdle)
+	}
+	return nil
+}
+
+func (w *Wallet) IsLocked() bool {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	return w.autoLock.locked
+}
+
+// withPrivateKey calls f with the wallet private key, or returns ErrLocked if the wallet is locked and
+// ErrWatchOnly if it has no private key
+func (w *Wallet) withPrivateKey(f func(pk bitcrypto.Privkey) error) error {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	if w.watchOnly {
+		return ErrWatchOnly
+	}
+	if w.autoLock.locked {
+		return ErrLocked
+	}
+	w.autoLock.lastActivity = time.Now()
+	return f(w.dbInfo.PrivateKey)
+}
@@ -7,7 +7,8 @@ import (
 	"still-blockchain/bitcrypto"
 )
 
-func (w *Wallet) decodeDatabase(data, pass []byte) error {
+func decodeDatabase(data, pass []byte) (dbInfo, error) {
+	var info dbInfo
 	d := binary.Des{
 		Data: data,
 	}
@@ -17,23 +18,23 @@ func (w *Wallet) decodeDatabase(data, pass []byte) error {
 	mem := d.ReadUint32()
 
 	if d.Error() != nil {
-		return d.Error()
+		return info, d.Error()
 	}
 
 	p := bitcrypto.KDF(pass, salt, time, mem)
 
 	cip, err := bitcrypto.NewCipher(p)
 	if err != nil {
-		return err
+		return info, err
 	}
 
 	dec, err := cip.Decrypt(d.Data)
 
 	if err != nil {
-		return err
+		return info, err
 	}
 
-	return json.Unmarshal(dec, &w.dbInfo)
+	return info, json.Unmarshal(dec, &info)
 }
 
 func saveDatabase(dbInfo dbInfo, pass []byte, time, mem uint32) ([]byte, error) {
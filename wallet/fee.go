@@ -0,0 +1,59 @@
+package wallet
+
+import (
+	"fmt"
+	"still-blockchain/rpc/daemonrpc"
+	"still-blockchain/transaction"
+)
+
+// Fee priorities, as the number of blocks a transaction should be mined within
+const (
+	FeePriorityHigh   = 1
+	FeePriorityNormal = 3
+	FeePriorityLow    = 10
+)
+
+// ParseFeePriority returns the number of blocks of a fee priority name: low, normal or high
+func ParseFeePriority(s string) (int, error) {
+	switch s {
+	case "low":
+		return FeePriorityLow, nil
+	case "normal":
+		return FeePriorityNormal, nil
+	case "high":
+		return FeePriorityHigh, nil
+	}
+	return 0, fmt.Errorf("unknown fee priority %q, expected low, normal or high", s)
+}
+
+// SetFeePriority sets the number of blocks the transactions built by Transfer should be mined within
+func (w *Wallet) SetFeePriority(blocks int) {
+	w.feeBlocks = blocks
+}
+
+func (w *Wallet) getFeePriority() int {
+	if w.feeBlocks < 1 {
+		return FeePriorityNormal
+	}
+	return w.feeBlocks
+}
+
+// EstimateFee returns the fee a transfer transaction should pay to be mined within the given number of blocks,
+// as estimated by the node. If the fee can't be estimated, it returns the error along with a fallback: the fee
+// required by the node's current relay fee, or the static minimum fee if the node can't be reached.
+func (w *Wallet) EstimateFee(withinBlocks int) (uint64, error) {
+	vsize := transaction.Transaction{}.GetVirtualSize()
+	minFee := transaction.Transaction{}.MinFee()
+
+	res, err := w.rpc.EstimateFee(daemonrpc.EstimateFeeRequest{
+		Blocks: withinBlocks,
+	})
+	if err != nil {
+		info, infoErr := w.rpc.GetInfo(daemonrpc.GetInfoRequest{})
+		if infoErr != nil {
+			return minFee, err
+		}
+		return max(minFee, info.RelayFee*vsize), err
+	}
+	return max(minFee, res.FeePerByte*vsize), nil
+}
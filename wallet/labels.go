@@ -0,0 +1,159 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"still-blockchain/address"
+	"still-blockchain/binary"
+	"time"
+)
+
+// maximum length of subaddress and address book labels
+const maxLabelLength = 100
+
+func checkLabel(label string) error {
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("label is too long: %d bytes, max: %d", len(label), maxLabelLength)
+	}
+	return nil
+}
+
+// GetSubaddress returns the wallet address with the given subaddress index
+func (w *Wallet) GetSubaddress(index uint64) address.Integrated {
+	return address.Integrated{
+		Addr:    w.dbInfo.Address.Addr,
+		Subaddr: index,
+	}
+}
+
+// SetSubaddressLabel sets the label of a subaddress, and saves it in the encrypted wallet database. An empty
+// label removes it. The wallet must be unlocked, since the database is encrypted with the password.
+func (w *Wallet) SetSubaddressLabel(index uint64, label string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+	return w.updateDatabase(func(info *dbInfo) {
+		if label == "" {
+			delete(info.SubaddrLabels, index)
+			return
+		}
+		if info.SubaddrLabels == nil {
+			info.SubaddrLabels = make(map[uint64]string)
+		}
+		info.SubaddrLabels[index] = label
+	})
+}
+
+// GetSubaddressLabel returns the label of a subaddress, or an empty string if it has none
+func (w *Wallet) GetSubaddressLabel(index uint64) string {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	return w.dbInfo.SubaddrLabels[index]
+}
+
+// GetSubaddressLabels returns the labels of all the labeled subaddresses
+func (w *Wallet) GetSubaddressLabels() map[uint64]string {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	return maps.Clone(w.dbInfo.SubaddrLabels)
+}
+
+// SetAddressBookEntry saves an external address in the address book with the given label, replacing the
+// previous address with the same label
+func (w *Wallet) SetAddressBookEntry(label string, addr address.Integrated) error {
+	if label == "" {
+		return errors.New("label is empty")
+	}
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+	return w.updateDatabase(func(info *dbInfo) {
+		if info.AddressBook == nil {
+			info.AddressBook = make(map[string]address.Integrated)
+		}
+		info.AddressBook[label] = addr
+	})
+}
+
+// DeleteAddressBookEntry removes the address with the given label from the address book
+func (w *Wallet) DeleteAddressBookEntry(label string) error {
+	if _, ok := w.GetAddressBookEntry(label); !ok {
+		return fmt.Errorf("address book has no entry %q", label)
+	}
+	return w.updateDatabase(func(info *dbInfo) {
+		delete(info.AddressBook, label)
+	})
+}
+
+// GetAddressBookEntry returns the address saved in the address book with the given label
+func (w *Wallet) GetAddressBookEntry(label string) (address.Integrated, bool) {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	addr, ok := w.dbInfo.AddressBook[label]
+	return addr, ok
+}
+
+// GetAddressBook returns all the entries of the address book
+func (w *Wallet) GetAddressBook() map[string]address.Integrated {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	return maps.Clone(w.dbInfo.AddressBook)
+}
+
+// updateDatabase applies f to the wallet database, encrypts it again with the password and the KDF parameters
+// it was created with, and writes it to the wallet file. The labels and the address book are read under the same
+// lock.
+func (w *Wallet) updateDatabase(f func(info *dbInfo)) error {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	if w.watchOnly {
+		return ErrWatchOnly
+	}
+	if w.autoLock.locked {
+		return ErrLocked
+	}
+	w.autoLock.lastActivity = time.Now()
+
+	// the KDF parameters follow the 16-byte salt
+	d := binary.NewDes(w.encrypted)
+	d.ReadFixedByteArray(16)
+	kdfTime := d.ReadUint32()
+	kdfMem := d.ReadUint32()
+	if d.Error() != nil {
+		return d.Error()
+	}
+
+	info := w.dbInfo
+	info.SubaddrLabels = maps.Clone(w.dbInfo.SubaddrLabels)
+	info.AddressBook = maps.Clone(w.dbInfo.AddressBook)
+	f(&info)
+
+	dbEnc, err := saveDatabase(info, w.password, kdfTime, kdfMem)
+	if err != nil {
+		return err
+	}
+	if w.filename != "" {
+		// the wallet file is replaced at once, so an interrupted write can't corrupt it
+		tmp := w.filename + ".tmp"
+		err = os.WriteFile(tmp, dbEnc, 0o660)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, w.filename)
+		if err != nil {
+			return err
+		}
+	}
+	// only the labels and the address book change: the address is read without locking
+	w.dbInfo.SubaddrLabels = info.SubaddrLabels
+	w.dbInfo.AddressBook = info.AddressBook
+	w.encrypted = dbEnc
+	return nil
+}
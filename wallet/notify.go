@@ -0,0 +1,114 @@
+package wallet
+
+import (
+	"still-blockchain/rpc/daemonrpc"
+	"still-blockchain/util"
+	"time"
+)
+
+// interval between the refreshes done by WaitForTransfer while waiting
+const transferPollInterval = 2 * time.Second
+
+// a WaitForTransfer caller skips its refresh if another one completed within this time, so that the concurrent
+// callers poll the node about once per transferPollInterval in total. It's a bit shorter than the interval, so
+// that the ticker jitter doesn't make a caller skip its own next refresh.
+const transferPollShared = transferPollInterval * 9 / 10
+
+// TransferNotification is sent when a refresh detects that the transactions involving the wallet changed: a
+// transaction entered or left mempool, or was confirmed. The counters are totals rather than differences, so
+// that a client which missed a notification can still tell what changed.
+type TransferNotification struct {
+	Seq uint64 // sequence number of the notification, starting from 1
+
+	LastIncoming    uint64 // number of confirmed incoming transactions, including block rewards
+	LastNonce       uint64 // number of confirmed outgoing transactions
+	MempoolIncoming uint64 // number of incoming transactions in mempool
+	MempoolOutgoing uint64 // number of outgoing transactions in mempool
+
+	Height         uint64
+	Balance        uint64
+	MempoolBalance uint64
+}
+
+// transferNotifier compares each refresh with the previous one, and wakes up the WaitForTransfer callers when
+// the transactions of the wallet changed
+type transferNotifier struct {
+	util.Mutex
+
+	prev *daemonrpc.GetAddressResponse // nil before the first refresh
+	last TransferNotification
+	wait chan struct{} // closed when the next notification is sent
+}
+
+// update is called by every refresh with the node response. The first refresh only records it.
+func (n *transferNotifier) update(res *daemonrpc.GetAddressResponse) {
+	n.Lock()
+	defer n.Unlock()
+
+	prev := n.prev
+	n.prev = res
+	if prev == nil || (prev.LastIncoming == res.LastIncoming && prev.LastNonce == res.LastNonce &&
+		prev.MempoolIncoming == res.MempoolIncoming && prev.MempoolNonce == res.MempoolNonce) {
+		return
+	}
+
+	n.last = TransferNotification{
+		Seq:             n.last.Seq + 1,
+		LastIncoming:    res.LastIncoming,
+		LastNonce:       res.LastNonce,
+		MempoolIncoming: res.MempoolIncoming,
+		MempoolOutgoing: res.MempoolNonce - res.LastNonce,
+		Height:          res.Height,
+		Balance:         res.Balance,
+		MempoolBalance:  res.MempoolBalance,
+	}
+	if n.wait != nil {
+		close(n.wait)
+		n.wait = nil
+	}
+}
+
+// since returns the last notification if its sequence number isn't seq, otherwise a channel closed when the
+// next notification is sent
+func (n *transferNotifier) since(seq uint64) (*TransferNotification, <-chan struct{}) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.last.Seq != 0 && n.last.Seq != seq {
+		last := n.last
+		return &last, nil
+	}
+	if n.wait == nil {
+		n.wait = make(chan struct{})
+	}
+	return nil, n.wait
+}
+
+// WaitForTransfer waits until a refresh detects a change of the transactions involving the wallet, and returns
+// its notification. seq is the sequence number of the last notification received, or 0: if a later one has
+// already been sent, it's returned at once. The wallet is refreshed periodically while waiting, without
+// postponing the auto-lock; the concurrent callers share the refreshes. It returns nil if no notification is sent within the timeout.
+func (w *Wallet) WaitForTransfer(seq uint64, timeout time.Duration) (*TransferNotification, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(transferPollInterval)
+	defer poll.Stop()
+
+	for {
+		n, wait := w.notifier.since(seq)
+		if n != nil {
+			return n, nil
+		}
+
+		select {
+		case <-wait:
+		case <-poll.C:
+			err := w.refreshIfOlder(transferPollShared)
+			if err != nil {
+				return nil, err
+			}
+		case <-deadline.C:
+			return nil, nil
+		}
+	}
+}
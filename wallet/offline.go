@@ -0,0 +1,90 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
+	"still-blockchain/rpc/daemonrpc"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+)
+
+var ErrWatchOnly = errors.New("wallet is watch-only")
+
+// OpenWatchOnly returns a wallet which only knows the public key of the address, for the online machine of a
+// cold storage setup: it reads the balance, creates the transactions with CreateUnsigned and submits the ones
+// signed offline with SubmitTx. It can't sign, and it isn't saved to a file, so labels and address book entries
+// can't be set.
+func OpenWatchOnly(rpcAddr string, pubkey bitcrypto.Pubkey) *Wallet {
+	w := &Wallet{
+		rpc:       daemonrpc.NewRpcClient(rpcAddr),
+		pubkey:    pubkey,
+		watchOnly: true,
+	}
+	w.dbInfo.Address = address.FromPubKey(pubkey).Integrated()
+	w.autoLock.locked = true
+	return w
+}
+
+// IsWatchOnly returns true if the wallet was opened with OpenWatchOnly
+func (w *Wallet) IsWatchOnly() bool {
+	return w.watchOnly
+}
+
+// CreateUnsigned returns a transfer transaction like Transfer, without signing it. It doesn't need the private
+// key, so it works while the wallet is locked or watch-only: the transaction can be serialized with SerializeUnsigned, signed
+// offline with SignOffline and then submitted.
+func (w *Wallet) CreateUnsigned(amount uint64, recipient address.Integrated) (*transaction.Transaction, error) {
+	err := w.Refresh()
+	if err != nil {
+		return nil, fmt.Errorf("wallet is not connected to daemon: %w", err)
+	}
+
+	if w.GetAddress() == recipient {
+		return nil, fmt.Errorf("cannot transfer funds to self")
+	}
+
+	nonce, balance := w.mempoolState()
+	txn := &transaction.Transaction{
+		Sender:    w.pubkey,
+		Recipient: recipient.Addr,
+		Nonce:     nonce + 1,
+		Amount:    amount,
+		Fee:       0,
+		Subaddr:   recipient.Subaddr,
+	}
+
+	// the node may require a higher fee than the minimum when its mempool is congested
+	txn.Fee, err = w.EstimateFee(w.getFeePriority())
+	if err != nil {
+		return nil, fmt.Errorf("cannot estimate the transaction fee: %w", err)
+	}
+
+	// the amount is chosen by the user and the fee by the node, so their sum can overflow
+	if spent, err := util.SafeAdd(txn.Amount, txn.Fee); err != nil || spent > balance {
+		return nil, fmt.Errorf("transaction spends too much money: amount %s, fee %s, unconfirmed balance %s",
+			util.FormatCoin(txn.Amount), util.FormatCoin(txn.Fee), util.FormatCoin(balance))
+	}
+
+	return txn, nil
+}
+
+// SignOffline signs an unsigned transaction serialized by SerializeUnsigned, and returns it ready to be
+// submitted. It doesn't connect to the node, so it can be used on an offline machine. The transaction must be
+// sent by this wallet.
+func (w *Wallet) SignOffline(unsigned []byte) (*transaction.Transaction, error) {
+	txn, err := transaction.DeserializeUnsigned(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if txn.Sender != w.pubkey {
+		return nil, errors.New("transaction is not sent by this wallet")
+	}
+
+	err = w.withPrivateKey(txn.Sign)
+	if err != nil {
+		return nil, err
+	}
+	return txn, txn.Prevalidate()
+}
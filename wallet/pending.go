@@ -0,0 +1,114 @@
+package wallet
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"still-blockchain/config"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"time"
+)
+
+// pendingTx is a transaction submitted by the wallet which the node may not report yet. The node reports a
+// transaction once it's added to mempool, but a wallet sending transactions back-to-back (or connected to a
+// different node than the one the transaction was submitted to) can refresh before that happens.
+type pendingTx struct {
+	nonce     uint64
+	spent     uint64 // amount plus fee
+	submitted time.Time
+}
+
+// addPending records a transaction submitted to the node, so that the next transaction is chained after it
+// using the reduced balance
+func (w *Wallet) addPending(txn *transaction.Transaction) {
+	if txn.Sender != w.pubkey {
+		return
+	}
+	spent, err := util.SafeAdd(txn.Amount, txn.Fee)
+	if err != nil {
+		// the node can't have accepted it, but the whole mempool balance is considered spent anyway
+		spent = math.MaxUint64
+	}
+	p := pendingTx{
+		nonce:     txn.Nonce,
+		spent:     spent,
+		submitted: time.Now(),
+	}
+
+	w.stateMut.Lock()
+	defer w.stateMut.Unlock()
+
+	w.pending = append(w.pending, p)
+	w.spendPending(p)
+}
+
+// NonceReconciliation describes a divergence between the nonces tracked by the wallet and the ones reported by
+// the node, found and corrected by a refresh. It's usually caused by a reorg which rolled back transactions of
+// the wallet: they have to be sent again.
+type NonceReconciliation struct {
+	PrevNonce uint64   // last confirmed nonce reported by the previous refresh
+	LastNonce uint64   // last confirmed nonce reported by the node, lower than PrevNonce if it was rolled back
+	Dropped   []uint64 // nonces of the submitted transactions forgotten, since they can't be confirmed anymore
+}
+
+// applyPending forgets the pending transactions which the node reports, or which it has already dropped from
+// mempool, and applies the other ones to the mempool nonce and balance just read from the node. It returns the
+// nonces of the pending transactions which don't follow the node's mempool nonce. stateMut must be held.
+func (w *Wallet) applyPending() (dropped []uint64) {
+	w.pending = slices.DeleteFunc(w.pending, func(p pendingTx) bool {
+		return p.nonce <= w.mempoolNonce || time.Since(p.submitted) > config.MEMPOOL_EXPIRATION
+	})
+
+	// when an earlier transaction is missing from the node, for example because a reorg rolled it back, the
+	// following ones can never be confirmed, and chaining new transactions after them would be useless
+	slices.SortStableFunc(w.pending, func(a, b pendingTx) int {
+		return cmp.Compare(a.nonce, b.nonce)
+	})
+	next := w.mempoolNonce + 1
+	for i, p := range w.pending {
+		if p.nonce > next {
+			for _, d := range w.pending[i:] {
+				dropped = append(dropped, d.nonce)
+			}
+			w.pending = w.pending[:i]
+			break
+		}
+		next = p.nonce + 1
+	}
+
+	for _, p := range w.pending {
+		w.spendPending(p)
+	}
+	return dropped
+}
+
+// TakeNonceReconciliation returns the divergence corrected by the last refreshes since the previous call, or nil
+// if the nonces reported by the node matched the ones tracked by the wallet
+func (w *Wallet) TakeNonceReconciliation() *NonceReconciliation {
+	w.stateMut.Lock()
+	defer w.stateMut.Unlock()
+
+	r := w.reconciled
+	w.reconciled = nil
+	return r
+}
+
+// spendPending applies a pending transaction to the mempool nonce and balance. stateMut must be held.
+func (w *Wallet) spendPending(p pendingTx) {
+	w.mempoolNonce = max(w.mempoolNonce, p.nonce)
+	if p.spent > w.mempoolBal {
+		w.mempoolBal = 0
+	} else {
+		w.mempoolBal -= p.spent
+	}
+}
+
+// mempoolState returns the mempool nonce and balance read together, so that a transaction built from them isn't
+// mixed with a concurrent refresh
+func (w *Wallet) mempoolState() (nonce, balance uint64) {
+	w.stateMut.RLock()
+	defer w.stateMut.RUnlock()
+
+	return w.mempoolNonce, w.mempoolBal
+}
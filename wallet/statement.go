@@ -0,0 +1,168 @@
+package wallet
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"still-blockchain/rpc/daemonrpc"
+	"still-blockchain/util"
+	"time"
+)
+
+// StatementHeader is the header row of the CSV written by WriteStatementCSV
+var StatementHeader = []string{"date", "direction", "counterparty", "amount", "fee", "txid", "height",
+	"confirmations"}
+
+// StatementEntry is a confirmed transaction in the statement of the wallet
+type StatementEntry struct {
+	Time          time.Time // timestamp of the block that includes the transaction
+	Incoming      bool
+	Counterparty  string // sender of incoming transactions, recipient of outgoing ones, "coinbase" for block rewards
+	Amount        uint64
+	Fee           uint64 // fee paid by the wallet, so it's zero for incoming transactions
+	Txid          util.Hash
+	Height        uint64
+	Confirmations uint64
+}
+
+// Statement returns the confirmed transactions of the wallet between minHeight and maxHeight included, sorted by
+// height. A maxHeight of 0 means up to the top block. The transactions are listed by the node, which returns
+// them newest first, so the older pages aren't read once they're below minHeight.
+func (w *Wallet) Statement(minHeight, maxHeight uint64) ([]StatementEntry, error) {
+	if maxHeight == 0 {
+		maxHeight = ^uint64(0)
+	}
+	if minHeight > maxHeight {
+		return nil, fmt.Errorf("min height %d is above max height %d", minHeight, maxHeight)
+	}
+
+	info, err := w.rpc.GetInfo(daemonrpc.GetInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	times := make(map[uint64]time.Time)
+
+	var entries []StatementEntry
+	for _, inc := range []bool{true, false} {
+		seen := make(map[util.Hash]bool)
+		for page := uint64(0); ; page++ {
+			list, err := w.GetTransations(inc, page)
+			if err != nil {
+				return nil, err
+			}
+
+			older := false
+			for _, txid := range list.Transactions {
+				if seen[txid] {
+					continue
+				}
+				seen[txid] = true
+
+				tx, err := w.GetTransaction(txid)
+				if err != nil {
+					return nil, fmt.Errorf("transaction %s: %w", txid, err)
+				}
+				if tx.Height == 0 || tx.Height > maxHeight {
+					continue
+				}
+				if tx.Height < minHeight {
+					older = true
+					continue
+				}
+
+				e := StatementEntry{
+					Incoming: inc,
+					Amount:   tx.Amount,
+					Txid:     txid,
+					Height:   tx.Height,
+				}
+				switch {
+				case !inc:
+					e.Counterparty = tx.Recipient.String()
+					e.Fee = tx.Fee
+				case tx.Coinbase || tx.Sender == nil:
+					e.Counterparty = "coinbase"
+				default:
+					e.Counterparty = tx.Sender.String()
+				}
+				if info.Height >= tx.Height {
+					e.Confirmations = info.Height - tx.Height + 1
+				}
+
+				t, ok := times[tx.Height]
+				if !ok {
+					bl, err := w.rpc.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
+						Height: tx.Height,
+					})
+					if err != nil {
+						return nil, fmt.Errorf("block %d: %w", tx.Height, err)
+					}
+					t = time.UnixMilli(int64(bl.Block.Timestamp)).UTC()
+					times[tx.Height] = t
+				}
+				e.Time = t
+
+				entries = append(entries, e)
+			}
+			if older || page >= list.MaxPage {
+				break
+			}
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b StatementEntry) int {
+		if c := cmp.Compare(a.Height, b.Height); c != 0 {
+			return c
+		}
+		if a.Incoming != b.Incoming {
+			if a.Incoming {
+				return -1
+			}
+			return 1
+		}
+		return bytes.Compare(a.Txid[:], b.Txid[:])
+	})
+	return entries, nil
+}
+
+// WriteStatementCSV writes the statement entries as CSV, after the StatementHeader row. Amounts and fees are in
+// coins, dates are RFC 3339 in UTC.
+func WriteStatementCSV(out io.Writer, entries []StatementEntry) error {
+	cw := csv.NewWriter(out)
+	if err := cw.Write(StatementHeader); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		direction := "out"
+		if e.Incoming {
+			direction = "in"
+		}
+		err := cw.Write([]string{
+			e.Time.Format(time.RFC3339),
+			direction,
+			e.Counterparty,
+			util.FormatCoin(e.Amount),
+			util.FormatCoin(e.Fee),
+			e.Txid.String(),
+			util.FormatUint(e.Height),
+			util.FormatUint(e.Confirmations),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportStatement writes the statement of the wallet between minHeight and maxHeight as CSV
+func (w *Wallet) ExportStatement(out io.Writer, minHeight, maxHeight uint64) error {
+	entries, err := w.Statement(minHeight, maxHeight)
+	if err != nil {
+		return err
+	}
+	return WriteStatementCSV(out, entries)
+}
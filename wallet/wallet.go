@@ -3,30 +3,54 @@
 package wallet
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"os"
 	"still-blockchain/address"
 	"still-blockchain/bitcrypto"
-	"still-blockchain/config"
 	"still-blockchain/rpc/daemonrpc"
 	"still-blockchain/transaction"
 	"still-blockchain/util"
+	"sync"
+	"time"
 )
 
-// wallet is not concurrency-safe, it should be used on a single thread
+// wallet is not concurrency-safe, it should be used on a single thread. Only the key material and the labels are
+// locked, since they can be erased by the auto-lock timer, and the state read from the node, since
+// WaitForTransfer refreshes while waiting. The address never changes once the wallet is opened.
 type Wallet struct {
 	dbInfo dbInfo
 
 	rpc *daemonrpc.RpcClient
 
+	// stateMut guards the state read from the node and the pending transactions, which are updated by the
+	// refreshes of WaitForTransfer while the wallet is used
+	stateMut     util.RWMutex
 	height       uint64
 	balance      uint64
 	lastNonce    uint64
 	mempoolBal   uint64
 	mempoolNonce uint64
 
+	pending    []pendingTx          // submitted transactions not reported by the node yet, see SubmitTx
+	reconciled *NonceReconciliation // nonce divergence found by refresh, see TakeNonceReconciliation
+
+	// refreshes can be done concurrently by WaitForTransfer. A plain sync.Mutex is used, since it's held while
+	// waiting for the node, which would be reported as a deadlock by util.Mutex.
+	refreshMut sync.Mutex
+	refreshed  time.Time        // time of the last successful refresh, guarded by refreshMut
+	notifier   transferNotifier // notifies WaitForTransfer of the changes detected by refresh
+
 	password []byte
+
+	encrypted []byte           // encrypted wallet database, used to verify the password when unlocking
+	pubkey    bitcrypto.Pubkey // kept while the wallet is locked
+	autoLock  autoLock
+	watchOnly bool // the wallet has no private key, see OpenWatchOnly
+
+	feeBlocks int // fee priority of the transactions built by Transfer, see SetFeePriority
+
+	filename string // wallet file updated when the database changes, empty for in-memory wallets
 }
 
 type dbInfo struct {
@@ -34,23 +58,35 @@ type dbInfo struct {
 	Mnemonic   string
 	PrivateKey bitcrypto.Privkey
 	Address    address.Integrated
+
+	SubaddrLabels map[uint64]string             // labels of the wallet subaddresses, see SetSubaddressLabel
+	AddressBook   map[string]address.Integrated // external addresses by label
 }
 
 func OpenWallet(rpcAddr string, walletdb, pass []byte) (*Wallet, error) {
 	w := &Wallet{
 		rpc:      daemonrpc.NewRpcClient(rpcAddr),
 		balance:  0,
-		password: pass,
+		password: bytes.Clone(pass), // erased by Lock, so the caller's slice is kept
 	}
 
-	return w, w.decodeDatabase(walletdb, pass)
+	var err error
+	w.dbInfo, err = decodeDatabase(walletdb, pass)
+	if err != nil {
+		return w, err
+	}
+	w.encrypted = walletdb
+	w.pubkey = w.dbInfo.PrivateKey.Public()
+	return w, nil
 }
 func OpenWalletFile(rpcAddr, filename string, pass []byte) (*Wallet, error) {
 	walletdb, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return OpenWallet(rpcAddr, walletdb, pass)
+	w, err := OpenWallet(rpcAddr, walletdb, pass)
+	w.filename = filename
+	return w, err
 }
 
 func CreateWallet(rpcAddr string, pass []byte, fastkdf bool) (*Wallet, []byte, error) {
@@ -58,7 +94,7 @@ func CreateWallet(rpcAddr string, pass []byte, fastkdf bool) (*Wallet, []byte, e
 		rpc:      daemonrpc.NewRpcClient(rpcAddr),
 		balance:  0,
 		dbInfo:   dbInfo{},
-		password: pass,
+		password: bytes.Clone(pass),
 	}
 
 	w.dbInfo.Mnemonic, w.dbInfo.PrivateKey = newMnemonic()
@@ -77,6 +113,8 @@ func CreateWallet(rpcAddr string, pass []byte, fastkdf bool) (*Wallet, []byte, e
 	if err != nil {
 		return nil, dbEnc, err
 	}
+	w.encrypted = dbEnc
+	w.pubkey = w.dbInfo.PrivateKey.Public()
 
 	return w, dbEnc, nil
 }
@@ -91,6 +129,7 @@ func CreateWalletFile(rpcAddr, filename string, pass []byte) (*Wallet, error) {
 	if err != nil {
 		return nil, err
 	}
+	wall.filename = filename
 	err = os.WriteFile(filename, dbEnc, 0o660)
 	return wall, err
 }
@@ -102,7 +141,7 @@ func CreateWalletFromMnemonic(
 		rpc:      daemonrpc.NewRpcClient(rpcAddr),
 		balance:  0,
 		dbInfo:   dbInfo{},
-		password: pass,
+		password: bytes.Clone(pass),
 	}
 	var err error
 	w.dbInfo.PrivateKey, err = decodeMnemonic(mnemonic)
@@ -120,6 +159,8 @@ func CreateWalletFromMnemonic(
 	}
 
 	dbEnc, err := saveDatabase(w.dbInfo, pass, kdfIterations, kdfMemory*1024)
+	w.encrypted = dbEnc
+	w.pubkey = w.dbInfo.PrivateKey.Public()
 
 	return w, dbEnc, err
 }
@@ -136,11 +177,38 @@ func CreateWalletFileFromMnemonic(
 	if err != nil {
 		return nil, err
 	}
+	wall.filename = filename
 	err = os.WriteFile(filename, dbEnc, 0o660)
 	return wall, err
 }
 
 func (w *Wallet) Refresh() error {
+	w.touch()
+	return w.refresh()
+}
+
+// refresh is like Refresh, but it doesn't postpone the auto-lock
+func (w *Wallet) refresh() error {
+	w.refreshMut.Lock()
+	defer w.refreshMut.Unlock()
+
+	return w.refreshLocked()
+}
+
+// refreshIfOlder refreshes the wallet, unless another refresh completed within maxAge. It lets the concurrent
+// WaitForTransfer callers share the refreshes instead of each polling the node.
+func (w *Wallet) refreshIfOlder(maxAge time.Duration) error {
+	w.refreshMut.Lock()
+	defer w.refreshMut.Unlock()
+
+	if time.Since(w.refreshed) < maxAge {
+		return nil
+	}
+	return w.refreshLocked()
+}
+
+// refreshLocked reads the wallet state from the node. refreshMut must be held.
+func (w *Wallet) refreshLocked() error {
 	if w.rpc == nil {
 		return errors.New("w.rpc is nil")
 	}
@@ -151,36 +219,85 @@ func (w *Wallet) Refresh() error {
 	if err != nil {
 		return err
 	}
+	w.refreshed = time.Now()
+
+	w.stateMut.Lock()
+	defer w.stateMut.Unlock()
+
+	prevNonce := w.lastNonce
 	w.balance = res.Balance
 	w.lastNonce = res.LastNonce
 	w.mempoolBal = res.MempoolBalance
 	w.mempoolNonce = res.MempoolNonce
 	w.height = res.Height
+	dropped := w.applyPending()
+	if res.LastNonce < prevNonce || len(dropped) > 0 {
+		if w.reconciled == nil {
+			w.reconciled = &NonceReconciliation{PrevNonce: prevNonce}
+		}
+		w.reconciled.LastNonce = res.LastNonce
+		w.reconciled.Dropped = append(w.reconciled.Dropped, dropped...)
+	}
+	w.notifier.update(res)
 
 	return nil
 }
 
+// GetPassword returns a copy of the wallet password, or nil if the wallet is locked
 func (w *Wallet) GetPassword() []byte {
-	return w.password
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
+	return bytes.Clone(w.password)
 }
 func (w *Wallet) GetHeight() uint64 {
+	w.stateMut.RLock()
+	defer w.stateMut.RUnlock()
+
 	return w.height
 }
 func (w *Wallet) GetBalance() uint64 {
+	w.stateMut.RLock()
+	defer w.stateMut.RUnlock()
+
 	return w.balance
 }
 func (w *Wallet) GetLastNonce() uint64 {
+	w.stateMut.RLock()
+	defer w.stateMut.RUnlock()
+
 	return w.lastNonce
 }
 func (w *Wallet) GetMempoolBalance() uint64 {
+	w.stateMut.RLock()
+	defer w.stateMut.RUnlock()
+
 	return w.mempoolBal
 }
 func (w *Wallet) GetMempoolLastNonce() uint64 {
+	w.stateMut.RLock()
+	defer w.stateMut.RUnlock()
+
 	return w.mempoolNonce
 }
 func (w *Wallet) GetAddress() address.Integrated {
 	return w.dbInfo.Address
 }
+func (w *Wallet) GetPublicKey() bitcrypto.Pubkey {
+	return w.pubkey
+}
+
+// SignMessage signs an arbitrary message, proving the ownership of the wallet address. The signature can be
+// verified with address.VerifyMessage, using the wallet's public key.
+func (w *Wallet) SignMessage(msg []byte) (bitcrypto.Signature, error) {
+	var sig bitcrypto.Signature
+	err := w.withPrivateKey(func(pk bitcrypto.Privkey) (err error) {
+		sig, err = bitcrypto.Sign(address.MessageHash(msg), pk)
+		return
+	})
+	return sig, err
+}
+
 func (w *Wallet) GetTransations(inc bool, page uint64) (*daemonrpc.GetTxListResponse, error) {
 	r := daemonrpc.GetTxListRequest{
 		Address: w.GetAddress(),
@@ -195,7 +312,12 @@ func (w *Wallet) GetTransations(inc bool, page uint64) (*daemonrpc.GetTxListResp
 
 	return w.rpc.GetTxList(r)
 }
+
+// GetMnemonic returns the wallet mnemonic seed, or an empty string if the wallet is locked
 func (w *Wallet) GetMnemonic() string {
+	w.autoLock.Lock()
+	defer w.autoLock.Unlock()
+
 	return w.dbInfo.Mnemonic
 }
 
@@ -205,6 +327,39 @@ func (w *Wallet) GetTransaction(txid util.Hash) (*daemonrpc.GetTransactionRespon
 	})
 }
 
+// GetConfirmations returns the number of confirmations of a transaction, counting the block that includes it,
+// or 0 if the transaction is still in mempool. The values are always read from the node, so a reorg removing
+// the transaction from mainchain is reflected in the result.
+func (w *Wallet) GetConfirmations(txid util.Hash) (int, error) {
+	tx, err := w.GetTransaction(txid)
+	if err != nil {
+		return 0, err
+	}
+	if tx.Height == 0 {
+		return 0, nil
+	}
+
+	info, err := w.rpc.GetInfo(daemonrpc.GetInfoRequest{})
+	if err != nil {
+		return 0, err
+	}
+	if info.Height < tx.Height {
+		// the node is reorganizing the chain
+		return 0, nil
+	}
+	return int(info.Height-tx.Height) + 1, nil
+}
+
+// IsNodeSynced returns true if the node reports that enough peers agree on its top block. Balances and
+// confirmations read from a node which isn't synced may be outdated.
+func (w *Wallet) IsNodeSynced() (bool, error) {
+	info, err := w.rpc.GetInfo(daemonrpc.GetInfoRequest{})
+	if err != nil {
+		return false, err
+	}
+	return info.Synced, nil
+}
+
 func (w *Wallet) GetRpcDaemonAddress() string {
 	return w.rpc.DaemonAddress
 }
@@ -213,34 +368,28 @@ func (w *Wallet) SetRpcDaemonAddress(a string) {
 }
 
 // This method doesn't submit the transaction. Use the SubmitTx method to submit it to the network.
+// The transaction is chained after the wallet transactions which are still unconfirmed, spending their change:
+// it uses the next nonce and the balance left by them.
 func (w *Wallet) Transfer(amount uint64, recipient address.Integrated) (*transaction.Transaction, error) {
-	err := w.Refresh()
+	txn, err := w.CreateUnsigned(amount, recipient)
 	if err != nil {
-		return nil, fmt.Errorf("wallet is not connected to daemon: %w", err)
-	}
-
-	if w.GetAddress() == recipient {
-		return nil, fmt.Errorf("cannot transfer funds to self")
-	}
-
-	txn := &transaction.Transaction{
-		Sender:    w.dbInfo.PrivateKey.Public(),
-		Recipient: recipient.Addr,
-		Nonce:     w.GetMempoolLastNonce() + 1,
-		Amount:    amount,
-		Fee:       0,
-		Subaddr:   recipient.Subaddr,
+		return nil, err
 	}
 
-	txn.Fee = txn.GetVirtualSize() * config.FEE_PER_BYTE
-
-	err = txn.Sign(w.dbInfo.PrivateKey)
+	err = w.withPrivateKey(txn.Sign)
 
 	return txn, err
 }
 
+// SubmitTx submits a transaction to the node. Transactions sent by the wallet are tracked until the node
+// reports them, so that the next Transfer is chained after them even if the wallet refreshes first.
 func (w *Wallet) SubmitTx(txn *transaction.Transaction) (*daemonrpc.SubmitTransactionResponse, error) {
-	return w.rpc.SubmitTransaction(daemonrpc.SubmitTransactionRequest{
+	res, err := w.rpc.SubmitTransaction(daemonrpc.SubmitTransactionRequest{
 		Hex: txn.Serialize(),
 	})
+	if err != nil {
+		return res, err
+	}
+	w.addPending(txn)
+	return res, nil
 }
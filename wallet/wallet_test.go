@@ -0,0 +1,929 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"still-blockchain/address"
+	"still-blockchain/bitcrypto"
+	"still-blockchain/config"
+	"still-blockchain/rpc"
+	"still-blockchain/rpc/daemonrpc"
+	"still-blockchain/transaction"
+	"still-blockchain/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignMessage(t *testing.T) {
+	w, _, err := CreateWallet("", []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("I own this address")
+	sig, err := w.SignMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := w.GetAddress().Addr
+	if !address.VerifyMessage(addr, msg, w.GetPublicKey(), sig) {
+		t.Fatal("valid message signature is rejected")
+	}
+
+	if address.VerifyMessage(addr, []byte("I own this address!"), w.GetPublicKey(), sig) {
+		t.Error("signature of tampered message is accepted")
+	}
+	tampered := sig
+	tampered[0] ^= 1
+	if address.VerifyMessage(addr, msg, w.GetPublicKey(), tampered) {
+		t.Error("tampered signature is accepted")
+	}
+	if address.VerifyMessage(address.GenesisAddress, msg, w.GetPublicKey(), sig) {
+		t.Error("signature is accepted for another address")
+	}
+}
+
+func TestGetConfirmations(t *testing.T) {
+	confirmed := util.Hash{1}
+	unconfirmed := util.Hash{2}
+
+	// mocked node with the chain at height 10, a transaction at height 5 and one in mempool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_info":
+			res.Result = daemonrpc.GetInfoResponse{Height: 10}
+		case "get_transaction":
+			var params daemonrpc.GetTransactionRequest
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				t.Error(err)
+				return
+			}
+			switch params.Txid {
+			case confirmed:
+				res.Result = daemonrpc.GetTransactionResponse{Height: 5}
+			case unconfirmed:
+				res.Result = daemonrpc.GetTransactionResponse{Height: 0}
+			default:
+				res.Error = &rpc.Error{Code: -1, Message: "transaction not found"}
+			}
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confs, err := w.GetConfirmations(confirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confs != 6 {
+		t.Errorf("confirmed transaction has %d confirmations, expected 6", confs)
+	}
+
+	confs, err = w.GetConfirmations(unconfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confs != 0 {
+		t.Errorf("mempool transaction has %d confirmations, expected 0", confs)
+	}
+
+	if _, err := w.GetConfirmations(util.Hash{3}); err == nil {
+		t.Error("unknown transaction did not return an error")
+	}
+}
+
+func TestTransferFeeEstimate(t *testing.T) {
+	const feePerByte = 50 * config.FEE_PER_BYTE
+	const relayFee = 20 * config.FEE_PER_BYTE
+	var estimateFails bool
+	var requestedBlocks int
+
+	// mocked node whose mempool is congested
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_address":
+			res.Result = daemonrpc.GetAddressResponse{
+				Balance:        10 * config.COIN,
+				MempoolBalance: 10 * config.COIN,
+				Height:         10,
+			}
+		case "estimate_fee":
+			var params daemonrpc.EstimateFeeRequest
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				t.Error(err)
+				return
+			}
+			requestedBlocks = params.Blocks
+			if estimateFails {
+				res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+				break
+			}
+			res.Result = daemonrpc.EstimateFeeResponse{
+				FeePerByte: feePerByte,
+				Fee:        feePerByte * transaction.Transaction{}.GetVirtualSize(),
+			}
+		case "get_info":
+			res.Result = daemonrpc.GetInfoResponse{RelayFee: relayFee}
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := address.Integrated{Addr: address.GenesisAddress}
+
+	w.SetFeePriority(FeePriorityHigh)
+	txn, err := w.Transfer(config.COIN, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestedBlocks != FeePriorityHigh {
+		t.Errorf("fee estimated within %d blocks, expected %d", requestedBlocks, FeePriorityHigh)
+	}
+	if expected := feePerByte * txn.GetVirtualSize(); txn.Fee != expected {
+		t.Errorf("transaction fee is %d, expected the estimated fee %d", txn.Fee, expected)
+	}
+
+	// when the node can't estimate the fee, the error is returned with a fee based on the relay fee, and no
+	// transaction is built
+	estimateFails = true
+	fee, err := w.EstimateFee(FeePriorityNormal)
+	if err == nil {
+		t.Error("failed estimate returned no error")
+	}
+	if expected := max(txn.MinFee(), relayFee*txn.GetVirtualSize()); fee != expected {
+		t.Errorf("fallback fee is %d, expected %d", fee, expected)
+	}
+	if _, err := w.Transfer(config.COIN, recipient); err == nil {
+		t.Error("transfer built without a fee estimate")
+	}
+}
+
+func TestTransferChained(t *testing.T) {
+	const lastNonce = 3
+	const balance = 10 * config.COIN
+
+	// mocked node which admits transactions like the node mempool, but only reports the first "reported" of
+	// its mempool transactions, as if the wallet refreshed before the node processed the others
+	var mempool []*transaction.Transaction
+	var reported int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_address":
+			result := daemonrpc.GetAddressResponse{
+				Balance:        balance,
+				LastNonce:      lastNonce,
+				MempoolBalance: balance,
+				MempoolNonce:   lastNonce,
+				Height:         10,
+			}
+			for _, v := range mempool[:reported] {
+				result.MempoolBalance -= v.Amount + v.Fee
+				result.MempoolNonce = max(result.MempoolNonce, v.Nonce)
+			}
+			res.Result = result
+		case "submit_transaction":
+			var params daemonrpc.SubmitTransactionRequest
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				t.Error(err)
+				return
+			}
+			txn := &transaction.Transaction{}
+			if err := txn.Deserialize(params.Hex); err != nil {
+				t.Error(err)
+				return
+			}
+			spent := txn.Amount + txn.Fee
+			for _, v := range mempool {
+				if v.Nonce == txn.Nonce {
+					res.Error = &rpc.Error{Code: -1, Message: "nonce is already used by a mempool transaction"}
+				}
+				spent += v.Amount + v.Fee
+			}
+			if txn.Nonce <= lastNonce || txn.Nonce > lastNonce+config.MEMPOOL_MAX_NONCE_GAP {
+				res.Error = &rpc.Error{Code: -1, Message: "unexpected nonce"}
+			}
+			if spent > balance {
+				res.Error = &rpc.Error{Code: -1, Message: "transaction spends too much money"}
+			}
+			if res.Error == nil {
+				mempool = append(mempool, txn)
+				res.Result = daemonrpc.SubmitTransactionResponse{TXID: util.Hash(txn.Hash())}
+			}
+		case "estimate_fee":
+			res.Result = daemonrpc.EstimateFeeResponse{
+				FeePerByte: config.FEE_PER_BYTE,
+				Fee:        transaction.Transaction{}.MinFee(),
+			}
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := address.Integrated{Addr: address.GenesisAddress}
+
+	// two transactions sent back-to-back are both admitted, the second one chained after the first
+	for i := uint64(1); i <= 2; i++ {
+		txn, err := w.Transfer(4*config.COIN, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txn.Nonce != lastNonce+i {
+			t.Errorf("transaction %d has nonce %d, expected %d", i, txn.Nonce, lastNonce+i)
+		}
+		if _, err := w.SubmitTx(txn); err != nil {
+			t.Fatalf("transaction %d is rejected: %v", i, err)
+		}
+	}
+	if len(mempool) != 2 {
+		t.Fatalf("node has %d mempool transactions, expected 2", len(mempool))
+	}
+
+	// the unconfirmed balance accounts for both transactions
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	spent := mempool[0].Amount + mempool[0].Fee + mempool[1].Amount + mempool[1].Fee
+	if w.GetMempoolBalance() != balance-spent || w.GetMempoolLastNonce() != lastNonce+2 {
+		t.Errorf("unconfirmed balance %d and nonce %d, expected %d and %d", w.GetMempoolBalance(),
+			w.GetMempoolLastNonce(), balance-spent, lastNonce+2)
+	}
+
+	// the third transaction can't spend more than the change left by the pending ones
+	if _, err := w.Transfer(4*config.COIN, recipient); err == nil {
+		t.Error("transaction spending more than the unconfirmed balance is created")
+	}
+	// an amount whose sum with the fee overflows isn't mistaken for a small one
+	if _, err := w.Transfer(math.MaxUint64, recipient); err == nil {
+		t.Error("transaction whose amount and fee overflow is created")
+	}
+
+	// the pending transactions are forgotten once the node reports them, without being counted twice
+	reported = 2
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.pending) != 0 {
+		t.Errorf("%d transactions reported by the node are still pending", len(w.pending))
+	}
+	if w.GetMempoolBalance() != balance-spent || w.GetMempoolLastNonce() != lastNonce+2 {
+		t.Errorf("unconfirmed balance %d and nonce %d after the node reports the transactions, expected %d "+
+			"and %d", w.GetMempoolBalance(), w.GetMempoolLastNonce(), balance-spent, lastNonce+2)
+	}
+}
+
+func TestSignOffline(t *testing.T) {
+	w, _, err := CreateWallet("", []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := CreateWallet("", []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := transaction.Transaction{
+		Sender:    w.GetPublicKey(),
+		Recipient: address.GenesisAddress,
+		Nonce:     1,
+		Amount:    config.COIN,
+		Fee:       config.FEE_PER_BYTE * config.MAX_TX_SIZE,
+	}
+	data := unsigned.SerializeUnsigned()
+
+	if _, err := other.SignOffline(data); err == nil {
+		t.Error("transaction sent by another wallet is signed")
+	}
+
+	txn, err := w.SignOffline(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &transaction.Transaction{}
+	if err := signed.Deserialize(txn.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.Prevalidate(); err != nil {
+		t.Errorf("transaction signed offline is invalid: %v", err)
+	}
+
+	if _, err := w.SignOffline(txn.Serialize()); err == nil {
+		t.Error("signed transaction is accepted as unsigned")
+	}
+}
+
+func TestWatchOnly(t *testing.T) {
+	const balance = 10 * config.COIN
+
+	var submitted []*transaction.Transaction
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_address":
+			res.Result = daemonrpc.GetAddressResponse{
+				Balance:        balance,
+				MempoolBalance: balance,
+				Height:         10,
+			}
+		case "estimate_fee":
+			res.Result = daemonrpc.EstimateFeeResponse{
+				FeePerByte: config.FEE_PER_BYTE,
+				Fee:        transaction.Transaction{}.MinFee(),
+			}
+		case "submit_transaction":
+			var params daemonrpc.SubmitTransactionRequest
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				t.Error(err)
+				return
+			}
+			txn := &transaction.Transaction{}
+			if err := txn.Deserialize(params.Hex); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := txn.Prevalidate(); err != nil {
+				res.Error = &rpc.Error{Code: -1, Message: err.Error()}
+				break
+			}
+			submitted = append(submitted, txn)
+			res.Result = daemonrpc.SubmitTransactionResponse{TXID: util.Hash(txn.Hash())}
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	// the keys stay on the offline wallet, the online one only has the public key
+	offline, _, err := CreateWallet("", []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	online := OpenWatchOnly(server.URL, offline.GetPublicKey())
+	if !online.IsWatchOnly() || online.GetAddress() != offline.GetAddress() {
+		t.Fatalf("watch-only wallet has address %s, expected %s", online.GetAddress(), offline.GetAddress())
+	}
+
+	recipient := address.Integrated{Addr: address.GenesisAddress}
+	if _, err := online.Transfer(config.COIN, recipient); !errors.Is(err, ErrWatchOnly) {
+		t.Errorf("watch-only wallet signs a transfer, error %v", err)
+	}
+	if err := online.Unlock([]byte("password")); !errors.Is(err, ErrWatchOnly) {
+		t.Errorf("watch-only wallet is unlocked, error %v", err)
+	}
+	if err := online.SetSubaddressLabel(1, "label"); !errors.Is(err, ErrWatchOnly) {
+		t.Errorf("watch-only wallet database is updated, error %v", err)
+	}
+
+	unsigned, err := online.CreateUnsigned(config.COIN, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := offline.SignOffline(unsigned.SerializeUnsigned())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := online.SubmitTx(signed); err != nil {
+		t.Fatalf("transaction signed offline is rejected: %v", err)
+	}
+	if len(submitted) != 1 || submitted[0].Hash() != signed.Hash() {
+		t.Fatalf("node received %d transactions, expected the signed one", len(submitted))
+	}
+
+	// the submitted transaction is pending, so the next one is chained after it
+	next, err := online.CreateUnsigned(config.COIN, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Nonce != signed.Nonce+1 {
+		t.Errorf("next transaction has nonce %d, expected %d", next.Nonce, signed.Nonce+1)
+	}
+}
+
+func TestWaitForTransfer(t *testing.T) {
+	const balance = 10 * config.COIN
+
+	// mocked node, the address state is changed by the test
+	var mut sync.Mutex
+	state := daemonrpc.GetAddressResponse{
+		Balance:        balance,
+		MempoolBalance: balance,
+		Height:         10,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_address":
+			mut.Lock()
+			res.Result = state
+			mut.Unlock()
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing changes before the timeout
+	n, err := w.WaitForTransfer(0, 50*time.Millisecond)
+	if err != nil || n != nil {
+		t.Fatalf("notification %v, error %v without any new transfer", n, err)
+	}
+
+	type result struct {
+		n   *TransferNotification
+		err error
+	}
+	waiting := make(chan result)
+	go func() {
+		n, err := w.WaitForTransfer(0, time.Minute)
+		waiting <- result{n, err}
+	}()
+
+	// an incoming transaction enters the mempool, and is detected by the next refresh
+	mut.Lock()
+	state.MempoolBalance += config.COIN
+	state.MempoolIncoming++
+	mut.Unlock()
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	var res result
+	select {
+	case res = <-waiting:
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiting call is not unblocked by the incoming transaction")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.n.Seq != 1 || res.n.MempoolIncoming != 1 || res.n.MempoolBalance != balance+config.COIN {
+		t.Errorf("unexpected notification %+v", *res.n)
+	}
+
+	// the notification is returned at once to a client which didn't receive it yet
+	n, err = w.WaitForTransfer(0, time.Minute)
+	if err != nil || n == nil || n.Seq != 1 {
+		t.Errorf("notification %v, error %v for a client which missed it", n, err)
+	}
+}
+
+func TestSharedRefresh(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		requests.Add(1)
+		json.NewEncoder(w).Encode(rpc.ResponseOut{
+			JsonRpc: "2.0",
+			Id:      req.Id,
+			Result:  daemonrpc.GetAddressResponse{Balance: config.COIN, MempoolBalance: config.COIN},
+		})
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the waiters reuse the recent refresh, while the state is read concurrently
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.refreshIfOlder(time.Minute); err != nil {
+				t.Error(err)
+			}
+			if w.GetBalance() != config.COIN || w.GetMempoolBalance() != config.COIN {
+				t.Error("unexpected balance", w.GetBalance(), w.GetMempoolBalance())
+			}
+		}()
+	}
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("node polled %d times, expected once", n)
+	}
+
+	if err := w.refreshIfOlder(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("node polled %d times after an outdated refresh, expected 2", n)
+	}
+}
+
+func TestAutoLock(t *testing.T) {
+	pass := []byte("password")
+	w, _, err := CreateWallet("", pass, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := w.GetPublicKey()
+	mnemonic := w.GetMnemonic()
+
+	w.SetAutoLock(50 * time.Millisecond)
+	if _, err := w.SignMessage([]byte("test")); err != nil {
+		t.Fatal("signing failed before the idle timeout:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if !w.IsLocked() {
+		t.Fatal("wallet is not locked after the idle timeout")
+	}
+	if _, err := w.SignMessage([]byte("test")); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if w.dbInfo.PrivateKey != (bitcrypto.Privkey{}) || w.GetMnemonic() != "" || w.GetPassword() != nil {
+		t.Fatal("key material is still in memory after locking")
+	}
+	if w.GetPublicKey() != pub {
+		t.Fatal("public key changed after locking")
+	}
+	if string(pass) != "password" {
+		t.Fatalf("password of the caller is %q after locking", pass)
+	}
+
+	if err := w.Unlock([]byte("wrong password")); err == nil {
+		t.Fatal("wallet unlocked with a wrong password")
+	}
+
+	// the address can be read while the wallet is unlocked
+	addr := w.GetAddress()
+	unlocked := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-unlocked:
+				return
+			default:
+			}
+			if got := w.GetAddress(); got.String() != addr.String() {
+				t.Errorf("address changed to %s while unlocking", got)
+				return
+			}
+		}
+	}()
+	err = w.Unlock([]byte("password"))
+	close(unlocked)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.GetMnemonic() != mnemonic {
+		t.Fatal("mnemonic does not match after unlocking")
+	}
+	sig, err := w.SignMessage([]byte("test"))
+	if err != nil {
+		t.Fatal("signing failed after unlocking:", err)
+	}
+	if !address.VerifyMessage(w.GetAddress().Addr, []byte("test"), pub, sig) {
+		t.Fatal("signature after unlocking is not valid")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	w, _, err := CreateWallet("", []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.filename = filepath.Join(t.TempDir(), "wallet.keys")
+
+	shop := address.GenesisAddress.Integrated()
+
+	if err := w.SetSubaddressLabel(1, "Invoice #123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetSubaddressLabel(2, "Invoice #124"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetSubaddressLabel(2, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetAddressBookEntry("shop", shop); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetAddressBookEntry("", shop); err == nil {
+		t.Fatal("expected error for empty address book label")
+	}
+
+	// the labels are read back from the encrypted wallet file
+	w2, err := OpenWalletFile("", w.filename, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w2.GetSubaddressLabel(1) != "Invoice #123" || w2.GetSubaddressLabel(2) != "" {
+		t.Fatalf("subaddress labels are %v after reopening", w2.GetSubaddressLabels())
+	}
+	if addr, ok := w2.GetAddressBookEntry("shop"); !ok || addr != shop {
+		t.Fatalf("address book entry is %v after reopening", addr)
+	}
+	if w2.GetMnemonic() != w.GetMnemonic() || w2.GetAddress() != w.GetAddress() {
+		t.Fatal("wallet keys changed after saving the labels")
+	}
+	if _, err := OpenWalletFile("", w.filename, []byte("wrong password")); err == nil {
+		t.Fatal("wallet file opened with a wrong password")
+	}
+
+	if err := w2.DeleteAddressBookEntry("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if len(w2.GetAddressBook()) != 0 {
+		t.Fatalf("address book is %v after deleting its entry", w2.GetAddressBook())
+	}
+
+	// labels can't be saved without the password
+	w2.Lock()
+	if err := w2.SetSubaddressLabel(3, "test"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if err := w2.Unlock([]byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if w2.GetSubaddressLabel(1) != "Invoice #123" || w2.GetSubaddressLabel(3) != "" {
+		t.Fatalf("subaddress labels are %v after unlocking", w2.GetSubaddressLabels())
+	}
+
+	// the labels can be read while they're being saved
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			w2.GetSubaddressLabel(1)
+			w2.GetAddressBook()
+		}
+	}()
+	for i := range 3 {
+		if err := w2.SetSubaddressLabel(uint64(i), "concurrent"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestNonceReconciliation(t *testing.T) {
+	const balance = 10 * config.COIN
+
+	// mocked node, the address state is changed by the test
+	var mut sync.Mutex
+	state := daemonrpc.GetAddressResponse{
+		Balance:        balance,
+		LastNonce:      3,
+		MempoolBalance: balance,
+		MempoolNonce:   3,
+		Height:         10,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_address":
+			mut.Lock()
+			res.Result = state
+			mut.Unlock()
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if r := w.TakeNonceReconciliation(); r != nil {
+		t.Errorf("reconciliation %+v while the node matches the wallet", r)
+	}
+
+	// the wallet submits two transactions chained after the confirmed ones
+	for nonce := uint64(4); nonce <= 5; nonce++ {
+		w.addPending(&transaction.Transaction{Sender: w.pubkey, Nonce: nonce, Amount: config.COIN})
+	}
+	if w.GetMempoolLastNonce() != 5 {
+		t.Fatalf("unconfirmed nonce %d, expected 5", w.GetMempoolLastNonce())
+	}
+
+	// a reorg rolls back the transaction with nonce 3, and the node doesn't have the submitted ones anymore
+	mut.Lock()
+	state.LastNonce = 2
+	state.MempoolNonce = 2
+	mut.Unlock()
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := w.TakeNonceReconciliation()
+	if r == nil {
+		t.Fatal("no reconciliation after the node reports a lower nonce")
+	}
+	if r.PrevNonce != 3 || r.LastNonce != 2 || len(r.Dropped) != 2 || r.Dropped[0] != 4 || r.Dropped[1] != 5 {
+		t.Errorf("reconciliation %+v, expected nonce 3 rolled back to 2 and nonces [4 5] dropped", r)
+	}
+	if len(w.pending) != 0 {
+		t.Errorf("%d transactions which can't be confirmed are still pending", len(w.pending))
+	}
+	if w.GetLastNonce() != 2 || w.GetMempoolLastNonce() != 2 || w.GetMempoolBalance() != balance {
+		t.Errorf("nonce %d, unconfirmed nonce %d and balance %d, expected the node ones", w.GetLastNonce(),
+			w.GetMempoolLastNonce(), w.GetMempoolBalance())
+	}
+	if r := w.TakeNonceReconciliation(); r != nil {
+		t.Errorf("reconciliation %+v is returned twice", r)
+	}
+
+	// a refresh matching the node doesn't report anything
+	if err := w.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if r := w.TakeNonceReconciliation(); r != nil {
+		t.Errorf("reconciliation %+v after a refresh without changes", r)
+	}
+}
+
+func TestExportStatement(t *testing.T) {
+	alice := address.Integrated{Addr: address.Address{1}}
+	bob := address.Integrated{Addr: address.Address{2}, Subaddr: 5}
+
+	// mocked node with a block reward and a transfer received, and two transfers sent
+	txs := map[util.Hash]daemonrpc.GetTransactionResponse{
+		{1}: {Amount: 50 * config.COIN, Height: 3, Coinbase: true},
+		{2}: {Sender: &alice, Amount: 2 * config.COIN, Fee: 100, Height: 5},
+		{3}: {Recipient: bob, Amount: config.COIN, Fee: 200, Height: 5},
+		{4}: {Recipient: alice, Amount: 3 * config.COIN, Fee: 300, Height: 8},
+	}
+	const topHeight = 9
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.RequestIn
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res := rpc.ResponseOut{JsonRpc: "2.0", Id: req.Id}
+		switch req.Method {
+		case "get_info":
+			res.Result = daemonrpc.GetInfoResponse{Height: topHeight}
+		case "get_tx_list":
+			var params daemonrpc.GetTxListRequest
+			json.Unmarshal(req.Params, &params)
+			// newest first, and consecutive pages overlap like the node ones
+			switch {
+			case params.TransferType == "outgoing":
+				res.Result = daemonrpc.GetTxListResponse{Transactions: []util.Hash{{4}, {3}}}
+			case params.Page == 0:
+				res.Result = daemonrpc.GetTxListResponse{Transactions: []util.Hash{{2}}, MaxPage: 1}
+			default:
+				res.Result = daemonrpc.GetTxListResponse{Transactions: []util.Hash{{2}, {1}}, MaxPage: 1}
+			}
+		case "get_transaction":
+			var params daemonrpc.GetTransactionRequest
+			json.Unmarshal(req.Params, &params)
+			res.Result = txs[params.Txid]
+		case "get_block_by_height":
+			var params daemonrpc.GetBlockByHeightRequest
+			json.Unmarshal(req.Params, &params)
+			bl := daemonrpc.GetBlockResponse{}
+			bl.Block.Timestamp = 1_700_000_000_000 + params.Height*60_000
+			res.Result = bl
+		default:
+			res.Error = &rpc.Error{Code: -1, Message: "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	w, _, err := CreateWallet(server.URL, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(b byte) string {
+		return util.Hash{b}.String()
+	}
+	rows := []string{
+		"2023-11-14T22:16:20Z,in,coinbase,50.000000000,0.000000000," + hash(1) + ",3,7",
+		"2023-11-14T22:18:20Z,in," + alice.String() + ",2.000000000,0.000000000," + hash(2) + ",5,5",
+		"2023-11-14T22:18:20Z,out," + bob.String() + ",1.000000000,0.000000200," + hash(3) + ",5,5",
+		"2023-11-14T22:21:20Z,out," + alice.String() + ",3.000000000,0.000000300," + hash(4) + ",8,2",
+	}
+	header := "date,direction,counterparty,amount,fee,txid,height,confirmations"
+
+	for _, test := range []struct {
+		min, max uint64
+		rows     []string
+	}{
+		{0, 0, rows},
+		{4, 0, rows[1:]},
+		{0, 5, rows[:3]},
+		{5, 5, rows[1:3]},
+		{10, 0, nil},
+	} {
+		var buf strings.Builder
+		if err := w.ExportStatement(&buf, test.min, test.max); err != nil {
+			t.Fatal(err)
+		}
+		expected := header + "\n" + strings.Join(append(test.rows, ""), "\n")
+		if buf.String() != expected {
+			t.Errorf("heights %d-%d: statement\n%s\nexpected\n%s", test.min, test.max, buf.String(), expected)
+		}
+	}
+
+	if err := w.ExportStatement(io.Discard, 6, 5); err == nil {
+		t.Error("min height above max height is accepted")
+	}
+}